@@ -21,7 +21,7 @@ type AccountRecord struct {
 	DirectoryPort int `json:"directoryPort"`
 
 	// MqttPort to connect with the MQTT broker. Default is 8885 for websocket, 8883 for TCP or 8884 for certificate
-	MqttPort int `json:"authPort"`
+	MqttPort int `json:"mqttPort"`
 
 	// Enabled to try to use this connection
 	Enabled bool `json:"enabled"`
@@ -1,6 +1,390 @@
 // Package accounts with storage of accounts
 package accounts
 
-// AccountStore is not yet implemented
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/sirupsen/logrus"
+)
+
+// accountStoreData is the content of the store file
+type accountStoreData struct {
+	// Accounts by account ID
+	Accounts map[string]AccountRecord `json:"accounts"`
+	// Passwords hashes by login name
+	Passwords map[string]string `json:"passwords"`
+}
+
+// AccountStore is a persistent store of accounts and the hashed passwords of their login names.
+// The store file is saved after each change.
+//
+// Use VerifyPassword to authenticate users, eg with TLSServer.EnableBasicAuth or a JWT auth service.
 type AccountStore struct {
+	// the accounts and password hashes
+	data accountStoreData
+	// algorithm used for new password hashes
+	hashAlgo string
+	// hash to verify passwords of unknown login names against, so they take as long as known login names
+	dummyHash string
+	// file to persist the store. "" to keep the store in memory
+	storeFile string
+	// refresh tokens of accounts that are not remembered, by account ID
+	sessionTokens map[string]string
+	// persistent store of refresh tokens of accounts with RememberMe
+	tokenStore TokenStore
+	// mutex for concurrent access to the store
+	mutex sync.RWMutex
+}
+
+// ExportMosquittoPasswords writes the password hashes to a mosquitto password file.
+// Mosquitto only supports PBKDF2-SHA512 hashes, so use SetHashAlgorithm(HashAlgoPBKDF2) before setting the
+// passwords. Login names whose password is hashed with another algorithm, or that are not valid in a password
+// file, are skipped with a warning.
+//  passwordFile to write
+func (store *AccountStore) ExportMosquittoPasswords(passwordFile string) error {
+	store.mutex.RLock()
+	loginNames := make([]string, 0, len(store.data.Passwords))
+	for loginName := range store.data.Passwords {
+		loginNames = append(loginNames, loginName)
+	}
+	sort.Strings(loginNames)
+	buf := bytes.Buffer{}
+	for _, loginName := range loginNames {
+		hash := store.data.Passwords[loginName]
+		if !strings.HasPrefix(hash, pbkdf2Prefix) || !isValidLoginName(loginName) {
+			logrus.Warningf("ExportMosquittoPasswords: skipping login name %q as mosquitto can't use its password",
+				loginName)
+			continue
+		}
+		fmt.Fprintf(&buf, "%s:%s\n", loginName, hash)
+	}
+	store.mutex.RUnlock()
+	return ioutil.WriteFile(passwordFile, buf.Bytes(), 0600)
+}
+
+// GetAccount returns the account with the given ID
+// Returns false if the account doesn't exist
+func (store *AccountStore) GetAccount(accountID string) (account AccountRecord, found bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	account, found = store.data.Accounts[accountID]
+	return account, found
+}
+
+// GetEnabledAccounts returns the accounts that are enabled, sorted by ID
+func (store *AccountStore) GetEnabledAccounts() []AccountRecord {
+	enabledAccounts := make([]AccountRecord, 0)
+	for _, account := range store.GetAccounts() {
+		if account.Enabled {
+			enabledAccounts = append(enabledAccounts, account)
+		}
+	}
+	return enabledAccounts
+}
+
+// GetRefreshToken returns the refresh token of an account, or "" if the account has no token
+func (store *AccountStore) GetRefreshToken(accountID string) string {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if token, found := store.sessionTokens[accountID]; found {
+		return token
+	}
+	return store.tokenStore.GetToken(accountID)
+}
+
+// GetAccounts returns all accounts sorted by ID
+func (store *AccountStore) GetAccounts() []AccountRecord {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	accounts := make([]AccountRecord, 0, len(store.data.Accounts))
+	for _, account := range store.data.Accounts {
+		accounts = append(accounts, account)
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].ID < accounts[j].ID
+	})
+	return accounts
+}
+
+// HasPassword returns whether a password is set for the login name
+func (store *AccountStore) HasPassword(loginName string) bool {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	_, found := store.data.Passwords[loginName]
+	return found
+}
+
+// RemoveAccount removes the account with the given ID.
+// The password of its login name is removed unless it is used by another account.
+func (store *AccountStore) RemoveAccount(accountID string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	account, found := store.data.Accounts[accountID]
+	if !found {
+		return fmt.Errorf("RemoveAccount: account '%s' not found", accountID)
+	}
+	err := store.update(func(data *accountStoreData) {
+		delete(data.Accounts, accountID)
+		isShared := false
+		for _, other := range data.Accounts {
+			if other.LoginName == account.LoginName {
+				isShared = true
+				break
+			}
+		}
+		if !isShared {
+			delete(data.Passwords, account.LoginName)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	delete(store.sessionTokens, accountID)
+	_ = store.tokenStore.RemoveToken(accountID)
+	return nil
+}
+
+// RemovePassword removes the password of a login name. The login name can no longer authenticate.
+func (store *AccountStore) RemovePassword(loginName string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.update(func(data *accountStoreData) {
+		delete(data.Passwords, loginName)
+	})
+}
+
+// SetAccount adds or updates an account
+// Returns an error if the account has no ID or saving the store failed
+func (store *AccountStore) SetAccount(account AccountRecord) error {
+	if account.ID == "" {
+		return errors.New("SetAccount: missing account ID")
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.update(func(data *accountStoreData) {
+		data.Accounts[account.ID] = account
+	})
+}
+
+// SetEnabled enables or disables an account
+func (store *AccountStore) SetEnabled(accountID string, enabled bool) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	account, found := store.data.Accounts[accountID]
+	if !found {
+		return fmt.Errorf("SetEnabled: account '%s' not found", accountID)
+	}
+	account.Enabled = enabled
+	return store.update(func(data *accountStoreData) {
+		data.Accounts[accountID] = account
+	})
+}
+
+// SetRefreshToken sets the refresh token of an account.
+// The token is persisted in the token store if the account has RememberMe set. Otherwise it is only kept
+// in memory until the application ends.
+//  accountID of the account
+//  refreshToken to store, or "" to remove the token
+func (store *AccountStore) SetRefreshToken(accountID string, refreshToken string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	account, found := store.data.Accounts[accountID]
+	if !found {
+		return fmt.Errorf("SetRefreshToken: account '%s' not found", accountID)
+	}
+	delete(store.sessionTokens, accountID)
+	if refreshToken == "" || !account.RememberMe {
+		if refreshToken != "" {
+			store.sessionTokens[accountID] = refreshToken
+		}
+		return store.tokenStore.RemoveToken(accountID)
+	}
+	return store.tokenStore.SetToken(accountID, refreshToken)
+}
+
+// SetTokenStore sets the persistent store of refresh tokens, eg one that uses the OS keyring
+// By default the tokens are stored in a file next to the store file. See NewAccountStore.
+func (store *AccountStore) SetTokenStore(tokenStore TokenStore) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.tokenStore = tokenStore
+}
+
+// SetHashAlgorithm sets the algorithm used to hash new passwords. Existing hashes remain valid.
+//  hashAlgo is HashAlgoArgon2id (default), HashAlgoBcrypt or HashAlgoPBKDF2 for use with mosquitto
+func (store *AccountStore) SetHashAlgorithm(hashAlgo string) error {
+	if hashAlgo != HashAlgoArgon2id && hashAlgo != HashAlgoBcrypt && hashAlgo != HashAlgoPBKDF2 {
+		return fmt.Errorf("SetHashAlgorithm: unsupported hash algorithm '%s'", hashAlgo)
+	}
+	dummyHash, err := createDummyHash(hashAlgo)
+	if err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.hashAlgo = hashAlgo
+	store.dummyHash = dummyHash
+	return nil
+}
+
+// SetPassword sets the password of a login name. Only the hash of the password is stored.
+// Login names can't contain a ':' as it separates the name from the hash in password files, nor whitespace or
+// control characters as lines in password files are separated by a newline.
+func (store *AccountStore) SetPassword(loginName string, password string) error {
+	if loginName == "" || password == "" {
+		return errors.New("SetPassword: missing login name or password")
+	} else if !isValidLoginName(loginName) {
+		return fmt.Errorf("SetPassword: login name %q contains a ':', whitespace or control characters", loginName)
+	}
+	store.mutex.RLock()
+	hashAlgo := store.hashAlgo
+	store.mutex.RUnlock()
+	hash, err := HashPassword(password, hashAlgo)
+	if err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.update(func(data *accountStoreData) {
+		data.Passwords[loginName] = hash
+	})
+}
+
+// VerifyPassword returns whether the password of the login name is correct.
+// This can be used as the credentials validation handler of TLSServer.EnableBasicAuth.
+func (store *AccountStore) VerifyPassword(loginName string, password string) bool {
+	store.mutex.RLock()
+	hash, found := store.data.Passwords[loginName]
+	dummyHash := store.dummyHash
+	store.mutex.RUnlock()
+	if !found {
+		// verify anyway so unknown login names can't be detected from the response time
+		_ = VerifyPasswordHash(dummyHash, password)
+		logrus.Infof("VerifyPassword: unknown login name '%s'", loginName)
+		return false
+	}
+	return VerifyPasswordHash(hash, password)
+}
+
+// load the store from file, if it exists
+func (store *AccountStore) load() error {
+	data, err := ioutil.ReadFile(store.storeFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, &store.data)
+	if err != nil {
+		return fmt.Errorf("invalid account store file '%s': %s", store.storeFile, err)
+	}
+	if store.data.Accounts == nil {
+		store.data.Accounts = make(map[string]AccountRecord)
+	}
+	if store.data.Passwords == nil {
+		store.data.Passwords = make(map[string]string)
+	}
+	return nil
+}
+
+// save the store data to file, if configured
+func (store *AccountStore) save(storeData accountStoreData) error {
+	if store.storeFile == "" {
+		return nil
+	}
+	data, _ := json.MarshalIndent(storeData, "", "  ")
+	tmpFile := store.storeFile + ".tmp"
+	err := ioutil.WriteFile(tmpFile, data, 0600)
+	if err == nil {
+		err = os.Rename(tmpFile, store.storeFile)
+	}
+	if err != nil {
+		logrus.Errorf("Failed saving account store to '%s': %s", store.storeFile, err)
+	}
+	return err
+}
+
+// update applies a change to a copy of the store data and saves it. The store is only changed if saving succeeds.
+// This must be called with the mutex locked.
+func (store *AccountStore) update(change func(data *accountStoreData)) error {
+	newData := accountStoreData{
+		Accounts:  make(map[string]AccountRecord, len(store.data.Accounts)),
+		Passwords: make(map[string]string, len(store.data.Passwords)),
+	}
+	for accountID, account := range store.data.Accounts {
+		newData.Accounts[accountID] = account
+	}
+	for loginName, hash := range store.data.Passwords {
+		newData.Passwords[loginName] = hash
+	}
+	change(&newData)
+	err := store.save(newData)
+	if err != nil {
+		return err
+	}
+	store.data = newData
+	return nil
+}
+
+// isValidLoginName returns whether the login name can be written to a password file
+func isValidLoginName(loginName string) bool {
+	for _, r := range loginName {
+		if r == ':' || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return loginName != ""
+}
+
+// createDummyHash creates the hash of a random password with the given algorithm
+func createDummyHash(hashAlgo string) (string, error) {
+	password := make([]byte, 16)
+	_, _ = rand.Read(password)
+	return HashPassword(base64.StdEncoding.EncodeToString(password), hashAlgo)
+}
+
+// NewAccountStore creates a store of accounts and passwords.
+// If a store file is given then the store is loaded from this file, and saved after each change.
+// The refresh tokens of accounts are stored in the file with the '.tokens' suffix, readable only by its owner.
+// New passwords are hashed with argon2id. Use SetHashAlgorithm to use bcrypt instead.
+//
+//  storeFile to persist the accounts and password hashes. Use "" to keep the store in memory.
+func NewAccountStore(storeFile string) (*AccountStore, error) {
+	dummyHash, err := createDummyHash(HashAlgoArgon2id)
+	if err != nil {
+		return nil, err
+	}
+	store := &AccountStore{
+		data: accountStoreData{
+			Accounts:  make(map[string]AccountRecord),
+			Passwords: make(map[string]string),
+		},
+		hashAlgo:      HashAlgoArgon2id,
+		dummyHash:     dummyHash,
+		sessionTokens: make(map[string]string),
+		storeFile:     storeFile,
+	}
+	if storeFile == "" {
+		store.tokenStore, _ = NewFileTokenStore("")
+		return store, nil
+	}
+	if err = store.load(); err != nil {
+		return nil, err
+	}
+	store.tokenStore, err = NewFileTokenStore(storeFile + ".tokens")
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
 }
@@ -0,0 +1,231 @@
+package accounts_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/wostzone/wost-go/pkg/accounts"
+)
+
+func TestPasswordHash(t *testing.T) {
+	logrus.Infof("--- TestPasswordHash ---")
+	for _, hashAlgo := range []string{accounts.HashAlgoArgon2id, accounts.HashAlgoBcrypt, accounts.HashAlgoPBKDF2} {
+		hash, err := accounts.HashPassword("secret", hashAlgo)
+		require.NoError(t, err)
+		assert.NotContains(t, hash, "secret")
+		assert.True(t, accounts.VerifyPasswordHash(hash, "secret"))
+		assert.False(t, accounts.VerifyPasswordHash(hash, "wrong"))
+	}
+	_, err := accounts.HashPassword("secret", "md5")
+	assert.Error(t, err)
+	assert.False(t, accounts.VerifyPasswordHash("$argon2id$bad", "secret"))
+	assert.False(t, accounts.VerifyPasswordHash("", ""))
+	assert.False(t, accounts.VerifyPasswordHash("$7$bad", "secret"))
+
+
+	// mosquitto hash with 101 iterations and salt '0123456789ab'
+	hash := "$7$101$MDEyMzQ1Njc4OWFi$EO/lLlkeUgIiBaS8G8UK0ZMP1u508TA7Tl+AdJ1cEsmlbGyEPAERErpfq84j1kepISs0UzmcdL4" +
+		"ucgZ2uodxfQ=="
+	assert.True(t, accounts.VerifyPasswordHash(hash, "secret"))
+	assert.False(t, accounts.VerifyPasswordHash(hash, "wrong"))
+}
+
+func TestAccountStore(t *testing.T) {
+	logrus.Infof("--- TestAccountStore ---")
+	storeFile := path.Join(t.TempDir(), "accounts.json")
+	store, err := accounts.NewAccountStore(storeFile)
+	require.NoError(t, err)
+
+	account1 := accounts.AccountRecord{ID: "hub1", DisplayName: "Hub 1", LoginName: "user1", Enabled: true}
+	err = store.SetAccount(account1)
+	require.NoError(t, err)
+	err = store.SetPassword("user1", "pass1")
+	require.NoError(t, err)
+	err = store.SetHashAlgorithm(accounts.HashAlgoBcrypt)
+	require.NoError(t, err)
+	err = store.SetPassword("user2", "pass2")
+	require.NoError(t, err)
+	err = store.SetHashAlgorithm(accounts.HashAlgoPBKDF2)
+	require.NoError(t, err)
+	err = store.SetPassword("user3", "pass3")
+	require.NoError(t, err)
+	assert.True(t, store.VerifyPassword("user1", "pass1"))
+	assert.True(t, store.VerifyPassword("user2", "pass2"))
+	assert.False(t, store.VerifyPassword("user1", "pass2"))
+	assert.True(t, store.VerifyPassword("user3", "pass3"))
+	assert.False(t, store.VerifyPassword("user4", "pass1"))
+
+	// the store is persisted
+	store2, err := accounts.NewAccountStore(storeFile)
+	require.NoError(t, err)
+	account, found := store2.GetAccount("hub1")
+	assert.True(t, found)
+	assert.Equal(t, account1, account)
+	assert.Len(t, store2.GetAccounts(), 1)
+	assert.True(t, store2.HasPassword("user3"))
+	assert.True(t, store2.VerifyPassword("user1", "pass1"))
+	storeData, _ := ioutil.ReadFile(storeFile)
+	assert.NotContains(t, string(storeData), "pass1")
+
+	// only the PBKDF2 hashes can be exported for mosquitto
+	passwordFile := path.Join(t.TempDir(), "mosquitto.passwd")
+	err = store2.ExportMosquittoPasswords(passwordFile)
+	require.NoError(t, err)
+	passwords, _ := ioutil.ReadFile(passwordFile)
+	lines := strings.Split(strings.TrimSpace(string(passwords)), "\n")
+	require.Len(t, lines, 1)
+	assert.True(t, strings.HasPrefix(lines[0], "user3:$7$210000$"))
+
+	// removing the account removes its password
+	err = store2.RemoveAccount("hub1")
+	assert.NoError(t, err)
+	assert.False(t, store2.HasPassword("user1"))
+	err = store2.RemoveAccount("hub1")
+	assert.Error(t, err)
+	err = store2.RemovePassword("user2")
+	assert.NoError(t, err)
+	assert.False(t, store2.VerifyPassword("user2", "pass2"))
+
+	// bad input
+	err = store2.SetAccount(accounts.AccountRecord{})
+	assert.Error(t, err)
+	err = store2.SetPassword("user1", "")
+	assert.Error(t, err)
+	err = store2.SetPassword("user:1", "pass1")
+	assert.Error(t, err)
+	err = store2.SetPassword("user 1", "pass1")
+	assert.Error(t, err)
+	err = store2.SetPassword("x\nadmin", "pass1")
+	assert.Error(t, err)
+	err = store2.SetHashAlgorithm("md5")
+	assert.Error(t, err)
+	err = ioutil.WriteFile(storeFile, []byte("not json"), 0600)
+	require.NoError(t, err)
+	_, err = accounts.NewAccountStore(storeFile)
+	assert.Error(t, err)
+}
+
+func TestExportInvalidLoginNames(t *testing.T) {
+	logrus.Infof("--- TestExportInvalidLoginNames ---")
+	storeFile := path.Join(t.TempDir(), "accounts.json")
+	hash, err := accounts.HashPassword("pass1", accounts.HashAlgoPBKDF2)
+	require.NoError(t, err)
+	// login names in an edited store file that would add lines to the password file
+	storeData, _ := json.Marshal(map[string]interface{}{
+		"accounts": map[string]interface{}{},
+		"passwords": map[string]string{
+			"user1":                hash,
+			"x\nadmin":             hash,
+			"user 2":               hash,
+			"admin:" + hash + "\r": hash,
+		},
+	})
+	err = ioutil.WriteFile(storeFile, storeData, 0600)
+	require.NoError(t, err)
+	store, err := accounts.NewAccountStore(storeFile)
+	require.NoError(t, err)
+
+	passwordFile := path.Join(t.TempDir(), "mosquitto.passwd")
+	err = store.ExportMosquittoPasswords(passwordFile)
+	require.NoError(t, err)
+	passwords, _ := ioutil.ReadFile(passwordFile)
+	assert.Equal(t, "user1:"+hash+"\n", string(passwords))
+}
+
+func TestAccountStoreSaveFailure(t *testing.T) {
+	logrus.Infof("--- TestAccountStoreSaveFailure ---")
+	storeFolder := t.TempDir()
+	storeFile := path.Join(storeFolder, "accounts.json")
+	store, err := accounts.NewAccountStore(storeFile)
+	require.NoError(t, err)
+	err = store.SetPassword("user1", "pass1")
+	require.NoError(t, err)
+
+	// changes that can't be saved are not applied
+	err = os.RemoveAll(storeFolder)
+	require.NoError(t, err)
+	err = store.SetPassword("user1", "pass2")
+	assert.Error(t, err)
+	assert.True(t, store.VerifyPassword("user1", "pass1"))
+	err = store.SetAccount(accounts.AccountRecord{ID: "hub1", LoginName: "user1"})
+	assert.Error(t, err)
+	_, found := store.GetAccount("hub1")
+	assert.False(t, found)
+	err = store.RemovePassword("user1")
+	assert.Error(t, err)
+	assert.True(t, store.HasPassword("user1"))
+}
+
+func TestAccountStoreTokens(t *testing.T) {
+	logrus.Infof("--- TestAccountStoreTokens ---")
+	storeFile := path.Join(t.TempDir(), "accounts.json")
+	tokenFile := storeFile + ".tokens"
+
+	store, err := accounts.NewAccountStore(storeFile)
+	require.NoError(t, err)
+	err = store.SetAccount(accounts.AccountRecord{ID: "hub1", LoginName: "user1", Enabled: true, RememberMe: true})
+	require.NoError(t, err)
+	err = store.SetAccount(accounts.AccountRecord{ID: "hub2", LoginName: "user1"})
+	require.NoError(t, err)
+	assert.Len(t, store.GetEnabledAccounts(), 1)
+	err = store.SetEnabled("hub2", true)
+	assert.NoError(t, err)
+	assert.Len(t, store.GetEnabledAccounts(), 2)
+	err = store.SetEnabled("hub3", true)
+	assert.Error(t, err)
+
+	// only the token of the remembered account is persisted, in a file readable by its owner
+	err = store.SetRefreshToken("hub1", "token1")
+	assert.NoError(t, err)
+	err = store.SetRefreshToken("hub2", "token2")
+	assert.NoError(t, err)
+	err = store.SetRefreshToken("hub3", "token3")
+	assert.Error(t, err)
+	assert.Equal(t, "token2", store.GetRefreshToken("hub2"))
+	fileInfo, err := os.Stat(tokenFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fileInfo.Mode().Perm())
+	storeData, _ := ioutil.ReadFile(storeFile)
+	assert.NotContains(t, string(storeData), "token1")
+
+	store2, err := accounts.NewAccountStore(storeFile)
+	require.NoError(t, err)
+	assert.Equal(t, "token1", store2.GetRefreshToken("hub1"))
+	assert.Equal(t, "", store2.GetRefreshToken("hub2"))
+	account, _ := store2.GetAccount("hub2")
+	assert.True(t, account.Enabled)
+
+	// removing the token or account removes the stored token
+	err = store2.SetRefreshToken("hub1", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "", store2.GetRefreshToken("hub1"))
+	err = store2.SetRefreshToken("hub1", "token1b")
+	assert.NoError(t, err)
+	err = store2.RemoveAccount("hub1")
+	assert.NoError(t, err)
+	tokenData, _ := ioutil.ReadFile(tokenFile)
+	assert.NotContains(t, string(tokenData), "token1b")
+
+	// a custom token store, eg the OS keyring
+	tokenStore, _ := accounts.NewFileTokenStore("")
+	store2.SetTokenStore(tokenStore)
+	err = store2.SetAccount(accounts.AccountRecord{ID: "hub1", LoginName: "user1", RememberMe: true})
+	require.NoError(t, err)
+	err = store2.SetRefreshToken("hub1", "token1c")
+	assert.NoError(t, err)
+	assert.Equal(t, "token1c", tokenStore.GetToken("hub1"))
+
+	// bad token file
+	err = ioutil.WriteFile(tokenFile, []byte("not json"), 0600)
+	require.NoError(t, err)
+	_, err = accounts.NewAccountStore(storeFile)
+	assert.Error(t, err)
+}
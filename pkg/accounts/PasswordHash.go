@@ -0,0 +1,143 @@
+package accounts
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Supported password hash algorithms
+const (
+	// HashAlgoArgon2id hashes passwords with argon2id in the PHC string format: $argon2id$v=19$m=,t=,p=$salt$hash
+	HashAlgoArgon2id = "argon2id"
+	// HashAlgoBcrypt hashes passwords with bcrypt: $2a$cost$saltandhash
+	HashAlgoBcrypt = "bcrypt"
+	// HashAlgoPBKDF2 hashes passwords with PBKDF2-SHA512 in the mosquitto password file format: $7$iterations$salt$hash
+	HashAlgoPBKDF2 = "pbkdf2-sha512"
+)
+
+// Parameters of the argon2id hash, as recommended by RFC9106 for memory constrained environments
+const (
+	argon2Memory  = 64 * 1024
+	argon2Time    = 3
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// Parameters of the PBKDF2-SHA512 hash. The salt length is that of mosquitto_passwd.
+const (
+	pbkdf2Iterations = 210000
+	pbkdf2SaltLen    = 12
+	pbkdf2Prefix     = "$7$"
+)
+
+// HashPassword returns the hash of a password
+//  password to hash
+//  hashAlgo is HashAlgoArgon2id, HashAlgoBcrypt or HashAlgoPBKDF2
+func HashPassword(password string, hashAlgo string) (string, error) {
+	switch hashAlgo {
+	case HashAlgoArgon2id:
+		salt := make([]byte, argon2SaltLen)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return "", err
+		}
+		hash := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+			argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+	case HashAlgoBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hash), err
+	case HashAlgoPBKDF2:
+		salt := make([]byte, pbkdf2SaltLen)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return "", err
+		}
+		hash := pbkdf2.Key([]byte(password), salt, pbkdf2Iterations, sha512.Size, sha512.New)
+		return fmt.Sprintf("%s%d$%s$%s", pbkdf2Prefix, pbkdf2Iterations,
+			base64.StdEncoding.EncodeToString(salt), base64.StdEncoding.EncodeToString(hash)), nil
+	}
+	return "", fmt.Errorf("HashPassword: unsupported hash algorithm '%s'", hashAlgo)
+}
+
+// VerifyPasswordHash returns whether the password matches the hash
+// The hash algorithm is determined from the hash.
+//  hash of the password created with HashPassword
+//  password to verify
+func VerifyPasswordHash(hash string, password string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return verifyArgon2id(hash, password) == nil
+	} else if strings.HasPrefix(hash, pbkdf2Prefix) {
+		return verifyPBKDF2(hash, password) == nil
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// verifyArgon2id verifies a password against an argon2id hash in the PHC string format
+func verifyArgon2id(hash string, password string) error {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return errors.New("invalid argon2id hash")
+	}
+	var version int
+	var memory, time uint32
+	var threads uint8
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return errors.New("unsupported argon2id version")
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	if err != nil {
+		return err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return err
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return err
+	}
+	actual := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(expected)))
+	if subtle.ConstantTimeCompare(expected, actual) != 1 {
+		return errors.New("password mismatch")
+	}
+	return nil
+}
+
+// verifyPBKDF2 verifies a password against a PBKDF2-SHA512 hash in the mosquitto format
+func verifyPBKDF2(hash string, password string) error {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 {
+		return errors.New("invalid pbkdf2 hash")
+	}
+	var iterations int
+	_, err := fmt.Sscanf(parts[2], "%d", &iterations)
+	if err != nil || iterations <= 0 {
+		return errors.New("invalid pbkdf2 iterations")
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return err
+	}
+	expected, err := base64.StdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return err
+	}
+	actual := pbkdf2.Key([]byte(password), salt, iterations, len(expected), sha512.New)
+	if subtle.ConstantTimeCompare(expected, actual) != 1 {
+		return errors.New("password mismatch")
+	}
+	return nil
+}
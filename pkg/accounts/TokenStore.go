@@ -0,0 +1,101 @@
+package accounts
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TokenStore persists the refresh tokens of accounts, so users don't need to login again
+// after a restart. Implementations can use a file or the OS keyring.
+type TokenStore interface {
+	// GetToken returns the refresh token of an account, or "" if none is stored
+	GetToken(accountID string) string
+	// RemoveToken removes the refresh token of an account
+	RemoveToken(accountID string) error
+	// SetToken stores the refresh token of an account
+	SetToken(accountID string, refreshToken string) error
+}
+
+// FileTokenStore is a TokenStore that keeps the refresh tokens in a file that is only
+// readable by its owner.
+type FileTokenStore struct {
+	// file to persist the tokens. "" to keep the tokens in memory
+	tokenFile string
+	// refresh tokens by account ID
+	tokens map[string]string
+	// mutex for concurrent access to the tokens
+	mutex sync.RWMutex
+}
+
+// GetToken returns the refresh token of an account, or "" if none is stored
+func (store *FileTokenStore) GetToken(accountID string) string {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.tokens[accountID]
+}
+
+// RemoveToken removes the refresh token of an account
+func (store *FileTokenStore) RemoveToken(accountID string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, found := store.tokens[accountID]; !found {
+		return nil
+	}
+	delete(store.tokens, accountID)
+	return store.save()
+}
+
+// SetToken stores the refresh token of an account
+func (store *FileTokenStore) SetToken(accountID string, refreshToken string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.tokens[accountID] = refreshToken
+	return store.save()
+}
+
+// save the tokens to file with owner only permissions, if configured
+// This must be called with the mutex locked.
+func (store *FileTokenStore) save() error {
+	if store.tokenFile == "" {
+		return nil
+	}
+	data, _ := json.MarshalIndent(store.tokens, "", "  ")
+	tmpFile := store.tokenFile + ".tmp"
+	err := ioutil.WriteFile(tmpFile, data, 0600)
+	if err == nil {
+		err = os.Rename(tmpFile, store.tokenFile)
+	}
+	if err != nil {
+		logrus.Errorf("Failed saving tokens to '%s': %s", store.tokenFile, err)
+	}
+	return err
+}
+
+// NewFileTokenStore creates a token store that persists the tokens in a file with 0600 permissions.
+// Existing tokens are loaded from the file.
+//  tokenFile to persist the tokens. Use "" to keep the tokens in memory.
+func NewFileTokenStore(tokenFile string) (*FileTokenStore, error) {
+	store := &FileTokenStore{
+		tokenFile: tokenFile,
+		tokens:    make(map[string]string),
+	}
+	if tokenFile == "" {
+		return store, nil
+	}
+	data, err := ioutil.ReadFile(tokenFile)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &store.tokens)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token file '%s': %s", tokenFile, err)
+	}
+	return store, nil
+}
@@ -0,0 +1,278 @@
+// Package acl with access control of clients to things on the MQTT message bus
+package acl
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/wostzone/wost-go/pkg/consumedthing"
+)
+
+// Operation that a client can be allowed to perform on a thing
+type Operation string
+
+const (
+	// OpRead allows reading the TD and status of a thing
+	OpRead Operation = "read"
+	// OpSubscribe allows subscribing to the events of a thing, including property value changes
+	OpSubscribe Operation = "subscribe"
+	// OpInvoke allows publishing action requests to a thing
+	OpInvoke Operation = "invoke"
+	// OpWrite allows publishing as the thing: its TD, events and status. It also allows receiving its action requests.
+	OpWrite Operation = "write"
+)
+
+// Special thing ID patterns of a rule
+const (
+	// AnyThing matches all thing IDs
+	AnyThing = "*"
+	// OwnThing matches the thing ID that is equal to the client ID
+	OwnThing = "{clientID}"
+)
+
+// AllClients is the client ID of a rule that applies to all clients
+const AllClients = "*"
+
+// Rule grants a client or group of clients the operations on things
+type Rule struct {
+	// ClientID the rule applies to, or AllClients. Use either ClientID or Group.
+	ClientID string `yaml:"clientID,omitempty"`
+	// Group the rule applies to. Use either ClientID or Group.
+	Group string `yaml:"group,omitempty"`
+	// Things is the thing ID, AnyThing, or OwnThing
+	Things string `yaml:"things"`
+	// Operations that are allowed
+	Operations []Operation `yaml:"operations"`
+}
+
+// AccessControl holds the groups and rules that determine which clients can access which things.
+// Access is denied unless it is granted by a rule.
+//
+// Use CanPublish and CanSubscribe to authorize MQTT requests, for example in a broker auth plugin or a
+// directory service, or use CreateMosquittoACL to generate an ACL file for the mosquitto broker.
+type AccessControl struct {
+	// group members by group name
+	groups map[string][]string
+	// rules granting access
+	rules []Rule
+	// mutex for concurrent access to the groups and rules
+	mutex sync.RWMutex
+}
+
+// AddGroupMember adds a client to a group
+// The group is created if it doesn't exist.
+// Returns an error if the group name or client ID isn't a valid identifier.
+func (ac *AccessControl) AddGroupMember(group string, clientID string) error {
+	if !isValidIdentifier(group) || !isValidIdentifier(clientID) {
+		return fmt.Errorf("AddGroupMember: invalid group %q or client ID %q", group, clientID)
+	}
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	for _, member := range ac.groups[group] {
+		if member == clientID {
+			return nil
+		}
+	}
+	ac.groups[group] = append(ac.groups[group], clientID)
+	return nil
+}
+
+// AddRule adds a rule that grants access
+// Returns an error if the rule has no client or group, its client ID or group isn't a valid identifier,
+// or its thing pattern isn't supported.
+func (ac *AccessControl) AddRule(rule Rule) error {
+	if (rule.ClientID == "") == (rule.Group == "") {
+		return fmt.Errorf("AddRule: rule must have either a clientID or a group")
+	}
+	if (rule.ClientID != "" && !isValidIdentifier(rule.ClientID)) || (rule.Group != "" && !isValidIdentifier(rule.Group)) {
+		return fmt.Errorf("AddRule: invalid clientID %q or group %q", rule.ClientID, rule.Group)
+	}
+	if !isValidIdentifier(rule.Things) ||
+		(strings.Contains(rule.Things, "*") && rule.Things != AnyThing) {
+		return fmt.Errorf("AddRule: invalid things pattern %q", rule.Things)
+	}
+	for _, op := range rule.Operations {
+		switch op {
+		case OpRead, OpSubscribe, OpInvoke, OpWrite:
+		default:
+			return fmt.Errorf("AddRule: unknown operation '%s'", op)
+		}
+	}
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	ac.rules = append(ac.rules, rule)
+	return nil
+}
+
+// CanPublish returns whether the client is allowed to publish on the topic
+//  clientID of the publisher
+//  topic to publish on, eg things/{thingID}/action/{name}
+func (ac *AccessControl) CanPublish(clientID string, topic string) bool {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 3 || strings.ContainsAny(topic, "+#") {
+		return false
+	}
+	// publishers announce their own status
+	if parts[0] == "publishers" {
+		return parts[1] == clientID && parts[2] == consumedthing.TopicTypeStatus
+	}
+	if parts[0] != "things" {
+		return false
+	}
+	switch parts[2] {
+	case consumedthing.TopicTypeAction:
+		return ac.IsAllowed(clientID, parts[1], OpInvoke)
+	case consumedthing.TopicTypeTD, consumedthing.TopicTypeEvent, consumedthing.TopicTypeStatus:
+		return ac.IsAllowed(clientID, parts[1], OpWrite)
+	}
+	return false
+}
+
+// CanSubscribe returns whether the client is allowed to subscribe to the topic filter.
+// A filter with a wildcard thing ID requires access to all things. A filter with a wildcard message
+// type requires the operations for all message types.
+//  clientID of the subscriber
+//  topicFilter to subscribe to, eg things/+/event/#
+func (ac *AccessControl) CanSubscribe(clientID string, topicFilter string) bool {
+	parts := strings.Split(topicFilter, "/")
+	if len(parts) < 2 {
+		return false
+	}
+	// the status of publishers is available to all clients
+	if parts[0] == "publishers" {
+		return len(parts) == 3 && parts[2] == consumedthing.TopicTypeStatus
+	}
+	if parts[0] != "things" {
+		return false
+	}
+	thingID := parts[1]
+	if thingID == "+" || thingID == "#" {
+		thingID = AnyThing
+	}
+	topicType := "#"
+	if len(parts) > 2 && thingID != "#" {
+		topicType = parts[2]
+	}
+	var operations []Operation
+	switch topicType {
+	case consumedthing.TopicTypeTD, consumedthing.TopicTypeStatus:
+		operations = []Operation{OpRead}
+	case consumedthing.TopicTypeEvent:
+		operations = []Operation{OpSubscribe}
+	case consumedthing.TopicTypeAction:
+		operations = []Operation{OpWrite}
+	case "+", "#":
+		operations = []Operation{OpRead, OpSubscribe, OpWrite}
+	default:
+		return false
+	}
+	for _, op := range operations {
+		if !ac.IsAllowed(clientID, thingID, op) {
+			return false
+		}
+	}
+	return true
+}
+
+// GetRules returns a copy of the rules
+func (ac *AccessControl) GetRules() []Rule {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	rules := make([]Rule, len(ac.rules))
+	copy(rules, ac.rules)
+	return rules
+}
+
+// IsAllowed returns whether a rule allows the client to perform the operation on the thing
+//  clientID of the client
+//  thingID of the thing, or AnyThing to require access to all things
+//  op is the operation to perform
+func (ac *AccessControl) IsAllowed(clientID string, thingID string, op Operation) bool {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+	for _, rule := range ac.rules {
+		if ac.appliesTo(rule, clientID) && matchThing(rule.Things, clientID, thingID) && hasOperation(rule, op) {
+			return true
+		}
+	}
+	logrus.Debugf("IsAllowed: client '%s' is not allowed to %s thing '%s'", clientID, op, thingID)
+	return false
+}
+
+// RemoveGroupMember removes a client from a group
+func (ac *AccessControl) RemoveGroupMember(group string, clientID string) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	members := ac.groups[group]
+	for i, member := range members {
+		if member == clientID {
+			ac.groups[group] = append(members[:i:i], members[i+1:]...)
+			return
+		}
+	}
+}
+
+// appliesTo returns whether the rule applies to the client
+// This must be called with the mutex locked.
+func (ac *AccessControl) appliesTo(rule Rule, clientID string) bool {
+	if rule.ClientID != "" {
+		return rule.ClientID == AllClients || rule.ClientID == clientID
+	}
+	for _, member := range ac.groups[rule.Group] {
+		if member == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// hasOperation returns whether the rule grants the operation
+func hasOperation(rule Rule, op Operation) bool {
+	for _, ruleOp := range rule.Operations {
+		if ruleOp == op {
+			return true
+		}
+	}
+	return false
+}
+
+// isValidIdentifier returns whether a client ID, group or thing ID can be used in rules.
+// Identifiers are written as-is to the mosquitto ACL file and used in topics, so they can't contain whitespace,
+// control characters, the '%' of mosquitto patterns, or the topic separator and wildcards.
+func isValidIdentifier(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || strings.ContainsRune("%/+#", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchThing returns whether the thing pattern of a rule matches the thing
+// A thingID of AnyThing is only matched by the AnyThing pattern.
+func matchThing(pattern string, clientID string, thingID string) bool {
+	switch pattern {
+	case AnyThing:
+		return true
+	case OwnThing:
+		return thingID == clientID
+	}
+	return thingID == pattern
+}
+
+// NewAccessControl creates an access control without rules, so all access is denied.
+// Use AddRule to grant access.
+func NewAccessControl() *AccessControl {
+	ac := &AccessControl{
+		groups: make(map[string][]string),
+		rules:  make([]Rule, 0),
+	}
+	return ac
+}
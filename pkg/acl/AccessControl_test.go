@@ -0,0 +1,143 @@
+package acl_test
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/wostzone/wost-go/pkg/acl"
+)
+
+const device1 = "device1"
+const thing2 = "thing2"
+const user1 = "user1"
+const operators = "operators"
+
+// create the access control used in testing
+func createTestACL(t *testing.T) *acl.AccessControl {
+	ac := acl.NewAccessControl()
+	// devices publish their own things
+	err := ac.AddRule(acl.Rule{ClientID: acl.AllClients, Things: acl.OwnThing,
+		Operations: []acl.Operation{acl.OpWrite}})
+	require.NoError(t, err)
+	// users can view all things
+	err = ac.AddRule(acl.Rule{ClientID: user1, Things: acl.AnyThing,
+		Operations: []acl.Operation{acl.OpRead, acl.OpSubscribe}})
+	require.NoError(t, err)
+	// operators can control thing2
+	err = ac.AddRule(acl.Rule{Group: operators, Things: thing2,
+		Operations: []acl.Operation{acl.OpInvoke}})
+	require.NoError(t, err)
+	err = ac.AddGroupMember(operators, user1)
+	require.NoError(t, err)
+	return ac
+}
+
+func TestAccessControl(t *testing.T) {
+	logrus.Infof("--- TestAccessControl ---")
+	ac := createTestACL(t)
+	assert.Len(t, ac.GetRules(), 3)
+
+	// devices can only publish under their own things topics
+	assert.True(t, ac.CanPublish(device1, "things/device1/event/temperature"))
+	assert.True(t, ac.CanPublish(device1, "things/device1/td"))
+	assert.True(t, ac.CanSubscribe(device1, "things/device1/action/#"))
+	assert.False(t, ac.CanPublish(device1, "things/thing2/event/temperature"))
+	assert.False(t, ac.CanPublish(device1, "things/device1/action/reset"))
+	assert.False(t, ac.CanSubscribe(device1, "things/+/event/#"))
+	assert.True(t, ac.CanPublish(device1, "publishers/device1/status"))
+	assert.False(t, ac.CanPublish(device1, "publishers/device2/status"))
+
+	// users can view all things and control thing2 through their group
+	assert.True(t, ac.CanSubscribe(user1, "things/+/event/#"))
+	assert.True(t, ac.CanSubscribe(user1, "things/thing2/td"))
+	assert.True(t, ac.CanPublish(user1, "things/thing2/action/switch"))
+	assert.False(t, ac.CanPublish(user1, "things/device1/action/reset"))
+	assert.False(t, ac.CanPublish(user1, "things/thing2/event/temperature"))
+	assert.False(t, ac.CanSubscribe(user1, "things/#"))
+	assert.False(t, ac.CanPublish(user1, "things/+/action/switch"))
+	assert.False(t, ac.CanSubscribe(user1, "other/topic"))
+
+	// access is revoked when leaving the group
+	ac.RemoveGroupMember(operators, user1)
+	assert.False(t, ac.CanPublish(user1, "things/thing2/action/switch"))
+}
+
+func TestBadRules(t *testing.T) {
+	logrus.Infof("--- TestBadRules ---")
+	ac := acl.NewAccessControl()
+	err := ac.AddRule(acl.Rule{Things: acl.AnyThing, Operations: []acl.Operation{acl.OpRead}})
+	assert.Error(t, err)
+	err = ac.AddRule(acl.Rule{ClientID: user1, Group: operators, Things: acl.AnyThing})
+	assert.Error(t, err)
+	err = ac.AddRule(acl.Rule{ClientID: user1, Things: "thing*"})
+	assert.Error(t, err)
+	err = ac.AddRule(acl.Rule{ClientID: user1, Things: "things/+"})
+	assert.Error(t, err)
+	err = ac.AddRule(acl.Rule{ClientID: user1, Things: thing2, Operations: []acl.Operation{"delete"}})
+	assert.Error(t, err)
+	err = ac.AddRule(acl.Rule{ClientID: "user 1", Things: thing2})
+	assert.Error(t, err)
+	err = ac.AddRule(acl.Rule{Group: "%u", Things: thing2})
+	assert.Error(t, err)
+	err = ac.AddRule(acl.Rule{ClientID: user1, Things: "thing\t2"})
+	assert.Error(t, err)
+	assert.Empty(t, ac.GetRules())
+	assert.False(t, ac.CanSubscribe(user1, "things/thing2/td"))
+}
+
+func TestMosquittoACL(t *testing.T) {
+	logrus.Infof("--- TestMosquittoACL ---")
+	ac := createTestACL(t)
+	aclFile := path.Join(t.TempDir(), "mosquitto.acl")
+	err := ac.SaveMosquittoACL(aclFile)
+	require.NoError(t, err)
+	aclData, err := ioutil.ReadFile(aclFile)
+	require.NoError(t, err)
+
+	expected := `# Mosquitto ACL generated from the WoST access control rules
+
+# access of all clients
+pattern write publishers/%u/status
+pattern read publishers/+/status
+pattern read things/%u/action/#
+pattern write things/%u/event/#
+pattern write things/%u/status
+pattern write things/%u/td
+
+user user1
+topic read things/+/event/#
+topic read things/+/status
+topic read things/+/td
+topic write things/thing2/action/#
+`
+	assert.Equal(t, expected, string(aclData))
+}
+
+func TestMosquittoACLInjection(t *testing.T) {
+	logrus.Infof("--- TestMosquittoACLInjection ---")
+	ac := createTestACL(t)
+	injection := "x\ntopic readwrite #"
+
+	// identifiers with a newline can't add lines to the ACL file
+	err := ac.AddRule(acl.Rule{ClientID: injection, Things: thing2, Operations: []acl.Operation{acl.OpRead}})
+	assert.Error(t, err)
+	err = ac.AddRule(acl.Rule{Group: injection, Things: thing2, Operations: []acl.Operation{acl.OpRead}})
+	assert.Error(t, err)
+	err = ac.AddRule(acl.Rule{ClientID: user1, Things: injection, Operations: []acl.Operation{acl.OpRead}})
+	assert.Error(t, err)
+	err = ac.AddGroupMember(operators, injection)
+	assert.Error(t, err)
+	err = ac.AddGroupMember(injection, user1)
+	assert.Error(t, err)
+	// wildcards in a group member would match all things of an OwnThing rule
+	err = ac.AddGroupMember(operators, "#")
+	assert.Error(t, err)
+
+	assert.Len(t, ac.GetRules(), 3)
+	assert.NotContains(t, ac.CreateMosquittoACL(), "readwrite")
+}
@@ -0,0 +1,127 @@
+package acl
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+)
+
+// mosquitto access of a topic
+const (
+	accessRead  = 1
+	accessWrite = 2
+)
+
+// topicAccess holds the mosquitto access of topics
+type topicAccess map[string]int
+
+// add the topics for the operation on the thing
+//  thingID is the thing ID as used in the topic, eg '+' or '%u'
+func (access topicAccess) add(thingID string, op Operation) {
+	thingTopic := "things/" + thingID
+	switch op {
+	case OpRead:
+		access[thingTopic+"/td"] |= accessRead
+		access[thingTopic+"/status"] |= accessRead
+	case OpSubscribe:
+		access[thingTopic+"/event/#"] |= accessRead
+	case OpInvoke:
+		access[thingTopic+"/action/#"] |= accessWrite
+	case OpWrite:
+		access[thingTopic+"/td"] |= accessWrite
+		access[thingTopic+"/event/#"] |= accessWrite
+		access[thingTopic+"/status"] |= accessWrite
+		access[thingTopic+"/action/#"] |= accessRead
+	}
+}
+
+// write the topic lines in sorted order
+//  keyword is 'topic' or 'pattern'
+func (access topicAccess) write(buf *bytes.Buffer, keyword string) {
+	topics := make([]string, 0, len(access))
+	for topic := range access {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		accessName := "read"
+		if access[topic] == accessWrite {
+			accessName = "write"
+		} else if access[topic] == accessRead|accessWrite {
+			accessName = "readwrite"
+		}
+		fmt.Fprintf(buf, "%s %s %s\n", keyword, accessName, topic)
+	}
+}
+
+// CreateMosquittoACL creates the content of a mosquitto ACL file from the rules.
+//
+// The username of clients must be their client ID. For clients that authenticate with a certificate
+// this requires 'use_identity_as_username true' in the mosquitto configuration.
+// Rules for all clients become patterns, while rules for clients and groups become topics of each user.
+func (ac *AccessControl) CreateMosquittoACL() string {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+
+	// rules for all clients
+	patterns := make(topicAccess)
+	patterns["publishers/%u/status"] |= accessWrite
+	patterns["publishers/+/status"] |= accessRead
+	// rules for users, including group members
+	users := make(map[string]topicAccess)
+	for _, rule := range ac.rules {
+		clientIDs := []string{rule.ClientID}
+		if rule.Group != "" {
+			clientIDs = ac.groups[rule.Group]
+		}
+		for _, clientID := range clientIDs {
+			var access topicAccess
+			thingID := rule.Things
+			if clientID == AllClients {
+				access = patterns
+				if thingID == OwnThing {
+					thingID = "%u"
+				}
+			} else {
+				access = users[clientID]
+				if access == nil {
+					access = make(topicAccess)
+					users[clientID] = access
+				}
+				if thingID == OwnThing {
+					thingID = clientID
+				}
+			}
+			if thingID == AnyThing {
+				thingID = "+"
+			}
+			for _, op := range rule.Operations {
+				access.add(thingID, op)
+			}
+		}
+	}
+
+	buf := bytes.Buffer{}
+	buf.WriteString("# Mosquitto ACL generated from the WoST access control rules\n")
+	buf.WriteString("\n# access of all clients\n")
+	patterns.write(&buf, "pattern")
+	userNames := make([]string, 0, len(users))
+	for userName := range users {
+		userNames = append(userNames, userName)
+	}
+	sort.Strings(userNames)
+	for _, userName := range userNames {
+		fmt.Fprintf(&buf, "\nuser %s\n", userName)
+		users[userName].write(&buf, "topic")
+	}
+	return buf.String()
+}
+
+// SaveMosquittoACL saves the rules as a mosquitto ACL file. See also CreateMosquittoACL.
+// Mosquitto reloads the ACL file when it receives a SIGHUP signal.
+//  aclFile is the file to write, eg the 'acl_file' setting in mosquitto.conf
+func (ac *AccessControl) SaveMosquittoACL(aclFile string) error {
+	aclData := ac.CreateMosquittoACL()
+	return ioutil.WriteFile(aclFile, []byte(aclData), 0600)
+}
@@ -0,0 +1,147 @@
+package certsclient
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"math/bits"
+	"net"
+)
+
+// Object identifiers of the key usage extensions
+var (
+	oidExtensionKeyUsage    = asn1.ObjectIdentifier{2, 5, 29, 15}
+	oidExtensionExtKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37}
+)
+
+// Object identifiers of the extended key usages that can be requested
+var extKeyUsageOIDs = map[x509.ExtKeyUsage]asn1.ObjectIdentifier{
+	x509.ExtKeyUsageServerAuth: {1, 3, 6, 1, 5, 5, 7, 3, 1},
+	x509.ExtKeyUsageClientAuth: {1, 3, 6, 1, 5, 5, 7, 3, 2},
+}
+
+// CSROptions with the subject and usage of the certificate to request
+type CSROptions struct {
+	// CommonName is the client ID or hostname of the certificate owner
+	CommonName string
+	// OrganizationalUnit determines the permissions of the client, eg OUIoTDevice
+	OrganizationalUnit string
+	// DNSNames with the hostnames the certificate is valid for
+	DNSNames []string
+	// IPAddresses the certificate is valid for
+	IPAddresses []net.IP
+	// KeyUsage requested for the certificate, eg x509.KeyUsageDigitalSignature. 0 to leave it to the CA.
+	KeyUsage x509.KeyUsage
+	// ExtKeyUsage requested for the certificate, eg x509.ExtKeyUsageClientAuth. Empty to leave it to the CA.
+	ExtKeyUsage []x509.ExtKeyUsage
+}
+
+// CreateCSR creates a PEM encoded certificate signing request for the owner of the private key.
+// The CSR is signed with the private key, so the CA can verify the requester owns it.
+//
+//  privateKey of the certificate owner. The certificate is issued for its public key.
+//  options with the subject, SANs and key usage to request
+// Returns the PEM encoded CSR
+func CreateCSR(privateKey crypto.Signer, options CSROptions) (csrPEM string, err error) {
+	if options.CommonName == "" {
+		return "", errors.New("CreateCSR: missing common name")
+	}
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName: options.CommonName,
+		},
+		DNSNames:    options.DNSNames,
+		IPAddresses: options.IPAddresses,
+	}
+	if options.OrganizationalUnit != "" {
+		template.Subject.OrganizationalUnit = []string{options.OrganizationalUnit}
+	}
+	if options.KeyUsage != 0 {
+		ext, err := marshalKeyUsage(options.KeyUsage)
+		if err != nil {
+			return "", err
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, ext)
+	}
+	if len(options.ExtKeyUsage) > 0 {
+		ext, err := marshalExtKeyUsage(options.ExtKeyUsage)
+		if err != nil {
+			return "", err
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, ext)
+	}
+	derBytes, err := x509.CreateCertificateRequest(rand.Reader, template, privateKey)
+	if err != nil {
+		return "", err
+	}
+	csrPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: derBytes}))
+	return csrPEM, nil
+}
+
+// CSRFromPEM parses a PEM encoded certificate signing request and verifies its signature
+func CSRFromPEM(csrPEM string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("not a valid CSR PEM string")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	err = csr.CheckSignature()
+	return csr, err
+}
+
+// CSROptionsFromCert returns the CSR options to renew a certificate with the same subject, SANs and usage
+func CSROptionsFromCert(cert *x509.Certificate) CSROptions {
+	options := CSROptions{
+		CommonName:  cert.Subject.CommonName,
+		DNSNames:    cert.DNSNames,
+		IPAddresses: cert.IPAddresses,
+		KeyUsage:    cert.KeyUsage,
+		ExtKeyUsage: cert.ExtKeyUsage,
+	}
+	if len(cert.Subject.OrganizationalUnit) > 0 {
+		options.OrganizationalUnit = cert.Subject.OrganizationalUnit[0]
+	}
+	return options
+}
+
+// marshalKeyUsage returns the key usage extension as a big-endian bit string
+func marshalKeyUsage(keyUsage x509.KeyUsage) (ext pkix.Extension, err error) {
+	data := make([]byte, 2)
+	// bit 0 of the bit string is the most significant bit of the first byte
+	reversed := bits.Reverse16(uint16(keyUsage))
+	data[0] = byte(reversed >> 8)
+	data[1] = byte(reversed)
+	bitLength := 16
+	for bitLength > 0 && reversed&(1<<(16-bitLength)) == 0 {
+		bitLength--
+	}
+	if bitLength <= 8 {
+		data = data[:1]
+	}
+	ext.Id = oidExtensionKeyUsage
+	ext.Critical = true
+	ext.Value, err = asn1.Marshal(asn1.BitString{Bytes: data, BitLength: bitLength})
+	return ext, err
+}
+
+// marshalExtKeyUsage returns the extended key usage extension
+func marshalExtKeyUsage(extKeyUsage []x509.ExtKeyUsage) (ext pkix.Extension, err error) {
+	oids := make([]asn1.ObjectIdentifier, 0, len(extKeyUsage))
+	for _, usage := range extKeyUsage {
+		oid, found := extKeyUsageOIDs[usage]
+		if !found {
+			return ext, errors.New("CreateCSR: unsupported extended key usage")
+		}
+		oids = append(oids, oid)
+	}
+	ext.Id = oidExtensionExtKeyUsage
+	ext.Value, err = asn1.Marshal(oids)
+	return ext, err
+}
@@ -0,0 +1,73 @@
+package certsclient_test
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/wostzone/wost-go/pkg/certsclient"
+	"github.com/wostzone/wost-go/pkg/testenv"
+)
+
+// signCSR issues a certificate for the CSR using the extensions requested in the CSR
+func signCSR(t *testing.T, csrPEM string, certs testenv.TestCerts, validity time.Duration) *x509.Certificate {
+	csr, err := certsclient.CSRFromPEM(csrPEM)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(time.Now().UnixNano()),
+		Subject:         csr.Subject,
+		DNSNames:        csr.DNSNames,
+		IPAddresses:     csr.IPAddresses,
+		NotBefore:       time.Now().Add(-time.Second),
+		NotAfter:        time.Now().Add(validity),
+		ExtraExtensions: csr.Extensions,
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, certs.CaCert, csr.PublicKey, certs.CaKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(derBytes)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestCreateCSR(t *testing.T) {
+	certs := testenv.CreateCertBundle()
+	for _, keyType := range []certsclient.KeyType{
+		certsclient.KeyTypeECDSA, certsclient.KeyTypeEd25519, certsclient.KeyTypeRSA} {
+
+		privKey, err := certsclient.CreateKeys(keyType)
+		require.NoError(t, err)
+		options := certsclient.CSROptions{
+			CommonName:         "device1",
+			OrganizationalUnit: certsclient.OUIoTDevice,
+			DNSNames:           []string{"device1.local"},
+			IPAddresses:        []net.IP{net.ParseIP("127.0.0.1").To4()},
+			KeyUsage:           x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		csrPEM, err := certsclient.CreateCSR(privKey, options)
+		require.NoError(t, err)
+
+		// the issued certificate has the requested subject, SANs and usage
+		cert := signCSR(t, csrPEM, certs, time.Hour)
+		assert.Equal(t, options, certsclient.CSROptionsFromCert(cert))
+	}
+}
+
+func TestCreateCSRBadInput(t *testing.T) {
+	privKey := certsclient.CreateECDSAKeys()
+	_, err := certsclient.CreateCSR(privKey, certsclient.CSROptions{})
+	assert.Error(t, err)
+	_, err = certsclient.CreateCSR(privKey, certsclient.CSROptions{
+		CommonName:  "device1",
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	assert.Error(t, err)
+	_, err = certsclient.CSRFromPEM("not a csr")
+	assert.Error(t, err)
+}
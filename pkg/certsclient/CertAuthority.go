@@ -0,0 +1,467 @@
+package certsclient
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ocsp"
+)
+
+// DefaultCACertValidity is the default validity of a CA certificate
+const DefaultCACertValidity = 10 * 365 * 24 * time.Hour
+
+// DefaultCRLValidity is the default time until the next CRL update
+const DefaultCRLValidity = 7 * 24 * time.Hour
+
+// Revocation reasons as defined in RFC5280
+const (
+	RevocationReasonUnspecified   = 0
+	RevocationReasonKeyCompromise = 1
+	RevocationReasonSuperseded    = 4
+	RevocationReasonCessation     = 5
+)
+
+// object identifier of the CRL reason code extension
+var oidExtensionReasonCode = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+// CertProfile determines the validity and usage of certificates issued for an OU
+type CertProfile struct {
+	// OU the profile applies to, eg OUIoTDevice
+	OU string
+	// Validity of issued certificates
+	Validity time.Duration
+	// KeyUsage of issued certificates
+	KeyUsage x509.KeyUsage
+	// ExtKeyUsage of issued certificates
+	ExtKeyUsage []x509.ExtKeyUsage
+}
+
+// DefaultCertProfiles returns the profiles for the client, device, plugin, service and admin OUs.
+// Services can act as server and client, the others are clients only.
+func DefaultCertProfiles() []CertProfile {
+	clientUsage := []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	serviceUsage := []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	keyUsage := x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	return []CertProfile{
+		{OU: OUClient, Validity: 30 * 24 * time.Hour, KeyUsage: keyUsage, ExtKeyUsage: clientUsage},
+		{OU: OUIoTDevice, Validity: 30 * 24 * time.Hour, KeyUsage: keyUsage, ExtKeyUsage: clientUsage},
+		{OU: OUAdmin, Validity: 7 * 24 * time.Hour, KeyUsage: keyUsage, ExtKeyUsage: clientUsage},
+		{OU: OUPlugin, Validity: 365 * 24 * time.Hour, KeyUsage: keyUsage, ExtKeyUsage: clientUsage},
+		{OU: OUService, Validity: 365 * 24 * time.Hour, KeyUsage: keyUsage, ExtKeyUsage: serviceUsage},
+	}
+}
+
+// IssuedCertRecord describes a certificate issued by the CA
+type IssuedCertRecord struct {
+	// SerialNumber of the certificate in hex
+	SerialNumber string `json:"serialNumber"`
+	// CommonName of the certificate owner
+	CommonName string `json:"commonName"`
+	// OU of the certificate owner
+	OU string `json:"ou,omitempty"`
+	// NotBefore is the start of the validity period
+	NotBefore time.Time `json:"notBefore"`
+	// NotAfter is the end of the validity period
+	NotAfter time.Time `json:"notAfter"`
+	// Revoked is set when the certificate is revoked
+	Revoked bool `json:"revoked,omitempty"`
+	// RevokedAt is the time the certificate was revoked
+	RevokedAt time.Time `json:"revokedAt,omitempty"`
+	// RevocationReason is the RFC5280 reason code of the revocation
+	RevocationReason int `json:"revocationReason,omitempty"`
+}
+
+// caIndex is the persisted index of the CA
+type caIndex struct {
+	// CRLNumber of the last issued CRL
+	CRLNumber int64 `json:"crlNumber"`
+	// Certs that are issued by the CA
+	Certs []*IssuedCertRecord `json:"certs"`
+}
+
+// CertAuthority issues and revokes certificates signed by a CA certificate.
+//
+// Issued certificates get a random serial number and the validity and usage of the profile of their OU.
+// The issued certificates are kept in an index, which is saved to a JSON file if one is configured.
+// Revoked certificates are included in the certificate revocation list created with CreateCRL.
+type CertAuthority struct {
+	// CA certificate that signs issued certificates
+	caCert *x509.Certificate
+	// private key of the CA
+	caKey crypto.Signer
+	// issued certificates and CRL number
+	index caIndex
+	// file to persist the index, "" to keep it in memory
+	indexFile string
+	// certificate profiles by OU
+	profiles map[string]CertProfile
+	// mutex for concurrent access to the index and profiles
+	mutex sync.RWMutex
+}
+
+// CreateCRL creates a PEM encoded certificate revocation list with the revoked certificates
+// that haven't expired yet. Each CRL has a new CRL number.
+//  validity is the time until the next update of the CRL. Use 0 for DefaultCRLValidity.
+func (ca *CertAuthority) CreateCRL(validity time.Duration) (crlPEM string, err error) {
+	if validity <= 0 {
+		validity = DefaultCRLValidity
+	}
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	now := time.Now()
+	revoked := make([]pkix.RevokedCertificate, 0)
+	for _, record := range ca.index.Certs {
+		if !record.Revoked || record.NotAfter.Before(now) {
+			continue
+		}
+		serial, _ := new(big.Int).SetString(record.SerialNumber, 16)
+		reason, _ := asn1.Marshal(asn1.Enumerated(record.RevocationReason))
+		revoked = append(revoked, pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: record.RevokedAt,
+			Extensions:     []pkix.Extension{{Id: oidExtensionReasonCode, Value: reason}},
+		})
+	}
+	template := &x509.RevocationList{
+		Number:              big.NewInt(ca.index.CRLNumber + 1),
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(validity),
+		RevokedCertificates: revoked,
+	}
+	derBytes, err := x509.CreateRevocationList(rand.Reader, template, ca.caCert, ca.caKey)
+	if err != nil {
+		return "", err
+	}
+	ca.index.CRLNumber++
+	err = ca.save()
+	crlPEM = string(pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: derBytes}))
+	return crlPEM, err
+}
+
+// CreateOCSPResponse creates a DER encoded OCSP response with the revocation status of a certificate.
+// Servers include this response in their TLS handshake (OCSP stapling) to prove their certificate is not revoked.
+//  cert issued by this CA
+//  validity is the time until the next update of the response. Use 0 for DefaultCRLValidity.
+func (ca *CertAuthority) CreateOCSPResponse(cert *x509.Certificate, validity time.Duration) ([]byte, error) {
+	if validity <= 0 {
+		validity = DefaultCRLValidity
+	}
+	record := ca.GetIssuedCert(cert.SerialNumber)
+	if record == nil {
+		return nil, fmt.Errorf("CreateOCSPResponse: certificate with serial %x is not issued by this CA",
+			cert.SerialNumber)
+	}
+	now := time.Now()
+	template := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: cert.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(validity),
+	}
+	if record.Revoked {
+		template.Status = ocsp.Revoked
+		template.RevokedAt = record.RevokedAt
+		template.RevocationReason = record.RevocationReason
+	}
+	return ocsp.CreateResponse(ca.caCert, ca.caCert, template, ca.caKey)
+}
+
+// GetCACert returns the CA certificate
+func (ca *CertAuthority) GetCACert() *x509.Certificate {
+	return ca.caCert
+}
+
+// GetIssuedCert returns the record of an issued certificate, or nil if the serial number is unknown
+func (ca *CertAuthority) GetIssuedCert(serialNumber *big.Int) *IssuedCertRecord {
+	ca.mutex.RLock()
+	defer ca.mutex.RUnlock()
+	record := ca.findRecord(serialNumber)
+	if record == nil {
+		return nil
+	}
+	recordCopy := *record
+	return &recordCopy
+}
+
+// GetIssuedCerts returns the records of all issued certificates, in the order they were issued
+func (ca *CertAuthority) GetIssuedCerts() []IssuedCertRecord {
+	ca.mutex.RLock()
+	defer ca.mutex.RUnlock()
+	records := make([]IssuedCertRecord, 0, len(ca.index.Certs))
+	for _, record := range ca.index.Certs {
+		records = append(records, *record)
+	}
+	return records
+}
+
+// GetProfile returns the certificate profile of an OU
+func (ca *CertAuthority) GetProfile(ou string) (profile CertProfile, found bool) {
+	ca.mutex.RLock()
+	defer ca.mutex.RUnlock()
+	profile, found = ca.profiles[ou]
+	return profile, found
+}
+
+// IsRevoked returns true if the certificate with the given serial number is revoked
+func (ca *CertAuthority) IsRevoked(serialNumber *big.Int) bool {
+	record := ca.GetIssuedCert(serialNumber)
+	return record != nil && record.Revoked
+}
+
+// IssueCert issues a certificate for the public key of a client or service.
+// The validity and key usage are determined by the profile of the OU. The requested
+// key usage in the options is ignored.
+//
+//  publicKey of the certificate owner
+//  options with the common name, OU and SANs of the certificate
+// Returns the issued certificate
+func (ca *CertAuthority) IssueCert(publicKey crypto.PublicKey, options CSROptions) (*x509.Certificate, error) {
+	if options.CommonName == "" {
+		return nil, errors.New("IssueCert: missing common name")
+	}
+	profile, found := ca.GetProfile(options.OrganizationalUnit)
+	if !found {
+		return nil, fmt.Errorf("IssueCert: no certificate profile for OU '%s'", options.OrganizationalUnit)
+	}
+	serialNumber, err := NewSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	notBefore := time.Now().Add(-time.Minute)
+	notAfter := notBefore.Add(profile.Validity)
+	if notAfter.After(ca.caCert.NotAfter) {
+		notAfter = ca.caCert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName: options.CommonName,
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              profile.KeyUsage,
+		ExtKeyUsage:           profile.ExtKeyUsage,
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+		DNSNames:              options.DNSNames,
+		IPAddresses:           options.IPAddresses,
+	}
+	if options.OrganizationalUnit != "" {
+		template.Subject.OrganizationalUnit = []string{options.OrganizationalUnit}
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, ca.caCert, publicKey, ca.caKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("Issued certificate for '%s' with OU '%s' and serial %x",
+		options.CommonName, options.OrganizationalUnit, serialNumber)
+
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	ca.index.Certs = append(ca.index.Certs, &IssuedCertRecord{
+		SerialNumber: serialNumber.Text(16),
+		CommonName:   options.CommonName,
+		OU:           options.OrganizationalUnit,
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+	})
+	err = ca.save()
+	return cert, err
+}
+
+// Revoke a certificate issued by the CA. It is included in the next CRL.
+//  serialNumber of the certificate to revoke
+//  reason is the RFC5280 revocation reason code, eg RevocationReasonKeyCompromise
+func (ca *CertAuthority) Revoke(serialNumber *big.Int, reason int) error {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	record := ca.findRecord(serialNumber)
+	if record == nil {
+		return fmt.Errorf("Revoke: certificate with serial %x is not issued by this CA", serialNumber)
+	} else if record.Revoked {
+		return nil
+	}
+	logrus.Warningf("Revoking certificate of '%s' with serial %x. Reason %d",
+		record.CommonName, serialNumber, reason)
+	record.Revoked = true
+	record.RevokedAt = time.Now()
+	record.RevocationReason = reason
+	return ca.save()
+}
+
+// SetProfile adds or replaces the certificate profile of an OU
+func (ca *CertAuthority) SetProfile(profile CertProfile) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	ca.profiles[profile.OU] = profile
+}
+
+// SignCSR issues a certificate for a certificate signing request.
+// The subject and SANs are taken from the CSR while the OU is chosen by the CA, as it determines the role of
+// the certificate holder. The validity and usage are determined by the profile of this OU.
+// CSRs that request a different OU are rejected.
+//  csrPEM is the PEM encoded CSR, see CreateCSR
+//  ou is the organizational unit the requester is allowed to have, eg OUIoTDevice
+func (ca *CertAuthority) SignCSR(csrPEM string, ou string) (*x509.Certificate, error) {
+	csr, err := CSRFromPEM(csrPEM)
+	if err != nil {
+		return nil, err
+	}
+	for _, csrOU := range csr.Subject.OrganizationalUnit {
+		if csrOU != ou {
+			return nil, fmt.Errorf("SignCSR: '%s' requests OU '%s' but is only allowed '%s'",
+				csr.Subject.CommonName, csrOU, ou)
+		}
+	}
+	options := CSROptions{
+		CommonName:         csr.Subject.CommonName,
+		OrganizationalUnit: ou,
+		DNSNames:           csr.DNSNames,
+		IPAddresses:        csr.IPAddresses,
+	}
+	return ca.IssueCert(csr.PublicKey, options)
+}
+
+// findRecord returns the record of an issued certificate
+// This must be called with the mutex locked.
+func (ca *CertAuthority) findRecord(serialNumber *big.Int) *IssuedCertRecord {
+	serial := serialNumber.Text(16)
+	for _, record := range ca.index.Certs {
+		if record.SerialNumber == serial {
+			return record
+		}
+	}
+	return nil
+}
+
+// load the index from file, if it exists
+func (ca *CertAuthority) load() error {
+	data, err := ioutil.ReadFile(ca.indexFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, &ca.index)
+	if err != nil {
+		return fmt.Errorf("invalid CA index file '%s': %s", ca.indexFile, err)
+	}
+	return nil
+}
+
+// save the index to file, if configured
+// This must be called with the mutex locked.
+func (ca *CertAuthority) save() error {
+	if ca.indexFile == "" {
+		return nil
+	}
+	data, _ := json.MarshalIndent(ca.index, "", "  ")
+	tmpFile := ca.indexFile + ".tmp"
+	err := ioutil.WriteFile(tmpFile, data, 0600)
+	if err == nil {
+		err = os.Rename(tmpFile, ca.indexFile)
+	}
+	if err != nil {
+		logrus.Errorf("Failed saving CA index to '%s': %s", ca.indexFile, err)
+	}
+	return err
+}
+
+// CreateCACert creates a self-signed CA certificate
+//  commonName of the CA
+//  caKey is the private key of the CA
+//  validity of the certificate. Use 0 for DefaultCACertValidity.
+func CreateCACert(commonName string, caKey crypto.Signer, validity time.Duration) (*x509.Certificate, error) {
+	if validity <= 0 {
+		validity = DefaultCACertValidity
+	}
+	serialNumber, err := NewSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"WoST"},
+			CommonName:   commonName,
+		},
+		NotBefore: time.Now().Add(-10 * time.Second),
+		NotAfter:  time.Now().Add(validity),
+		// CA cert can be used to sign certificate and revocation lists
+		KeyUsage:    x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+
+		// This CA is the only CA. No intermediate CAs
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            0,
+		MaxPathLenZero:        true,
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, template, caKey.Public(), caKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(derBytes)
+}
+
+// NewSerialNumber returns a random 127 bit certificate serial number
+func NewSerialNumber() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), 127)
+	serialNumber, err := rand.Int(rand.Reader, limit)
+	if err != nil {
+		return nil, err
+	}
+	// serial numbers must be positive
+	return serialNumber.Add(serialNumber, big.NewInt(1)), nil
+}
+
+// NewCertAuthority creates a certificate authority using the default profiles.
+// If an index file is given then the issued certificates are loaded from this file, and saved after
+// issuing or revoking a certificate.
+//
+//  caCert is the CA certificate that signs issued certificates
+//  caKey is the private key of the CA certificate
+//  indexFile to persist issued certificates. Use "" to keep the index in memory.
+func NewCertAuthority(caCert *x509.Certificate, caKey crypto.Signer, indexFile string) (*CertAuthority, error) {
+	if caCert == nil || caKey == nil || !caCert.IsCA {
+		return nil, errors.New("NewCertAuthority: missing CA certificate or key")
+	}
+	publicKey, ok := caKey.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(caCert.PublicKey) {
+		return nil, errors.New("NewCertAuthority: CA key doesn't belong to the CA certificate")
+	}
+	ca := &CertAuthority{
+		caCert:    caCert,
+		caKey:     caKey,
+		index:     caIndex{Certs: make([]*IssuedCertRecord, 0)},
+		indexFile: indexFile,
+		profiles:  make(map[string]CertProfile),
+	}
+	for _, profile := range DefaultCertProfiles() {
+		ca.profiles[profile.OU] = profile
+	}
+	if indexFile != "" {
+		if err := ca.load(); err != nil {
+			return nil, err
+		}
+	}
+	return ca, nil
+}
@@ -0,0 +1,133 @@
+package certsclient_test
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/wostzone/wost-go/pkg/certsclient"
+)
+
+// create a CA for testing
+func createTestCA(t *testing.T, indexFile string) *certsclient.CertAuthority {
+	caKey := certsclient.CreateECDSAKeys()
+	caCert, err := certsclient.CreateCACert("Test CA", caKey, 0)
+	require.NoError(t, err)
+	ca, err := certsclient.NewCertAuthority(caCert, caKey, indexFile)
+	require.NoError(t, err)
+	return ca
+}
+
+func TestIssueCert(t *testing.T) {
+	logrus.Infof("--- TestIssueCert ---")
+	ca := createTestCA(t, "")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.GetCACert())
+
+	deviceKey := certsclient.CreateECDSAKeys()
+	deviceCert, err := ca.IssueCert(&deviceKey.PublicKey, certsclient.CSROptions{
+		CommonName:         "device1",
+		OrganizationalUnit: certsclient.OUIoTDevice,
+		IPAddresses:        []net.IP{net.ParseIP("192.168.0.2")},
+	})
+	require.NoError(t, err)
+	_, err = deviceCert.Verify(x509.VerifyOptions{
+		Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	assert.NoError(t, err)
+	profile, _ := ca.GetProfile(certsclient.OUIoTDevice)
+	assert.WithinDuration(t, time.Now().Add(profile.Validity), deviceCert.NotAfter, time.Minute*2)
+
+	// services are servers with SANs
+	serviceKey, _ := certsclient.CreateKeys(certsclient.KeyTypeRSA)
+	csrPEM, _ := certsclient.CreateCSR(serviceKey, certsclient.CSROptions{
+		CommonName:         "thingdir",
+		OrganizationalUnit: certsclient.OUService,
+		DNSNames:           []string{"hub.local"},
+	})
+	serviceCert, err := ca.SignCSR(csrPEM, certsclient.OUService)
+	require.NoError(t, err)
+	_, err = serviceCert.Verify(x509.VerifyOptions{
+		Roots: roots, DNSName: "hub.local", KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	assert.NoError(t, err)
+
+	// the CA chooses the OU, a CSR can't request another role
+	_, err = ca.SignCSR(csrPEM, certsclient.OUIoTDevice)
+	assert.Error(t, err)
+	csrPEM, _ = certsclient.CreateCSR(deviceKey, certsclient.CSROptions{CommonName: "device2"})
+	device2Cert, err := ca.SignCSR(csrPEM, certsclient.OUIoTDevice)
+	require.NoError(t, err)
+	assert.Equal(t, []string{certsclient.OUIoTDevice}, device2Cert.Subject.OrganizationalUnit)
+
+	// serial numbers are unique
+	assert.NotEqual(t, deviceCert.SerialNumber, serviceCert.SerialNumber)
+	assert.Len(t, ca.GetIssuedCerts(), 3)
+
+	// unknown OU or missing name fail
+	_, err = ca.IssueCert(&deviceKey.PublicKey, certsclient.CSROptions{CommonName: "x", OrganizationalUnit: "bad"})
+	assert.Error(t, err)
+	_, err = ca.IssueCert(&deviceKey.PublicKey, certsclient.CSROptions{OrganizationalUnit: certsclient.OUIoTDevice})
+	assert.Error(t, err)
+
+	// custom profile
+	ca.SetProfile(certsclient.CertProfile{OU: "sensor", Validity: time.Hour,
+		KeyUsage: x509.KeyUsageDigitalSignature, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	sensorCert, err := ca.IssueCert(&deviceKey.PublicKey, certsclient.CSROptions{
+		CommonName: "sensor1", OrganizationalUnit: "sensor"})
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), sensorCert.NotAfter, time.Minute*2)
+}
+
+func TestRevokeCert(t *testing.T) {
+	logrus.Infof("--- TestRevokeCert ---")
+	indexFile := path.Join(testCertFolder, "caindex.json")
+	caKey := certsclient.CreateECDSAKeys()
+	caCert, _ := certsclient.CreateCACert("Test CA", caKey, 0)
+	ca, err := certsclient.NewCertAuthority(caCert, caKey, indexFile)
+	require.NoError(t, err)
+	deviceKey := certsclient.CreateECDSAKeys()
+	options := certsclient.CSROptions{CommonName: "device1", OrganizationalUnit: certsclient.OUIoTDevice}
+	cert1, _ := ca.IssueCert(&deviceKey.PublicKey, options)
+	cert2, _ := ca.IssueCert(&deviceKey.PublicKey, options)
+
+	err = ca.Revoke(cert1.SerialNumber, certsclient.RevocationReasonKeyCompromise)
+	require.NoError(t, err)
+	assert.True(t, ca.IsRevoked(cert1.SerialNumber))
+	assert.False(t, ca.IsRevoked(cert2.SerialNumber))
+	err = ca.Revoke(big.NewInt(1), certsclient.RevocationReasonUnspecified)
+	assert.Error(t, err)
+
+	// the CRL lists the revoked certificate
+	crlPEM, err := ca.CreateCRL(0)
+	require.NoError(t, err)
+	block, _ := pem.Decode([]byte(crlPEM))
+	require.NotNil(t, block)
+	crl, err := x509.ParseCRL(block.Bytes)
+	require.NoError(t, err)
+	assert.NoError(t, caCert.CheckCRLSignature(crl))
+	revoked := crl.TBSCertList.RevokedCertificates
+	require.Len(t, revoked, 1)
+	assert.Equal(t, cert1.SerialNumber, revoked[0].SerialNumber)
+
+	// the index is persisted
+	ca2, err := certsclient.NewCertAuthority(caCert, caKey, indexFile)
+	require.NoError(t, err)
+	assert.Len(t, ca2.GetIssuedCerts(), 2)
+	assert.True(t, ca2.IsRevoked(cert1.SerialNumber))
+	record := ca2.GetIssuedCert(cert1.SerialNumber)
+	require.NotNil(t, record)
+	assert.Equal(t, certsclient.RevocationReasonKeyCompromise, record.RevocationReason)
+
+	// invalid CA key
+	_, err = certsclient.NewCertAuthority(caCert, nil, indexFile)
+	assert.Error(t, err)
+	_, err = certsclient.NewCertAuthority(caCert, certsclient.CreateECDSAKeys(), indexFile)
+	assert.Error(t, err)
+}
@@ -0,0 +1,125 @@
+package certsclient
+
+import (
+	"crypto/tls"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+
+	"github.com/wostzone/wost-go/pkg/watcher"
+)
+
+// CertProvider provides a TLS certificate that is loaded from PEM files and reloaded when the files change.
+//
+// Use GetCertificate as the tls.Config GetCertificate function of servers and GetClientCertificate as the
+// GetClientCertificate function of clients, so a renewed certificate is used on the next handshake without
+// a restart.
+type CertProvider struct {
+	// PEM file of the certificate
+	certFile string
+	// PEM file of the private key
+	keyFile string
+	// current certificate
+	cert *tls.Certificate
+	// handler invoked after the certificate is reloaded
+	changeHandler func(cert *tls.Certificate)
+	// watchers of the certificate and key files
+	watchers []*fsnotify.Watcher
+	// mutex for concurrent access to the certificate
+	mutex sync.RWMutex
+}
+
+// Close stops watching the certificate files
+func (provider *CertProvider) Close() {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	for _, fileWatcher := range provider.watchers {
+		_ = fileWatcher.Close()
+	}
+	provider.watchers = nil
+}
+
+// GetCert returns the current certificate
+func (provider *CertProvider) GetCert() *tls.Certificate {
+	provider.mutex.RLock()
+	defer provider.mutex.RUnlock()
+	return provider.cert
+}
+
+// GetCertificate returns the current certificate for use by tls.Config GetCertificate of a server
+func (provider *CertProvider) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return provider.GetCert(), nil
+}
+
+// GetClientCertificate returns the current certificate for use by tls.Config GetClientCertificate of a client
+func (provider *CertProvider) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return provider.GetCert(), nil
+}
+
+// OnChange sets the handler that is invoked after the certificate is reloaded
+//  handler is invoked with the new certificate. Use nil to remove the handler.
+func (provider *CertProvider) OnChange(handler func(cert *tls.Certificate)) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.changeHandler = handler
+}
+
+// Reload the certificate from its PEM files.
+// If loading fails, for example because only one of the files is updated, the current certificate is kept.
+func (provider *CertProvider) Reload() error {
+	cert, err := LoadTLSCertFromPEM(provider.certFile, provider.keyFile)
+	if err != nil {
+		logrus.Errorf("CertProvider.Reload: Unable to load certificate '%s': %s. Keeping the current certificate.",
+			provider.certFile, err)
+		return err
+	}
+	provider.mutex.Lock()
+	provider.cert = cert
+	handler := provider.changeHandler
+	provider.mutex.Unlock()
+	logrus.Infof("CertProvider.Reload: Reloaded certificate '%s'", provider.certFile)
+	if handler != nil {
+		handler(cert)
+	}
+	return nil
+}
+
+// Watch the certificate and key files and reload the certificate when they change.
+// Use Close to stop watching.
+func (provider *CertProvider) Watch() error {
+	provider.Close()
+	watchers := make([]*fsnotify.Watcher, 0, 2)
+	for _, file := range []string{provider.certFile, provider.keyFile} {
+		fileWatcher, err := watcher.WatchFile(file, provider.Reload, "CertProvider")
+		if err != nil {
+			_ = fileWatcher.Close()
+			for _, w := range watchers {
+				_ = w.Close()
+			}
+			return err
+		}
+		watchers = append(watchers, fileWatcher)
+	}
+	provider.mutex.Lock()
+	provider.watchers = watchers
+	provider.mutex.Unlock()
+	return nil
+}
+
+// NewCertProvider creates a provider of the certificate in the given PEM files.
+// The certificate is loaded immediately. Use Watch to reload it when the files change.
+//  certFile is the PEM file of the certificate
+//  keyFile is the PEM file of the private key
+func NewCertProvider(certFile string, keyFile string) (*CertProvider, error) {
+	provider := &CertProvider{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	cert, err := LoadTLSCertFromPEM(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	provider.cert = cert
+	return provider, nil
+}
@@ -0,0 +1,60 @@
+package certsclient_test
+
+import (
+	"crypto/tls"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/wostzone/wost-go/pkg/certsclient"
+	"github.com/wostzone/wost-go/pkg/testenv"
+)
+
+func TestCertProvider(t *testing.T) {
+	logrus.Infof("--- TestCertProvider ---")
+	certFile := path.Join(testCertFolder, "providerCert.pem")
+	keyFile := path.Join(testCertFolder, "providerKey.pem")
+	certs := testenv.CreateCertBundle()
+	err := certsclient.SaveTLSCertToPEM(certs.PluginCert, certFile, keyFile)
+	require.NoError(t, err)
+
+	provider, err := certsclient.NewCertProvider(certFile, keyFile)
+	require.NoError(t, err)
+	err = provider.Watch()
+	require.NoError(t, err)
+	defer provider.Close()
+	cert, err := provider.GetClientCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, certs.PluginCert.Certificate, cert.Certificate)
+	changed := make(chan *tls.Certificate, 10)
+	provider.OnChange(func(newCert *tls.Certificate) {
+		changed <- newCert
+	})
+
+	// the renewed certificate is loaded when the files change
+	err = certsclient.SaveTLSCertToPEM(certs.DeviceCert, certFile, keyFile)
+	require.NoError(t, err)
+	select {
+	case changedCert := <-changed:
+		assert.Equal(t, certs.DeviceCert.Certificate, changedCert.Certificate)
+	case <-time.After(5 * time.Second):
+		t.Fatal("certificate was not reloaded")
+	}
+	cert, err = provider.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, certs.DeviceCert.Certificate, cert.Certificate)
+
+	// a mismatched key keeps the current certificate
+	err = certsclient.SaveTLSCertToPEM(certs.PluginCert, certFile, path.Join(testCertFolder, "otherKey.pem"))
+	require.NoError(t, err)
+	err = provider.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, certs.DeviceCert.Certificate, provider.GetCert().Certificate)
+
+	_, err = certsclient.NewCertProvider("/not/a/cert.pem", keyFile)
+	assert.Error(t, err)
+}
@@ -0,0 +1,258 @@
+package certsclient
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/wostzone/wost-go/pkg/tlsclient"
+)
+
+// DefaultCertRenewalPath is the path of the provisioning endpoint that renews client certificates
+const DefaultCertRenewalPath = "/idprov/renew"
+
+// DefaultRenewalRetryInterval is the time to wait before retrying a failed renewal
+const DefaultRenewalRetryInterval = time.Minute
+
+// CertRenewalRequest is the message posted to the provisioning endpoint to renew a client certificate
+type CertRenewalRequest struct {
+	// ClientID of the certificate owner
+	ClientID string `json:"clientID"`
+	// CSR is the PEM encoded certificate signing request
+	CSR string `json:"csr"`
+}
+
+// CertRenewalResponse is the response of the provisioning endpoint with the renewed certificate
+type CertRenewalResponse struct {
+	// ClientCertPEM is the PEM encoded renewed certificate
+	ClientCertPEM string `json:"clientCertPEM"`
+}
+
+// CertRenewalClient renews a client certificate before it expires.
+//
+// The renewal request contains a CSR with the subject of the current certificate. It is submitted to
+// the provisioning endpoint using the current certificate for authentication. When the renewed
+// certificate is received the handler is invoked, so it can be used without restarting the client.
+type CertRenewalClient struct {
+	// current client certificate
+	clientCert *tls.Certificate
+	// x509 certificate of the current client certificate
+	x509Cert *x509.Certificate
+	// CA that issues the client certificates
+	caCert *x509.Certificate
+	// host:port of the provisioning server
+	hostPort string
+	// renewal is scheduled while running
+	isRunning bool
+	// path of the renewal endpoint
+	path string
+	// renew when the remaining validity is less than this duration. 0 to renew after 2/3 of the validity period
+	renewBefore time.Duration
+	// handler invoked with the renewed certificate
+	renewedHandler func(clientCert *tls.Certificate)
+	// timer of the next renewal attempt
+	timer *time.Timer
+	// mutex for concurrent access to the certificate and timer
+	mutex sync.Mutex
+}
+
+// GetCertificate returns the current client certificate
+func (client *CertRenewalClient) GetCertificate() *tls.Certificate {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.clientCert
+}
+
+// GetRenewalTime returns the time when the certificate is renewed
+func (client *CertRenewalClient) GetRenewalTime() time.Time {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.renewalTime()
+}
+
+// Renew the client certificate now.
+// The renewed certificate is checked to be issued by the CA for the client's private key.
+// Returns the renewed certificate or an error if renewal failed
+func (client *CertRenewalClient) Renew() (*tls.Certificate, error) {
+	client.mutex.Lock()
+	clientCert := client.clientCert
+	x509Cert := client.x509Cert
+	client.mutex.Unlock()
+
+	privateKey, ok := clientCert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("Renew: client certificate has no private key")
+	}
+	csrPEM, err := CreateCSR(privateKey, CSROptionsFromCert(x509Cert))
+	if err != nil {
+		return nil, err
+	}
+	tlsClient := tlsclient.NewTLSClient(client.hostPort, client.caCert)
+	err = tlsClient.ConnectWithClientCert(clientCert)
+	if err != nil {
+		return nil, err
+	}
+	defer tlsClient.Close()
+	request := CertRenewalRequest{ClientID: x509Cert.Subject.CommonName, CSR: csrPEM}
+	respBody, err := tlsClient.Post(client.path, request)
+	if err != nil {
+		return nil, err
+	}
+	response := CertRenewalResponse{}
+	err = json.Unmarshal(respBody, &response)
+	if err != nil {
+		return nil, fmt.Errorf("Renew: invalid response: %s", err)
+	}
+	newCert, err := X509CertFromPEM(response.ClientCertPEM)
+	if err != nil {
+		return nil, fmt.Errorf("Renew: invalid certificate: %s", err)
+	}
+	err = client.verifyCert(newCert, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	renewedCert := &tls.Certificate{
+		Certificate: [][]byte{newCert.Raw},
+		PrivateKey:  clientCert.PrivateKey,
+		Leaf:        newCert,
+	}
+	logrus.Infof("Renewed certificate of '%s'. Valid until %s",
+		newCert.Subject.CommonName, newCert.NotAfter.Format(time.RFC3339))
+
+	client.mutex.Lock()
+	client.clientCert = renewedCert
+	client.x509Cert = newCert
+	handler := client.renewedHandler
+	client.mutex.Unlock()
+	if handler != nil {
+		handler(renewedCert)
+	}
+	return renewedCert, nil
+}
+
+// SetRenewBefore sets the remaining validity of the certificate at which it is renewed.
+// This takes effect at the next renewal.
+//  renewBefore is the remaining validity. Use 0 to renew after 2/3 of the validity period.
+func (client *CertRenewalClient) SetRenewBefore(renewBefore time.Duration) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.renewBefore = renewBefore
+}
+
+// Start renewing the certificate before it expires.
+// Failed renewals are retried until the certificate has expired.
+func (client *CertRenewalClient) Start() {
+	client.mutex.Lock()
+	client.isRunning = true
+	client.mutex.Unlock()
+	client.schedule(false)
+}
+
+// Stop renewing the certificate
+func (client *CertRenewalClient) Stop() {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.isRunning = false
+	if client.timer != nil {
+		client.timer.Stop()
+		client.timer = nil
+	}
+}
+
+// renewalTime returns the time the certificate is due for renewal
+// This must be called with the mutex locked.
+func (client *CertRenewalClient) renewalTime() time.Time {
+	if client.renewBefore > 0 {
+		return client.x509Cert.NotAfter.Add(-client.renewBefore)
+	}
+	validity := client.x509Cert.NotAfter.Sub(client.x509Cert.NotBefore)
+	return client.x509Cert.NotBefore.Add(validity * 2 / 3)
+}
+
+// schedule the next renewal.
+//  isRetry schedules a retry of a failed renewal, if the certificate hasn't expired
+func (client *CertRenewalClient) schedule(isRetry bool) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.timer != nil {
+		client.timer.Stop()
+		client.timer = nil
+	}
+	if !client.isRunning {
+		return
+	}
+	delay := time.Until(client.renewalTime())
+	if isRetry {
+		if time.Now().After(client.x509Cert.NotAfter) {
+			logrus.Errorf("Certificate of '%s' has expired. Renewal stopped.", client.x509Cert.Subject.CommonName)
+			client.timer = nil
+			return
+		}
+		delay = DefaultRenewalRetryInterval
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	client.timer = time.AfterFunc(delay, func() {
+		_, err := client.Renew()
+		if err != nil {
+			logrus.Errorf("Certificate renewal failed: %s. Retrying in %s", err, DefaultRenewalRetryInterval)
+		}
+		client.schedule(err != nil)
+	})
+}
+
+// verifyCert checks that a certificate is issued by the CA for the private key
+func (client *CertRenewalClient) verifyCert(cert *x509.Certificate, privateKey crypto.Signer) error {
+	if client.caCert != nil {
+		roots := x509.NewCertPool()
+		roots.AddCert(client.caCert)
+		_, err := cert.Verify(x509.VerifyOptions{
+			Roots:     roots,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err != nil {
+			return fmt.Errorf("Renew: certificate is not issued by the CA: %s", err)
+		}
+	}
+	publicKey, ok := privateKey.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(cert.PublicKey) {
+		return errors.New("Renew: certificate is not issued for the client's key")
+	}
+	return nil
+}
+
+// NewCertRenewalClient creates a client that renews the client certificate with the provisioning server.
+// Use Start to renew the certificate automatically before it expires.
+//
+//  hostPort of the provisioning server
+//  caCert is the CA that issues client certificates and the certificate of the server
+//  clientCert is the current client certificate
+//  renewedHandler is invoked with the renewed certificate, eg ExposedThingFactory.UpdateClientCert
+func NewCertRenewalClient(hostPort string, caCert *x509.Certificate, clientCert *tls.Certificate,
+	renewedHandler func(clientCert *tls.Certificate)) (*CertRenewalClient, error) {
+
+	if clientCert == nil || len(clientCert.Certificate) == 0 {
+		return nil, errors.New("NewCertRenewalClient: missing client certificate")
+	}
+	x509Cert, err := x509.ParseCertificate(clientCert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	client := &CertRenewalClient{
+		caCert:         caCert,
+		clientCert:     clientCert,
+		hostPort:       hostPort,
+		path:           DefaultCertRenewalPath,
+		renewedHandler: renewedHandler,
+		x509Cert:       x509Cert,
+	}
+	return client, nil
+}
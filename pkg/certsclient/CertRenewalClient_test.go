@@ -0,0 +1,123 @@
+package certsclient_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/wostzone/wost-go/pkg/certsclient"
+	"github.com/wostzone/wost-go/pkg/testenv"
+)
+
+// startRenewalServer starts a provisioning server that issues certificates with the given validity
+func startRenewalServer(t *testing.T, certs testenv.TestCerts, validity time.Duration) *httptest.Server {
+	caCertPool := x509.NewCertPool()
+	caCertPool.AddCert(certs.CaCert)
+	mux := http.NewServeMux()
+	mux.HandleFunc(certsclient.DefaultCertRenewalPath, func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		request := certsclient.CertRenewalRequest{}
+		err := json.Unmarshal(body, &request)
+		if err != nil || len(req.TLS.PeerCertificates) == 0 ||
+			req.TLS.PeerCertificates[0].Subject.CommonName != request.ClientID {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		cert := signCSR(t, request.CSR, certs, validity)
+		response, _ := json.Marshal(certsclient.CertRenewalResponse{ClientCertPEM: certsclient.X509CertToPEM(cert)})
+		_, _ = w.Write(response)
+	})
+	server := httptest.NewUnstartedServer(mux)
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{*certs.ServerCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    caCertPool,
+	}
+	server.StartTLS()
+	return server
+}
+
+func TestRenewCert(t *testing.T) {
+	logrus.Infof("--- TestRenewCert ---")
+	var renewedCert *tls.Certificate
+	certs := testenv.CreateCertBundle()
+	server := startRenewalServer(t, certs, 2*time.Hour)
+	defer server.Close()
+
+	client, err := certsclient.NewCertRenewalClient(
+		server.Listener.Addr().String(), certs.CaCert, certs.DeviceCert, func(cert *tls.Certificate) {
+			renewedCert = cert
+		})
+	require.NoError(t, err)
+	cert, err := client.Renew()
+	require.NoError(t, err)
+	assert.Equal(t, cert, renewedCert)
+	assert.Equal(t, cert, client.GetCertificate())
+	assert.Equal(t, certs.DeviceCert.PrivateKey, cert.PrivateKey)
+	assert.Equal(t, "Device", cert.Leaf.Subject.CommonName)
+	assert.Equal(t, []string{testenv.OUDevice}, cert.Leaf.Subject.OrganizationalUnit)
+	assert.True(t, cert.Leaf.NotAfter.After(time.Now().Add(time.Hour)))
+
+	// renewal is due after 2/3 of the validity of the new certificate
+	renewalTime := client.GetRenewalTime()
+	assert.True(t, renewalTime.After(time.Now().Add(time.Hour)))
+	client.SetRenewBefore(30 * time.Minute)
+	assert.Equal(t, cert.Leaf.NotAfter.Add(-30*time.Minute), client.GetRenewalTime())
+}
+
+func TestAutomaticRenewal(t *testing.T) {
+	logrus.Infof("--- TestAutomaticRenewal ---")
+	renewCount := 0
+	mutex := sync.Mutex{}
+	certs := testenv.CreateCertBundle()
+	server := startRenewalServer(t, certs, 2*time.Hour)
+	defer server.Close()
+
+	// the device certificate is valid for an hour. Renewing 2 hours before expiry renews immediately.
+	client, err := certsclient.NewCertRenewalClient(
+		server.Listener.Addr().String(), certs.CaCert, certs.DeviceCert, func(cert *tls.Certificate) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			renewCount++
+		})
+	require.NoError(t, err)
+	client.SetRenewBefore(90 * time.Minute)
+	client.Start()
+	time.Sleep(time.Second)
+	client.Stop()
+
+	// the renewed certificate is valid for 2 hours so it isn't renewed again
+	mutex.Lock()
+	assert.Equal(t, 1, renewCount)
+	mutex.Unlock()
+	assert.NotEqual(t, certs.DeviceCert, client.GetCertificate())
+}
+
+func TestRenewCertFails(t *testing.T) {
+	logrus.Infof("--- TestRenewCertFails ---")
+	certs := testenv.CreateCertBundle()
+	otherCerts := testenv.CreateCertBundle()
+	server := startRenewalServer(t, otherCerts, time.Hour)
+	defer server.Close()
+
+	_, err := certsclient.NewCertRenewalClient(server.Listener.Addr().String(), certs.CaCert, nil, nil)
+	assert.Error(t, err)
+
+	// the server doesn't accept a certificate from another CA
+	client, err := certsclient.NewCertRenewalClient(
+		server.Listener.Addr().String(), certs.CaCert, certs.DeviceCert, nil)
+	require.NoError(t, err)
+	_, err = client.Renew()
+	assert.Error(t, err)
+	assert.Equal(t, certs.DeviceCert, client.GetCertificate())
+}
@@ -2,15 +2,34 @@
 package certsclient
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io/ioutil"
 )
 
+// KeyType identifies the algorithm of an asymmetric key
+type KeyType string
+
+const (
+	// KeyTypeECDSA is an ECDSA key on the P-256 curve. This is the default key type.
+	KeyTypeECDSA KeyType = "ecdsa"
+	// KeyTypeEd25519 is an Ed25519 key. These keys can sign but can't be used for encryption.
+	KeyTypeEd25519 KeyType = "ed25519"
+	// KeyTypeRSA is a 2048 bit RSA key
+	KeyTypeRSA KeyType = "rsa"
+)
+
+// RSAKeySize is the size in bits of generated RSA keys
+const RSAKeySize = 2048
+
 // CreateECDSAKeys creates a asymmetric key set
 // Clients save the private key locally, not to be shared with anyone and freely share
 //  the public key. The keys are needed in client certificate creation.
@@ -23,7 +42,40 @@ func CreateECDSAKeys() *ecdsa.PrivateKey {
 	return privKey
 }
 
+// CreateKeys creates an asymmetric key set of the given type.
+// Use GetKeyType to determine the type of an existing key.
+//
+//  keyType is one of KeyTypeECDSA, KeyTypeEd25519 or KeyTypeRSA
+// Returns the private key that contains its associated public key
+func CreateKeys(keyType KeyType) (privateKey crypto.Signer, err error) {
+	switch keyType {
+	case KeyTypeECDSA:
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeEd25519:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	case KeyTypeRSA:
+		privateKey, err = rsa.GenerateKey(rand.Reader, RSAKeySize)
+	default:
+		err = fmt.Errorf("CreateKeys: unsupported key type '%s'", keyType)
+	}
+	return privateKey, err
+}
+
+// GetKeyType returns the type of a private or public key, or "" if the key type is not supported
+func GetKeyType(key interface{}) KeyType {
+	switch key.(type) {
+	case *ecdsa.PrivateKey, *ecdsa.PublicKey:
+		return KeyTypeECDSA
+	case ed25519.PrivateKey, ed25519.PublicKey:
+		return KeyTypeEd25519
+	case *rsa.PrivateKey, *rsa.PublicKey:
+		return KeyTypeRSA
+	}
+	return ""
+}
+
 // LoadKeysFromPEM loads ECDSA public/private key pair from PEM file
+// Use LoadSignerFromPEM to load Ed25519 and RSA keys.
 func LoadKeysFromPEM(pemPath string) (privateKey *ecdsa.PrivateKey, err error) {
 	pemEncodedPriv, err := ioutil.ReadFile(pemPath)
 	if err != nil {
@@ -33,6 +85,7 @@ func LoadKeysFromPEM(pemPath string) (privateKey *ecdsa.PrivateKey, err error) {
 }
 
 // LoadPublicKeyFromPEM loads ECDSA public key from file
+// Use LoadPublicKeyFromPEMGeneric to load Ed25519 and RSA keys.
 func LoadPublicKeyFromPEM(pemPath string) (publicKey *ecdsa.PublicKey, err error) {
 	pemEncodedKey, err := ioutil.ReadFile(pemPath)
 	if err != nil {
@@ -41,45 +94,85 @@ func LoadPublicKeyFromPEM(pemPath string) (publicKey *ecdsa.PublicKey, err error
 	return PublicKeyFromPEM(string(pemEncodedKey))
 }
 
+// LoadPublicKeyFromPEMGeneric loads an ECDSA, Ed25519 or RSA public key from file
+func LoadPublicKeyFromPEMGeneric(pemPath string) (publicKey crypto.PublicKey, err error) {
+	pemEncodedKey, err := ioutil.ReadFile(pemPath)
+	if err != nil {
+		return nil, err
+	}
+	return PublicKeyFromPEMGeneric(string(pemEncodedKey))
+}
+
+// LoadSignerFromPEM loads an ECDSA, Ed25519 or RSA private key from PEM file
+func LoadSignerFromPEM(pemPath string) (privateKey crypto.Signer, err error) {
+	pemEncodedPriv, err := ioutil.ReadFile(pemPath)
+	if err != nil {
+		return nil, err
+	}
+	return SignerFromPEM(string(pemEncodedPriv))
+}
+
 // PrivateKeyFromPEM converts a PEM encoded private key into a ECDSA private key object
-// Intended to decode the public key portion of a certificate. This can be used to encrypt messages
-// to the certificate holder.
+// Use SignerFromPEM to convert Ed25519 and RSA keys.
 func PrivateKeyFromPEM(pemEncodedKey string) (privateKey *ecdsa.PrivateKey, err error) {
-	blockPub, _ := pem.Decode([]byte(pemEncodedKey))
-	if blockPub == nil {
-		return nil, errors.New("not a valid PEM string")
+	signer, err := SignerFromPEM(pemEncodedKey)
+	if err != nil {
+		return nil, err
 	}
-	derBytes := blockPub.Bytes
-	rawPrivateKey, err := x509.ParsePKCS8PrivateKey(derBytes)
-	if err == nil {
-		var ok bool
-		privateKey, ok = rawPrivateKey.(*ecdsa.PrivateKey)
-		if !ok || privateKey == nil {
-			err = errors.New("PEM is not a ECDSA key format")
-		}
+	privateKey, ok := signer.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("PEM is not a ECDSA key format")
 	}
-	return privateKey, err
+	return privateKey, nil
 }
 
-// PublicKeyFromPEM converts a PEM encoded public key into a ECDSA or RSA public key object
+// PublicKeyFromPEM converts a PEM encoded public key into a ECDSA public key object
 // Intended to decode the public key portion of a certificate. This can be used to encrypt messages
-// to the certificate holder.
+// to the certificate holder. Use PublicKeyFromPEMGeneric to convert Ed25519 and RSA keys.
 func PublicKeyFromPEM(pemEncodedPub string) (publicKey *ecdsa.PublicKey, err error) {
-	blockPub, _ := pem.Decode([]byte(pemEncodedPub))
-	if blockPub == nil {
+	genericPublicKey, err := PublicKeyFromPEMGeneric(pemEncodedPub)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := genericPublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Not a ECDSA public key")
+	}
+	return publicKey, nil
+}
+
+// PublicKeyFromPEMGeneric converts a PEM encoded public key into an ECDSA, Ed25519 or RSA public key object
+// Use GetKeyType to determine the type of the key.
+func PublicKeyFromPEMGeneric(pemEncodedPub string) (publicKey crypto.PublicKey, err error) {
+	block, _ := pem.Decode([]byte(pemEncodedPub))
+	if block == nil {
 		return nil, errors.New("not a valid PEM string")
 	}
-	x509EncodedPub := blockPub.Bytes
-	genericPublicKey, err := x509.ParsePKIXPublicKey(x509EncodedPub)
-	if err == nil {
-		var ok bool
-		publicKey, ok = genericPublicKey.(*ecdsa.PublicKey)
-		if !ok || publicKey == nil {
-			err = errors.New("Not a ECDSA public key")
-		}
+	publicKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	} else if GetKeyType(publicKey) == "" {
+		return nil, errors.New("PEM is not a supported public key format")
 	}
+	return publicKey, nil
+}
 
-	return
+// SignerFromPEM converts a PEM encoded PKCS8 private key into an ECDSA, Ed25519 or RSA private key object.
+// Use GetKeyType to determine the type of the key.
+func SignerFromPEM(pemEncodedKey string) (privateKey crypto.Signer, err error) {
+	block, _ := pem.Decode([]byte(pemEncodedKey))
+	if block == nil {
+		return nil, errors.New("not a valid PEM string")
+	}
+	rawPrivateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := rawPrivateKey.(crypto.Signer)
+	if !ok || GetKeyType(privateKey) == "" {
+		return nil, errors.New("PEM is not a supported private key format")
+	}
+	return privateKey, nil
 }
 
 // PrivateKeyToPEM converts the private/public key set to PEM formatted string.
@@ -116,6 +116,52 @@ func TestWrongKeyFormat(t *testing.T) {
 	_, err = certsclient.PublicKeyFromPEM(pubPEM)
 	assert.Error(t, err)
 
+	// the generic functions load RSA keys as RSA keys
+	privKey2, err := certsclient.SignerFromPEM(privPEM)
+	assert.NoError(t, err)
+	assert.Equal(t, certsclient.KeyTypeRSA, certsclient.GetKeyType(privKey2))
+	pubKey2, err := certsclient.PublicKeyFromPEMGeneric(pubPEM)
+	assert.NoError(t, err)
+	assert.Equal(t, certsclient.KeyTypeRSA, certsclient.GetKeyType(pubKey2))
+
 	_, err = certsclient.X509CertFromPEM("not a real pem")
 	assert.Error(t, err)
 }
+
+func TestGenericKeys(t *testing.T) {
+	for _, keyType := range []certsclient.KeyType{
+		certsclient.KeyTypeECDSA, certsclient.KeyTypeEd25519, certsclient.KeyTypeRSA} {
+
+		privKey, err := certsclient.CreateKeys(keyType)
+		require.NoError(t, err)
+		assert.Equal(t, keyType, certsclient.GetKeyType(privKey))
+		assert.Equal(t, keyType, certsclient.GetKeyType(privKey.Public()))
+
+		err = certsclient.SaveKeysToPEM(privKey, testPrivKeyPemFile)
+		require.NoError(t, err)
+		privKey2, err := certsclient.LoadSignerFromPEM(testPrivKeyPemFile)
+		require.NoError(t, err)
+		assert.Equal(t, keyType, certsclient.GetKeyType(privKey2))
+
+		pubPEM, err := certsclient.PublicKeyToPEM(privKey.Public())
+		require.NoError(t, err)
+		pubKey, err := certsclient.PublicKeyFromPEMGeneric(pubPEM)
+		require.NoError(t, err)
+		assert.Equal(t, privKey.Public(), pubKey)
+		err = certsclient.SavePublicKeyToPEM(privKey.Public(), testPubKeyPemFile)
+		require.NoError(t, err)
+		pubKey, err = certsclient.LoadPublicKeyFromPEMGeneric(testPubKeyPemFile)
+		require.NoError(t, err)
+		assert.Equal(t, privKey.Public(), pubKey)
+	}
+	_, err := certsclient.CreateKeys("dsa")
+	assert.Error(t, err)
+	_, err = certsclient.SignerFromPEM("PRIVATE KEY")
+	assert.Error(t, err)
+	_, err = certsclient.PublicKeyFromPEMGeneric("PUBLIC KEY")
+	assert.Error(t, err)
+	_, err = certsclient.LoadSignerFromPEM("/filedoesnotexist.pem")
+	assert.Error(t, err)
+	_, err = certsclient.LoadPublicKeyFromPEMGeneric("/filedoesnotexist.pem")
+	assert.Error(t, err)
+}
@@ -11,7 +11,9 @@ import (
 	"gopkg.in/yaml.v3"
 
 	"github.com/wostzone/wost-go/pkg/certsclient"
+	"github.com/wostzone/wost-go/pkg/cors"
 	"github.com/wostzone/wost-go/pkg/hubnet"
+	"github.com/wostzone/wost-go/pkg/logging"
 )
 
 // DefaultHubConfigName with the configuration file name of the hub
@@ -91,6 +93,10 @@ type HubConfig struct {
 	// This is intended for access control to Things from a different zone.
 	Zone string `yaml:"zone"`
 
+	// CORS policy for cross-origin requests from web browsers to the Hub services.
+	// Default only allows web applications served by the Hub itself. See cors.DefaultCORSConfig
+	CORS cors.CORSConfig `yaml:"cors"`
+
 	// Files and Folders
 	Loglevel    string `yaml:"logLevel"`    // debug, info, warning, error. Default is warning
 	LogFolder   string `yaml:"logFolder"`   // location of Wost log files
@@ -100,6 +106,9 @@ type HubConfig struct {
 	CertsFolder string `yaml:"certsFolder"` // Folder containing certificates, default is {homeFolder}/certsclient
 	// ConfigFolder the location of additional configuration files. Default is {homeFolder}/config
 	ConfigFolder string `yaml:"configFolder"`
+	// Logging format, per package levels and log file rotation. The level and file default to
+	// logLevel and logFile. A relative log file is relative to the logFolder.
+	Logging logging.LoggingConfig `yaml:"logging"`
 
 	// Keep server certificate on startup. Default is false
 	// enable to keep using access tokens between restarts
@@ -194,6 +203,14 @@ func (hubConfig *HubConfig) Load(configFile string, clientID string) error {
 	} else if !path.IsAbs(hubConfig.LogFile) {
 		hubConfig.LogFile = path.Join(hubConfig.LogFolder, hubConfig.LogFile)
 	}
+	if hubConfig.Logging.Level == "" {
+		hubConfig.Logging.Level = hubConfig.Loglevel
+	}
+	if hubConfig.Logging.File == "" {
+		hubConfig.Logging.File = hubConfig.LogFile
+	} else if !path.IsAbs(hubConfig.Logging.File) {
+		hubConfig.Logging.File = path.Join(hubConfig.LogFolder, hubConfig.Logging.File)
+	}
 
 	if !path.IsAbs(hubConfig.ConfigFolder) {
 		hubConfig.ConfigFolder = path.Join(hubConfig.HomeFolder, hubConfig.ConfigFolder)
@@ -303,6 +320,7 @@ func CreateHubConfig(homeFolder string) *HubConfig {
 		ConfigFolder: path.Join(homeFolder, DefaultConfigFolder),
 		LogFolder:    path.Join(homeFolder, DefaultLogFolder),
 		Loglevel:     "warning",
+		Logging:      logging.DefaultLoggingConfig("", ""),
 
 		Address:      hubnet.GetOutboundIP("").String(),
 		MqttPortCert: DefaultMqttPortCert,
@@ -310,6 +328,7 @@ func CreateHubConfig(homeFolder string) *HubConfig {
 		MqttPortWS:   DefaultMqttPortWS,
 		// Plugins:      make([]string, 0),
 		Zone: "local",
+		CORS: cors.DefaultCORSConfig(),
 	}
 	// config.Messenger.CertsFolder = path.Join(homeFolder, "certsclient")
 	// config.AclStorePath = path.Join(config.ConfigFolder, DefaultAclFile)
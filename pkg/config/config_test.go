@@ -26,9 +26,21 @@ mqttPortWS:   9995  # username password auth over WebSocket/TLS
 # Logging
 logLevel: "info"    # debug, info, warning, error. Default is warning
 logFile: /var/log/{clientID}.log
+logging:
+  format: json
+  levels:
+    mqttclient: debug
+  rotation:
+    maxSizeMB: 10
+    maxBackups: 5
 
 #configFolder: "./config" # plugin config, relative to the app home folder
 #certsFolder: "./certs"   # certificates, relative to the app home folder
+
+# Cross-origin requests from web browsers
+cors:
+  allowedOrigins: ["https://*.example.com", "http://localhost:*"]
+  maxAge: 60
 `
 
 const hubYamlBadTemplate = `
@@ -116,6 +128,20 @@ func TestLoadHubConfig(t *testing.T) {
 	err := hc.Load(hubConfigFile, "plugin1")
 	assert.NoError(t, err)
 	assert.Equal(t, "info", hc.Loglevel)
+	// cors settings not in the config file keep their default
+	assert.Equal(t, []string{"https://*.example.com", "http://localhost:*"}, hc.CORS.AllowedOrigins)
+	assert.Equal(t, 60, hc.CORS.MaxAge)
+	assert.True(t, hc.CORS.AllowSameAddress)
+	assert.True(t, hc.CORS.AllowCredentials)
+	assert.NotEmpty(t, hc.CORS.AllowedMethods)
+	// logging settings not in the config file use the logLevel and logFile
+	assert.Equal(t, logging.FormatJSON, hc.Logging.Format)
+	assert.Equal(t, "info", hc.Logging.Level)
+	assert.Equal(t, "debug", hc.Logging.Levels["mqttclient"])
+	assert.Equal(t, "/var/log/plugin1.log", hc.Logging.File)
+	assert.True(t, hc.Logging.Append)
+	assert.Equal(t, 10, hc.Logging.Rotation.MaxSizeMB)
+	assert.Equal(t, 5, hc.Logging.Rotation.MaxBackups)
 }
 
 func TestLoadHubConfigRelPath(t *testing.T) {
@@ -66,6 +66,13 @@ type ConsumedThing struct {
 	valueStore map[string]*thing.InteractionOutput
 	// mutex for concurrent access to stored values
 	valueStoreMutex sync.RWMutex
+
+	// online status of the thing, one of ThingStatusXyz
+	status string
+	// handler of changes to the online status
+	statusHandler func(status string)
+	// mutex for concurrent access to the status
+	statusMutex sync.RWMutex
 }
 
 // _getValue reads the latest cached value from the value store
@@ -92,6 +99,34 @@ func (cThing *ConsumedThing) GetThingDescription() *thing.ThingTD {
 	return cThing.TD
 }
 
+// GetStatus returns the online status of the thing.
+// Returns one of ThingStatusOnline, ThingStatusOffline, ThingStatusLost or ThingStatusUnknown if no status
+// has been received.
+func (cThing *ConsumedThing) GetStatus() string {
+	cThing.statusMutex.RLock()
+	defer cThing.statusMutex.RUnlock()
+	return cThing.status
+}
+
+// HandleStatusChange handles a change of the online status of the thing.
+//
+// This updates the status and notifies the status subscriber, if any, when the status has changed.
+//  status is one of ThingStatusOnline, ThingStatusOffline, ThingStatusLost or ThingStatusUnknown
+func (cThing *ConsumedThing) HandleStatusChange(status string) {
+	cThing.statusMutex.Lock()
+	oldStatus := cThing.status
+	cThing.status = status
+	handler := cThing.statusHandler
+	cThing.statusMutex.Unlock()
+
+	if status != oldStatus {
+		logrus.Infof("Thing '%s' status changed from '%s' to '%s'", cThing.TD.ID, oldStatus, status)
+		if handler != nil {
+			handler(status)
+		}
+	}
+}
+
 // HandleEvent handles incoming events for the consumed thing.
 //
 // This updates the cached event value and invokes the subscriber to the event, if any, or the default subscriber
@@ -198,6 +233,11 @@ func (cThing *ConsumedThing) InvokeAction(actionName string, data interface{}) e
 	return cThing.InvokeActionHook(actionName, data)
 }
 
+// IsOnline returns true if the thing is exposed and its publisher is connected
+func (cThing *ConsumedThing) IsOnline() bool {
+	return cThing.GetStatus() == ThingStatusOnline
+}
+
 // ObserveProperty makes a request for Property value change notifications.
 // Takes as arguments propertyName and a handler.
 //
@@ -277,6 +317,10 @@ func (cThing *ConsumedThing) Stop() {
 	cThing.valueStoreMutex.Lock()
 	defer cThing.valueStoreMutex.Unlock()
 	cThing.valueStore = make(map[string]*thing.InteractionOutput)
+
+	cThing.statusMutex.Lock()
+	defer cThing.statusMutex.Unlock()
+	cThing.statusHandler = nil
 }
 
 // SubscribeEvent makes a request for subscribing to events
@@ -307,6 +351,28 @@ func (cThing *ConsumedThing) SubscribeEvent(
 	return nil
 }
 
+// SubscribeOnlineChange makes a request for notifications of changes to the online status of the thing.
+// The status changes to ThingStatusLost when the connection with its publisher is lost without disconnecting.
+//
+// Takes as argument the handler that is invoked with the new status.
+// Returns nil if subscription is successful or NotAllowed error if a subscription already exists
+func (cThing *ConsumedThing) SubscribeOnlineChange(handler func(status string)) error {
+	cThing.statusMutex.Lock()
+	defer cThing.statusMutex.Unlock()
+
+	// Only a single subscriber is allowed
+	if cThing.statusHandler != nil {
+		logrus.Errorf("A subscription to the status of thing '%s' already exists", cThing.TD.ID)
+		return errors.New("NotAllowed")
+	}
+	if handler == nil {
+		logrus.Errorf("Nil handler for status of thing '%s'", cThing.TD.ID)
+		return errors.New("TypeError")
+	}
+	cThing.statusHandler = handler
+	return nil
+}
+
 // WriteProperty submit a request to change a property value.
 // Takes as arguments propertyName and value, and sends a property update to the exposedThing that in turn
 // updates the actual device.
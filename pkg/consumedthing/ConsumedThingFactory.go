@@ -6,7 +6,11 @@ import (
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/wostzone/wost-go/pkg/accounts"
+	"github.com/wostzone/wost-go/pkg/logging"
+	"github.com/wostzone/wost-go/pkg/metrics"
 	"github.com/wostzone/wost-go/pkg/mqttclient"
+	"github.com/wostzone/wost-go/pkg/revocation"
+	"github.com/wostzone/wost-go/pkg/signing"
 	"github.com/wostzone/wost-go/pkg/thing"
 	"github.com/wostzone/wost-go/pkg/tlsclient"
 	"sync"
@@ -39,17 +43,39 @@ type ConsumedThingFactory struct {
 	// The current connection status of the factory bindings
 	connectionStatus ConnectionStatus
 
+	// handler to notify of connection status changes
+	connectionChangeHandler func(status ConnectionStatus)
+
+	// mutex for safe concurrent access to the connection status and handler
+	statusMutex sync.RWMutex
+
 	// Consumed things by thing ID
 	ctMap map[string]*ConsumedThing
 
 	// mutex for safe concurrent access to ctMap and bindings maps
 	ctMapMutex sync.RWMutex
 
+	// logger with the appID as clientID field
+	logger *logrus.Entry
+
+	// messages counts the messages of consumed things, nil when metrics are disabled
+	messages *metrics.Counter
+
 	// mqttClient holds the message bus connection
 	mqttClient *mqttclient.MqttClient
 
+	// signer for signing action requests and verifying events, nil when signing is not enabled
+	signer *signing.MessageSigner
+	// policy for accepting events based on their signature
+	signaturePolicy signing.SignaturePolicy
+	// optional checker that rejects events signed with a revoked certificate
+	revocationChecker *revocation.RevocationChecker
+
 	// store of TD documents
 	thingStore *thing.ThingStore
+
+	// tokenManager refreshes the access token before it expires. Not used when connecting with client cert.
+	tokenManager *TokenManager
 }
 
 // Authenticate or refresh the access token used by the authentication protocol.
@@ -61,21 +87,36 @@ type ConsumedThingFactory struct {
 func (ctFactory *ConsumedThingFactory) Authenticate(password string) error {
 	var err error
 	if ctFactory.authClient == nil {
-		logrus.Infof("No auth client. Ignored ")
+		ctFactory.logger.Infof("No auth client. Ignored ")
+		return nil
 	} else if password != "" {
-		logrus.Infof("With password. Attempt to get JWT tokens.")
-		accessToken, err := ctFactory.authClient.ConnectWithJWTLogin(
+		ctFactory.logger.Infof("With password. Attempt to get JWT tokens.")
+		var accessToken string
+		accessToken, err = ctFactory.authClient.ConnectWithJWTLogin(
 			ctFactory.account.LoginName, password, "")
 		if err == nil {
 			ctFactory.accessToken = accessToken
 		}
 	} else {
-		logrus.Infof("No password, attempt to refresh JWT tokens")
-		tokens, err := ctFactory.authClient.RefreshJWTTokens("")
+		ctFactory.logger.Infof("No password, attempt to refresh JWT tokens")
+		var tokens *tlsclient.JwtAuthResponse
+		tokens, err = ctFactory.authClient.RefreshJWTTokens("")
 		if err == nil {
 			ctFactory.accessToken = tokens.AccessToken
 		}
 	}
+	ctFactory.updateStatus(func(status *ConnectionStatus) {
+		status.Authenticated = err == nil
+		if err == nil {
+			status.AccessToken = ctFactory.accessToken
+			status.AuthStatus = "Authenticated"
+			status.PasswordNeeded = false
+		} else {
+			status.AccessToken = ""
+			status.AuthStatus = fmt.Sprintf("Authentication failed: %s", err)
+			status.LastError = err
+		}
+	})
 	return err
 }
 
@@ -93,10 +134,13 @@ func (ctFactory *ConsumedThingFactory) Connect(password string) error {
 	// Shutdown existing connections
 	ctFactory.Disconnect()
 
-	logrus.Infof("account '%s' to: %s", account.ID, account.Address)
+	ctFactory.logger.Infof("account '%s' to: %s", account.ID, account.Address)
 
 	//ctFactory.connectionStatus.Account = account
-	ctFactory.connectionStatus.StatusMessage = ""
+	ctFactory.updateStatus(func(status *ConnectionStatus) {
+		status.StatusMessage = "Connecting"
+		status.LastError = nil
+	})
 	ctFactory.thingStore = thing.NewThingStore(account.ID)
 	ctFactory.thingStore.Load()
 
@@ -104,14 +148,22 @@ func (ctFactory *ConsumedThingFactory) Connect(password string) error {
 	ctFactory.authClient.ConnectNoAuth()
 	err := ctFactory.Authenticate(password)
 	if err != nil {
-		logrus.Errorf("Authentication failed. Retry with password.")
+		ctFactory.logger.Errorf("Authentication failed. Retry with password.")
+		ctFactory.updateStatus(func(status *ConnectionStatus) {
+			status.StatusMessage = "Authentication failed. A password is needed."
+			status.PasswordNeeded = true
+		})
 	} else {
+		// keep the access token valid while connected
+		ctFactory.tokenManager.Start(ctFactory.accessToken)
+
 		// step 2: Connect to the directory service in order to read TDs and values
 		ctFactory.dirClient.ConnectWithJwtAccessToken(account.LoginName, ctFactory.accessToken)
 
 		// step 3: connect to the mqtt message bus
 		mqttHostPort := fmt.Sprintf("%s:%d", account.Address, account.MqttPort)
 		err = ctFactory.mqttClient.ConnectWithAccessToken(mqttHostPort, account.LoginName, ctFactory.accessToken)
+		ctFactory.updateConnectResult(err)
 	}
 	return err
 }
@@ -128,10 +180,16 @@ func (ctFactory *ConsumedThingFactory) ConnectWithCert(clientCert *tls.Certifica
 	// Shutdown existing connections
 	ctFactory.Disconnect()
 
-	logrus.Infof("account '%s' to: %s", account.ID, account.Address)
+	ctFactory.logger.Infof("account '%s' to: %s", account.ID, account.Address)
 
 	//ctFactory.connectionStatus.Account = account
-	ctFactory.connectionStatus.StatusMessage = ""
+	ctFactory.updateStatus(func(status *ConnectionStatus) {
+		status.StatusMessage = "Connecting"
+		status.LastError = nil
+		// the client certificate is the authentication
+		status.Authenticated = true
+		status.AuthStatus = "Client certificate"
+	})
 	ctFactory.thingStore = thing.NewThingStore(account.ID)
 	ctFactory.thingStore.Load()
 
@@ -142,9 +200,33 @@ func (ctFactory *ConsumedThingFactory) ConnectWithCert(clientCert *tls.Certifica
 	if err == nil {
 		err = ctFactory.dirClient.ConnectWithClientCert(clientCert)
 	}
+	ctFactory.updateConnectResult(err)
 	return err
 }
 
+// EnableSigning signs action requests with the key of the client certificate, and verifies the signature of
+// events using the certificate of the sender, issued by the CA.
+//
+//  clientCert with the certificate signed by the Hub CA. Use nil to only verify events.
+//  policy determines which events are accepted. Use signing.SignaturePolicyRequire to reject
+//  events that are unsigned or fail to verify.
+func (ctFactory *ConsumedThingFactory) EnableSigning(clientCert *tls.Certificate, policy signing.SignaturePolicy) error {
+	signer, err := signing.NewCertMessageSigner(clientCert, ctFactory.caCert)
+	if err != nil {
+		ctFactory.logger.Errorf("Unable to enable signing: %s", err)
+		return err
+	}
+	ctFactory.ctMapMutex.Lock()
+	defer ctFactory.ctMapMutex.Unlock()
+	signer.SetRevocationChecker(ctFactory.revocationChecker)
+	ctFactory.signer = signer
+	ctFactory.signaturePolicy = policy
+	for _, binding := range ctFactory.bindings {
+		binding.SetSigning(signer, policy)
+	}
+	return nil
+}
+
 // Consume returns a 'Consumed Thing' instance for interacting with a remote (exposed) thing and binds it
 // to the relevant protocol bindings. This is the only method allowed to create consumed thing instances.
 //
@@ -156,7 +238,7 @@ func (ctFactory *ConsumedThingFactory) ConnectWithCert(clientCert *tls.Certifica
 //
 // @param td is the Thing TD whose interaction instance to create
 func (ctFactory *ConsumedThingFactory) Consume(td *thing.ThingTD) *ConsumedThing {
-	logrus.Infof("Thing: %s", td.ID)
+	ctFactory.logger.WithField(logging.FieldThingID, td.ID).Infof("consume thing")
 
 	ctFactory.ctMapMutex.Lock()
 	defer ctFactory.ctMapMutex.Unlock()
@@ -166,6 +248,11 @@ func (ctFactory *ConsumedThingFactory) Consume(td *thing.ThingTD) *ConsumedThing
 		// WoST communication is mqtt and http based
 		cThing = CreateConsumedThing(td)
 		binding := CreateConsumedThingProtocolBinding(cThing)
+		binding.SetTokenManager(ctFactory.tokenManager)
+		binding.SetMessagesCounter(ctFactory.messages)
+		if ctFactory.signer != nil {
+			binding.SetSigning(ctFactory.signer, ctFactory.signaturePolicy)
+		}
 		ctFactory.bindings[td.ID] = binding
 		ctFactory.ctMap[td.ID] = cThing
 		binding.Start(
@@ -179,7 +266,7 @@ func (ctFactory *ConsumedThingFactory) Consume(td *thing.ThingTD) *ConsumedThing
 // Destroy stops and removes the consumed thing.
 // This stops listening to external events
 func (ctFactory *ConsumedThingFactory) Destroy(cThing *ConsumedThing) {
-	logrus.Infof("Thing: %s", cThing.TD.ID)
+	ctFactory.logger.WithField(logging.FieldThingID, cThing.TD.ID).Infof("destroy consumed thing")
 	ctFactory.ctMapMutex.Lock()
 	defer ctFactory.ctMapMutex.Unlock()
 
@@ -197,20 +284,150 @@ func (ctFactory *ConsumedThingFactory) Destroy(cThing *ConsumedThing) {
 
 // Disconnect the factory from the account
 func (ctFactory *ConsumedThingFactory) Disconnect() {
+	ctFactory.tokenManager.Stop()
 	if ctFactory.mqttClient != nil {
 		ctFactory.mqttClient.Disconnect()
 	}
-	ctFactory.connectionStatus.Connected = false
+	ctFactory.updateStatus(func(status *ConnectionStatus) {
+		status.Connected = false
+		status.StatusMessage = "Disconnected"
+	})
 	if ctFactory.thingStore != nil {
 		ctFactory.thingStore.Save()
 	}
 }
 
+// GetAccount returns the account the factory connects with
+func (ctFactory *ConsumedThingFactory) GetAccount() *accounts.AccountRecord {
+	return ctFactory.account
+}
+
+// ConnectionStatus returns a copy of the current connection status of the factory
+func (ctFactory *ConsumedThingFactory) ConnectionStatus() ConnectionStatus {
+	ctFactory.statusMutex.RLock()
+	defer ctFactory.statusMutex.RUnlock()
+	return ctFactory.connectionStatus
+}
+
+// GetRefreshToken returns the refresh token obtained with the last authentication, if any.
+// Store this token to authenticate without password in a later session. See SetRefreshToken.
+func (ctFactory *ConsumedThingFactory) GetRefreshToken() string {
+	return ctFactory.authClient.GetRefreshToken()
+}
+
+// GetSigner returns the signer of action requests and verifier of events, or nil if signing is not enabled.
+// See EnableSigning.
+func (ctFactory *ConsumedThingFactory) GetSigner() *signing.MessageSigner {
+	ctFactory.ctMapMutex.RLock()
+	defer ctFactory.ctMapMutex.RUnlock()
+	return ctFactory.signer
+}
+
 // GetThingStore returns the Thing store where the factory keeps its things
 func (ctFactory *ConsumedThingFactory) GetThingStore() *thing.ThingStore {
 	return ctFactory.thingStore
 }
 
+// GetTokenManager returns the manager that refreshes the access token while connected
+func (ctFactory *ConsumedThingFactory) GetTokenManager() *TokenManager {
+	return ctFactory.tokenManager
+}
+
+// OnConnectionChange sets the handler that is notified when the connection status changes.
+// This includes changes to the authentication status, the message bus connection and reconnect attempts.
+// Only a single handler is active. Use nil to remove the handler.
+//
+// The handler should not block as it can be invoked from the message bus client.
+func (ctFactory *ConsumedThingFactory) OnConnectionChange(handler func(status ConnectionStatus)) {
+	ctFactory.statusMutex.Lock()
+	defer ctFactory.statusMutex.Unlock()
+	ctFactory.connectionChangeHandler = handler
+}
+
+// onPasswordNeeded updates the connection status when the tokens can't be refreshed
+func (ctFactory *ConsumedThingFactory) onPasswordNeeded(err error) {
+	ctFactory.updateStatus(func(status *ConnectionStatus) {
+		status.AccessToken = ""
+		status.Authenticated = false
+		status.AuthStatus = fmt.Sprintf("Authentication expired: %s", err)
+		status.LastError = err
+		status.PasswordNeeded = true
+		status.StatusMessage = "Authentication expired. A password is needed."
+	})
+}
+
+// onTokenRefresh updates the connection status with the refreshed access token
+func (ctFactory *ConsumedThingFactory) onTokenRefresh(accessToken string) {
+	ctFactory.updateStatus(func(status *ConnectionStatus) {
+		ctFactory.accessToken = accessToken
+		status.AccessToken = accessToken
+		status.Authenticated = true
+		status.AuthStatus = "Authenticated"
+		status.PasswordNeeded = false
+	})
+}
+
+// onMqttConnectionChange updates the connection status when the message bus connection changes
+func (ctFactory *ConsumedThingFactory) onMqttConnectionChange(state mqttclient.ConnectionState) {
+	ctFactory.updateStatus(func(status *ConnectionStatus) {
+		status.Connected = state.Connected
+		status.ReconnectAttempts = state.ReconnectAttempts
+		if state.Connected {
+			status.StatusMessage = "Connected"
+		} else if state.LastError != nil {
+			status.LastError = state.LastError
+			status.StatusMessage = fmt.Sprintf("Not connected: %s", state.LastError)
+		}
+	})
+}
+
+// SetMetrics sets the registry of the metrics of the message bus connection and consumed things.
+// The default is metrics.DefaultRegistry. Things that are already consumed keep their metrics.
+//  registry to use, or nil to disable the metrics
+func (ctFactory *ConsumedThingFactory) SetMetrics(registry *metrics.Registry) {
+	ctFactory.ctMapMutex.Lock()
+	defer ctFactory.ctMapMutex.Unlock()
+	ctFactory.messages = newMessagesCounter(registry)
+	ctFactory.mqttClient.SetMetrics(registry)
+}
+
+// SetRevocationChecker sets the checker that rejects events signed with a revoked certificate.
+// This applies to the next EnableSigning.
+//  checker to use or nil to disable revocation checking
+func (ctFactory *ConsumedThingFactory) SetRevocationChecker(checker *revocation.RevocationChecker) {
+	ctFactory.ctMapMutex.Lock()
+	defer ctFactory.ctMapMutex.Unlock()
+	ctFactory.revocationChecker = checker
+}
+
+// SetRefreshToken sets the refresh token from a previous session to use when connecting without password
+func (ctFactory *ConsumedThingFactory) SetRefreshToken(refreshToken string) {
+	ctFactory.authClient.SetRefreshToken(refreshToken)
+}
+
+// updateConnectResult updates the connection status with the result of a connect attempt
+func (ctFactory *ConsumedThingFactory) updateConnectResult(err error) {
+	ctFactory.updateStatus(func(status *ConnectionStatus) {
+		if err != nil {
+			status.LastError = err
+			status.StatusMessage = fmt.Sprintf("Connection failed: %s", err)
+		}
+	})
+}
+
+// updateStatus applies a change to the connection status and notifies the connection change handler
+func (ctFactory *ConsumedThingFactory) updateStatus(update func(status *ConnectionStatus)) {
+	ctFactory.statusMutex.Lock()
+	update(&ctFactory.connectionStatus)
+	newStatus := ctFactory.connectionStatus
+	handler := ctFactory.connectionChangeHandler
+	ctFactory.statusMutex.Unlock()
+
+	if handler != nil {
+		handler(newStatus)
+	}
+}
+
 // CreateConsumedThingFactory creates a factory instance for consumed things for the given account
 //
 // If no CA certificate is provided there will be no protection against a man-in-the-middle attack.
@@ -225,18 +442,25 @@ func CreateConsumedThingFactory(
 
 	authHostPort := fmt.Sprintf("%s:%d", account.Address, account.AuthPort)
 	dirHostPort := fmt.Sprintf("%s:%d", account.Address, account.DirectoryPort)
-	//mqttHostPort := fmt.Sprintf("%s:%d", account.Address, account.MqttPort)
 
 	ctFactory := &ConsumedThingFactory{
 		account:    account,
 		bindings:   make(map[string]*ConsumedThingProtocolBinding),
+		caCert:     caCert,
 		ctMap:      make(map[string]*ConsumedThing),
 		ctMapMutex: sync.RWMutex{},
+		logger:     logrus.WithField(logging.FieldClientID, appID),
+		messages:   newMessagesCounter(metrics.DefaultRegistry),
 		thingStore: thing.NewThingStore(""),
 		//
 		authClient: tlsclient.NewTLSClient(authHostPort, caCert),
 		dirClient:  tlsclient.NewTLSClient(dirHostPort, caCert),
 		mqttClient: mqttclient.NewMqttClient(appID, caCert, 0),
 	}
+	ctFactory.mqttClient.OnConnectionChange(ctFactory.onMqttConnectionChange)
+	ctFactory.tokenManager = CreateTokenManager(account.LoginName,
+		ctFactory.authClient, ctFactory.dirClient, ctFactory.mqttClient)
+	ctFactory.tokenManager.OnTokenRefresh(ctFactory.onTokenRefresh)
+	ctFactory.tokenManager.OnPasswordNeeded(ctFactory.onPasswordNeeded)
 	return ctFactory
 }
@@ -62,3 +62,28 @@ func TestConnect(t *testing.T) {
 	err := factory.Connect("")
 	assert.Error(t, err)
 }
+
+func TestConnectionStatus(t *testing.T) {
+	logrus.Infof("--- TestConnectionStatus ---")
+	var lastStatus consumedthing.ConnectionStatus
+	changeCount := 0
+
+	factory := createTestFactory()
+	factory.OnConnectionChange(func(status consumedthing.ConnectionStatus) {
+		lastStatus = status
+		changeCount++
+	})
+	// without auth service the authentication fails
+	err := factory.Connect("")
+	assert.Error(t, err)
+	status := factory.ConnectionStatus()
+	assert.False(t, status.Authenticated)
+	assert.False(t, status.Connected)
+	assert.Error(t, status.LastError)
+	assert.NotEmpty(t, status.AuthStatus)
+	assert.Greater(t, changeCount, 0)
+	assert.Equal(t, status, lastStatus)
+
+	factory.Disconnect()
+	assert.False(t, factory.ConnectionStatus().Connected)
+}
@@ -1,12 +1,20 @@
 package consumedthing
 
 import (
+	"crypto/x509"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/wostzone/wost-go/pkg/certsclient"
+	"github.com/wostzone/wost-go/pkg/logging"
+	"github.com/wostzone/wost-go/pkg/metrics"
 	"github.com/wostzone/wost-go/pkg/mqttclient"
+	"github.com/wostzone/wost-go/pkg/signing"
 	"github.com/wostzone/wost-go/pkg/thing"
 	"github.com/wostzone/wost-go/pkg/tlsclient"
 )
@@ -23,6 +31,35 @@ type ConsumedThingProtocolBinding struct {
 	dirClient  *tlsclient.TLSClient
 	td         *thing.ThingTD
 	cThing     *ConsumedThing
+	// subscription to the thing's events
+	eventSubscription *mqttclient.TopicSubscription
+
+	// ID of the publisher of the thing as reported in the thing status
+	publisherID string
+	// status of the publisher, the thing is lost when its publisher is lost
+	publisherStatus string
+	// subscription to the status of the publisher
+	publisherSubscription *mqttclient.TopicSubscription
+	// status of the thing as published by its publisher
+	thingStatus string
+	// subscription to the status of the thing
+	statusSubscription *mqttclient.TopicSubscription
+	// mutex for concurrent access to the status
+	statusMutex sync.Mutex
+
+	// optional signer of action requests and verifier of received events
+	signer *signing.MessageSigner
+	// policy for accepting events based on their signature
+	signaturePolicy signing.SignaturePolicy
+	// mutex for concurrent access to the signer
+	signerMutex sync.RWMutex
+
+	// optional manager of the access token used by the message bus connection
+	tokenManager *TokenManager
+	// optional counter of the messages of the thing
+	messages *metrics.Counter
+	// logger with the thing ID as thingID field
+	logger *logrus.Entry
 }
 
 // Handle incoming events or property update message.
@@ -34,25 +71,105 @@ type ConsumedThingProtocolBinding struct {
 //  address is the MQTT topic that the event is published on as: things/{thingID}/event/{eventName}
 //  whereas message is the body of the event.
 func (binding *ConsumedThingProtocolBinding) handleEvent(topic string, message []byte) {
-	logrus.Infof("HandleEvent: received event on topic %s", topic)
+	binding.logger.WithField(logging.FieldTopic, topic).Infof("HandleEvent: received event")
 
 	// the event topic is "things/id/event/name"
 	parts := strings.Split(topic, "/")
 	if len(parts) < 4 {
-		logrus.Warningf("HandleEvent: EventName is missing in topic %s", topic)
+		binding.logger.WithField(logging.FieldTopic, topic).Warningf("HandleEvent: EventName is missing in topic")
 		return
 	}
 	eventName := parts[3]
+	signer, policy := binding.getSigner()
+	payload, _, _ := signing.OpenSignedMessage(message)
+	if signer != nil {
+		var err error
+		payload, _, err = signer.VerifyWithPolicy(message, binding.td.ID, topic, policy)
+		if err != nil {
+			binding.logger.Warningf("HandleEvent: Rejected event '%s': %s", eventName, err)
+			return
+		}
+	}
 	_, found := binding.td.Events[eventName]
 	if found {
-		binding.cThing.HandleEvent(eventName, message)
+		binding.messages.Inc(binding.td.ID, MessageTypeEvent)
+		binding.cThing.HandleEvent(eventName, payload)
 	}
 	_, found = binding.td.Properties[eventName]
 	if found {
-		binding.cThing.HandlePropertyChange(eventName, message)
+		binding.messages.Inc(binding.td.ID, MessageTypeProperty)
+		binding.cThing.HandlePropertyChange(eventName, payload)
+	}
+}
+
+// getSigner returns the message signer and signature policy, or nil if signing is not enabled
+func (binding *ConsumedThingProtocolBinding) getSigner() (*signing.MessageSigner, signing.SignaturePolicy) {
+	binding.signerMutex.RLock()
+	defer binding.signerMutex.RUnlock()
+	return binding.signer, binding.signaturePolicy
+}
+
+// handlePublisherStatus handles the retained status message of the thing's publisher
+func (binding *ConsumedThingProtocolBinding) handlePublisherStatus(topic string, message []byte) {
+	statusMsg := ThingStatusMessage{}
+	err := json.Unmarshal(message, &statusMsg)
+	if err != nil {
+		binding.logger.WithField(logging.FieldTopic, topic).Warningf("handlePublisherStatus: invalid status message: %s", err)
+		return
+	}
+	binding.statusMutex.Lock()
+	binding.publisherStatus = statusMsg.Status
+	binding.statusMutex.Unlock()
+	binding.updateStatus()
+}
+
+// handleThingStatus handles the retained status message of the thing.
+// If the publisher changed then the subscription to the publisher status is moved to the new publisher.
+func (binding *ConsumedThingProtocolBinding) handleThingStatus(topic string, message []byte) {
+	statusMsg := ThingStatusMessage{}
+	err := json.Unmarshal(message, &statusMsg)
+	if err != nil {
+		binding.logger.WithField(logging.FieldTopic, topic).Warningf("handleThingStatus: invalid status message: %s", err)
+		return
+	}
+	binding.statusMutex.Lock()
+	binding.thingStatus = statusMsg.Status
+	oldSubscription := binding.publisherSubscription
+	publisherChanged := statusMsg.Publisher != binding.publisherID
+	if publisherChanged {
+		binding.publisherID = statusMsg.Publisher
+		binding.publisherStatus = ThingStatusUnknown
+		binding.publisherSubscription = nil
+	}
+	binding.statusMutex.Unlock()
+	binding.updateStatus()
+
+	if publisherChanged {
+		if oldSubscription != nil {
+			binding.mqttClient.UnsubscribeHandler(oldSubscription)
+		}
+		if statusMsg.Publisher != "" {
+			publisherTopic := strings.ReplaceAll(TopicPublisherStatus, "{publisherID}", statusMsg.Publisher)
+			sub := binding.mqttClient.Subscribe(publisherTopic, binding.handlePublisherStatus)
+			binding.statusMutex.Lock()
+			binding.publisherSubscription = sub
+			binding.statusMutex.Unlock()
+		}
 	}
 }
 
+// updateStatus passes the effective status of the thing to the consumed thing.
+// An online thing is lost when its publisher is lost.
+func (binding *ConsumedThingProtocolBinding) updateStatus() {
+	binding.statusMutex.Lock()
+	status := binding.thingStatus
+	if status == ThingStatusOnline && binding.publisherStatus == ThingStatusLost {
+		status = ThingStatusLost
+	}
+	binding.statusMutex.Unlock()
+	binding.cThing.HandleStatusChange(status)
+}
+
 // InvokeAction publishes the action request
 //
 // @param cThing is the consumed thing invoking the action
@@ -65,15 +182,88 @@ func (binding *ConsumedThingProtocolBinding) InvokeAction(actionName string, dat
 	if action == nil {
 		err := errors.New("can't invoke action '" + actionName +
 			"'. Action is not defined in TD '" + binding.td.ID + "'")
-		logrus.Error(err)
+		binding.logger.Error(err)
 	} else {
 		topic := strings.ReplaceAll(TopicInvokeAction, "{thingID}", binding.td.ID) + "/" + actionName
-		err = binding.mqttClient.PublishObject(topic, data)
-		// TODO: reauthenticate if unauthorized
+		// reauthenticate if the access token expired, eg after the system was suspended
+		err = binding.reauthenticate()
+		if err != nil {
+			return err
+		} else if action.Input.IsSecret() {
+			err = binding.publishEncrypted(topic, data)
+		} else {
+			err = binding.publishObject(topic, data)
+		}
+		if err == nil {
+			binding.messages.Inc(binding.td.ID, MessageTypeAction)
+		}
 	}
 	return err
 }
 
+// publishEncrypted marshals the data into json and publishes it encrypted with the public key of the
+// certificate in the TD, so that only the exposed thing can read it. The data is signed first if the signer
+// has a private key.
+// Returns an error if signing is not enabled, or the TD doesn't have a certificate that is issued by the CA
+// to the thing or to the publisher in its thing ID.
+func (binding *ConsumedThingProtocolBinding) publishEncrypted(topic string, data interface{}) error {
+	signer, _ := binding.getSigner()
+	if signer == nil {
+		err := fmt.Errorf("signing must be enabled to verify the certificate of thing '%s'", binding.td.ID)
+		binding.logger.Error(err)
+		return err
+	}
+	certPEM := binding.td.GetCertificate()
+	if certPEM == "" {
+		err := fmt.Errorf("thing '%s' doesn't have a certificate for encrypting secret data", binding.td.ID)
+		binding.logger.Error(err)
+		return err
+	}
+	cert, err := certsclient.X509CertFromPEM(certPEM)
+	if err != nil {
+		binding.logger.Errorf("Invalid certificate of thing: %s", err)
+		return err
+	}
+	if !isThingCertificate(cert, binding.td.ID) {
+		err = fmt.Errorf("certificate of '%s' doesn't belong to thing '%s'", cert.Subject.CommonName, binding.td.ID)
+		binding.logger.Error(err)
+		return err
+	}
+	publicKey, err := signer.CertificatePublicKey(cert)
+	if err != nil {
+		binding.logger.Errorf("Certificate of thing '%s' is not accepted: %s", binding.td.ID, err)
+		return err
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	encrypted, err := signer.SignAndEncryptMessage(binding.td.ID, topic, payload, publicKey)
+	if err != nil {
+		binding.logger.WithField(logging.FieldTopic, topic).Errorf("Failed encrypting message: %s", err)
+		return err
+	}
+	return binding.mqttClient.Publish(topic, []byte(encrypted))
+}
+
+// publishObject marshals the data into json and publishes it, signed if a signer with private key is set
+func (binding *ConsumedThingProtocolBinding) publishObject(topic string, data interface{}) error {
+	signer, _ := binding.getSigner()
+	if signer == nil || !signer.CanSign() {
+		return binding.mqttClient.PublishObject(topic, data)
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	signed, err := signer.SignMessage(binding.td.ID, topic, payload)
+	if err != nil {
+		binding.logger.WithField(logging.FieldTopic, topic).Errorf("Failed signing message: %s", err)
+		return err
+	}
+	return binding.mqttClient.Publish(topic, []byte(signed))
+}
+
 //// ReadProperties requests a refresh of the cached property values of the thing
 //// Properties will be refreshed in the background.
 ////
@@ -82,6 +272,43 @@ func (binding *ConsumedThingProtocolBinding) InvokeAction(actionName string, dat
 //	return nil
 //}
 
+// reauthenticate refreshes the access token of the message bus connection if it is expired
+// Returns an error if a login with password is needed.
+func (binding *ConsumedThingProtocolBinding) reauthenticate() error {
+	if binding.tokenManager == nil {
+		return nil
+	}
+	err := binding.tokenManager.RefreshIfExpired()
+	if err != nil {
+		err = fmt.Errorf("thing '%s' can't be reached as reauthentication failed: %s", binding.td.ID, err)
+		binding.logger.Error(err)
+	}
+	return err
+}
+
+// SetMessagesCounter sets the counter of the received and sent messages of the thing. This must be
+// called before Start. nil to not count messages.
+func (binding *ConsumedThingProtocolBinding) SetMessagesCounter(messages *metrics.Counter) {
+	binding.messages = messages
+}
+
+// SetSigning sets the signer for signing action requests and verifying received events.
+//
+//  signer signs action requests if it has a private key. nil to disable signing.
+//  policy determines which events are accepted based on their signature
+func (binding *ConsumedThingProtocolBinding) SetSigning(signer *signing.MessageSigner, policy signing.SignaturePolicy) {
+	binding.signerMutex.Lock()
+	defer binding.signerMutex.Unlock()
+	binding.signer = signer
+	binding.signaturePolicy = policy
+}
+
+// SetTokenManager sets the manager of the access token, used to reauthenticate when the token has expired
+// before publishing a request. nil when authenticating with a client certificate.
+func (binding *ConsumedThingProtocolBinding) SetTokenManager(tokenManager *TokenManager) {
+	binding.tokenManager = tokenManager
+}
+
 // Start subscribes to Thing events
 func (binding *ConsumedThingProtocolBinding) Start(
 	authClient *tlsclient.TLSClient,
@@ -93,13 +320,27 @@ func (binding *ConsumedThingProtocolBinding) Start(
 	binding.mqttClient = mqttClient
 	// subscribe to all event messages of this thing
 	topic := strings.ReplaceAll(TopicEmitEvent, "{thingID}", binding.td.ID) + "/#"
-	binding.mqttClient.Subscribe(topic, binding.handleEvent)
+	binding.eventSubscription = binding.mqttClient.Subscribe(topic, binding.handleEvent)
+	// the status of the thing is retained and received after subscribing
+	topic = strings.ReplaceAll(TopicThingStatus, "{thingID}", binding.td.ID)
+	binding.statusSubscription = binding.mqttClient.Subscribe(topic, binding.handleThingStatus)
 }
 
 // Stop unsubscribes from all messages
 func (binding *ConsumedThingProtocolBinding) Stop() {
-	topic := strings.ReplaceAll(TopicEmitEvent, "{thingID}", binding.td.ID) + "/#"
-	binding.mqttClient.Unsubscribe(topic)
+	binding.mqttClient.UnsubscribeHandler(binding.eventSubscription)
+	binding.eventSubscription = nil
+	binding.mqttClient.UnsubscribeHandler(binding.statusSubscription)
+	binding.statusSubscription = nil
+
+	binding.statusMutex.Lock()
+	publisherSubscription := binding.publisherSubscription
+	binding.publisherSubscription = nil
+	binding.publisherID = ""
+	binding.statusMutex.Unlock()
+	if publisherSubscription != nil {
+		binding.mqttClient.UnsubscribeHandler(publisherSubscription)
+	}
 }
 
 // WriteProperty publishes a request to change a property value in the exposed thing
@@ -116,10 +357,32 @@ func (binding *ConsumedThingProtocolBinding) Stop() {
 func (binding *ConsumedThingProtocolBinding) WriteProperty(propName string, propValue any) error {
 	var err error
 	topic := strings.ReplaceAll(TopicInvokeAction, "{thingID}", binding.td.ID) + "/" + propName
-	err = binding.mqttClient.PublishObject(topic, propValue)
+	propAffordance := binding.td.GetProperty(propName)
+	err = binding.reauthenticate()
+	if err != nil {
+		return err
+	} else if propAffordance != nil && propAffordance.IsSecret() {
+		err = binding.publishEncrypted(topic, propValue)
+	} else {
+		err = binding.publishObject(topic, propValue)
+	}
+	if err == nil {
+		binding.messages.Inc(binding.td.ID, MessageTypeWrite)
+	}
 	return err
 }
 
+// isThingCertificate returns true if the common name of the certificate is the thing ID, or the publisher
+// that is included in the thing ID
+func isThingCertificate(cert *x509.Certificate, thingID string) bool {
+	cn := cert.Subject.CommonName
+	if cn == "" {
+		return false
+	}
+	_, publisherID, _, _ := thing.SplitThingID(thingID)
+	return cn == thingID || cn == publisherID
+}
+
 // CreateConsumedThingProtocolBinding creates the protocol binding for
 // the consumed thing.
 // Use 'Start' to subscribe and Stop to unsubscribe.
@@ -127,6 +390,7 @@ func CreateConsumedThingProtocolBinding(cThing *ConsumedThing) *ConsumedThingPro
 	binding := &ConsumedThingProtocolBinding{
 		cThing: cThing,
 		td:     cThing.TD,
+		logger: logrus.WithField(logging.FieldThingID, cThing.TD.ID),
 	}
 	cThing.InvokeActionHook = binding.InvokeAction
 	cThing.WritePropertyHook = binding.WriteProperty
@@ -0,0 +1,41 @@
+package consumedthing_test
+
+import (
+	"crypto/x509"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/wostzone/wost-go/pkg/certsclient"
+	"github.com/wostzone/wost-go/pkg/consumedthing"
+	"github.com/wostzone/wost-go/pkg/signing"
+	"github.com/wostzone/wost-go/pkg/testenv"
+	"github.com/wostzone/wost-go/pkg/vocab"
+)
+
+func TestEncryptWithCertOfOtherClient(t *testing.T) {
+	logrus.Infof("--- TestEncryptWithCertOfOtherClient ---")
+	const secretAction = "setCode"
+	certs := testenv.CreateCertBundle()
+
+	// the TD holds a CA issued certificate of a client that isn't the thing or its publisher
+	td := createTestTD()
+	td.AddAction(secretAction, "Set door code", vocab.DataTypeSecret)
+	deviceCert, err := x509.ParseCertificate(certs.DeviceCert.Certificate[0])
+	require.NoError(t, err)
+	td.UpdateCertificate(certsclient.X509CertToPEM(deviceCert))
+
+	cThing := consumedthing.CreateConsumedThing(td)
+	binding := consumedthing.CreateConsumedThingProtocolBinding(cThing)
+	signer, err := signing.NewCertMessageSigner(certs.PluginCert, certs.CaCert)
+	require.NoError(t, err)
+	binding.SetSigning(signer, signing.SignaturePolicyVerify)
+
+	// secret data is not encrypted with the key of this certificate
+	err = binding.InvokeAction(secretAction, "1234")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "doesn't belong to thing")
+	cThing.Stop()
+}
@@ -232,3 +232,42 @@ func TestInvokeActionNoHook(t *testing.T) {
 	err := cThing.InvokeAction(testActionName, "bob")
 	assert.Error(t, err)
 }
+
+func TestSubscribeOnlineChange(t *testing.T) {
+	logrus.Infof("--- TestSubscribeOnlineChange ---")
+	var lastStatus string
+	var changeCount = 0
+
+	td := createTestTD()
+	cThing := consumedthing.CreateConsumedThing(td)
+	assert.Equal(t, consumedthing.ThingStatusUnknown, cThing.GetStatus())
+	assert.False(t, cThing.IsOnline())
+
+	err := cThing.SubscribeOnlineChange(func(status string) {
+		changeCount++
+		lastStatus = status
+	})
+	assert.NoError(t, err)
+	// only a single subscriber is allowed
+	err = cThing.SubscribeOnlineChange(func(status string) {})
+	assert.Error(t, err)
+
+	// impersonate a binding
+	cThing.HandleStatusChange(consumedthing.ThingStatusOnline)
+	assert.True(t, cThing.IsOnline())
+	assert.Equal(t, consumedthing.ThingStatusOnline, lastStatus)
+
+	// repeated status is not a change
+	cThing.HandleStatusChange(consumedthing.ThingStatusOnline)
+	assert.Equal(t, 1, changeCount)
+
+	cThing.HandleStatusChange(consumedthing.ThingStatusLost)
+	assert.False(t, cThing.IsOnline())
+	assert.Equal(t, consumedthing.ThingStatusLost, lastStatus)
+	assert.Equal(t, 2, changeCount)
+
+	cThing.Stop()
+	// no notifications after stop
+	cThing.HandleStatusChange(consumedthing.ThingStatusOffline)
+	assert.Equal(t, 2, changeCount)
+}
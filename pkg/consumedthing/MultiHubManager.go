@@ -0,0 +1,224 @@
+package consumedthing
+
+import (
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wostzone/wost-go/pkg/accounts"
+	"github.com/wostzone/wost-go/pkg/thing"
+)
+
+// HubThing is the TD of a thing in the merged view of the things of multiple Hubs
+// Different Hubs can have things with the same ID, so things are identified by account ID and thing ID.
+type HubThing struct {
+	// AccountID of the Hub account that has the thing
+	AccountID string
+	// TD of the thing
+	TD *thing.ThingTD
+}
+
+// MultiHubManager manages the consumed thing factories of multiple Hub accounts.
+// It runs one factory for each enabled account in the account store and merges the things of
+// all connected Hubs into a single view. Things are identified by their account ID and thing ID.
+//
+// Refresh tokens obtained by the factories, including those of automatic refreshes, are saved in the
+// account store, so accounts can reconnect without password. Accounts with RememberMe keep their token
+// across restarts.
+type MultiHubManager struct {
+	// unique ID of the application instance
+	appID string
+	// CA certificates by account ID
+	caCerts map[string]*x509.Certificate
+	// handler to notify of connection status changes of an account
+	connectionChangeHandler func(accountID string, status ConnectionStatus)
+	// factories of connected accounts by account ID
+	factories map[string]*ConsumedThingFactory
+	// mutex for safe concurrent access to the factories, CA certs and handler
+	mutex sync.RWMutex
+	// store with the accounts to connect to
+	store *accounts.AccountStore
+}
+
+// Connect (re)connects a factory for the account with the given ID.
+// Without password the refresh token from the account store is used.
+//  accountID of the account in the store
+//  password to use when no valid refresh token is available, or "" to use the refresh token
+func (mgr *MultiHubManager) Connect(accountID string, password string) error {
+	account, found := mgr.store.GetAccount(accountID)
+	if !found {
+		return fmt.Errorf("Connect: account '%s' not found", accountID)
+	}
+	mgr.Disconnect(accountID)
+
+	mgr.mutex.Lock()
+	factory := CreateConsumedThingFactory(mgr.appID, &account, mgr.caCerts[accountID])
+	mgr.factories[accountID] = factory
+	mgr.mutex.Unlock()
+
+	factory.SetRefreshToken(mgr.store.GetRefreshToken(accountID))
+	factory.OnConnectionChange(func(status ConnectionStatus) {
+		mgr.onConnectionChange(accountID, factory, status)
+	})
+	return factory.Connect(password)
+}
+
+// ConnectAll connects a factory for each enabled account using their stored refresh tokens.
+// Accounts that fail to connect remain managed so the application can retry with a password.
+// Returns the connection errors by account ID
+func (mgr *MultiHubManager) ConnectAll() map[string]error {
+	errs := make(map[string]error)
+	for _, account := range mgr.store.GetEnabledAccounts() {
+		err := mgr.Connect(account.ID, "")
+		if err != nil {
+			logrus.Warningf("Account '%s' failed to connect: %s", account.ID, err)
+			errs[account.ID] = err
+		}
+	}
+	return errs
+}
+
+// Consume returns the consumed thing of the thing with the given ID from the Hub of an account.
+// Returns nil if the account has no factory or its Hub doesn't have the thing.
+//  accountID of the Hub account, see HubThing
+//  thingID of the thing
+func (mgr *MultiHubManager) Consume(accountID string, thingID string) *ConsumedThing {
+	factory := mgr.GetFactory(accountID)
+	if factory == nil {
+		return nil
+	}
+	td := factory.GetThingStore().GetByID(thingID)
+	if td == nil {
+		return nil
+	}
+	return factory.Consume(td)
+}
+
+// DisableAccount disables the account and disconnects its factory
+func (mgr *MultiHubManager) DisableAccount(accountID string) error {
+	mgr.Disconnect(accountID)
+	return mgr.store.SetEnabled(accountID, false)
+}
+
+// Disconnect disconnects and removes the factory of the account, if it is connected
+func (mgr *MultiHubManager) Disconnect(accountID string) {
+	mgr.mutex.Lock()
+	factory := mgr.factories[accountID]
+	delete(mgr.factories, accountID)
+	mgr.mutex.Unlock()
+
+	if factory != nil {
+		factory.Disconnect()
+		factory.OnConnectionChange(nil)
+	}
+}
+
+// DisconnectAll disconnects the factories of all accounts
+func (mgr *MultiHubManager) DisconnectAll() {
+	for _, accountID := range mgr.GetAccountIDs() {
+		mgr.Disconnect(accountID)
+	}
+}
+
+// EnableAccount enables the account and connects a factory for it
+//  accountID of the account in the store
+//  password to use when no valid refresh token is available, or "" to use the refresh token
+func (mgr *MultiHubManager) EnableAccount(accountID string, password string) error {
+	err := mgr.store.SetEnabled(accountID, true)
+	if err != nil {
+		return err
+	}
+	return mgr.Connect(accountID, password)
+}
+
+// GetAccountIDs returns the sorted IDs of the accounts that have a factory
+func (mgr *MultiHubManager) GetAccountIDs() []string {
+	mgr.mutex.RLock()
+	defer mgr.mutex.RUnlock()
+	accountIDs := make([]string, 0, len(mgr.factories))
+	for accountID := range mgr.factories {
+		accountIDs = append(accountIDs, accountID)
+	}
+	sort.Strings(accountIDs)
+	return accountIDs
+}
+
+// GetFactory returns the factory of the account with the given ID, or nil if the account has no factory
+func (mgr *MultiHubManager) GetFactory(accountID string) *ConsumedThingFactory {
+	mgr.mutex.RLock()
+	defer mgr.mutex.RUnlock()
+	return mgr.factories[accountID]
+}
+
+// GetThings returns the merged list of the things of all Hubs, sorted by account ID and thing ID
+func (mgr *MultiHubManager) GetThings() []HubThing {
+	mgr.mutex.RLock()
+	defer mgr.mutex.RUnlock()
+	things := make([]HubThing, 0)
+	for accountID, factory := range mgr.factories {
+		store := factory.GetThingStore()
+		for _, thingID := range store.GetIDs() {
+			if td := store.GetByID(thingID); td != nil {
+				things = append(things, HubThing{AccountID: accountID, TD: td})
+			}
+		}
+	}
+	sort.Slice(things, func(i, j int) bool {
+		if things[i].AccountID != things[j].AccountID {
+			return things[i].AccountID < things[j].AccountID
+		}
+		return things[i].TD.ID < things[j].TD.ID
+	})
+	return things
+}
+
+// OnConnectionChange sets the handler that is notified when the connection status of an account changes.
+// Only a single handler is active. Use nil to remove the handler.
+func (mgr *MultiHubManager) OnConnectionChange(handler func(accountID string, status ConnectionStatus)) {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	mgr.connectionChangeHandler = handler
+}
+
+// onConnectionChange saves the refresh token of an authenticated factory and passes the
+// connection status change to the handler.
+func (mgr *MultiHubManager) onConnectionChange(accountID string, factory *ConsumedThingFactory, status ConnectionStatus) {
+	// keep the refresh token, even if the message bus connection failed
+	refreshToken := factory.GetRefreshToken()
+	if status.Authenticated && refreshToken != "" && refreshToken != mgr.store.GetRefreshToken(accountID) {
+		if err := mgr.store.SetRefreshToken(accountID, refreshToken); err != nil {
+			logrus.Errorf("Unable to save the refresh token of account '%s': %s", accountID, err)
+		}
+	}
+	mgr.mutex.RLock()
+	handler := mgr.connectionChangeHandler
+	mgr.mutex.RUnlock()
+	if handler != nil {
+		handler(accountID, status)
+	}
+}
+
+// SetCACert sets the CA certificate used to validate the Hub of an account. This applies to the next connect.
+// Without a CA certificate there is no protection against a man-in-the-middle attack.
+func (mgr *MultiHubManager) SetCACert(accountID string, caCert *x509.Certificate) {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	mgr.caCerts[accountID] = caCert
+}
+
+// CreateMultiHubManager creates a manager for consumed things of the accounts in the account store.
+// Use ConnectAll to connect to the Hubs of all enabled accounts.
+//
+//  appID unique ID of the application instance
+//  store with the Hub accounts
+func CreateMultiHubManager(appID string, store *accounts.AccountStore) *MultiHubManager {
+	mgr := &MultiHubManager{
+		appID:     appID,
+		caCerts:   make(map[string]*x509.Certificate),
+		factories: make(map[string]*ConsumedThingFactory),
+		store:     store,
+	}
+	return mgr
+}
@@ -0,0 +1,83 @@
+package consumedthing_test
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/wostzone/wost-go/pkg/accounts"
+	"github.com/wostzone/wost-go/pkg/consumedthing"
+	"github.com/wostzone/wost-go/pkg/testenv"
+)
+
+func TestMultiHubManager(t *testing.T) {
+	logrus.Infof("--- TestMultiHubManager ---")
+	certs := testenv.CreateCertBundle()
+	store, err := accounts.NewAccountStore("")
+	require.NoError(t, err)
+	for _, accountID := range []string{"hub1", "hub2", "hub3"} {
+		err = store.SetAccount(accounts.AccountRecord{
+			ID:        accountID,
+			Address:   testenv.ServerAddress,
+			LoginName: "user1",
+			MqttPort:  testenv.MqttPortUnpw,
+			AuthPort:  testAuthPort,
+			Enabled:   accountID != "hub3",
+		})
+		require.NoError(t, err)
+	}
+	mgr := consumedthing.CreateMultiHubManager(testAppID, store)
+	statusCount := make(map[string]int)
+	mgr.OnConnectionChange(func(accountID string, status consumedthing.ConnectionStatus) {
+		statusCount[accountID]++
+	})
+	mgr.SetCACert("hub1", certs.CaCert)
+	mgr.SetCACert("hub2", certs.CaCert)
+
+	// without auth service the enabled accounts fail to connect but remain managed
+	errs := mgr.ConnectAll()
+	assert.Len(t, errs, 2)
+	assert.Equal(t, []string{"hub1", "hub2"}, mgr.GetAccountIDs())
+	assert.NotNil(t, mgr.GetFactory("hub1"))
+	assert.Nil(t, mgr.GetFactory("hub3"))
+	assert.Greater(t, statusCount["hub1"], 0)
+	assert.Equal(t, 0, statusCount["hub3"])
+	assert.Equal(t, "", store.GetRefreshToken("hub1"))
+
+	// things of all hubs are merged, and things with the same ID are kept apart by hub
+	td := createTestTD()
+	mgr.GetFactory("hub2").GetThingStore().AddTD(td)
+	things := mgr.GetThings()
+	require.Len(t, things, 1)
+	assert.Equal(t, "hub2", things[0].AccountID)
+	assert.Equal(t, td.ID, things[0].TD.ID)
+	td1 := createTestTD()
+	mgr.GetFactory("hub1").GetThingStore().AddTD(td1)
+	things = mgr.GetThings()
+	require.Len(t, things, 2)
+	assert.Equal(t, "hub1", things[0].AccountID)
+	assert.Equal(t, "hub2", things[1].AccountID)
+	cThing1 := mgr.Consume("hub1", td.ID)
+	cThing2 := mgr.Consume("hub2", td.ID)
+	require.NotNil(t, cThing1)
+	require.NotNil(t, cThing2)
+	assert.NotSame(t, cThing1, cThing2)
+	assert.Nil(t, mgr.Consume("hub2", "not-a-thing"))
+	assert.Nil(t, mgr.Consume("hub3", td.ID))
+
+	// enable and disable accounts
+	err = mgr.DisableAccount("hub1")
+	assert.NoError(t, err)
+	assert.Nil(t, mgr.GetFactory("hub1"))
+	err = mgr.EnableAccount("hub3", "")
+	assert.Error(t, err)
+	assert.NotNil(t, mgr.GetFactory("hub3"))
+	assert.Len(t, store.GetEnabledAccounts(), 2)
+	err = mgr.Connect("hub4", "")
+	assert.Error(t, err)
+
+	mgr.DisconnectAll()
+	assert.Len(t, mgr.GetAccountIDs(), 0)
+}
@@ -0,0 +1,23 @@
+// Package consumedthing with the online status of things
+package consumedthing
+
+// Online status of a thing or its publisher
+const (
+	// ThingStatusOnline the thing is exposed and its publisher is connected
+	ThingStatusOnline = "online"
+	// ThingStatusOffline the thing is no longer exposed or its publisher has disconnected
+	ThingStatusOffline = "offline"
+	// ThingStatusLost the connection with the publisher was lost without disconnecting
+	ThingStatusLost = "lost"
+	// ThingStatusUnknown no status has been received
+	ThingStatusUnknown = ""
+)
+
+// ThingStatusMessage is the retained message published on the thing and publisher status topics
+type ThingStatusMessage struct {
+	// Status is one of ThingStatusOnline, ThingStatusOffline or ThingStatusLost
+	Status string `json:"status"`
+	// Publisher is the ID of the publisher that exposes the thing. The thing is lost if its publisher is lost.
+	// This is not used in the publisher status message.
+	Publisher string `json:"publisher,omitempty"`
+}
@@ -0,0 +1,280 @@
+package consumedthing
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/sirupsen/logrus"
+
+	"github.com/wostzone/wost-go/pkg/mqttclient"
+	"github.com/wostzone/wost-go/pkg/tlsclient"
+)
+
+// DefaultTokenRefreshMargin is the time before expiry of the access token that it is refreshed.
+// Tokens that are valid for less than twice the margin are refreshed halfway their validity.
+const DefaultTokenRefreshMargin = time.Minute
+
+// DefaultTokenRetryInterval is the time to wait before retrying a failed refresh, while the access token is valid
+const DefaultTokenRetryInterval = 10 * time.Second
+
+// TokenManager keeps the JWT access token of a consumer valid.
+//
+// The access token is refreshed before it expires using the refresh token of the auth client. After a refresh,
+// the directory client uses the new access token and the message bus client uses the new token as password
+// when it reconnects. The message bus client is not reconnected after a refresh. The broker only verifies the
+// password when a client connects, so the existing connection remains valid, and reconnecting would interrupt
+// the subscriptions and drop messages that are in flight.
+//
+// If the refresh fails and the access token expires then a new login with password is needed. The
+// password needed handler is notified.
+type TokenManager struct {
+	// current access token and its expiry time
+	accessToken string
+	expiry      time.Time
+	// client to refresh the tokens with
+	authClient *tlsclient.TLSClient
+	// client of the directory service that uses the access token, or nil
+	dirClient *tlsclient.TLSClient
+	// login name of the user the tokens are issued to
+	loginName string
+	// message bus client that uses the access token as password, or nil
+	mqttClient *mqttclient.MqttClient
+	// handler to notify when the refresh failed and a password is needed
+	passwordNeededHandler func(err error)
+	// time before expiry to refresh the access token
+	refreshMargin time.Duration
+	// timer that triggers the next refresh, nil when not started
+	refreshTimer *time.Timer
+	// the manager is stopped and no longer updates the tokens of the clients
+	isStopped bool
+	// time to wait before retrying a failed refresh
+	retryInterval time.Duration
+	// handler to notify of a new access token
+	tokenRefreshHandler func(accessToken string)
+	// mutex for concurrent access to the tokens, handlers and timer
+	mutex sync.Mutex
+	// mutex to serialize refresh requests
+	refreshMutex sync.Mutex
+}
+
+// GetAccessToken returns the current access token
+func (tm *TokenManager) GetAccessToken() string {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	return tm.accessToken
+}
+
+// GetExpiry returns the expiry time of the current access token, or the zero time if it has none
+func (tm *TokenManager) GetExpiry() time.Time {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	return tm.expiry
+}
+
+// OnPasswordNeeded sets the handler that is notified when the tokens can't be refreshed and the access token
+// expired. A new login with password is needed to continue. Only a single handler is active.
+func (tm *TokenManager) OnPasswordNeeded(handler func(err error)) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.passwordNeededHandler = handler
+}
+
+// OnTokenRefresh sets the handler that is notified after the access token is refreshed.
+// Only a single handler is active.
+func (tm *TokenManager) OnTokenRefresh(handler func(accessToken string)) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.tokenRefreshHandler = handler
+}
+
+// Refresh obtains a new access and refresh token pair, updates the clients that use the access token and
+// schedules the next refresh.
+// Returns an error if the refresh fails or the manager is stopped. The current tokens remain in use.
+func (tm *TokenManager) Refresh() error {
+	tm.refreshMutex.Lock()
+	defer tm.refreshMutex.Unlock()
+
+	if tm.stopped() {
+		return fmt.Errorf("refresh of the tokens of '%s' failed: token manager is stopped", tm.loginName)
+	}
+	tokens, err := tm.authClient.RefreshJWTTokens("")
+	if err == nil && tokens.AccessToken == "" {
+		err = errors.New("no access token received")
+	}
+	if err != nil {
+		err = fmt.Errorf("refresh of the tokens of '%s' failed: %s", tm.loginName, err)
+		logrus.Warning(err)
+		return err
+	}
+	// the clients are not updated if the manager was stopped during the refresh
+	tm.mutex.Lock()
+	if tm.isStopped {
+		tm.mutex.Unlock()
+		return fmt.Errorf("refresh of the tokens of '%s' failed: token manager is stopped", tm.loginName)
+	}
+	logrus.Infof("Tokens of '%s' are refreshed", tm.loginName)
+	if tm.dirClient != nil {
+		tm.dirClient.ConnectWithJwtAccessToken(tm.loginName, tokens.AccessToken)
+	}
+	if tm.mqttClient != nil {
+		tm.mqttClient.UpdateAccessToken(tokens.AccessToken)
+	}
+	isRunning := tm.refreshTimer != nil
+	handler := tm.tokenRefreshHandler
+	tm.setAccessToken(tokens.AccessToken, isRunning)
+	tm.mutex.Unlock()
+	if handler != nil {
+		handler(tokens.AccessToken)
+	}
+	return nil
+}
+
+// RefreshIfExpired refreshes the tokens if the access token is expired, eg after the system has been
+// suspended. The password needed handler is notified if the refresh fails.
+// Returns nil if the access token is valid or an error if a password is needed.
+func (tm *TokenManager) RefreshIfExpired() error {
+	expiry := tm.GetExpiry()
+	if expiry.IsZero() || time.Now().Before(expiry) {
+		return nil
+	}
+	err := tm.Refresh()
+	if err != nil {
+		tm.notifyPasswordNeeded(err)
+	}
+	return err
+}
+
+// SetRefreshMargin sets the time before expiry of the access token that it is refreshed, and the
+// interval between retries of a failed refresh. This applies to the next scheduled refresh.
+//  refreshMargin time before expiry. 0 for DefaultTokenRefreshMargin
+//  retryInterval after a failed refresh. 0 for DefaultTokenRetryInterval
+func (tm *TokenManager) SetRefreshMargin(refreshMargin time.Duration, retryInterval time.Duration) {
+	if refreshMargin <= 0 {
+		refreshMargin = DefaultTokenRefreshMargin
+	}
+	if retryInterval <= 0 {
+		retryInterval = DefaultTokenRetryInterval
+	}
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.refreshMargin = refreshMargin
+	tm.retryInterval = retryInterval
+}
+
+// Start managing the access token obtained with a login or refresh.
+// The tokens are refreshed before the access token expires.
+//  accessToken currently in use by the clients
+func (tm *TokenManager) Start(accessToken string) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.isStopped = false
+	tm.setAccessToken(accessToken, true)
+}
+
+// Stop refreshing the tokens. Refreshes that are in progress don't update the clients.
+func (tm *TokenManager) Stop() {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.isStopped = true
+	if tm.refreshTimer != nil {
+		tm.refreshTimer.Stop()
+		tm.refreshTimer = nil
+	}
+}
+
+// notifyPasswordNeeded notifies the handler that a new login with password is needed
+func (tm *TokenManager) notifyPasswordNeeded(err error) {
+	tm.mutex.Lock()
+	handler := tm.passwordNeededHandler
+	tm.mutex.Unlock()
+	logrus.Warningf("A password is needed to login '%s': %s", tm.loginName, err)
+	if handler != nil {
+		handler(err)
+	}
+}
+
+// stopped returns whether the manager is stopped
+func (tm *TokenManager) stopped() bool {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	return tm.isStopped
+}
+
+// onRefreshTimer refreshes the tokens when the timer expires. A failed refresh is retried
+// while the access token is still valid.
+func (tm *TokenManager) onRefreshTimer() {
+	err := tm.Refresh()
+	if err == nil {
+		return
+	}
+	tm.mutex.Lock()
+	isRunning := tm.refreshTimer != nil
+	retryAt := time.Now().Add(tm.retryInterval)
+	canRetry := isRunning && retryAt.Before(tm.expiry)
+	if canRetry {
+		tm.refreshTimer = time.AfterFunc(tm.retryInterval, tm.onRefreshTimer)
+	}
+	tm.mutex.Unlock()
+
+	if isRunning && !canRetry {
+		tm.notifyPasswordNeeded(err)
+	}
+}
+
+// setAccessToken updates the access token and its expiry, and schedules the next refresh.
+// Tokens without expiry are not refreshed. This must be called with the mutex locked.
+//  accessToken to use
+//  schedule the refresh of the token
+func (tm *TokenManager) setAccessToken(accessToken string, schedule bool) {
+	claims := jwt.StandardClaims{}
+	_, _, err := new(jwt.Parser).ParseUnverified(accessToken, &claims)
+	if err != nil {
+		logrus.Warningf("Access token of '%s' is not a valid JWT token. It won't be refreshed: %s",
+			tm.loginName, err)
+	}
+	tm.accessToken = accessToken
+	tm.expiry = time.Time{}
+	if claims.ExpiresAt != 0 {
+		tm.expiry = time.Unix(claims.ExpiresAt, 0)
+	}
+	if tm.refreshTimer != nil {
+		tm.refreshTimer.Stop()
+		tm.refreshTimer = nil
+	}
+	if !schedule || tm.expiry.IsZero() {
+		return
+	}
+	// refresh halfway the validity if the token is short lived
+	refreshAt := tm.expiry.Add(-tm.refreshMargin)
+	if claims.IssuedAt != 0 {
+		issuedAt := time.Unix(claims.IssuedAt, 0)
+		if tm.expiry.Sub(issuedAt) < 2*tm.refreshMargin {
+			refreshAt = issuedAt.Add(tm.expiry.Sub(issuedAt) / 2)
+		}
+	}
+	tm.refreshTimer = time.AfterFunc(time.Until(refreshAt), tm.onRefreshTimer)
+}
+
+// CreateTokenManager creates a manager that keeps the access token of the clients valid.
+// Use Start to begin refreshing the tokens after login.
+//
+//  loginName of the user the tokens are issued to
+//  authClient with the refresh token obtained from login or a previous session
+//  dirClient of the directory service to update with the new access token, or nil
+//  mqttClient of the message bus to update with the new access token, or nil
+func CreateTokenManager(loginName string, authClient *tlsclient.TLSClient,
+	dirClient *tlsclient.TLSClient, mqttClient *mqttclient.MqttClient) *TokenManager {
+
+	tm := &TokenManager{
+		authClient:    authClient,
+		dirClient:     dirClient,
+		loginName:     loginName,
+		mqttClient:    mqttClient,
+		refreshMargin: DefaultTokenRefreshMargin,
+		retryInterval: DefaultTokenRetryInterval,
+	}
+	return tm
+}
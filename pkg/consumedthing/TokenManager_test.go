@@ -0,0 +1,89 @@
+package consumedthing_test
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/wostzone/wost-go/pkg/consumedthing"
+	"github.com/wostzone/wost-go/pkg/testenv"
+	"github.com/wostzone/wost-go/pkg/tlsclient"
+	"github.com/wostzone/wost-go/pkg/tlsserver"
+)
+
+func TestTokenManager(t *testing.T) {
+	logrus.Infof("--- TestTokenManager ---")
+	user1 := "user1"
+	password1 := "user1pass"
+	path1 := "/things"
+	certs := testenv.CreateCertBundle()
+
+	// auth and directory service with short-lived access tokens
+	srv := tlsserver.NewTLSServer(testenv.ServerAddress, testAuthPort, certs.ServerCert, certs.CaCert)
+	issuer := tlsserver.NewJWTIssuer("test", certs.ServerKey)
+	issuer.SetValidity(2*time.Second, 0)
+	tlsserver.NewJWTAuthService(srv, issuer, func(loginID string, password string) bool {
+		return loginID == user1 && password == password1
+	})
+	srv.AddHandler(path1, func(userID string, resp http.ResponseWriter, req *http.Request) {
+		_, _ = resp.Write([]byte("[]"))
+	})
+	err := srv.Start()
+	require.NoError(t, err)
+	defer srv.Stop()
+
+	hostPort := fmt.Sprintf("%s:%d", testenv.ServerAddress, testAuthPort)
+	authClient := tlsclient.NewTLSClient(hostPort, certs.CaCert)
+	dirClient := tlsclient.NewTLSClient(hostPort, certs.CaCert)
+	accessToken, err := authClient.ConnectWithJWTLogin(user1, password1, "")
+	require.NoError(t, err)
+	dirClient.ConnectWithJwtAccessToken(user1, accessToken)
+
+	var refreshCount int32
+	var passwordNeeded int32
+	tm := consumedthing.CreateTokenManager(user1, authClient, dirClient, nil)
+	tm.SetRefreshMargin(0, 100*time.Millisecond)
+	tm.OnTokenRefresh(func(newToken string) {
+		atomic.AddInt32(&refreshCount, 1)
+	})
+	tm.OnPasswordNeeded(func(err error) {
+		atomic.AddInt32(&passwordNeeded, 1)
+	})
+	tm.Start(accessToken)
+	defer tm.Stop()
+	assert.Equal(t, accessToken, tm.GetAccessToken())
+	assert.True(t, tm.GetExpiry().After(time.Now()))
+	assert.NoError(t, tm.RefreshIfExpired())
+
+	// the short-lived token is refreshed halfway its validity and the directory client keeps access
+	time.Sleep(2500 * time.Millisecond)
+	assert.GreaterOrEqual(t, atomic.LoadInt32(&refreshCount), int32(1))
+	assert.NotEqual(t, accessToken, tm.GetAccessToken())
+	_, err = dirClient.Get(path1)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&passwordNeeded))
+
+	// when the refresh token is revoked a password is needed after the access token expires
+	issuer.RevokeUser(user1)
+	time.Sleep(3 * time.Second)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&passwordNeeded))
+	err = tm.RefreshIfExpired()
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&passwordNeeded))
+
+	// a stopped manager doesn't refresh the tokens
+	accessToken = tm.GetAccessToken()
+	tm.Start(accessToken)
+	tm.Stop()
+	count := atomic.LoadInt32(&refreshCount)
+	err = tm.Refresh()
+	assert.Error(t, err)
+	assert.Equal(t, count, atomic.LoadInt32(&refreshCount))
+	assert.Equal(t, accessToken, tm.GetAccessToken())
+}
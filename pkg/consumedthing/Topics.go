@@ -17,6 +17,14 @@ const TopicEmitEvent = "things/{thingID}/" + TopicTypeEvent
 const TopicTypeAction = "action"
 const TopicInvokeAction = "things/{thingID}/" + TopicTypeAction
 
+// TopicTypeStatus topic for publishing the online status of a thing or publisher
+const TopicTypeStatus = "status"
+const TopicThingStatus = "things/{thingID}/" + TopicTypeStatus
+
+// TopicPublisherStatus topic for publishing the online status of the publisher of exposed things.
+// This is used as the MQTT last will of the publisher, as a client connection only has a single last will.
+const TopicPublisherStatus = "publishers/{publisherID}/" + TopicTypeStatus
+
 // TopicSubjectProperties base topic for publishing a map of property values updates
 //const TopicSubjectProperties = "properties"
 
@@ -0,0 +1,24 @@
+package consumedthing
+
+import (
+	"github.com/wostzone/wost-go/pkg/metrics"
+)
+
+// Message types used as 'type' label of the thing message metrics of consumed and exposed things
+const (
+	MessageTypeAction   = TopicTypeAction // action requests
+	MessageTypeEvent    = TopicTypeEvent  // events
+	MessageTypeProperty = "property"      // property value changes
+	MessageTypeWrite    = "write"         // property write requests
+)
+
+// newMessagesCounter creates or obtains the counter of consumed thing messages in the registry
+// Returns nil if the registry is nil, which disables the metric.
+func newMessagesCounter(registry *metrics.Registry) *metrics.Counter {
+	if registry == nil {
+		return nil
+	}
+	return registry.NewCounter("wost_consumedthing_messages_total",
+		"Number of received events and property changes, and sent action and write requests of consumed things",
+		"thing", "type")
+}
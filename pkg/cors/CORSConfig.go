@@ -0,0 +1,85 @@
+// Package cors with the policy for cross-origin requests from web browsers
+package cors
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CORSConfig is the policy for cross-origin requests from web browsers
+type CORSConfig struct {
+	// AllowedOrigins are the origins of web applications that can access the server. An origin is either
+	// exact, eg "https://app.example.com", or contains a single '*' wildcard, eg "https://*.example.com"
+	// or "http://localhost:*". "*" allows any origin, but is ignored when credentials are allowed.
+	AllowedOrigins []string `yaml:"allowedOrigins,omitempty"`
+	// AllowSameAddress allows https origins whose host is the host the request is sent to. Default is true.
+	AllowSameAddress bool `yaml:"allowSameAddress"`
+	// AllowedMethods are the methods of cross-origin requests. Default is GET, POST, PUT, PATCH, DELETE and OPTIONS
+	AllowedMethods []string `yaml:"allowedMethods,omitempty"`
+	// AllowedHeaders are the headers of cross-origin requests. Default includes Authorization.
+	AllowedHeaders []string `yaml:"allowedHeaders,omitempty"`
+	// AllowCredentials allows cookies and authorization headers in cross-origin requests. Default is true.
+	AllowCredentials bool `yaml:"allowCredentials"`
+	// MaxAge is the time in seconds browsers can cache the result of a preflight request. Default is 600.
+	MaxAge int `yaml:"maxAge,omitempty"`
+	// Debug logs the handling of cross-origin requests. Default is false.
+	Debug bool `yaml:"debug,omitempty"`
+}
+
+// DefaultCORSConfig returns the default CORS policy that only allows web applications served by the server
+// itself over https. Add the origins of other web applications, eg "http://localhost:*" for development,
+// to AllowedOrigins.
+func DefaultCORSConfig() CORSConfig {
+	return CORSConfig{
+		AllowedOrigins:   []string{},
+		AllowSameAddress: true,
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch,
+			http.MethodDelete, http.MethodOptions},
+		AllowedHeaders:   []string{"Origin", "Accept", "Content-Type", "Authorization", "Headers"},
+		AllowCredentials: true,
+		MaxAge:           600,
+	}
+}
+
+// IsOriginAllowed returns whether cross-origin requests from the origin are allowed
+//  origin of the request, eg https://app.example.com
+//  requestHost is the Host of the request with optional port, used to allow the same address
+func (config *CORSConfig) IsOriginAllowed(origin string, requestHost string) bool {
+	if config.AllowSameAddress && requestHost != "" {
+		host, _, err := net.SplitHostPort(requestHost)
+		if err != nil {
+			host = requestHost
+		}
+		host = strings.Trim(host, "[]")
+		originURL, err := url.Parse(origin)
+		if err == nil && originURL.Scheme == "https" && strings.EqualFold(originURL.Hostname(), host) {
+			return true
+		}
+	}
+	for _, allowed := range config.AllowedOrigins {
+		if allowed == "*" {
+			if !config.AllowCredentials {
+				return true
+			}
+		} else if matchOrigin(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOrigin returns whether the origin matches the allowed origin with an optional '*' wildcard
+func matchOrigin(allowed string, origin string) bool {
+	allowed = strings.ToLower(allowed)
+	origin = strings.ToLower(origin)
+	wildcard := strings.Index(allowed, "*")
+	if wildcard < 0 {
+		return allowed == origin
+	}
+	prefix := allowed[:wildcard]
+	suffix := allowed[wildcard+1:]
+	return len(origin) >= len(prefix)+len(suffix) &&
+		strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix)
+}
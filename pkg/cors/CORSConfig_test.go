@@ -0,0 +1,39 @@
+package cors_test
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/wostzone/wost-go/pkg/cors"
+)
+
+func TestCORSOrigins(t *testing.T) {
+	logrus.Infof("--- TestCORSOrigins ---")
+	config := cors.DefaultCORSConfig()
+	config.AllowedOrigins = []string{"https://app.example.com", "https://*.example.org", "*"}
+
+	// same host as the request over https only
+	assert.True(t, config.IsOriginAllowed("https://10.0.0.1", "10.0.0.1"))
+	assert.True(t, config.IsOriginAllowed("https://10.0.0.1:8443", "10.0.0.1:8881"))
+	assert.True(t, config.IsOriginAllowed("https://HUB.local", "hub.local:8881"))
+	assert.True(t, config.IsOriginAllowed("https://[fe80::1]:8443", "[fe80::1]:8881"))
+	assert.False(t, config.IsOriginAllowed("http://10.0.0.1", "10.0.0.1"))
+	assert.False(t, config.IsOriginAllowed("https://10.0.0.10", "10.0.0.1"))
+	assert.False(t, config.IsOriginAllowed("https://10.0.0.1", ""))
+	// exact and wildcard origins
+	assert.True(t, config.IsOriginAllowed("https://app.example.com", "10.0.0.1"))
+	assert.True(t, config.IsOriginAllowed("https://APP.example.com", "10.0.0.1"))
+	assert.False(t, config.IsOriginAllowed("https://app.example.com.evil.com", "10.0.0.1"))
+	assert.True(t, config.IsOriginAllowed("https://app.example.org", "10.0.0.1"))
+	assert.False(t, config.IsOriginAllowed("https://example.org", "10.0.0.1"))
+	assert.False(t, config.IsOriginAllowed("http://localhost:8080", "10.0.0.1"))
+
+	// any origin is only allowed without credentials
+	config.AllowCredentials = false
+	assert.True(t, config.IsOriginAllowed("http://localhost:8080", "10.0.0.1"))
+	config.AllowedOrigins = nil
+	config.AllowSameAddress = false
+	assert.False(t, config.IsOriginAllowed("https://10.0.0.1", "10.0.0.1"))
+}
@@ -70,6 +70,10 @@ import (
 
 type ExposedThing struct {
 
+	// Protocol binding hook to decrypt and verify the signature of action requests
+	// Returns the request payload and whether the request was encrypted, or an error if the request is rejected
+	DecryptActionHook func(name string, message []byte) (payload []byte, isEncrypted bool, err error)
+
 	// deviceID for reverse looking of device by their internal ID
 	DeviceID string
 
@@ -261,6 +265,9 @@ func (eThing *ExposedThing) GetValue(key string) (value *thing.InteractionOutput
 // HandleActionRequest for this Thing to be invoked by the protocol binding.
 // This passes the request to the registered action handler.
 // If no specific handler is set then the default handler with name "" is invoked.
+//
+// The request is first decrypted and verified using the DecryptActionHook of the protocol binding.
+// Requests for actions or properties with secret data are rejected unless they are encrypted.
 func (eThing *ExposedThing) HandleActionRequest(actionName string, message []byte) {
 	var actionData *thing.InteractionOutput
 	var err error
@@ -269,6 +276,20 @@ func (eThing *ExposedThing) HandleActionRequest(actionName string, message []byt
 
 	// TODO: Are channels a better way for the protocol binding to push action requests? do we care?
 
+	isEncrypted := false
+	if eThing.DecryptActionHook != nil {
+		message, isEncrypted, err = eThing.DecryptActionHook(actionName, message)
+		if err != nil {
+			logrus.Warningf("Rejected request '%s' for thing '%s': %s", actionName, eThing.TD.ID, err)
+			return
+		}
+	}
+	if !isEncrypted && eThing.isSecret(actionName) {
+		logrus.Warningf("Rejected request '%s' for thing '%s': secret data requires an encrypted request",
+			actionName, eThing.TD.ID)
+		return
+	}
+
 	// determine the action schema
 	actionAffordance := eThing.TD.GetAction(actionName)
 	if actionAffordance != nil {
@@ -298,6 +319,16 @@ func (eThing *ExposedThing) HandleActionRequest(actionName string, message []byt
 	}
 }
 
+// isSecret returns true if the input of the action or the property with the given name holds secret data
+func (eThing *ExposedThing) isSecret(name string) bool {
+	actionAffordance := eThing.TD.GetAction(name)
+	if actionAffordance != nil {
+		return actionAffordance.Input.IsSecret()
+	}
+	propAffordance := eThing.TD.GetProperty(name)
+	return propAffordance != nil && propAffordance.IsSecret()
+}
+
 // handlePropertyWriteRequest for updating a property
 // This invokes the property update handler with the value of the new property.
 //
@@ -3,12 +3,20 @@ package exposedthing
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/wostzone/wost-go/pkg/consumedthing"
+	"github.com/wostzone/wost-go/pkg/logging"
+	"github.com/wostzone/wost-go/pkg/metrics"
 	"github.com/wostzone/wost-go/pkg/mqttclient"
+	"github.com/wostzone/wost-go/pkg/revocation"
+	"github.com/wostzone/wost-go/pkg/signing"
 	"github.com/wostzone/wost-go/pkg/thing"
 )
 
@@ -24,6 +32,9 @@ import (
 // It will bind the instance to protocol bindings for publishing TDs, properties and events,
 // and receive action and property change requests as sent by consumed things.
 type ExposedThingFactory struct {
+	// appID is the publisher ID of the exposed things
+	appID string
+
 	// Bindings that are in use with exposed things by thing ID
 	bindings map[string]*ExposedThingMqttBinding
 
@@ -33,14 +44,38 @@ type ExposedThingFactory struct {
 	// Client certificate used to authenticate
 	clientCert *tls.Certificate
 
+	// The current connection status of the message bus
+	connectionStatus mqttclient.ConnectionStatus
+
+	// handler to notify of connection status changes
+	connectionChangeHandler func(status mqttclient.ConnectionStatus)
+
 	// Exposed things by thing ID
 	etMap map[string]*ExposedThing
 
 	// mutex for safe concurrent access to etMap and bindings maps
 	etMapMutex sync.RWMutex
 
+	// logger with the appID as clientID field
+	logger *logrus.Entry
+
+	// messages counts the messages of exposed things, nil when metrics are disabled
+	messages *metrics.Counter
+
 	// mqttClient holds the message bus connection
 	mqttClient *mqttclient.MqttClient
+
+	// signer for signing published messages and verifying action requests, nil when signing is not enabled
+	signer *signing.MessageSigner
+	// policy for accepting action requests based on their signature
+	signaturePolicy signing.SignaturePolicy
+	// guard that rejects replayed action requests when signing is enabled
+	replayGuard *signing.ReplayGuard
+	// optional checker that rejects action requests signed with a revoked certificate
+	revocationChecker *revocation.RevocationChecker
+
+	// mutex for safe concurrent access to the connection status and handler
+	statusMutex sync.RWMutex
 }
 
 // Connect the factory to message bus.
@@ -48,23 +83,45 @@ type ExposedThingFactory struct {
 //  address of the hub server that runs the mqtt broker
 //  mqttPort with port of the mqtt broker for certificate auth
 func (etFactory *ExposedThingFactory) Connect(address string, mqttPort int) error {
-	logrus.Infof("address=%s, mqttPort=%d", address, mqttPort)
+	etFactory.logger.Infof("address=%s, mqttPort=%d", address, mqttPort)
+	etFactory.updateStatus(func(status *mqttclient.ConnectionStatus) {
+		status.StatusMessage = "Connecting"
+		status.LastError = nil
+		// the client certificate is the authentication
+		status.Authenticated = etFactory.clientCert != nil
+		status.AuthStatus = "Client certificate"
+	})
 	hostPort := fmt.Sprintf("%s:%d", address, mqttPort)
-	return etFactory.mqttClient.ConnectWithClientCert(hostPort, etFactory.clientCert)
+	err := etFactory.mqttClient.ConnectWithClientCert(hostPort, etFactory.clientCert)
+	if err != nil {
+		etFactory.updateStatus(func(status *mqttclient.ConnectionStatus) {
+			status.LastError = err
+			status.StatusMessage = fmt.Sprintf("Connection failed: %s", err)
+		})
+	}
+	return err
 }
 
 // Disconnect the factory from the message bus
+// This publishes the offline status of the exposed things before disconnecting.
 func (etFactory *ExposedThingFactory) Disconnect() {
-	logrus.Infof("")
+	etFactory.logger.Infof("")
 	if etFactory.mqttClient != nil {
+		if etFactory.ConnectionStatus().Connected {
+			etFactory.publishStatus(consumedthing.ThingStatusOffline)
+		}
 		etFactory.mqttClient.Disconnect()
 	}
+	etFactory.updateStatus(func(status *mqttclient.ConnectionStatus) {
+		status.Connected = false
+		status.StatusMessage = "Disconnected"
+	})
 }
 
 // Destroy stops and removes the exposed thing.
 // This stops listening to external requests.
 func (etFactory *ExposedThingFactory) Destroy(eThing *ExposedThing) {
-	logrus.Infof("exposed thing: %s", eThing.TD.ID)
+	etFactory.logger.WithField(logging.FieldThingID, eThing.TD.ID).Infof("destroy exposed thing")
 	etFactory.etMapMutex.Lock()
 	defer etFactory.etMapMutex.Unlock()
 
@@ -80,12 +137,36 @@ func (etFactory *ExposedThingFactory) Destroy(eThing *ExposedThing) {
 	delete(etFactory.etMap, eThing.TD.ID)
 }
 
+// EnableSigning signs the events and property values of exposed things with the key of the client certificate,
+// and verifies the signature of action requests using the certificate of the sender, issued by the CA.
+// Signed action requests that are replayed or outside the replay window are rejected. See also SetReplayWindow.
+//
+//  policy determines which action requests are accepted. Use signing.SignaturePolicyRequire to reject
+//  requests that are unsigned or fail to verify.
+func (etFactory *ExposedThingFactory) EnableSigning(policy signing.SignaturePolicy) error {
+	signer, err := signing.NewCertMessageSigner(etFactory.clientCert, etFactory.caCert)
+	if err != nil {
+		etFactory.logger.Errorf("Unable to enable signing: %s", err)
+		return err
+	}
+	signer.SetReplayGuard(etFactory.replayGuard)
+	etFactory.etMapMutex.Lock()
+	defer etFactory.etMapMutex.Unlock()
+	signer.SetRevocationChecker(etFactory.revocationChecker)
+	etFactory.signer = signer
+	etFactory.signaturePolicy = policy
+	for _, binding := range etFactory.bindings {
+		binding.SetSigning(signer, policy)
+	}
+	return nil
+}
+
 // Expose creates an exposed thing instance and starts serving external requests for the Thing so that
 // WoT Interactions using Properties and Actions will be possible.
 // This also publishes the TD document of this Thing.
 // Returns the exposed thing with a flag whether an existing thing was returned
 func (etFactory *ExposedThingFactory) Expose(deviceID string, td *thing.ThingTD) (eThing *ExposedThing, found bool) {
-	logrus.Infof("device '%s'; ID: %s", deviceID, td.ID)
+	etFactory.logger.WithField(logging.FieldThingID, td.ID).Infof("device '%s'", deviceID)
 
 	etFactory.etMapMutex.Lock()
 	defer etFactory.etMapMutex.Unlock()
@@ -93,7 +174,11 @@ func (etFactory *ExposedThingFactory) Expose(deviceID string, td *thing.ThingTD)
 
 	if !found {
 		eThing = CreateExposedThing(deviceID, td)
-		binding := CreateExposedThingMqttBinding(eThing, etFactory.mqttClient)
+		binding := CreateExposedThingMqttBinding(eThing, etFactory.mqttClient, etFactory.appID)
+		binding.SetMessagesCounter(etFactory.messages)
+		if etFactory.signer != nil {
+			binding.SetSigning(etFactory.signer, etFactory.signaturePolicy)
+		}
 		etFactory.bindings[td.ID] = binding
 		etFactory.etMap[td.ID] = eThing
 		binding.Start()
@@ -101,6 +186,150 @@ func (etFactory *ExposedThingFactory) Expose(deviceID string, td *thing.ThingTD)
 	return eThing, found
 }
 
+// ConnectionStatus returns a copy of the current connection status of the factory
+func (etFactory *ExposedThingFactory) ConnectionStatus() mqttclient.ConnectionStatus {
+	etFactory.statusMutex.RLock()
+	defer etFactory.statusMutex.RUnlock()
+	return etFactory.connectionStatus
+}
+
+// GetSigner returns the signer of published messages and verifier of action requests,
+// or nil if signing is not enabled. See EnableSigning.
+func (etFactory *ExposedThingFactory) GetSigner() *signing.MessageSigner {
+	etFactory.etMapMutex.RLock()
+	defer etFactory.etMapMutex.RUnlock()
+	return etFactory.signer
+}
+
+// OnConnectionChange sets the handler that is notified when the connection status changes.
+// This includes connecting, losing the connection and reconnect attempts of the message bus.
+// Only a single handler is active. Use nil to remove the handler.
+//
+// The handler should not block as it can be invoked from the message bus client.
+func (etFactory *ExposedThingFactory) OnConnectionChange(handler func(status mqttclient.ConnectionStatus)) {
+	etFactory.statusMutex.Lock()
+	defer etFactory.statusMutex.Unlock()
+	etFactory.connectionChangeHandler = handler
+}
+
+// onMqttConnectionChange updates the connection status when the message bus connection changes
+func (etFactory *ExposedThingFactory) onMqttConnectionChange(state mqttclient.ConnectionState) {
+	etFactory.updateStatus(func(status *mqttclient.ConnectionStatus) {
+		status.Connected = state.Connected
+		status.ReconnectAttempts = state.ReconnectAttempts
+		if state.Connected {
+			status.StatusMessage = "Connected"
+		} else if state.LastError != nil {
+			status.LastError = state.LastError
+			status.StatusMessage = fmt.Sprintf("Not connected: %s", state.LastError)
+		}
+	})
+	// after a reconnect the last will might have replaced the online status
+	if state.Connected {
+		etFactory.publishStatus(consumedthing.ThingStatusOnline)
+	}
+}
+
+// publishStatus publishes the status of the publisher followed by the status of all exposed things
+//  status is one of consumedthing.ThingStatusOnline or ThingStatusOffline
+func (etFactory *ExposedThingFactory) publishStatus(status string) {
+	topic := strings.ReplaceAll(consumedthing.TopicPublisherStatus, "{publisherID}", etFactory.appID)
+	msg, _ := json.Marshal(consumedthing.ThingStatusMessage{Status: status})
+	err := etFactory.mqttClient.PublishRetained(topic, msg)
+	if err != nil {
+		etFactory.logger.Warningf("Failed publishing status '%s' of publisher '%s': %s", status, etFactory.appID, err)
+	}
+
+	etFactory.etMapMutex.RLock()
+	defer etFactory.etMapMutex.RUnlock()
+	for _, binding := range etFactory.bindings {
+		_ = binding.PublishStatus(status)
+	}
+}
+
+// updateStatus applies a change to the connection status and notifies the connection change handler
+func (etFactory *ExposedThingFactory) updateStatus(update func(status *mqttclient.ConnectionStatus)) {
+	etFactory.statusMutex.Lock()
+	update(&etFactory.connectionStatus)
+	newStatus := etFactory.connectionStatus
+	handler := etFactory.connectionChangeHandler
+	etFactory.statusMutex.Unlock()
+
+	if handler != nil {
+		handler(newStatus)
+	}
+}
+
+// SetMetrics sets the registry of the metrics of the message bus connection and exposed things.
+// The default is metrics.DefaultRegistry. Things that are already exposed keep their metrics.
+//  registry to use, or nil to disable the metrics
+func (etFactory *ExposedThingFactory) SetMetrics(registry *metrics.Registry) {
+	etFactory.etMapMutex.Lock()
+	defer etFactory.etMapMutex.Unlock()
+	etFactory.messages = newMessagesCounter(registry)
+	etFactory.mqttClient.SetMetrics(registry)
+}
+
+// SetPublishQueue sets the queue for messages that are published while the message bus is not connected.
+// This lets devices keep their events and latest property values during a restart of the Hub.
+// Use nil to disable queuing.
+//
+//  queue to use, see mqttclient.NewPublishQueue
+func (etFactory *ExposedThingFactory) SetPublishQueue(queue *mqttclient.PublishQueue) {
+	etFactory.mqttClient.SetPublishQueue(queue)
+
+	etFactory.etMapMutex.RLock()
+	defer etFactory.etMapMutex.RUnlock()
+	for _, binding := range etFactory.bindings {
+		binding.setQueuePolicies()
+	}
+}
+
+// SetRevocationChecker sets the checker that rejects action requests signed with a revoked certificate.
+// This applies to the next EnableSigning.
+//  checker to use or nil to disable revocation checking
+func (etFactory *ExposedThingFactory) SetRevocationChecker(checker *revocation.RevocationChecker) {
+	etFactory.etMapMutex.Lock()
+	defer etFactory.etMapMutex.Unlock()
+	etFactory.revocationChecker = checker
+}
+
+// SetReplayWindow sets the window in which signed action requests are accepted.
+// Requests that are signed longer ago, or are replayed within the window, are rejected.
+//
+//  window is the maximum time difference between signing and receiving a request. Default is 5 minutes.
+func (etFactory *ExposedThingFactory) SetReplayWindow(window time.Duration) {
+	etFactory.replayGuard.SetWindow(window)
+}
+
+// UpdateClientCert replaces the client certificate, for example after it is renewed with
+// certsclient.CertRenewalClient. The message bus connection uses the new certificate when it reconnects,
+// and if signing is enabled then messages are signed with the new certificate.
+//
+//  clientCert is the new client certificate
+func (etFactory *ExposedThingFactory) UpdateClientCert(clientCert *tls.Certificate) {
+	etFactory.logger.Infof("Updating client certificate")
+	etFactory.mqttClient.UpdateClientCert(clientCert)
+
+	etFactory.etMapMutex.Lock()
+	defer etFactory.etMapMutex.Unlock()
+	etFactory.clientCert = clientCert
+	if etFactory.signer == nil {
+		return
+	}
+	signer, err := signing.NewCertMessageSigner(clientCert, etFactory.caCert)
+	if err != nil {
+		etFactory.logger.Errorf("Unable to sign with the new certificate: %s", err)
+		return
+	}
+	signer.SetReplayGuard(etFactory.replayGuard)
+	signer.SetRevocationChecker(etFactory.revocationChecker)
+	etFactory.signer = signer
+	for _, binding := range etFactory.bindings {
+		binding.SetSigning(signer, etFactory.signaturePolicy)
+	}
+}
+
 // CreateExposedThingFactory creates a factory instance for exposed things.
 //
 // Intended for use by IoT devices and Hub services. IoT devices authenticate themselves with a client certificate
@@ -118,12 +347,23 @@ func CreateExposedThingFactory(
 	//mqttHostPort := fmt.Sprintf("%s:%d", account.Address, account.MqttPort)
 
 	etFactory := &ExposedThingFactory{
+		appID:      appID,
 		bindings:   make(map[string]*ExposedThingMqttBinding),
+		caCert:     caCert,
 		clientCert: clientCert,
 		etMap:      make(map[string]*ExposedThing),
 		etMapMutex: sync.RWMutex{},
+		logger:     logrus.WithField(logging.FieldClientID, appID),
+		messages:   newMessagesCounter(metrics.DefaultRegistry),
 		//
-		mqttClient: mqttclient.NewMqttClient(appID, caCert, 0),
+		mqttClient:  mqttclient.NewMqttClient(appID, caCert, 0),
+		replayGuard: signing.NewReplayGuard(signing.DefaultReplayWindow, signing.DefaultReplayCacheSize),
 	}
+	etFactory.mqttClient.OnConnectionChange(etFactory.onMqttConnectionChange)
+
+	// the broker publishes the last will when the connection is lost, which makes the exposed things lost
+	lastWillTopic := strings.ReplaceAll(consumedthing.TopicPublisherStatus, "{publisherID}", appID)
+	lastWill, _ := json.Marshal(consumedthing.ThingStatusMessage{Status: consumedthing.ThingStatusLost})
+	etFactory.mqttClient.SetLastWill(lastWillTopic, lastWill, true)
 	return etFactory
 }
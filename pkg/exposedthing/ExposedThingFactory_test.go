@@ -2,10 +2,13 @@
 package exposedthing_test
 
 import (
+	"crypto/x509"
 	"net/http"
 	"os"
 	"os/exec"
 	"path"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -16,8 +19,12 @@ import (
 	"github.com/wostzone/wost-go/pkg/accounts"
 	"github.com/wostzone/wost-go/pkg/consumedthing"
 	"github.com/wostzone/wost-go/pkg/exposedthing"
+	"github.com/wostzone/wost-go/pkg/metrics"
+	"github.com/wostzone/wost-go/pkg/mqttclient"
+	"github.com/wostzone/wost-go/pkg/signing"
 	"github.com/wostzone/wost-go/pkg/testenv"
 	"github.com/wostzone/wost-go/pkg/thing"
+	"github.com/wostzone/wost-go/pkg/vocab"
 )
 
 var testCerts = testenv.CreateCertBundle()
@@ -55,6 +62,35 @@ func TestCreateFactory(t *testing.T) {
 	tearDown(factory)
 }
 
+func TestConnectionStatus(t *testing.T) {
+	logrus.Infof("--- TestConnectionStatus ---")
+	var lastStatus mqttclient.ConnectionStatus
+	statusMutex := sync.Mutex{}
+
+	factory, _ := setupTestFactory(false)
+	factory.OnConnectionChange(func(status mqttclient.ConnectionStatus) {
+		statusMutex.Lock()
+		defer statusMutex.Unlock()
+		lastStatus = status
+	})
+	err := factory.Connect(testenv.ServerAddress, testenv.MqttPortCert)
+	require.NoError(t, err)
+	status := factory.ConnectionStatus()
+	assert.True(t, status.Connected)
+	assert.True(t, status.Authenticated)
+	assert.Equal(t, 0, status.ReconnectAttempts)
+	statusMutex.Lock()
+	assert.True(t, lastStatus.Connected)
+	statusMutex.Unlock()
+
+	factory.Disconnect()
+	assert.False(t, factory.ConnectionStatus().Connected)
+	statusMutex.Lock()
+	assert.False(t, lastStatus.Connected)
+	statusMutex.Unlock()
+	tearDown(factory)
+}
+
 func TestExposeDestroyThing(t *testing.T) {
 	logrus.Infof("--- TestExposeDestroyThing ---")
 
@@ -173,6 +209,54 @@ func TestExposedThing_HandleActionRequest(t *testing.T) {
 	assert.Equal(t, value1, rxValue)
 }
 
+func TestThingMetrics(t *testing.T) {
+	logrus.Infof("--- TestThingMetrics ---")
+	etRegistry := metrics.NewRegistry()
+	ctRegistry := metrics.NewRegistry()
+
+	factory, _ := setupTestFactory(true)
+	factory.SetMetrics(etRegistry)
+	td := createTestTD()
+	eThing, _ := factory.Expose(testDeviceID, td)
+	eThing.SetActionHandler(testActionName,
+		func(eThing *exposedthing.ExposedThing, actionName string, value *thing.InteractionOutput) error {
+			return nil
+		})
+	account := accounts.AccountRecord{
+		Address:   testenv.ServerAddress,
+		MqttPort:  testenv.MqttPortCert,
+		LoginName: "sss",
+		Enabled:   true,
+	}
+	cFactory := consumedthing.CreateConsumedThingFactory("etTest", &account, testCerts.CaCert)
+	cFactory.SetMetrics(ctRegistry)
+	err := cFactory.ConnectWithCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	_ = cFactory.Consume(td)
+	time.Sleep(time.Millisecond * 100)
+
+	// the consumer counts the event also as property change, as the test TD has a property with the same name
+	err = eThing.EmitEvent(testEventName, "value1")
+	assert.NoError(t, err)
+	err = cFactory.Consume(td).InvokeAction(testActionName, "value1")
+	assert.NoError(t, err)
+	time.Sleep(time.Millisecond * 100)
+
+	etMessages := etRegistry.NewCounter("wost_exposedthing_messages_total", "")
+	ctMessages := ctRegistry.NewCounter("wost_consumedthing_messages_total", "")
+	assert.Equal(t, 1.0, etMessages.Get(td.ID, consumedthing.MessageTypeEvent))
+	assert.Equal(t, 1.0, etMessages.Get(td.ID, consumedthing.MessageTypeAction))
+	assert.Equal(t, 1.0, ctMessages.Get(td.ID, consumedthing.MessageTypeEvent))
+	assert.Equal(t, 1.0, ctMessages.Get(td.ID, consumedthing.MessageTypeProperty))
+	assert.Equal(t, 1.0, ctMessages.Get(td.ID, consumedthing.MessageTypeAction))
+	mqttPublishes := etRegistry.NewCounter("wost_mqtt_publish_total", "")
+	assert.Greater(t, mqttPublishes.Get(testAppID), 0.0)
+
+	cFactory.Disconnect()
+	factory.Destroy(eThing)
+	tearDown(factory)
+}
+
 func TestExposedThing_HandleWritePropertyRequest(t *testing.T) {
 	const value2 = "value2"
 	var rxValue string
@@ -215,6 +299,242 @@ func TestExposedThing_HandleWritePropertyRequest(t *testing.T) {
 	assert.Equal(t, value2, rxValue)
 }
 
+func TestThingOnlineStatus(t *testing.T) {
+	logrus.Infof("--- TestThingOnlineStatus ---")
+
+	// step 1: expose the thing, which publishes its online status
+	factory, _ := setupTestFactory(true)
+	td := createTestTD()
+	eThing, _ := factory.Expose(testDeviceID, td)
+	require.NotNil(t, eThing)
+
+	// step 2: the consumed side receives the retained status
+	account := accounts.AccountRecord{
+		Address:   testenv.ServerAddress,
+		MqttPort:  testenv.MqttPortCert,
+		LoginName: "sss",
+		Enabled:   true,
+	}
+	cFactory := consumedthing.CreateConsumedThingFactory(
+		"etTest", &account, testCerts.CaCert)
+	err := cFactory.ConnectWithCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	cThing := cFactory.Consume(td)
+	time.Sleep(time.Millisecond * 100)
+	assert.True(t, cThing.IsOnline())
+
+	// step 3: destroying the exposed thing makes it offline
+	factory.Destroy(eThing)
+	time.Sleep(time.Millisecond * 100)
+	assert.False(t, cThing.IsOnline())
+	assert.Equal(t, consumedthing.ThingStatusOffline, cThing.GetStatus())
+
+	cFactory.Disconnect()
+	tearDown(factory)
+}
+
+func TestRetainedPropertyValue(t *testing.T) {
+	logrus.Infof("--- TestRetainedPropertyValue ---")
+
+	// step 1: expose a thing whose property value is retained by the broker
+	factory, _ := setupTestFactory(true)
+	td := createTestTD()
+	prop1 := td.GetProperty(testProp1Name)
+	prop1.Forms = []thing.Form{{Op: "observeproperty", MqvQos: "1", MqvRetain: true}}
+	eThing, _ := factory.Expose(testDeviceID, td)
+	require.NotNil(t, eThing)
+	err := eThing.EmitPropertyChange(testProp1Name, testProp1Value, false)
+	assert.NoError(t, err)
+
+	// step 2: a consumer that subscribes afterwards receives the retained value
+	account := accounts.AccountRecord{
+		Address:   testenv.ServerAddress,
+		MqttPort:  testenv.MqttPortCert,
+		LoginName: "sss",
+		Enabled:   true,
+	}
+	cFactory := consumedthing.CreateConsumedThingFactory(
+		"etTest", &account, testCerts.CaCert)
+	err = cFactory.ConnectWithCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	cThing := cFactory.Consume(td)
+	time.Sleep(time.Millisecond * 100)
+	value, err := cThing.ReadProperty(testProp1Name)
+	assert.NoError(t, err)
+	if assert.NotNil(t, value) {
+		assert.Equal(t, testProp1Value, value.ValueAsString())
+	}
+
+	cFactory.Disconnect()
+	factory.Destroy(eThing)
+	tearDown(factory)
+}
+
+func TestSignedActionRequest(t *testing.T) {
+	const value1 = "value1"
+	var rxValue string
+	rxMutex := sync.Mutex{}
+	logrus.Infof("--- TestSignedActionRequest ---")
+
+	// step 1: expose a thing that only accepts signed action requests
+	factory, _ := setupTestFactory(true)
+	err := factory.EnableSigning(signing.SignaturePolicyRequire)
+	require.NoError(t, err)
+	td := createTestTD()
+	eThing, _ := factory.Expose(testDeviceID, td)
+	eThing.SetActionHandler(testActionName,
+		func(eThing *exposedthing.ExposedThing, actionName string, value *thing.InteractionOutput) error {
+			rxMutex.Lock()
+			defer rxMutex.Unlock()
+			rxValue = value.ValueAsString()
+			return nil
+		})
+
+	// step 2: an unsigned request is rejected
+	account := accounts.AccountRecord{
+		Address:   testenv.ServerAddress,
+		MqttPort:  testenv.MqttPortCert,
+		LoginName: "sss",
+		Enabled:   true,
+	}
+	cFactory := consumedthing.CreateConsumedThingFactory(
+		"etTest", &account, testCerts.CaCert)
+	err = cFactory.ConnectWithCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	cThing := cFactory.Consume(td)
+	err = cThing.InvokeAction(testActionName, value1)
+	assert.NoError(t, err)
+	time.Sleep(time.Millisecond * 100)
+	rxMutex.Lock()
+	assert.Empty(t, rxValue)
+	rxMutex.Unlock()
+
+	// step 3: a request signed with the client certificate is accepted
+	err = cFactory.EnableSigning(testCerts.PluginCert, signing.SignaturePolicyRequire)
+	require.NoError(t, err)
+	err = cThing.InvokeAction(testActionName, value1)
+	assert.NoError(t, err)
+	time.Sleep(time.Millisecond * 100)
+	rxMutex.Lock()
+	assert.Equal(t, value1, rxValue)
+	rxMutex.Unlock()
+
+	cFactory.Disconnect()
+	factory.Destroy(eThing)
+	tearDown(factory)
+}
+
+func TestFactorySigning(t *testing.T) {
+	payload := []byte(`"value1"`)
+	logrus.Infof("--- TestFactorySigning ---")
+
+	// both factories use the CA certificate to verify the certificate included in signed messages
+	account := accounts.AccountRecord{Address: testenv.ServerAddress, MqttPort: testenv.MqttPortCert}
+	cFactory := consumedthing.CreateConsumedThingFactory("etTest", &account, testCerts.CaCert)
+	assert.Nil(t, cFactory.GetSigner())
+	err := cFactory.EnableSigning(testCerts.PluginCert, signing.SignaturePolicyRequire)
+	require.NoError(t, err)
+	factory := exposedthing.CreateExposedThingFactory(testAppID, testCerts.DeviceCert, testCerts.CaCert)
+	err = factory.EnableSigning(signing.SignaturePolicyRequire)
+	require.NoError(t, err)
+
+	// an action request signed by the consumer is accepted by the exposed thing
+	thingID := "urn:thing1"
+	topic := strings.ReplaceAll(consumedthing.TopicInvokeAction, "{thingID}", thingID) + "/" + testActionName
+	signed, err := cFactory.GetSigner().SignMessage(thingID, topic, payload)
+	require.NoError(t, err)
+	rxPayload, sender, err := factory.GetSigner().VerifyWithPolicy(
+		[]byte(signed), thingID, topic, signing.SignaturePolicyRequire)
+	assert.NoError(t, err)
+	assert.Equal(t, "Plugin", sender)
+	assert.Equal(t, payload, rxPayload)
+
+	// the request can't be replayed to another thing
+	_, _, err = factory.GetSigner().VerifyWithPolicy(
+		[]byte(signed), "urn:thing2", topic, signing.SignaturePolicyRequire)
+	assert.Error(t, err)
+
+	// an event signed by the exposed thing is accepted by the consumer
+	topic = strings.ReplaceAll(consumedthing.TopicEmitEvent, "{thingID}", thingID) + "/" + testEventName
+	signed, err = factory.GetSigner().SignMessage(thingID, topic, payload)
+	require.NoError(t, err)
+	rxPayload, _, err = cFactory.GetSigner().VerifyWithPolicy(
+		[]byte(signed), thingID, topic, signing.SignaturePolicyRequire)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, rxPayload)
+
+	// a message signed by a certificate of another CA is rejected
+	otherCerts := testenv.CreateCertBundle()
+	otherFactory := exposedthing.CreateExposedThingFactory(testAppID, otherCerts.DeviceCert, otherCerts.CaCert)
+	err = otherFactory.EnableSigning(signing.SignaturePolicyRequire)
+	require.NoError(t, err)
+	signed, _ = otherFactory.GetSigner().SignMessage(thingID, topic, payload)
+	_, _, err = cFactory.GetSigner().VerifyWithPolicy([]byte(signed), thingID, topic, signing.SignaturePolicyRequire)
+	assert.Error(t, err)
+}
+
+func TestEncryptedActionRequest(t *testing.T) {
+	const secretAction = "setCode"
+	const code = "1234"
+	var rxValue string
+	rxMutex := sync.Mutex{}
+	logrus.Infof("--- TestEncryptedActionRequest ---")
+
+	// step 1: expose a thing with a secret action. Signing provides the key for decryption.
+	// The certificate of the factory is issued to the publisher of the thing.
+	factory, _ := setupTestFactory(true)
+	err := factory.EnableSigning(signing.SignaturePolicyVerify)
+	require.NoError(t, err)
+	pluginCert, _ := x509.ParseCertificate(testCerts.PluginCert.Certificate[0])
+	td := createTestTD()
+	td.ID = thing.CreatePublisherID("", pluginCert.Subject.CommonName, testDeviceID, testDeviceType)
+	td.AddAction(secretAction, "Set door code", vocab.DataTypeSecret)
+	eThing, _ := factory.Expose(testDeviceID, td)
+	assert.NotEmpty(t, td.GetCertificate())
+	eThing.SetActionHandler(secretAction,
+		func(eThing *exposedthing.ExposedThing, actionName string, value *thing.InteractionOutput) error {
+			rxMutex.Lock()
+			defer rxMutex.Unlock()
+			rxValue = value.ValueAsString()
+			return nil
+		})
+
+	// step 2: the consumer encrypts the secret input with the key of the CA verified certificate in the TD
+	account := accounts.AccountRecord{
+		Address:   testenv.ServerAddress,
+		MqttPort:  testenv.MqttPortCert,
+		LoginName: "sss",
+		Enabled:   true,
+	}
+	cFactory := consumedthing.CreateConsumedThingFactory(
+		"etTest", &account, testCerts.CaCert)
+	err = cFactory.ConnectWithCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	err = cFactory.EnableSigning(testCerts.PluginCert, signing.SignaturePolicyVerify)
+	require.NoError(t, err)
+	cThing := cFactory.Consume(td)
+	err = cThing.InvokeAction(secretAction, code)
+	assert.NoError(t, err)
+	time.Sleep(time.Millisecond * 100)
+	rxMutex.Lock()
+	assert.Equal(t, code, rxValue)
+	rxMutex.Unlock()
+
+	// step 3: the certificate is not accepted for a thing of another publisher
+	td2 := createTestTD()
+	td2.AddAction(secretAction, "Set door code", vocab.DataTypeSecret)
+	eThing2, _ := factory.Expose("device2", td2)
+	assert.NotEmpty(t, td2.GetCertificate())
+	cThing2 := cFactory.Consume(td2)
+	err = cThing2.InvokeAction(secretAction, code)
+	assert.Error(t, err)
+
+	cFactory.Disconnect()
+	factory.Destroy(eThing2)
+	factory.Destroy(eThing)
+	tearDown(factory)
+}
+
 //
 //func TestHandleActionRequest(t *testing.T) {
 //	logrus.Infof("--- TestHandleActionRequest ---")
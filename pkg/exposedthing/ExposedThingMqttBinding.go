@@ -2,12 +2,19 @@
 package exposedthing
 
 import (
+	"encoding/json"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/wostzone/wost-go/pkg/certsclient"
 	"github.com/wostzone/wost-go/pkg/consumedthing"
+	"github.com/wostzone/wost-go/pkg/logging"
+	"github.com/wostzone/wost-go/pkg/metrics"
 	"github.com/wostzone/wost-go/pkg/mqttclient"
+	"github.com/wostzone/wost-go/pkg/signing"
 	"github.com/wostzone/wost-go/pkg/thing"
 )
 
@@ -16,6 +23,23 @@ type ExposedThingMqttBinding struct {
 	eThing     *ExposedThing
 	mqttClient *mqttclient.MqttClient
 	td         *thing.ThingTD
+	// ID of the publisher whose connection status applies to the thing
+	publisherID string
+	// subscription to the thing's action requests
+	actionSubscription *mqttclient.TopicSubscription
+	// publish options of events and properties whose forms have MQTT settings
+	eventOptions    map[string]mqttclient.PublishOptions
+	propertyOptions map[string]mqttclient.PublishOptions
+	// optional signer of published messages and verifier of action requests
+	signer *signing.MessageSigner
+	// policy for accepting action requests based on their signature
+	signaturePolicy signing.SignaturePolicy
+	// mutex for concurrent access to the signer
+	signerMutex sync.RWMutex
+	// optional counter of the messages of the thing
+	messages *metrics.Counter
+	// logger with the thing ID as thingID field
+	logger *logrus.Entry
 }
 
 // EmitEvent publishes a single event to subscribers.
@@ -26,8 +50,17 @@ type ExposedThingMqttBinding struct {
 // data is the event value as defined in the TD events schema and used as the payload
 // Returns an error if the event is not found or cannot be published
 func (binding *ExposedThingMqttBinding) EmitEvent(name string, data interface{}) error {
+	var err error
 	topic := strings.ReplaceAll(consumedthing.TopicEmitEvent, "{thingID}", binding.td.ID) + "/" + name
-	err := binding.mqttClient.PublishObject(topic, data)
+	options, hasOptions := binding.eventOptions[name]
+	if hasOptions {
+		err = binding.publishObject(topic, data, &options)
+	} else {
+		err = binding.publishObject(topic, data, nil)
+	}
+	if err == nil {
+		binding.messages.Inc(binding.td.ID, consumedthing.MessageTypeEvent)
+	}
 	return err
 }
 
@@ -39,8 +72,17 @@ func (binding *ExposedThingMqttBinding) EmitEvent(name string, data interface{})
 //  data is the property value as defined in the TD events schema and serialized to json
 // Returns an error if the event is not found or cannot be published
 func (binding *ExposedThingMqttBinding) EmitPropertyChange(name string, data interface{}) error {
+	var err error
 	topic := strings.ReplaceAll(consumedthing.TopicEmitEvent, "{thingID}", binding.td.ID) + "/" + name
-	err := binding.mqttClient.PublishObject(topic, data)
+	options, hasOptions := binding.propertyOptions[name]
+	if hasOptions {
+		err = binding.publishObject(topic, data, &options)
+	} else {
+		err = binding.publishObject(topic, data, nil)
+	}
+	if err == nil {
+		binding.messages.Inc(binding.td.ID, consumedthing.MessageTypeProperty)
+	}
 	return err
 }
 
@@ -66,6 +108,28 @@ func (binding *ExposedThingMqttBinding) EmitPropertyChange(name string, data int
 //	return err
 //}
 
+// getPublishOptions returns the publish options from the MQTT settings in the forms of an affordance.
+// Returns false if none of the forms has MQTT settings, in which case the client defaults apply.
+func getPublishOptions(forms []thing.Form) (options mqttclient.PublishOptions, found bool) {
+	options.QoS = mqttclient.DefaultQos
+	for _, form := range forms {
+		if form.MqvQos != "" {
+			qos, err := strconv.Atoi(form.MqvQos)
+			if err != nil || qos < 0 || qos > 2 {
+				logrus.Warningf("Invalid mqv:qos '%s' in form. Ignored.", form.MqvQos)
+			} else {
+				options.QoS = byte(qos)
+				found = true
+			}
+		}
+		if form.MqvRetain {
+			options.Retain = true
+			found = true
+		}
+	}
+	return options, found
+}
+
 // Handle action requests for this Thing.
 //
 // This passes the request to the registered handler.
@@ -73,51 +137,202 @@ func (binding *ExposedThingMqttBinding) EmitPropertyChange(name string, data int
 //
 // Since property write requests are sent as actions, this also handles these
 // requests. In this case the action name is the property name.
+//
+// The exposed thing decrypts and verifies the request using the decryptActionRequest hook.
 func (binding *ExposedThingMqttBinding) handleActionRequest(address string, message []byte) {
-	logrus.Infof("address '%s', message: '%s'", address, message)
+	binding.logger.WithField(logging.FieldTopic, address).Infof("message: '%s'", message)
 
 	// the topic is "things/id/action/actionName"
 	thingID, messageType, actionName := consumedthing.SplitTopic(address)
 	if thingID == "" || messageType == "" {
-		logrus.Warningf("actionName is missing in topic %s", address)
+		binding.logger.WithField(logging.FieldTopic, address).Warningf("actionName is missing in topic")
 		return
 	}
+	binding.messages.Inc(binding.td.ID, consumedthing.MessageTypeAction)
 	binding.eThing.HandleActionRequest(actionName, message)
 }
 
+// decryptActionRequest decrypts the request if it is encrypted and verifies its signature.
+// Encrypted requests can only be decrypted when signing is enabled, as it provides the private key.
+// If signing is enabled then requests are rejected when they don't meet the signature policy.
+func (binding *ExposedThingMqttBinding) decryptActionRequest(
+	actionName string, message []byte) (payload []byte, isEncrypted bool, err error) {
+	signer, policy := binding.getSigner()
+	if signer == nil {
+		// without signing there is no key to decrypt with and signatures are not checked
+		signer = signing.NewMessageSigner("", nil, nil)
+		policy = signing.SignaturePolicyNone
+	}
+	message, isEncrypted, err = signer.DecryptMessage(message)
+	if err != nil {
+		return nil, isEncrypted, err
+	}
+	// the request must be signed for this thing and action
+	topic := strings.ReplaceAll(consumedthing.TopicInvokeAction, "{thingID}", binding.td.ID) + "/" + actionName
+	payload, sender, err := signer.VerifyWithPolicy(message, binding.td.ID, topic, policy)
+	if err == nil && sender != "" {
+		binding.logger.Infof("Request '%s' from '%s' (encrypted=%v)", actionName, sender, isEncrypted)
+	}
+	return payload, isEncrypted, err
+}
+
+// getSigner returns the message signer and signature policy, or nil if signing is not enabled
+func (binding *ExposedThingMqttBinding) getSigner() (*signing.MessageSigner, signing.SignaturePolicy) {
+	binding.signerMutex.RLock()
+	defer binding.signerMutex.RUnlock()
+	return binding.signer, binding.signaturePolicy
+}
+
+// publishObject marshals the data into json and publishes it, signed if a signer is set.
+//  options to publish with, or nil to use the client defaults
+func (binding *ExposedThingMqttBinding) publishObject(
+	topic string, data interface{}, options *mqttclient.PublishOptions) error {
+	signer, _ := binding.getSigner()
+	if signer == nil || !signer.CanSign() {
+		if options != nil {
+			return binding.mqttClient.PublishObjectWithOptions(topic, data, *options)
+		}
+		return binding.mqttClient.PublishObject(topic, data)
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	signed, err := signer.SignMessage(binding.td.ID, topic, payload)
+	if err != nil {
+		binding.logger.WithField(logging.FieldTopic, topic).Errorf("Failed signing message: %s", err)
+		return err
+	}
+	if options != nil {
+		return binding.mqttClient.PublishWithOptions(topic, []byte(signed), *options)
+	}
+	return binding.mqttClient.Publish(topic, []byte(signed))
+}
+
+// PublishStatus publishes the retained online status of the thing.
+// The status includes the publisher ID so consumers can tell when the thing is lost with its publisher.
+//
+//  status is one of consumedthing.ThingStatusOnline or ThingStatusOffline
+func (binding *ExposedThingMqttBinding) PublishStatus(status string) error {
+	topic := strings.ReplaceAll(consumedthing.TopicThingStatus, "{thingID}", binding.td.ID)
+	msg, _ := json.Marshal(consumedthing.ThingStatusMessage{
+		Status:    status,
+		Publisher: binding.publisherID,
+	})
+	err := binding.mqttClient.PublishRetained(topic, msg)
+	return err
+}
+
+// SetMessagesCounter sets the counter of the emitted and received messages of the thing. This must be
+// called before Start. nil to not count messages.
+func (binding *ExposedThingMqttBinding) SetMessagesCounter(messages *metrics.Counter) {
+	binding.messages = messages
+}
+
+// SetSigning sets the signer for signing published events and verifying received action requests.
+// The certificate of the signer is added to the TD so consumers can verify it with the CA and encrypt
+// action requests with its public key. If the binding has started then the updated TD is published.
+//
+//  signer signs published messages and decrypts requests if it has a private key. nil to disable signing.
+//  policy determines which action requests are accepted based on their signature
+func (binding *ExposedThingMqttBinding) SetSigning(signer *signing.MessageSigner, policy signing.SignaturePolicy) {
+	binding.signerMutex.Lock()
+	binding.signer = signer
+	binding.signaturePolicy = policy
+	binding.signerMutex.Unlock()
+
+	certPEM := ""
+	if signer != nil && signer.CanSign() && signer.Certificate() != nil {
+		certPEM = certsclient.X509CertToPEM(signer.Certificate())
+	}
+	if certPEM != binding.td.GetCertificate() {
+		binding.td.UpdateCertificate(certPEM)
+		if binding.actionSubscription != nil {
+			binding.publishTD()
+		}
+	}
+}
+
+// publishTD publishes the Thing's own TD
+func (binding *ExposedThingMqttBinding) publishTD() {
+	topic := strings.ReplaceAll(consumedthing.TopicThingTD, "{thingID}", binding.td.ID)
+	err := binding.mqttClient.PublishObject(topic, binding.td)
+	// TBD how to handle the error?
+	_ = err
+}
+
+// setPublishOptions collects the publish options of the event and property affordances that have
+// MQTT settings in their forms, for example retained property values or QoS 0 for high rate telemetry events.
+func (binding *ExposedThingMqttBinding) setPublishOptions() {
+	binding.eventOptions = make(map[string]mqttclient.PublishOptions)
+	binding.propertyOptions = make(map[string]mqttclient.PublishOptions)
+	for name, event := range binding.td.Events {
+		if options, found := getPublishOptions(event.Forms); found {
+			binding.eventOptions[name] = options
+		}
+	}
+	for name, prop := range binding.td.Properties {
+		if options, found := getPublishOptions(prop.Forms); found {
+			binding.propertyOptions[name] = options
+		}
+	}
+}
+
+// setQueuePolicies sets the policies for queuing messages while offline.
+// Only the latest TD and property values are of interest, while all events are kept.
+// This does nothing if the mqtt client has no publish queue.
+func (binding *ExposedThingMqttBinding) setQueuePolicies() {
+	topic := strings.ReplaceAll(consumedthing.TopicThingTD, "{thingID}", binding.td.ID)
+	binding.mqttClient.SetTopicQueuePolicy(topic, mqttclient.QueuePolicyKeepLatest)
+	for propName := range binding.td.Properties {
+		// an event with the same name as a property is a property value change
+		if _, isEvent := binding.td.Events[propName]; !isEvent {
+			topic = strings.ReplaceAll(consumedthing.TopicEmitEvent, "{thingID}", binding.td.ID) + "/" + propName
+			binding.mqttClient.SetTopicQueuePolicy(topic, mqttclient.QueuePolicyKeepLatest)
+		}
+	}
+}
+
 // Start subscribes to Thing action requests
 // Publish the Thing's own TD
 func (binding *ExposedThingMqttBinding) Start() {
-	logrus.Infof("binding for exposed thing '%s'", binding.td.ID)
+	binding.logger.Infof("start binding for exposed thing")
+	binding.setPublishOptions()
+	binding.setQueuePolicies()
 	// subscribe to action/property write messages for the thing
 	topic := strings.ReplaceAll(consumedthing.TopicInvokeAction, "{thingID}", binding.td.ID) + "/#"
-	binding.mqttClient.Subscribe(topic, binding.handleActionRequest)
+	binding.actionSubscription = binding.mqttClient.Subscribe(topic, binding.handleActionRequest)
 
-	topic = strings.ReplaceAll(consumedthing.TopicThingTD, "{thingID}", binding.td.ID)
-	err := binding.mqttClient.PublishObject(topic, binding.td)
-	// TBD how to handle the error?
-	_ = err
+	binding.publishTD()
+	// when offline the status is published after connecting
+	_ = binding.PublishStatus(consumedthing.ThingStatusOnline)
 }
 
-// Stop unsubscribes from all messages
+// Stop unsubscribes from all messages and publishes the offline status
 func (binding *ExposedThingMqttBinding) Stop() {
-	logrus.Infof("binding for exposed thing '%s'", binding.td.ID)
-	topic := strings.ReplaceAll(consumedthing.TopicInvokeAction, "{thingID}", binding.td.ID) + "/#"
-	binding.mqttClient.Unsubscribe(topic)
+	binding.logger.Infof("stop binding for exposed thing")
+	_ = binding.PublishStatus(consumedthing.ThingStatusOffline)
+	binding.mqttClient.UnsubscribeHandler(binding.actionSubscription)
+	binding.actionSubscription = nil
 }
 
 // CreateExposedThingMqttBinding constructs a mqtt protocol binding for exposed things.
 //
 //  eThing is the Exposed Thing to bind to
 //  mqttClient MQTT client for binding to the MQTT protocol
-func CreateExposedThingMqttBinding(eThing *ExposedThing, mqttClient *mqttclient.MqttClient) *ExposedThingMqttBinding {
+//  publisherID is the ID of the publisher whose last will indicates the thing is lost
+func CreateExposedThingMqttBinding(
+	eThing *ExposedThing, mqttClient *mqttclient.MqttClient, publisherID string) *ExposedThingMqttBinding {
 	binding := &ExposedThingMqttBinding{
-		td:         eThing.TD,
-		eThing:     eThing,
-		mqttClient: mqttClient,
+		td:          eThing.TD,
+		eThing:      eThing,
+		mqttClient:  mqttClient,
+		publisherID: publisherID,
+		logger:      logrus.WithField(logging.FieldThingID, eThing.TD.ID),
 	}
 	//eThing.EmitPropertiesChangeHook = binding.EmitPropertiesChange
 	eThing.EmitPropertyChangeHook = binding.EmitPropertyChange
 	eThing.EmitEventHook = binding.EmitEvent
+	eThing.DecryptActionHook = binding.decryptActionRequest
 	return binding
 }
@@ -146,6 +146,36 @@ func TestHandleActionRequestNoHandler(t *testing.T) {
 	// check logging for an error
 }
 
+func TestHandleSecretActionRequest(t *testing.T) {
+	logrus.Infof("--- TestHandleSecretActionRequest ---")
+	const secretAction = "setCode"
+	var rxCount = 0
+
+	// step 1 setup an action with a secret input
+	td := createTestTD()
+	td.AddAction(secretAction, "Set door code", vocab.DataTypeSecret)
+	eThing := exposedthing.CreateExposedThing(testDeviceID, td)
+	eThing.SetActionHandler(secretAction,
+		func(eThing *exposedthing.ExposedThing, name string, val *thing.InteractionOutput) error {
+			rxCount++
+			return nil
+		})
+
+	// step 2 an unencrypted request is rejected
+	jsonValue, _ := json.Marshal("1234")
+	eThing.HandleActionRequest(secretAction, jsonValue)
+	assert.Equal(t, 0, rxCount)
+
+	// step 3 a request that the binding decrypted is accepted
+	eThing.DecryptActionHook = func(name string, message []byte) ([]byte, bool, error) {
+		return message, true, nil
+	}
+	eThing.HandleActionRequest(secretAction, jsonValue)
+	assert.Equal(t, 1, rxCount)
+
+	eThing.Destroy()
+}
+
 func TestHandlePropertyWriteRequest(t *testing.T) {
 	logrus.Infof("--- TestHandlePropertyWriteRequest ---")
 	var rxDefaultPropName string
@@ -0,0 +1,17 @@
+package exposedthing
+
+import (
+	"github.com/wostzone/wost-go/pkg/metrics"
+)
+
+// newMessagesCounter creates or obtains the counter of exposed thing messages in the registry
+// The message types are those of the consumed things, eg consumedthing.MessageTypeEvent.
+// Returns nil if the registry is nil, which disables the metric.
+func newMessagesCounter(registry *metrics.Registry) *metrics.Counter {
+	if registry == nil {
+		return nil
+	}
+	return registry.NewCounter("wost_exposedthing_messages_total",
+		"Number of emitted events and property changes, and received action requests of exposed things",
+		"thing", "type")
+}
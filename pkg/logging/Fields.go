@@ -0,0 +1,12 @@
+package logging
+
+// Names of the contextual fields that are added to log entries, so entries of a client or Thing
+// can be found in the log regardless of the package that logs them.
+const (
+	// FieldClientID is the ID of the application or client that logs the entry
+	FieldClientID = "clientID"
+	// FieldThingID is the ID of the Thing the entry is about
+	FieldThingID = "thingID"
+	// FieldTopic is the MQTT topic the entry is about
+	FieldTopic = "topic"
+)
@@ -0,0 +1,199 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the timestamp format in the names of rotated log files
+const backupTimeFormat = "20060102T150405.000"
+
+// RotationConfig holds the log file rotation and retention settings.
+// Rotated log files are renamed to {name}-{timestamp}{ext} in the folder of the log file.
+type RotationConfig struct {
+	// MaxSizeMB is the size in MB at which the log file is rotated. Use 0 to not rotate by size.
+	MaxSizeMB int `yaml:"maxSizeMB,omitempty"`
+	// MaxAgeHours is the age in hours at which the log file is rotated. Use 0 to not rotate by age.
+	MaxAgeHours int `yaml:"maxAgeHours,omitempty"`
+	// MaxBackups is the number of rotated log files to keep. Use 0 to keep all.
+	MaxBackups int `yaml:"maxBackups,omitempty"`
+	// MaxBackupDays is the number of days to keep rotated log files. Use 0 to keep all.
+	MaxBackupDays int `yaml:"maxBackupDays,omitempty"`
+}
+
+// RotatingFile is a log file writer that rotates the file when it reaches its maximum size or age,
+// and removes rotated files that exceed the retention settings.
+type RotatingFile struct {
+	filename string
+	rotation RotationConfig
+	file     *os.File
+	// time the current file was opened
+	openTime time.Time
+	// current size of the file
+	size int64
+	// mutex for concurrent writes
+	mutex sync.Mutex
+}
+
+// Close the log file
+func (rf *RotatingFile) Close() error {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
+
+// Rotate renames the current log file to a backup, opens a new log file and removes old backups
+func (rf *RotatingFile) Rotate() error {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	return rf.rotate()
+}
+
+// Write writes to the log file and rotates it first if the write would exceed the maximum size or
+// if the file has exceeded its maximum age.
+func (rf *RotatingFile) Write(data []byte) (n int, err error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if len(data) == 0 {
+		return 0, nil
+	}
+	if rf.file == nil {
+		if err = rf.open(true); err != nil {
+			return 0, err
+		}
+	}
+	maxSize := int64(rf.rotation.MaxSizeMB) * 1024 * 1024
+	maxAge := time.Duration(rf.rotation.MaxAgeHours) * time.Hour
+	if (maxSize > 0 && rf.size > 0 && rf.size+int64(len(data)) > maxSize) ||
+		(maxAge > 0 && time.Since(rf.openTime) > maxAge) {
+		if err = rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err = rf.file.Write(data)
+	rf.size += int64(n)
+	return n, err
+}
+
+// backupName returns the name of a rotated log file for the given time
+func (rf *RotatingFile) backupName(t time.Time) string {
+	ext := path.Ext(rf.filename)
+	base := strings.TrimSuffix(rf.filename, ext)
+	return fmt.Sprintf("%s-%s%s", base, t.Format(backupTimeFormat), ext)
+}
+
+// open the log file and determine its size
+//  appendMode appends to an existing file, otherwise it is truncated
+func (rf *RotatingFile) open(appendMode bool) error {
+	flags := os.O_WRONLY | os.O_CREATE
+	if appendMode {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(rf.filename, flags, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = info.Size()
+	rf.openTime = time.Now()
+	return nil
+}
+
+// removeOldBackups removes the rotated log files that exceed the retention settings
+// Only files whose name matches the backup name of this log file are removed.
+// This is called while writing a log entry, so errors are returned instead of logged.
+// Returns the last error, after attempting to remove all old backups.
+func (rf *RotatingFile) removeOldBackups() (err error) {
+	if rf.rotation.MaxBackups <= 0 && rf.rotation.MaxBackupDays <= 0 {
+		return nil
+	}
+	folder, name := path.Split(rf.filename)
+	if folder == "" {
+		folder = "."
+	}
+	ext := path.Ext(name)
+	prefix := strings.TrimSuffix(name, ext) + "-"
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return fmt.Errorf("unable to read log folder '%s': %s", folder, err)
+	}
+	// backup names sorted from newest to oldest
+	backups := make([]string, 0)
+	for _, entry := range entries {
+		entryName := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(entryName, prefix) || !strings.HasSuffix(entryName, ext) {
+			continue
+		}
+		timestamp := strings.TrimSuffix(strings.TrimPrefix(entryName, prefix), ext)
+		if _, err2 := time.Parse(backupTimeFormat, timestamp); err2 == nil {
+			backups = append(backups, entryName)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	oldest := time.Now().Add(-time.Duration(rf.rotation.MaxBackupDays) * 24 * time.Hour)
+	for i, backup := range backups {
+		backupPath := path.Join(folder, backup)
+		remove := rf.rotation.MaxBackups > 0 && i >= rf.rotation.MaxBackups
+		if !remove && rf.rotation.MaxBackupDays > 0 {
+			info, err2 := os.Stat(backupPath)
+			remove = err2 == nil && info.ModTime().Before(oldest)
+		}
+		if remove {
+			if err2 := os.Remove(backupPath); err2 != nil {
+				err = fmt.Errorf("unable to remove old log file '%s': %s", backupPath, err2)
+			}
+		}
+	}
+	return err
+}
+
+// rotate renames the log file to a backup, opens a new log file and removes old backups
+func (rf *RotatingFile) rotate() error {
+	if rf.file != nil {
+		_ = rf.file.Close()
+		rf.file = nil
+	}
+	if err := os.Rename(rf.filename, rf.backupName(time.Now())); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err := rf.open(false)
+	// logging the error would write to this file again, so report it on stderr
+	if err2 := rf.removeOldBackups(); err2 != nil {
+		fmt.Fprintf(os.Stderr, "RotatingFile: %s\n", err2)
+	}
+	return err
+}
+
+// NewRotatingFile opens a log file that rotates by size or age
+//  filename is the log file full name including path
+//  appendMode appends to an existing log file, otherwise it is truncated
+//  rotation holds the rotation and retention settings
+func NewRotatingFile(filename string, appendMode bool, rotation RotationConfig) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		filename: filename,
+		rotation: rotation,
+	}
+	err := rf.open(appendMode)
+	if err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
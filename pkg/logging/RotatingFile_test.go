@@ -0,0 +1,147 @@
+package logging_test
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/wostzone/wost-go/pkg/logging"
+)
+
+// return the names of the rotated log files in the folder
+func getBackups(t *testing.T, folder string) []string {
+	entries, err := os.ReadDir(folder)
+	require.NoError(t, err)
+	backups := make([]string, 0)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "test-") {
+			backups = append(backups, entry.Name())
+		}
+	}
+	return backups
+}
+
+func TestRotateBySize(t *testing.T) {
+	logrus.Infof("--- TestRotateBySize ---")
+	folder := t.TempDir()
+	logFile := path.Join(folder, "test.log")
+	line := []byte(strings.Repeat("x", 1023) + "\n")
+
+	rf, err := logging.NewRotatingFile(logFile, true, logging.RotationConfig{MaxSizeMB: 1})
+	require.NoError(t, err)
+	// fill the file up to 1MB
+	for i := 0; i < 1024; i++ {
+		_, err = rf.Write(line)
+		require.NoError(t, err)
+	}
+	assert.Empty(t, getBackups(t, folder))
+
+	// the next write rotates the file
+	_, err = rf.Write([]byte("after rotation\n"))
+	require.NoError(t, err)
+	err = rf.Close()
+	assert.NoError(t, err)
+
+	backups := getBackups(t, folder)
+	require.Len(t, backups, 1)
+	assert.True(t, strings.HasSuffix(backups[0], ".log"))
+	data, err := os.ReadFile(logFile)
+	require.NoError(t, err)
+	assert.Equal(t, "after rotation\n", string(data))
+	info, err := os.Stat(path.Join(folder, backups[0]))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1024*1024), info.Size())
+
+	// writing after close reopens the file
+	_, err = rf.Write([]byte("after close\n"))
+	assert.NoError(t, err)
+	_ = rf.Close()
+}
+
+func TestRotateRetention(t *testing.T) {
+	logrus.Infof("--- TestRotateRetention ---")
+	folder := t.TempDir()
+	logFile := path.Join(folder, "test.log")
+	unrelated := path.Join(folder, "test-notabackup.log")
+	err := os.WriteFile(unrelated, []byte("keep"), 0644)
+	require.NoError(t, err)
+
+	rf, err := logging.NewRotatingFile(logFile, false, logging.RotationConfig{MaxBackups: 2})
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err = rf.Write([]byte("hello\n"))
+		require.NoError(t, err)
+		err = rf.Rotate()
+		require.NoError(t, err)
+		// backup names have millisecond resolution
+		time.Sleep(time.Millisecond * 2)
+	}
+	_ = rf.Close()
+
+	// 2 backups and the unrelated file remain
+	backups := getBackups(t, folder)
+	assert.Len(t, backups, 3)
+	assert.FileExists(t, unrelated)
+
+	// old backups are removed by age
+	oldTime := time.Now().Add(-48 * time.Hour)
+	for _, backup := range backups {
+		_ = os.Chtimes(path.Join(folder, backup), oldTime, oldTime)
+	}
+	rf, err = logging.NewRotatingFile(logFile, true, logging.RotationConfig{MaxBackupDays: 1})
+	require.NoError(t, err)
+	err = rf.Rotate()
+	assert.NoError(t, err)
+	_ = rf.Close()
+	backups = getBackups(t, folder)
+	assert.Len(t, backups, 2)
+	assert.FileExists(t, unrelated)
+}
+
+// errors while rotating a file that logrus writes to are not logged with logrus
+func TestRotateErrorWhileLogging(t *testing.T) {
+	logrus.Infof("--- TestRotateErrorWhileLogging ---")
+	folder := path.Join(t.TempDir(), "logs")
+	err := os.Mkdir(folder, 0755)
+	require.NoError(t, err)
+	rf, err := logging.NewRotatingFile(path.Join(folder, "test.log"), true,
+		logging.RotationConfig{MaxSizeMB: 1, MaxBackups: 1})
+	require.NoError(t, err)
+	defer rf.Close()
+	_, err = rf.Write([]byte(strings.Repeat("x", 1024*1024)))
+	require.NoError(t, err)
+
+	// the log folder is removed so rotation and removal of old backups fail
+	err = os.RemoveAll(folder)
+	require.NoError(t, err)
+	previousOutput := logrus.StandardLogger().Out
+	logrus.SetOutput(rf)
+	done := make(chan bool)
+	go func() {
+		logrus.Info("this rotates the log file")
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		// the output can't be restored while logrus is blocked
+		t.Fatal("logging while rotating the log file doesn't return")
+	}
+	logrus.SetOutput(previousOutput)
+}
+
+func TestRotateBadFile(t *testing.T) {
+	logrus.Infof("--- TestRotateBadFile ---")
+	_, err := logging.NewRotatingFile("/notafolder/test.log", true, logging.RotationConfig{})
+	assert.Error(t, err)
+
+	err = logging.SetLoggingConfig(logging.DefaultLoggingConfig("info", "/notafolder/test.log"))
+	assert.Error(t, err)
+	logging.SetLogging("info", "")
+}
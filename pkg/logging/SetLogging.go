@@ -4,84 +4,282 @@ package logging
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 )
 
+// Log output formats
+const (
+	// FormatJSON writes each log entry as a JSON object, for use by log collectors
+	FormatJSON = "json"
+	// FormatText writes each log entry as human readable text
+	FormatText = "text"
+)
+
+// timestampFormat is ISO8601 YYYY-MM-DDTHH:MM:SS.sss-TZ
+const timestampFormat = "2006-01-02T15:04:05.000-0700"
+
+// LoggingConfig holds the logging configuration of an application
+type LoggingConfig struct {
+	// Level is the default logging level: "error", "warning", "info" or "debug". Default is "debug".
+	Level string `yaml:"level,omitempty"`
+	// Levels holds the logging levels of specific packages by package name or import path, eg
+	// {"mqttclient": "debug"}. Packages without a level use the default level.
+	Levels map[string]string `yaml:"levels,omitempty"`
+	// Format is the output format, FormatText or FormatJSON. Default is FormatText.
+	Format string `yaml:"format,omitempty"`
+	// File is the log file full name including path. Use "" to only log to stdout.
+	File string `yaml:"file,omitempty"`
+	// Append to an existing log file instead of truncating it
+	Append bool `yaml:"append"`
+	// Rotation of the log file by size or age
+	Rotation RotationConfig `yaml:"rotation,omitempty"`
+}
+
+// levelHook writes the entries that are within the level of the package that logs them. This is used
+// when packages have their own logging level, so entries that are filtered out are never formatted.
+type levelHook struct {
+	defaultLevel  logrus.Level
+	formatter     logrus.Formatter
+	packageLevels map[string]logrus.Level
+	// out is the output of the hook, nil after the hook is replaced
+	out io.Writer
+	// mutex for concurrent writes
+	mutex sync.Mutex
+}
+
+// Levels returns all levels, as the package levels are checked when the hook fires
+func (hook *levelHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire formats and writes the entry if its level is enabled for the package that logs it
+func (hook *levelHook) Fire(entry *logrus.Entry) error {
+	level := hook.defaultLevel
+	if entry.Caller != nil {
+		importPath := callerPackage(entry.Caller.Function)
+		if pkgLevel, found := hook.packageLevels[importPath]; found {
+			level = pkgLevel
+		} else if pkgLevel, found = hook.packageLevels[path.Base(importPath)]; found {
+			level = pkgLevel
+		}
+	}
+	if entry.Level > level {
+		return nil
+	}
+	data, err := hook.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	hook.mutex.Lock()
+	defer hook.mutex.Unlock()
+	if hook.out == nil {
+		return nil
+	}
+	_, err = hook.out.Write(data)
+	return err
+}
+
+// stop the hook from writing to its output
+func (hook *levelHook) stop() {
+	hook.mutex.Lock()
+	defer hook.mutex.Unlock()
+	hook.out = nil
+}
+
+// discardFormatter is the formatter of the logger when the levelHook writes the entries
+type discardFormatter struct{}
+
+// Format returns no output
+func (discardFormatter) Format(*logrus.Entry) ([]byte, error) {
+	return nil, nil
+}
+
+// current logging output, replaced by SetLoggingConfig
+var (
+	currentFile  *RotatingFile
+	currentHook  *levelHook
+	currentMutex sync.Mutex
+)
+
+// DefaultLoggingConfig returns the default logging configuration that appends text output to the log file
+//  levelName is the default logging level: "error", "warning", "info", "debug"
+//  filename is the output log file full name including path, use "" for stdout
+func DefaultLoggingConfig(levelName string, filename string) LoggingConfig {
+	return LoggingConfig{
+		Level:  levelName,
+		Format: FormatText,
+		File:   filename,
+		Append: true,
+	}
+}
+
+// ParseLevel returns the logging level with the given name
+//  levelName is one of "error", "warning", "info" or "debug". Default is debug.
+func ParseLevel(levelName string) logrus.Level {
+	switch strings.ToLower(levelName) {
+	case "error":
+		return logrus.ErrorLevel
+	case "warn", "warning":
+		return logrus.WarnLevel
+	case "info":
+		return logrus.InfoLevel
+	}
+	return logrus.DebugLevel
+}
+
 // SetLogging sets the logging level and output file
 // This sets the timeFormat to ISO8601 YYYY-MM-DDTHH:MM:SS.sss-TZ
 // Intended for standardize logging in the hub and plugins
 //  levelName is the requested logging level: "error", "warning", "info", "debug"
 //  filename is the output log file full name including path, use "" for stderr
 func SetLogging(levelName string, filename string) {
-	loggingLevel := logrus.DebugLevel
+	_ = SetLoggingConfig(DefaultLoggingConfig(levelName, filename))
+}
+
+// SetLoggingConfig sets the logging levels, output format and output file.
+// Logging is always written to stdout, and to the log file if configured. Text is only colored when
+// logging to stdout alone, so the log file doesn't contain color codes.
+// The log file of a previous call is closed.
+//
+// Package levels are applied by a logrus hook. As logrus has a single level, a package with a more
+// verbose level than the default still enables that level for the log calls of all packages.
+//
+// Returns an error if the log file can't be opened. Logging continues to stdout.
+func SetLoggingConfig(config LoggingConfig) error {
+	var err error
+	var logFile *RotatingFile
+	currentMutex.Lock()
+	defer currentMutex.Unlock()
 	logrus.SetReportCaller(true)
 
-	if levelName != "" {
-		switch strings.ToLower(levelName) {
-		case "error":
-			loggingLevel = logrus.ErrorLevel
-		case "warn", "warning":
-			loggingLevel = logrus.WarnLevel
-		case "info":
-			loggingLevel = logrus.InfoLevel
-		case "debug":
-			loggingLevel = logrus.DebugLevel
-		}
-	}
 	var logOut io.Writer = os.Stdout
-	if filename != "" {
-		logFileHandle, err2 := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
-		if err2 != nil {
-			logrus.Errorf("SetLogging: Unable to open logfile: %s", err2)
+	if config.File != "" {
+		logFile, err = NewRotatingFile(config.File, config.Append, config.Rotation)
+		if err != nil {
+			logrus.Errorf("SetLogging: Unable to open logfile: %s", err)
 		} else {
-			logrus.Infof("SetLogging: Send '%s' logging to '%s'", levelName, filename)
-			logOut = io.MultiWriter(logOut, logFileHandle)
+			logrus.Infof("SetLogging: Send '%s' logging to '%s'", config.Level, config.File)
+			logOut = io.MultiWriter(logOut, logFile)
 		}
 	}
 
 	// Customize logging output with source file and line number
-	logrus.SetFormatter(
-		&logrus.TextFormatter{
-			DisableColors:   false,
-			ForceColors:     true,
-			PadLevelText:    true,
-			TimestampFormat: "2006-01-02T15:04:05.000-0700",
-			FullTimestamp:   true,
-			CallerPrettyfier: func(f *runtime.Frame) (string, string) {
-				funcName := f.Func.Name()
-				// remove classname
-				names := strings.Split(funcName, ".")
-				if len(names) > 1 {
-					funcName = names[len(names)-1]
-				}
-				// levelColor := 37
-				// fileInfo := fmt.Sprintf(" \x1b[%dm%s:%v\x1b[0m", levelColor, path.Base(f.File), f.Line)
-				// funcName = fmt.Sprintf("\x1b[%dm%s\x1b[0m()", levelColor, funcName)
-
-				// remove the path from the function name
-				_, funcName = path.Split(funcName)
-				funcName += "(): "
-				//funcName = fmt.Sprintf("%-30s", funcName)
-
-				fileName := path.Base(f.File)
-				//if len(fileName) > 15 {
-				//	fileName = fileName[:10] + "..."
-				//}
-				fileInfo := fmt.Sprintf(" %s:%v", fileName, f.Line)
-				fileInfo = fmt.Sprintf("%s", fileInfo)
-				return funcName, fileInfo
-			},
-		})
-	logrus.SetOutput(logOut)
+	var formatter logrus.Formatter
+	if strings.ToLower(config.Format) == FormatJSON {
+		formatter = &logrus.JSONFormatter{
+			TimestampFormat:  timestampFormat,
+			CallerPrettyfier: prettyCaller,
+		}
+	} else {
+		formatter = &logrus.TextFormatter{
+			DisableColors:    logOut != os.Stdout,
+			ForceColors:      logOut == os.Stdout,
+			PadLevelText:     true,
+			TimestampFormat:  timestampFormat,
+			FullTimestamp:    true,
+			CallerPrettyfier: prettyCaller,
+		}
+	}
+
+	// logrus filters on the most verbose level, the hook filters the package levels
+	defaultLevel := ParseLevel(config.Level)
+	loggingLevel := defaultLevel
+	var hook *levelHook
+	if len(config.Levels) > 0 {
+		packageLevels := make(map[string]logrus.Level)
+		for pkgName, levelName := range config.Levels {
+			pkgLevel := ParseLevel(levelName)
+			packageLevels[pkgName] = pkgLevel
+			if pkgLevel > loggingLevel {
+				loggingLevel = pkgLevel
+			}
+		}
+		hook = &levelHook{
+			defaultLevel:  defaultLevel,
+			formatter:     formatter,
+			packageLevels: packageLevels,
+			out:           logOut,
+		}
+	}
+	replaceHook(hook)
+	if hook != nil {
+		logrus.SetFormatter(discardFormatter{})
+		logrus.SetOutput(ioutil.Discard)
+	} else {
+		logrus.SetFormatter(formatter)
+		logrus.SetOutput(logOut)
+	}
 	logrus.SetLevel(loggingLevel)
 
-	// var hook = ContextHook{}
-	// logrus.AddHook(hook)
+	// the previous log file is no longer written to
+	if currentFile != nil {
+		_ = currentFile.Close()
+	}
+	currentFile = logFile
+	return err
+}
+
+// replaceHook replaces the level hook of the previous configuration, keeping the hooks of the application.
+// The previous hook is stopped so it no longer writes to the previous log file.
+//  hook is the new level hook, nil to only remove the previous hook
+func replaceHook(hook *levelHook) {
+	hooks := make(logrus.LevelHooks)
+	for level, levelHooks := range logrus.StandardLogger().Hooks {
+		for _, h := range levelHooks {
+			if h != logrus.Hook(currentHook) {
+				hooks[level] = append(hooks[level], h)
+			}
+		}
+	}
+	if hook != nil {
+		hooks.Add(hook)
+	}
+	logrus.StandardLogger().ReplaceHooks(hooks)
+	if currentHook != nil {
+		currentHook.stop()
+	}
+	currentHook = hook
+}
+
+// callerPackage returns the import path of the package of a function
+//  function is the full function name, eg github.com/wostzone/wost-go/pkg/mqttclient.(*MqttClient).Publish
+func callerPackage(function string) string {
+	slash := strings.LastIndex(function, "/")
+	dot := strings.Index(function[slash+1:], ".")
+	if dot < 0 {
+		return function
+	}
+	return function[:slash+1+dot]
+}
+
+// prettyCaller returns the function name and file:line of the caller of a log entry
+func prettyCaller(f *runtime.Frame) (string, string) {
+	funcName := f.Func.Name()
+	// remove classname
+	names := strings.Split(funcName, ".")
+	if len(names) > 1 {
+		funcName = names[len(names)-1]
+	}
+	// levelColor := 37
+	// fileInfo := fmt.Sprintf(" \x1b[%dm%s:%v\x1b[0m", levelColor, path.Base(f.File), f.Line)
+	// funcName = fmt.Sprintf("\x1b[%dm%s\x1b[0m()", levelColor, funcName)
+
+	// remove the path from the function name
+	_, funcName = path.Split(funcName)
+	funcName += "(): "
+	//funcName = fmt.Sprintf("%-30s", funcName)
 
-	// logrus.SetReportCaller(false) // publisher logging includes caller and file:line#
+	fileName := path.Base(f.File)
+	//if len(fileName) > 15 {
+	//	fileName = fileName[:10] + "..."
+	//}
+	fileInfo := fmt.Sprintf(" %s:%v", fileName, f.Line)
+	return funcName, fileInfo
 }
@@ -1,11 +1,17 @@
 package logging_test
 
 import (
-	"github.com/wostzone/wost-go/pkg/logging"
+	"encoding/json"
 	"os"
+	"path"
+	"strings"
 	"testing"
 
 	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/wostzone/wost-go/pkg/logging"
 )
 
 func TestLogging(t *testing.T) {
@@ -25,3 +31,138 @@ func TestLogging(t *testing.T) {
 	//assert.FileExists(t, logFile)
 	//os.Remove(logFile)
 }
+
+func TestLoggingAppend(t *testing.T) {
+	logrus.Infof("--- TestLoggingAppend ---")
+	logFile := path.Join(t.TempDir(), "TestLoggingAppend.log")
+
+	logging.SetLogging("info", logFile)
+	logrus.Info("Hello first")
+	logging.SetLogging("info", logFile)
+	logrus.Info("Hello second")
+	logging.SetLogging("info", "")
+
+	data, err := os.ReadFile(logFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "Hello first")
+	assert.Contains(t, string(data), "Hello second")
+	// the log file has no color codes
+	assert.NotContains(t, string(data), "\x1b[")
+
+	// without append the file is truncated
+	config := logging.DefaultLoggingConfig("info", logFile)
+	config.Append = false
+	err = logging.SetLoggingConfig(config)
+	assert.NoError(t, err)
+	logrus.Info("Hello third")
+	logging.SetLogging("info", "")
+
+	data, err = os.ReadFile(logFile)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "Hello first")
+	assert.Contains(t, string(data), "Hello third")
+}
+
+func TestLoggingJSON(t *testing.T) {
+	logrus.Infof("--- TestLoggingJSON ---")
+	logFile := path.Join(t.TempDir(), "TestLoggingJSON.log")
+	config := logging.DefaultLoggingConfig("info", logFile)
+	config.Format = logging.FormatJSON
+	err := logging.SetLoggingConfig(config)
+	require.NoError(t, err)
+
+	logrus.WithField(logging.FieldThingID, "thing1").Info("Hello json")
+	logging.SetLogging("info", "")
+
+	data, err := os.ReadFile(logFile)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	entry := make(map[string]interface{})
+	err = json.Unmarshal([]byte(lines[len(lines)-1]), &entry)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello json", entry["msg"])
+	assert.Equal(t, "info", entry["level"])
+	assert.Equal(t, "thing1", entry[logging.FieldThingID])
+	assert.Contains(t, entry["file"], "SetLogging_test.go")
+}
+
+func TestLoggingPackageLevels(t *testing.T) {
+	logrus.Infof("--- TestLoggingPackageLevels ---")
+	logFile := path.Join(t.TempDir(), "TestLoggingPackageLevels.log")
+
+	// debug for this package only
+	config := logging.DefaultLoggingConfig("error", logFile)
+	config.Levels = map[string]string{"logging_test": "debug"}
+	err := logging.SetLoggingConfig(config)
+	require.NoError(t, err)
+	logrus.Debug("Hello package debug")
+
+	// debug for another package does not apply to this package
+	config.Level = "warning"
+	config.Levels = map[string]string{"mqttclient": "debug"}
+	err = logging.SetLoggingConfig(config)
+	require.NoError(t, err)
+	assert.Equal(t, logrus.DebugLevel, logrus.GetLevel())
+	logrus.Info("Hello other info")
+	logrus.Warning("Hello other warning")
+
+	// the package level also works with the import path
+	config.Level = "error"
+	config.Levels = map[string]string{"github.com/wostzone/wost-go/pkg/logging_test": "info"}
+	err = logging.SetLoggingConfig(config)
+	require.NoError(t, err)
+	logrus.Info("Hello path info")
+	logging.SetLogging("info", "")
+
+	data, err := os.ReadFile(logFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "Hello package debug")
+	assert.NotContains(t, string(data), "Hello other info")
+	assert.Contains(t, string(data), "Hello other warning")
+	assert.Contains(t, string(data), "Hello path info")
+}
+
+// countHook counts the entries that are logged
+type countHook struct {
+	count int
+}
+
+func (hook *countHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (hook *countHook) Fire(*logrus.Entry) error {
+	hook.count++
+	return nil
+}
+
+func TestLoggingReconfigure(t *testing.T) {
+	logrus.Infof("--- TestLoggingReconfigure ---")
+	logFile := path.Join(t.TempDir(), "TestLoggingReconfigure.log")
+	hook := &countHook{}
+	logrus.AddHook(hook)
+
+	// repeated configuration closes the previous log file
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("open files can't be counted on this system")
+	}
+	config := logging.DefaultLoggingConfig("info", logFile)
+	config.Levels = map[string]string{"mqttclient": "debug"}
+	for i := 0; i < 10; i++ {
+		err = logging.SetLoggingConfig(config)
+		require.NoError(t, err)
+	}
+	fds2, _ := os.ReadDir("/proc/self/fd")
+	assert.LessOrEqual(t, len(fds2), len(fds)+1)
+
+	// the hooks of the application are kept and the level hook is replaced
+	hook.count = 0
+	logrus.Info("Hello once")
+	logging.SetLogging("info", "")
+	assert.Equal(t, 1, hook.count)
+	data, err := os.ReadFile(logFile)
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(data), "Hello once"))
+	logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+}
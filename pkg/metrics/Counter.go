@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"bufio"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// counterSeries is the value of a counter for a combination of label values
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+// Counter is a metric whose value only increases, such as the number of messages sent.
+// A nil counter ignores all updates, so metrics can be disabled by not creating them.
+type Counter struct {
+	help       string
+	labelNames []string
+	name       string
+	// series by key of their label values
+	series map[string]*counterSeries
+	// mutex for concurrent access to the series
+	mutex sync.RWMutex
+}
+
+// Add adds a value to the counter with the given label values
+//  value to add. Negative values are ignored as counters can't decrease.
+//  labelValues of the series, in the order of the counter's label names
+func (counter *Counter) Add(value float64, labelValues ...string) {
+	if counter == nil {
+		return
+	} else if value < 0 {
+		logrus.Errorf("Add: Counter '%s' can't decrease. Ignored.", counter.name)
+		return
+	} else if len(labelValues) != len(counter.labelNames) {
+		logrus.Errorf("Add: Counter '%s' has labels %v but %d values are provided. Ignored.",
+			counter.name, counter.labelNames, len(labelValues))
+		return
+	}
+	key := seriesKey(labelValues)
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	series, found := counter.series[key]
+	if !found {
+		series = &counterSeries{labelValues: append([]string(nil), labelValues...)}
+		counter.series[key] = series
+	}
+	series.value += value
+}
+
+// Get returns the value of the counter with the given label values, or 0 if it wasn't counted
+func (counter *Counter) Get(labelValues ...string) float64 {
+	if counter == nil {
+		return 0
+	}
+	counter.mutex.RLock()
+	defer counter.mutex.RUnlock()
+	if series, found := counter.series[seriesKey(labelValues)]; found {
+		return series.value
+	}
+	return 0
+}
+
+// Inc increments the counter with the given label values by 1
+func (counter *Counter) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+// writeText writes the counter in the Prometheus text format, with its series sorted by label values
+func (counter *Counter) writeText(w *bufio.Writer) {
+	counter.mutex.RLock()
+	defer counter.mutex.RUnlock()
+	writeHeader(w, counter.name, counter.help, "counter")
+	keys := make([]string, 0, len(counter.series))
+	for key := range counter.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := counter.series[key]
+		_, _ = w.WriteString(counter.name + formatLabels(counter.labelNames, series.labelValues) +
+			" " + formatValue(series.value) + "\n")
+	}
+}
+
+// newCounter creates a counter that is not registered
+func newCounter(name string, help string, labelNames []string) *Counter {
+	counter := &Counter{
+		help:       help,
+		labelNames: append([]string(nil), labelNames...),
+		name:       name,
+		series:     make(map[string]*counterSeries),
+	}
+	return counter
+}
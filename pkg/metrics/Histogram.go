@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"bufio"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultBuckets are the upper bounds of histogram buckets suitable for durations in seconds, from 5 msec to 10 sec
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogramSeries holds the observations of a histogram for a combination of label values
+type histogramSeries struct {
+	// number of observations in each bucket, not cumulative. The last bucket is +Inf.
+	bucketCounts []uint64
+	count        uint64
+	labelValues  []string
+	sum          float64
+}
+
+// Histogram is a metric that counts observations, such as request durations, in buckets.
+// A nil histogram ignores all observations, so metrics can be disabled by not creating them.
+type Histogram struct {
+	// upper bounds of the buckets in increasing order, without +Inf
+	buckets    []float64
+	help       string
+	labelNames []string
+	name       string
+	// series by key of their label values
+	series map[string]*histogramSeries
+	// mutex for concurrent access to the series
+	mutex sync.RWMutex
+}
+
+// GetCount returns the number of observations with the given label values
+func (histogram *Histogram) GetCount(labelValues ...string) uint64 {
+	if histogram == nil {
+		return 0
+	}
+	histogram.mutex.RLock()
+	defer histogram.mutex.RUnlock()
+	if series, found := histogram.series[seriesKey(labelValues)]; found {
+		return series.count
+	}
+	return 0
+}
+
+// GetSum returns the sum of the observations with the given label values
+func (histogram *Histogram) GetSum(labelValues ...string) float64 {
+	if histogram == nil {
+		return 0
+	}
+	histogram.mutex.RLock()
+	defer histogram.mutex.RUnlock()
+	if series, found := histogram.series[seriesKey(labelValues)]; found {
+		return series.sum
+	}
+	return 0
+}
+
+// Observe adds an observation with the given label values
+//  value of the observation, eg a duration in seconds
+//  labelValues of the series, in the order of the histogram's label names
+func (histogram *Histogram) Observe(value float64, labelValues ...string) {
+	if histogram == nil {
+		return
+	} else if len(labelValues) != len(histogram.labelNames) {
+		logrus.Errorf("Observe: Histogram '%s' has labels %v but %d values are provided. Ignored.",
+			histogram.name, histogram.labelNames, len(labelValues))
+		return
+	}
+	key := seriesKey(labelValues)
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	series, found := histogram.series[key]
+	if !found {
+		series = &histogramSeries{
+			bucketCounts: make([]uint64, len(histogram.buckets)+1),
+			labelValues:  append([]string(nil), labelValues...),
+		}
+		histogram.series[key] = series
+	}
+	// the index of the first bucket whose upper bound is not less than the value, or +Inf
+	index := sort.SearchFloat64s(histogram.buckets, value)
+	series.bucketCounts[index]++
+	series.count++
+	series.sum += value
+}
+
+// ObserveSince adds the duration in seconds since the given start time as observation
+func (histogram *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	histogram.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// writeText writes the histogram in the Prometheus text format, with cumulative bucket counts
+func (histogram *Histogram) writeText(w *bufio.Writer) {
+	histogram.mutex.RLock()
+	defer histogram.mutex.RUnlock()
+	writeHeader(w, histogram.name, histogram.help, "histogram")
+	keys := make([]string, 0, len(histogram.series))
+	for key := range histogram.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	bucketLabels := append(append([]string(nil), histogram.labelNames...), "le")
+	for _, key := range keys {
+		series := histogram.series[key]
+		bucketValues := append(append([]string(nil), series.labelValues...), "")
+		cumulative := uint64(0)
+		for i, count := range series.bucketCounts {
+			cumulative += count
+			upperBound := math.Inf(+1)
+			if i < len(histogram.buckets) {
+				upperBound = histogram.buckets[i]
+			}
+			bucketValues[len(bucketValues)-1] = formatValue(upperBound)
+			_, _ = w.WriteString(histogram.name + "_bucket" + formatLabels(bucketLabels, bucketValues) +
+				" " + formatValue(float64(cumulative)) + "\n")
+		}
+		labels := formatLabels(histogram.labelNames, series.labelValues)
+		_, _ = w.WriteString(histogram.name + "_sum" + labels + " " + formatValue(series.sum) + "\n")
+		_, _ = w.WriteString(histogram.name + "_count" + labels + " " + formatValue(float64(series.count)) + "\n")
+	}
+}
+
+// newHistogram creates a histogram that is not registered
+//  buckets are the upper bounds of the buckets, nil for DefaultBuckets
+func newHistogram(name string, help string, buckets []float64, labelNames []string) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	sortedBuckets := make([]float64, 0, len(buckets))
+	for _, upperBound := range buckets {
+		if !math.IsInf(upperBound, +1) {
+			sortedBuckets = append(sortedBuckets, upperBound)
+		}
+	}
+	sort.Float64s(sortedBuckets)
+	histogram := &Histogram{
+		buckets:    sortedBuckets,
+		help:       help,
+		labelNames: append([]string(nil), labelNames...),
+		name:       name,
+		series:     make(map[string]*histogramSeries),
+	}
+	return histogram
+}
@@ -0,0 +1,193 @@
+// Package metrics with counters and histograms that are exposed in the Prometheus text format
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultMetricsPath is the path on which services serve their metrics
+const DefaultMetricsPath = "/metrics"
+
+// TextContentType is the content type of the Prometheus text exposition format
+const TextContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultRegistry is the registry used by the clients, servers and factories of this library,
+// unless configured otherwise.
+var DefaultRegistry = NewRegistry()
+
+// validName is the pattern of valid metric and label names
+var validName = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
+
+// metric is implemented by the metric types of the registry
+type metric interface {
+	// writeText writes the metric in the Prometheus text format
+	writeText(w *bufio.Writer)
+}
+
+// Registry holds the metrics of an application and serves them in the Prometheus text format.
+//
+// Metrics are identified by their name. Creating a metric with the name of an existing metric of the same
+// type returns the existing metric, so multiple instances of a client share the metric and are distinguished
+// by their label values.
+type Registry struct {
+	// metrics by name
+	metrics map[string]metric
+	// mutex for concurrent access to the metrics
+	mutex sync.RWMutex
+}
+
+// NewCounter returns the counter with the given name, creating it if it doesn't exist.
+// By convention counter names end with '_total'.
+//  name of the counter, eg "wost_mqtt_publish_total"
+//  help text that describes the counter
+//  labelNames are the names of the labels whose values are provided when counting
+func (registry *Registry) NewCounter(name string, help string, labelNames ...string) *Counter {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if existing, found := registry.metrics[name]; found {
+		if counter, isCounter := existing.(*Counter); isCounter {
+			return counter
+		}
+		logrus.Errorf("NewCounter: Metric '%s' is already registered with another type. Not registered.", name)
+		return newCounter(name, help, labelNames)
+	}
+	counter := newCounter(name, help, labelNames)
+	if isValidMetric(name, labelNames) {
+		registry.metrics[name] = counter
+	}
+	return counter
+}
+
+// NewHistogram returns the histogram with the given name, creating it if it doesn't exist.
+//  name of the histogram, eg "wost_tlsserver_request_duration_seconds"
+//  help text that describes the histogram
+//  buckets are the upper bounds of the buckets, nil for DefaultBuckets
+//  labelNames are the names of the labels whose values are provided when observing
+func (registry *Registry) NewHistogram(
+	name string, help string, buckets []float64, labelNames ...string) *Histogram {
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if existing, found := registry.metrics[name]; found {
+		if histogram, isHistogram := existing.(*Histogram); isHistogram {
+			return histogram
+		}
+		logrus.Errorf("NewHistogram: Metric '%s' is already registered with another type. Not registered.", name)
+		return newHistogram(name, help, buckets, labelNames)
+	}
+	histogram := newHistogram(name, help, buckets, labelNames)
+	if isValidMetric(name, labelNames) {
+		registry.metrics[name] = histogram
+	}
+	return histogram
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format
+// This can be used as handler of TLSServer.AddHandlerNoAuth, or with TLSServer.AddMetricsHandler.
+func (registry *Registry) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", TextContentType)
+	if err := registry.WriteText(resp); err != nil {
+		logrus.Warningf("ServeHTTP: Writing the metrics to %s failed: %s", req.RemoteAddr, err)
+	}
+}
+
+// WriteText writes all metrics in the Prometheus text format, sorted by name
+func (registry *Registry) WriteText(w io.Writer) error {
+	registry.mutex.RLock()
+	names := make([]string, 0, len(registry.metrics))
+	for name := range registry.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]metric, 0, len(names))
+	for _, name := range names {
+		metrics = append(metrics, registry.metrics[name])
+	}
+	registry.mutex.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.writeText(bw)
+	}
+	return bw.Flush()
+}
+
+// NewRegistry creates an empty metrics registry
+// Most applications use the DefaultRegistry.
+func NewRegistry() *Registry {
+	registry := &Registry{
+		metrics: make(map[string]metric),
+	}
+	return registry
+}
+
+// formatLabels returns the labels in the text format, eg {method="GET",route="/things"}
+// Returns "" if there are no labels.
+func formatLabels(labelNames []string, labelValues []string) string {
+	if len(labelNames) == 0 {
+		return ""
+	}
+	parts := make([]string, len(labelNames))
+	for i, labelName := range labelNames {
+		parts[i] = labelName + "=\"" + escapeLabelValue(labelValues[i]) + "\""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// formatValue returns a sample value in the text format
+func formatValue(value float64) string {
+	if math.IsInf(value, +1) {
+		return "+Inf"
+	} else if math.IsInf(value, -1) {
+		return "-Inf"
+	} else if math.IsNaN(value) {
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// escapeHelp escapes backslash and newline in help text
+func escapeHelp(help string) string {
+	return strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(help)
+}
+
+// escapeLabelValue escapes backslash, double quote and newline in label values
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(value)
+}
+
+// isValidMetric checks the metric and label names and logs an error if they are invalid
+func isValidMetric(name string, labelNames []string) bool {
+	if !validName.MatchString(name) {
+		logrus.Errorf("Metric name '%s' is invalid. Not registered.", name)
+		return false
+	}
+	for _, labelName := range labelNames {
+		if !validName.MatchString(labelName) || strings.HasPrefix(labelName, "__") || labelName == "le" {
+			logrus.Errorf("Label name '%s' of metric '%s' is invalid. Not registered.", labelName, name)
+			return false
+		}
+	}
+	return true
+}
+
+// seriesKey returns the key of the series with the given label values
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric
+func writeHeader(w *bufio.Writer, name string, help string, metricType string) {
+	_, _ = w.WriteString("# HELP " + name + " " + escapeHelp(help) + "\n")
+	_, _ = w.WriteString("# TYPE " + name + " " + metricType + "\n")
+}
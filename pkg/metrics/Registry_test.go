@@ -0,0 +1,96 @@
+package metrics_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/wostzone/wost-go/pkg/metrics"
+)
+
+func TestCounter(t *testing.T) {
+	logrus.Infof("--- TestCounter ---")
+	registry := metrics.NewRegistry()
+	counter := registry.NewCounter("test_messages_total", "Number of messages", "thing", "type")
+	counter.Inc("thing1", "event")
+	counter.Add(2, "thing1", "event")
+	counter.Inc("thing2", "action")
+	assert.Equal(t, 3.0, counter.Get("thing1", "event"))
+	assert.Equal(t, 1.0, counter.Get("thing2", "action"))
+	assert.Equal(t, 0.0, counter.Get("thing3", "action"))
+
+	// invalid updates are ignored
+	counter.Add(-1, "thing1", "event")
+	counter.Inc("thing1")
+	assert.Equal(t, 3.0, counter.Get("thing1", "event"))
+
+	// the existing counter is returned for the same name
+	counter2 := registry.NewCounter("test_messages_total", "Number of messages", "thing", "type")
+	assert.Same(t, counter, counter2)
+
+	// nil counters are disabled
+	var noCounter *metrics.Counter
+	noCounter.Inc()
+	assert.Equal(t, 0.0, noCounter.Get())
+}
+
+func TestHistogram(t *testing.T) {
+	logrus.Infof("--- TestHistogram ---")
+	registry := metrics.NewRegistry()
+	histogram := registry.NewHistogram("test_duration_seconds", "Duration", []float64{1, 0.1}, "route")
+	histogram.Observe(0.05, "/a")
+	histogram.Observe(0.1, "/a")
+	histogram.Observe(0.5, "/a")
+	histogram.Observe(5, "/a")
+	assert.Equal(t, uint64(4), histogram.GetCount("/a"))
+	assert.Equal(t, 5.65, histogram.GetSum("/a"))
+	assert.Equal(t, uint64(0), histogram.GetCount("/b"))
+
+	// a histogram can't replace a counter
+	counter := registry.NewCounter("test_total", "Counter")
+	histogram2 := registry.NewHistogram("test_total", "Histogram", nil)
+	assert.NotNil(t, histogram2)
+	counter.Inc()
+
+	buf := bytes.Buffer{}
+	err := registry.WriteText(&buf)
+	require.NoError(t, err)
+	expected := `# HELP test_duration_seconds Duration
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="/a",le="0.1"} 2
+test_duration_seconds_bucket{route="/a",le="1"} 3
+test_duration_seconds_bucket{route="/a",le="+Inf"} 4
+test_duration_seconds_sum{route="/a"} 5.65
+test_duration_seconds_count{route="/a"} 4
+# HELP test_total Counter
+# TYPE test_total counter
+test_total 1
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestServeMetrics(t *testing.T) {
+	logrus.Infof("--- TestServeMetrics ---")
+	registry := metrics.NewRegistry()
+	counter := registry.NewCounter("test_requests_total", "Number of\nrequests", "path")
+	counter.Inc("/say \"hello\"\n")
+	// invalid names are not registered
+	registry.NewCounter("test-invalid", "Invalid name").Inc()
+	registry.NewCounter("test_invalid_label", "Invalid label", "le").Inc("1")
+
+	resp := httptest.NewRecorder()
+	registry.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, metrics.DefaultMetricsPath, nil))
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, metrics.TextContentType, resp.Header().Get("Content-Type"))
+	expected := `# HELP test_requests_total Number of\nrequests
+# TYPE test_requests_total counter
+test_requests_total{path="/say \"hello\"\n"} 1
+`
+	assert.Equal(t, expected, string(body))
+}
@@ -0,0 +1,34 @@
+package mqttclient
+
+// ConnectionStatus contains the status of the protocol bindings used in the consumed and exposed thing factories
+type ConnectionStatus struct {
+	// Account that is connected
+	//Account accounts.AccountRecord
+
+	// AccessToken to authenticate with
+	AccessToken string
+
+	// Authenticated indicates the access token is valid
+	Authenticated bool
+
+	// AuthStatus with a text description of authentication result
+	AuthStatus string
+
+	// Connected indicates that a message bus is connected
+	Connected bool
+
+	// DirectoryRead indicates the TDs are obtained from the directory
+	DirectoryRead bool
+
+	// PasswordNeeded indicates the tokens can't be refreshed and a login with password is needed
+	PasswordNeeded bool
+
+	// LastError holds the last authentication or connection error, or nil
+	LastError error
+
+	// ReconnectAttempts is the number of attempts to connect to the message bus since the connection was lost
+	ReconnectAttempts int
+
+	// StatusMessage with a human description of the connection status
+	StatusMessage string
+}
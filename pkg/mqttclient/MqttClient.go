@@ -7,12 +7,15 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"reflect"
 	"sync"
 	"time"
 
 	pahomqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/sirupsen/logrus"
+
+	"github.com/wostzone/wost-go/pkg/certsclient"
+	"github.com/wostzone/wost-go/pkg/logging"
+	"github.com/wostzone/wost-go/pkg/metrics"
 )
 
 // DefaultTimeoutSec constant with connection, reconnection and disconnection timeouts
@@ -21,33 +24,70 @@ const DefaultTimeoutSec = 3
 // DefaultKeepAliveSec time a keep alive ping is sent. This is the max wait time to discover a broken connection
 const DefaultKeepAliveSec = 10
 
+// DefaultQos is the QoS used for publishing and subscribing unless specified otherwise.
+// QoS 1 guarantees delivery at least once.
+const DefaultQos = 1
+
+// PublishOptions with the options for publishing a message
+type PublishOptions struct {
+	// QoS is the quality of service to publish with: 0 at most once, 1 at least once, 2 exactly once
+	QoS byte
+	// Retain asks the broker to keep the message as the latest value for new subscribers
+	Retain bool
+	// Expiry is the time a message remains valid when queued while offline. Expired messages are
+	// discarded instead of published after reconnecting. 0 to never expire.
+	Expiry time.Duration
+}
+
+// ConnectionState holds the state of the connection with the broker
+type ConnectionState struct {
+	// Connected is true while the connection with the broker is established
+	Connected bool
+	// LastError holds the reason of the last connection failure or loss, or nil
+	LastError error
+	// ReconnectAttempts is the number of connection attempts since the connection was lost or first started
+	ReconnectAttempts int
+}
+
 // MqttClient client wrapper around pahoClient
 // This addresses problems with reconnect and auto resubscribe while using clean session
 type MqttClient struct {
 	// clientID string // unique ID of the client (used for logging)
 	hostPort string // host:port of server to connect to
-	pubQos   byte
-	subQos   byte
-	timeout  int // connection timeout in seconds before giving up.
+	pubQos   byte   // default QoS for publishing
+	subQos   byte   // default QoS for subscribing
+	timeout  int    // connection timeout in seconds before giving up.
 	//
 	appID     string // Application ID used in MQTT client ID
 	isRunning bool   // listen for messages while running
 	// json formatting indentation for PublishObject, if set
-	jsonIndent          string
-	pahoClient          pahomqtt.Client               // Paho MQTT Client
-	subscriptions       map[string]*TopicSubscription // map of TopicSubscription for re-subscribing after reconnect
-	tlsVerifyServerCert bool                          // verify the server certificate, this requires a Root CA signed cert
-	caCert              *x509.Certificate             // CA certificate of the server
-	updateMutex         *sync.Mutex                   // mutex for async updating of subscriptions
-}
-
-// TopicSubscription holds subscriptions to restore after disconnect
-type TopicSubscription struct {
-	topic     string
-	handler   func(address string, message []byte)
-	handlerID reflect.Value
-	// token     pahomqtt.Token // for debugging
-	// client *MqttClient //
+	jsonIndent    string
+	pahoClient    pahomqtt.Client // Paho MQTT Client
+	router        *TopicRouter    // subscription handlers for dispatching and re-subscribing after reconnect
+	brokerFilters map[string]byte // topic filters and QoS currently subscribed to with the broker
+	publishQueue  *PublishQueue   // optional queue for messages published while offline
+	// last will message published by the broker when the connection is lost, if set
+	lastWillTopic   string
+	lastWillMessage []byte
+	lastWillRetain  bool
+	// connection state and handler to notify of changes
+	connectionState         ConnectionState
+	connectionChangeHandler func(state ConnectionState)
+	tlsVerifyServerCert     bool              // verify the server certificate, this requires a Root CA signed cert
+	caCert                  *x509.Certificate // CA certificate of the server
+	updateMutex             *sync.Mutex       // mutex for async updating of subscriptions
+	// client certificate used for authentication when connecting or reconnecting
+	clientCert      *tls.Certificate
+	clientCertMutex sync.RWMutex
+	// optional provider of the client certificate, used instead of clientCert when set
+	certProvider *certsclient.CertProvider
+	// access token used as password when connecting or reconnecting
+	accessToken      string
+	accessTokenMutex sync.RWMutex
+	// metrics of publishing and receiving messages, nil when disabled
+	metrics *clientMetrics
+	// logger with the appID as clientID field
+	logger *logrus.Entry
 }
 
 // connect to the MQTT broker.
@@ -66,7 +106,7 @@ type TopicSubscription struct {
 //  clientCert  to authenticate with client certificate. Use nil to authenticate with username/access token
 func (mqttClient *MqttClient) connect(
 	hostPort string, username string, accessToken string, clientCert *tls.Certificate) error {
-	logrus.Infof("username='%s', has clientCert '%v'", username, clientCert != nil)
+	mqttClient.logger.Infof("username='%s', has clientCert '%v'", username, clientCert != nil)
 
 	// ClientID defaults to hostname-millisecondsSinceEpoc
 	mqttClient.hostPort = hostPort
@@ -95,20 +135,32 @@ func (mqttClient *MqttClient) connect(
 	opts.SetCleanSession(true)
 	opts.SetKeepAlive(DefaultKeepAliveSec * time.Second) // pings to detect a disconnect. Use same as reconnect interval
 	//opts.SetKeepAlive(60) // keepalive causes deadlock in v1.1.0. See github issue #126
+	// Subscriptions are made without a paho callback so all messages are passed to the local router
+	opts.SetDefaultPublishHandler(mqttClient.onMessage)
 
 	opts.SetOnConnectHandler(func(client pahomqtt.Client) {
-		logrus.Warningf("onConnect: Connected to server at %s. Connected=%v. ClientId=%s",
+		mqttClient.logger.Warningf("onConnect: Connected to server at %s. Connected=%v. ClientId=%s",
 			brokerURL, client.IsConnected(), clientID)
+		mqttClient.updateConnectionState(true, nil, false)
 		// Subscribe to address already registered by the app on connect or reconnect
 		mqttClient.resubscribe()
+		// Publish the messages that were queued while offline. Don't block the paho handler.
+		go mqttClient.flushQueue()
 	})
 	opts.SetConnectionLostHandler(func(client pahomqtt.Client, err error) {
-		logrus.Warningf("onConnectionLost: Disconnected from server %s. Error %s, ClientId=%s",
+		mqttClient.logger.Warningf("onConnectionLost: Disconnected from server %s. Error %s, ClientId=%s",
 			brokerURL, err, clientID)
+		mqttClient.updateConnectionState(false, err, false)
+	})
+	opts.SetReconnectingHandler(func(client pahomqtt.Client, options *pahomqtt.ClientOptions) {
+		mqttClient.logger.Infof("onReconnecting: Reconnecting to server %s. ClientId=%s", brokerURL, clientID)
+		mqttClient.countReconnect()
+		mqttClient.updateConnectionState(false, nil, true)
 	})
-	// if lastWillAddress != "" {
-	// 	opts.SetWill(lastWillAddress, lastWillValue, 1, false)
-	// }
+	if mqttClient.lastWillTopic != "" {
+		opts.SetBinaryWill(mqttClient.lastWillTopic, mqttClient.lastWillMessage,
+			mqttClient.pubQos, mqttClient.lastWillRetain)
+	}
 	// Use TLS if a CA certificate is given
 	var rootCA *x509.CertPool
 	if mqttClient.caCert != nil {
@@ -128,17 +180,32 @@ func (mqttClient *MqttClient) connect(
 		ServerName: "", // hostname on the server certificate. How to get this?
 	}
 	// auth with client certificate and/or username/accessToken
+	// the certificate is obtained on each (re)connect so that a renewed certificate is used
+	mqttClient.UpdateClientCert(clientCert)
 	if clientCert != nil {
-		tlsConfig.Certificates = []tls.Certificate{*clientCert}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			mqttClient.clientCertMutex.RLock()
+			defer mqttClient.clientCertMutex.RUnlock()
+			if mqttClient.certProvider != nil {
+				return mqttClient.certProvider.GetCert(), nil
+			}
+			return mqttClient.clientCert, nil
+		}
 	}
 	//
 	opts.Username = username
+	// the access token is obtained on each (re)connect so that a refreshed token is used
+	mqttClient.UpdateAccessToken(accessToken)
 	if accessToken != "" {
-		opts.Password = accessToken
+		opts.SetCredentialsProvider(func() (string, string) {
+			mqttClient.accessTokenMutex.RLock()
+			defer mqttClient.accessTokenMutex.RUnlock()
+			return username, mqttClient.accessToken
+		})
 	}
 	opts.SetTLSConfig(tlsConfig)
 
-	logrus.Infof("Connecting to MQTT server: %s with clientID=%s, username=%s, client-certificate: %v",
+	mqttClient.logger.Infof("Connecting to MQTT server: %s with clientID=%s, username=%s, client-certificate: %v",
 		brokerURL, clientID, username, clientCert != nil)
 
 	// FIXME: PahoMqtt disconnects when sending a lot of messages, like on startup of some adapters.
@@ -161,9 +228,10 @@ func (mqttClient *MqttClient) connect(
 		if err == nil {
 			break
 		}
+		mqttClient.updateConnectionState(false, err, true)
 		retryDuration++
 
-		logrus.Errorf("Connecting to broker on %s failed: %s. retrying in %d seconds.",
+		mqttClient.logger.Errorf("Connecting to broker on %s failed: %s. retrying in %d seconds.",
 			brokerURL, token.Error(), retryDelaySec)
 		sleepDuration := time.Duration(retryDelaySec)
 		retryDuration += int(sleepDuration)
@@ -193,17 +261,63 @@ func (mqttClient *MqttClient) ConnectWithAccessToken(hostPort string, userName s
 //  clientCert client TLS certificate to authenticate the client with the broker. This certificate
 //   must be signed by the CA of the broker, so that the broker can authenticate the client.
 func (mqttClient *MqttClient) ConnectWithClientCert(hostPort string, clientCert *tls.Certificate) error {
-	logrus.Infof("appID='%s'", mqttClient.appID)
+	mqttClient.logger.Infof("appID='%s'", mqttClient.appID)
 
 	if clientCert == nil {
 		err := fmt.Errorf("clientCert is nil")
-		logrus.Errorf("%s", err)
+		mqttClient.logger.Errorf("%s", err)
 		return err
 	}
+	mqttClient.setCertProvider(nil)
 	err := mqttClient.connect(hostPort, mqttClient.appID, "", clientCert)
 	return err
 }
 
+// ConnectWithCertProvider connects to the MQTT broker using client certificate authentication with
+// the certificate of the provider. The certificate is obtained from the provider on each (re)connect,
+// so a certificate that is reloaded by the provider is used without restarting the client.
+//  hostPort with address and port for certificate authentication
+//  certProvider provides the client certificate, eg one that watches the certificate PEM files
+func (mqttClient *MqttClient) ConnectWithCertProvider(hostPort string, certProvider *certsclient.CertProvider) error {
+	mqttClient.logger.Infof("appID='%s'", mqttClient.appID)
+
+	if certProvider == nil || certProvider.GetCert() == nil {
+		err := fmt.Errorf("certProvider has no certificate")
+		mqttClient.logger.Errorf("%s", err)
+		return err
+	}
+	mqttClient.setCertProvider(certProvider)
+	err := mqttClient.connect(hostPort, mqttClient.appID, "", certProvider.GetCert())
+	return err
+}
+
+// setCertProvider sets the provider of the client certificate. nil to use the client certificate.
+func (mqttClient *MqttClient) setCertProvider(certProvider *certsclient.CertProvider) {
+	mqttClient.clientCertMutex.Lock()
+	defer mqttClient.clientCertMutex.Unlock()
+	mqttClient.certProvider = certProvider
+}
+
+// UpdateClientCert replaces the client certificate used to authenticate with the broker, for example
+// after the certificate is renewed. The existing connection remains in use and the new certificate is
+// used when reconnecting.
+//  clientCert is the new client certificate
+func (mqttClient *MqttClient) UpdateClientCert(clientCert *tls.Certificate) {
+	mqttClient.clientCertMutex.Lock()
+	defer mqttClient.clientCertMutex.Unlock()
+	mqttClient.clientCert = clientCert
+}
+
+// UpdateAccessToken replaces the access token used to authenticate with the broker, for example
+// after the token is refreshed. The existing connection remains in use and the new token is
+// used when reconnecting.
+//  accessToken is the new access token
+func (mqttClient *MqttClient) UpdateAccessToken(accessToken string) {
+	mqttClient.accessTokenMutex.Lock()
+	defer mqttClient.accessTokenMutex.Unlock()
+	mqttClient.accessToken = accessToken
+}
+
 // Disconnect the connection to the MQTT broker and unsubscribe from all addresss and set
 // device state to disconnected
 func (mqttClient *MqttClient) Disconnect() {
@@ -213,54 +327,141 @@ func (mqttClient *MqttClient) Disconnect() {
 
 	if mqttClient.pahoClient != nil {
 		opts := mqttClient.pahoClient.OptionsReader()
-		logrus.Warningf("Client %s", opts.ClientID())
+		mqttClient.logger.Warningf("Client %s", opts.ClientID())
 		time.Sleep(time.Second / 10) // Disconnect doesn't seem to wait for all messages. A small delay ahead helps
 		mqttClient.pahoClient.Disconnect(DefaultTimeoutSec * 1000)
 		mqttClient.pahoClient = nil
 
-		mqttClient.subscriptions = make(map[string]*TopicSubscription)
+		mqttClient.router.Clear()
+		mqttClient.brokerFilters = make(map[string]byte)
+		mqttClient.updateConnectionState(false, nil, false)
+	}
+	// keep the queued messages for the next run
+	if mqttClient.publishQueue != nil {
+		_ = mqttClient.publishQueue.Save()
+	}
+}
+
+// flushQueue publishes the messages that were queued while offline, in the order they were queued.
+// If publishing fails then the remaining messages stay in the queue until the next reconnect.
+func (mqttClient *MqttClient) flushQueue() {
+	queue := mqttClient.publishQueue
+	if queue == nil || queue.Len() == 0 {
+		return
+	}
+	err := queue.Flush(mqttClient.publishAndWait)
+	if err != nil {
+		mqttClient.logger.Warningf("Failed publishing queued messages: %s", err)
 	}
 }
 
 // Wrapper for message handling to support multiple subscribers to one topic
-// func (mqttClient *MqttClient) onMessage(c pahomqtt.Client, msg pahomqtt.Message) {
-// 	topic := msg.Topic()
-// 	payload := msg.Payload()
-
-// 	logrus.Infof("address=%s", topic)
-// 	subscription := mqttClient.subscriptions[topic]
-// 	if subscription == nil {
-// 		logrus.Errorf("no subscription for topic %s", topic)
-// 		return
-// 	}
-// 	subscription.handler(topic, payload)
-// }
-
-// Publish a message to a topic address
+// The router passes the message to the handlers of all matching topic filters.
+func (mqttClient *MqttClient) onMessage(c pahomqtt.Client, msg pahomqtt.Message) {
+	topic := msg.Topic()
+	payload := msg.Payload()
+
+	mqttClient.logger.WithField(logging.FieldTopic, topic).Infof("onMessage")
+	start := time.Now()
+	mqttClient.router.Dispatch(topic, payload)
+	if m := mqttClient.metrics; m != nil {
+		m.received.Inc(mqttClient.appID)
+		m.handlerDuration.ObserveSince(start, mqttClient.appID)
+	}
+}
+
+// Publish a message to a topic address using the default QoS
+// If a publish queue is set then messages published while offline are queued and published after reconnect.
+// While queued messages are waiting to be published, new messages are added to the queue to preserve ordering.
+// Returns an error if not connected and the message is not queued.
 func (mqttClient *MqttClient) Publish(topic string, message []byte) error {
-	var err error
+	return mqttClient.PublishWithOptions(topic, message, PublishOptions{QoS: mqttClient.pubQos})
+}
 
-	if mqttClient.pahoClient == nil || !mqttClient.pahoClient.IsConnected() {
-		logrus.Warnf("Unable to publish. No connection with server.")
-		return errors.New("no connection with server")
+// PublishRetained publishes a message that the broker retains for new subscribers.
+// Retained messages are not queued while offline as they are intended to hold the current state.
+// Returns an error if not connected.
+func (mqttClient *MqttClient) PublishRetained(topic string, message []byte) error {
+	logger := mqttClient.logger.WithField(logging.FieldTopic, topic)
+	pahoClient := mqttClient.pahoClient
+	if pahoClient == nil || !pahoClient.IsConnected() {
+		logger.Warnf("Unable to publish. No connection with server.")
+		err := errors.New("no connection with server")
+		mqttClient.countPublish(err)
+		return err
+	}
+	logger.Infof("%.25s (retained)", message)
+	token := pahoClient.Publish(topic, mqttClient.pubQos, true, message)
+	err := token.Error()
+	mqttClient.countPublish(err)
+	return err
+}
+
+// PublishWithOptions publishes a message to a topic address with the given QoS and retain flag.
+// If a publish queue is set then messages published while offline are queued with their options and published
+// after reconnect, unless they have expired by then.
+// Returns an error if not connected and the message is not queued.
+func (mqttClient *MqttClient) PublishWithOptions(topic string, message []byte, options PublishOptions) error {
+	var err error
+	logger := mqttClient.logger.WithField(logging.FieldTopic, topic)
+
+	isConnected := mqttClient.pahoClient != nil && mqttClient.pahoClient.IsConnected()
+	queue := mqttClient.publishQueue
+	if queue != nil && (!isConnected || queue.Len() > 0) {
+		if queue.EnqueueWithOptions(topic, message, options) {
+			logger.Infof("message queued. %d messages in queue", queue.Len())
+			if isConnected {
+				go mqttClient.flushQueue()
+			}
+			return nil
+		}
+	}
+	if !isConnected {
+		logger.Warnf("Unable to publish. No connection with server.")
+		err = errors.New("no connection with server")
+		mqttClient.countPublish(err)
+		return err
 	}
-	//logrus.Infof("[]byte: topic=%s, qos=%d", topic, mqttClient.pubQos)
 	valueString := fmt.Sprintf("%.25s", message)
-	logrus.Infof("topic=%s: %s", topic, valueString)
-	token := mqttClient.pahoClient.Publish(topic, mqttClient.pubQos, false, message)
+	logger.Infof("qos=%d, retain=%v: %s", options.QoS, options.Retain, valueString)
+	token := mqttClient.pahoClient.Publish(topic, options.QoS, options.Retain, message)
 
 	err = token.Error()
+	mqttClient.countPublish(err)
 	if err != nil {
 		// TODO: confirm that with qos=1 the message is sent after reconnect
-		logrus.Warnf("Error during publish on address %s: %v", topic, err)
+		logger.Warnf("Error during publish: %v", err)
 		//return err
 	}
 	return err
 }
 
+// publishAndWait publishes a queued message and waits for the broker to acknowledge it.
+// This is used to flush the queue so that failed messages remain queued.
+func (mqttClient *MqttClient) publishAndWait(msg *QueuedMessage) error {
+	pahoClient := mqttClient.pahoClient
+	if pahoClient == nil || !pahoClient.IsConnected() {
+		return errors.New("no connection with server")
+	}
+	token := pahoClient.Publish(msg.Topic, msg.QoS, msg.Retain, msg.Payload)
+	if !token.WaitTimeout(DefaultTimeoutSec * time.Second) {
+		mqttClient.countPublish(errors.New("timeout"))
+		return fmt.Errorf("timeout publishing to %s", msg.Topic)
+	}
+	err := token.Error()
+	mqttClient.countPublish(err)
+	return err
+}
+
 // PublishObject marshals an object into json and publishes it to the given topic
 // If jsonIndent is provided then the message is formatted nicely for humans
 func (mqttClient *MqttClient) PublishObject(topic string, object interface{}) error {
+	return mqttClient.PublishObjectWithOptions(topic, object, PublishOptions{QoS: mqttClient.pubQos})
+}
+
+// PublishObjectWithOptions marshals an object into json and publishes it with the given options
+// If jsonIndent is provided then the message is formatted nicely for humans
+func (mqttClient *MqttClient) PublishObjectWithOptions(topic string, object interface{}, options PublishOptions) error {
 	var jsonText []byte
 	var err error
 	if mqttClient.jsonIndent != "" {
@@ -271,7 +472,7 @@ func (mqttClient *MqttClient) PublishObject(topic string, object interface{}) er
 	if err != nil {
 		return err
 	}
-	err = mqttClient.Publish(topic, jsonText)
+	err = mqttClient.PublishWithOptions(topic, jsonText, options)
 	return err
 }
 
@@ -284,32 +485,146 @@ func (mqttClient *MqttClient) resubscribe() {
 	mqttClient.updateMutex.Lock()
 	defer mqttClient.updateMutex.Unlock()
 
-	logrus.Infof("resubscribe to %d addresess", len(mqttClient.subscriptions))
-	for topic, subscription := range mqttClient.subscriptions {
+	filters := mqttClient.router.BrokerFilters()
+	mqttClient.logger.Infof("resubscribe to %d addresess", len(filters))
+	mqttClient.brokerFilters = make(map[string]byte)
+	for topic, qos := range filters {
 		// clear existing subscription in case it is still there
 		mqttClient.pahoClient.Unsubscribe(topic)
 
-		logrus.Debugf("address %s", topic)
-		// create a new variable to hold the subscription in the closure
-		mqttClient.pahoClient.Subscribe(
-			topic, mqttClient.pubQos,
-			func(c pahomqtt.Client, msg pahomqtt.Message) {
-				topic := msg.Topic()
-				payload := msg.Payload()
+		mqttClient.logger.WithField(logging.FieldTopic, topic).Debugf("qos %d", qos)
+		// messages are passed to the router by the default publish handler
+		mqttClient.pahoClient.Subscribe(topic, qos, nil)
+		mqttClient.brokerFilters[topic] = qos
+	}
+}
 
-				logrus.Infof("onMessage. address=%s", topic)
-				subscription.handler(topic, payload)
-			})
+// updateConnectionState updates the connection state and notifies the connection change handler
+//  connected is the new connection status
+//  err is the reason of a connection failure or loss. nil to keep the last error.
+//  isAttempt increases the reconnect attempt count. This is reset when connected.
+func (mqttClient *MqttClient) updateConnectionState(connected bool, err error, isAttempt bool) {
+	mqttClient.updateMutex.Lock()
+	state := &mqttClient.connectionState
+	state.Connected = connected
+	if connected {
+		state.LastError = nil
+		state.ReconnectAttempts = 0
+	} else if err != nil {
+		state.LastError = err
+	}
+	if isAttempt {
+		state.ReconnectAttempts++
+	}
+	newState := *state
+	handler := mqttClient.connectionChangeHandler
+	mqttClient.updateMutex.Unlock()
 
-		// token := messenger.pahoClient.Subscribe(newSubscr.topic, messenger.pubQos, newSubscr.onMessage)
-		//token := messenger.pahoClient.Subscribe(newSubscr.address, newSubscr.qos, func (c pahomqtt.Client, msg pahomqtt.Message) {
-		//logrus.Infof("mqtt.resubscribe.onMessage: address %s, subscription %s", msg.Topic(), newSubscr.address)
-		//newSubscr.onMessage(c, msg)
-		//})
-		// newSubscr.token = token
+	if handler != nil {
+		handler(newState)
 	}
 }
 
+// updateBrokerSubscriptions subscribes and unsubscribes with the broker after the handlers have changed.
+// Only filters that are not covered by a wider filter are subscribed to, as the broker sends a copy of
+// the message for each matching subscription. New filters are subscribed before the ones no longer needed
+// are unsubscribed, so no messages are missed when a wide filter is replaced by narrower filters.
+// Filters whose QoS has changed are subscribed again, which replaces the QoS of the existing subscription.
+//
+// This must be called with the updateMutex locked.
+func (mqttClient *MqttClient) updateBrokerSubscriptions() {
+	if mqttClient.pahoClient == nil {
+		// resubscribe takes care of it after connecting
+		return
+	}
+	required := mqttClient.router.BrokerFilters()
+	for topic, qos := range required {
+		currentQos, isSubscribed := mqttClient.brokerFilters[topic]
+		if !isSubscribed || currentQos != qos {
+			mqttClient.logger.WithField(logging.FieldTopic, topic).Debugf("subscribe with qos %d", qos)
+			mqttClient.pahoClient.Subscribe(topic, qos, nil)
+		}
+	}
+	for topic := range mqttClient.brokerFilters {
+		if _, isRequired := required[topic]; !isRequired {
+			mqttClient.logger.WithField(logging.FieldTopic, topic).Debugf("unsubscribe")
+			mqttClient.pahoClient.Unsubscribe(topic)
+		}
+	}
+	mqttClient.brokerFilters = required
+}
+
+// GetConnectionState returns the current state of the connection with the broker
+func (mqttClient *MqttClient) GetConnectionState() ConnectionState {
+	mqttClient.updateMutex.Lock()
+	defer mqttClient.updateMutex.Unlock()
+	return mqttClient.connectionState
+}
+
+// GetPublishQueue returns the queue for messages published while offline, or nil if not set
+func (mqttClient *MqttClient) GetPublishQueue() *PublishQueue {
+	return mqttClient.publishQueue
+}
+
+// SetMetrics sets the registry of the client's metrics. The default is metrics.DefaultRegistry.
+// The metrics are labeled with the application ID of the client.
+//  registry to use, or nil to disable the metrics
+func (mqttClient *MqttClient) SetMetrics(registry *metrics.Registry) {
+	mqttClient.metrics = newClientMetrics(registry)
+}
+
+// SetPublishQueue sets the queue for messages that are published while offline.
+// Use nil to disable queuing. Queued messages are published in order after (re)connecting.
+// Use NewPublishQueue to create a queue.
+func (mqttClient *MqttClient) SetPublishQueue(queue *PublishQueue) {
+	mqttClient.publishQueue = queue
+}
+
+// SetTopicQueuePolicy sets the policy for queuing messages of topics matching the filter.
+// This does nothing if no publish queue is set.
+//  filter is the topic filter and can contain the + and # wildcards
+//  policy is one of QueuePolicyKeepAll, QueuePolicyKeepLatest or QueuePolicyNone
+func (mqttClient *MqttClient) SetTopicQueuePolicy(filter string, policy QueuePolicy) {
+	if mqttClient.publishQueue != nil {
+		mqttClient.publishQueue.SetTopicPolicy(filter, policy)
+	}
+}
+
+// OnConnectionChange sets the handler that is invoked when the connection state changes.
+// The handler is invoked when connected, when the connection is lost, and on each failed connection attempt.
+// Only a single handler is active. Use nil to remove the handler.
+//
+// The handler is invoked from the MQTT client goroutine and should not block.
+func (mqttClient *MqttClient) OnConnectionChange(handler func(state ConnectionState)) {
+	mqttClient.updateMutex.Lock()
+	defer mqttClient.updateMutex.Unlock()
+	mqttClient.connectionChangeHandler = handler
+}
+
+// SetLastWill sets the message that the broker publishes when the connection is lost unexpectedly.
+// This takes effect on the next connect.
+//  topic to publish the last will on. Use "" to clear the last will.
+//  message with the payload of the last will
+//  retain the last will message for new subscribers, eg to keep the status of the client
+func (mqttClient *MqttClient) SetLastWill(topic string, message []byte, retain bool) {
+	mqttClient.updateMutex.Lock()
+	defer mqttClient.updateMutex.Unlock()
+	mqttClient.lastWillTopic = topic
+	mqttClient.lastWillMessage = message
+	mqttClient.lastWillRetain = retain
+}
+
+// SetDefaultQos sets the QoS used by Publish, PublishObject and Subscribe.
+// The default is DefaultQos. Existing subscriptions keep their QoS.
+//  pubQos is the QoS for publishing messages
+//  subQos is the QoS for subscribing to topics
+func (mqttClient *MqttClient) SetDefaultQos(pubQos byte, subQos byte) {
+	mqttClient.updateMutex.Lock()
+	defer mqttClient.updateMutex.Unlock()
+	mqttClient.pubQos = pubQos
+	mqttClient.subQos = subQos
+}
+
 // SetPrettyPrint enables/disables pretty-print in marshalling json
 func (mqttClient *MqttClient) SetPrettyPrint(enable bool) {
 	if enable {
@@ -319,59 +634,81 @@ func (mqttClient *MqttClient) SetPrettyPrint(enable bool) {
 	}
 }
 
-// Subscribe to a address
-// If a subscription already exists, it is replaced.
-// topic: address to subscribe to. This supports mqtt wildcards such as + and #
-// handler: callback handler.
+// Subscribe a handler to a topic
+// Multiple handlers can subscribe to the same topic. Overlapping wildcard subscriptions are matched
+// locally, so each handler is invoked once for each matching message.
+// The broker is only asked to subscribe when the first handler for the topic is added.
+//
+// If two filters partially overlap, eg 'test/+/5' and 'test/1/+', the broker sends a copy of the message
+// for each filter. Only the first copy is passed to the handlers.
+//
+//  topic: address to subscribe to. This supports mqtt wildcards such as + and #
+//  handler: callback handler.
+// Returns the subscription handle for use with UnsubscribeHandler
 func (mqttClient *MqttClient) Subscribe(
-	topic string, handler func(address string, message []byte)) {
-	handlerID := reflect.ValueOf(handler)
-	subscription := &TopicSubscription{
-		topic:     topic,
-		handler:   handler,
-		handlerID: handlerID,
-	}
-	logrus.Infof("topic %s, qos %d", topic, mqttClient.subQos)
+	topic string, handler func(address string, message []byte)) *TopicSubscription {
+	mqttClient.updateMutex.Lock()
+	qos := mqttClient.subQos
+	mqttClient.updateMutex.Unlock()
+
+	return mqttClient.SubscribeWithQos(topic, qos, handler)
+}
+
+// SubscribeWithQos subscribes a handler to a topic with the given QoS
+// When multiple handlers are subscribed to overlapping topics, the broker subscription uses the highest QoS.
+//
+//  topic: address to subscribe to. This supports mqtt wildcards such as + and #
+//  qos: maximum QoS at which to receive messages: 0 at most once, 1 at least once, 2 exactly once
+//  handler: callback handler.
+// Returns the subscription handle for use with UnsubscribeHandler
+func (mqttClient *MqttClient) SubscribeWithQos(
+	topic string, qos byte, handler func(address string, message []byte)) *TopicSubscription {
+	mqttClient.logger.WithField(logging.FieldTopic, topic).Infof("qos %d", qos)
 
 	mqttClient.updateMutex.Lock()
 	defer mqttClient.updateMutex.Unlock()
 
-	// if mqttClient.subscriptions[topic] != nil {
-	// 	logrus.Warningf("Subscribe: Existing subscription to %s is replaced", topic)
-	// } else {
-	if mqttClient.pahoClient != nil {
-		// save handler on the stack
-		subscribedHandler := handler
-		mqttClient.pahoClient.Subscribe(topic, mqttClient.subQos,
-			func(c pahomqtt.Client, msg pahomqtt.Message) {
-				topic := msg.Topic()
-				payload := msg.Payload()
-
-				logrus.Infof("onMessage. address=%s", topic)
-				subscribedHandler(topic, payload)
-			})
-	}
-	// }
-	mqttClient.subscriptions[topic] = subscription
+	subscription := mqttClient.router.Add(topic, qos, handler)
+	mqttClient.updateBrokerSubscriptions()
+	return subscription
 }
 
-// Unsubscribe a topic
+// Unsubscribe all handlers of a topic
+// The broker is only asked to unsubscribe when no other filter covers the topic.
 func (mqttClient *MqttClient) Unsubscribe(topic string) {
-	logrus.Infof("topic='%s'", topic)
+	logger := mqttClient.logger.WithField(logging.FieldTopic, topic)
+	logger.Infof("unsubscribe")
 
-	// messenger.publishMutex.Lock()
+	mqttClient.updateMutex.Lock()
+	defer mqttClient.updateMutex.Unlock()
 
-	subscription := mqttClient.subscriptions[topic]
-	if subscription == nil {
+	removed := mqttClient.router.RemoveFilter(topic)
+	if !removed {
 		// nothing to unsubscribe
-		logrus.Warningf("Subscription on topic %s didn't exist. Ignored", topic)
+		logger.Warningf("Subscription on topic didn't exist. Ignored")
 		return
 	}
+	mqttClient.updateBrokerSubscriptions()
+}
 
-	if mqttClient.pahoClient != nil {
-		mqttClient.pahoClient.Unsubscribe(topic)
-		mqttClient.subscriptions[topic] = nil
+// UnsubscribeHandler removes a single handler that was subscribed with Subscribe
+// The broker is only asked to unsubscribe when the last handler of the topic is removed.
+func (mqttClient *MqttClient) UnsubscribeHandler(subscription *TopicSubscription) {
+	if subscription == nil {
+		return
+	}
+	logger := mqttClient.logger.WithField(logging.FieldTopic, subscription.filter)
+	logger.Infof("unsubscribe handler")
+
+	mqttClient.updateMutex.Lock()
+	defer mqttClient.updateMutex.Unlock()
+
+	found := mqttClient.router.Remove(subscription)
+	if !found {
+		logger.Warningf("Subscription on topic didn't exist. Ignored")
+		return
 	}
+	mqttClient.updateBrokerSubscriptions()
 }
 
 // NewMqttClient creates a new MQTT messenger instance.
@@ -388,15 +725,18 @@ func NewMqttClient(appID string, caCert *x509.Certificate, timeoutSec int) *Mqtt
 	}
 	messenger := &MqttClient{
 		appID:         appID,
-		pubQos:        1,
-		subQos:        1,
+		pubQos:        DefaultQos,
+		subQos:        DefaultQos,
 		pahoClient:    nil,
-		subscriptions: make(map[string]*TopicSubscription),
+		router:        NewTopicRouter(),
+		brokerFilters: make(map[string]byte),
 		//messageChannel: make(chan *IncomingMessage),
 		timeout:             timeoutSec,
 		caCert:              caCert,
 		tlsVerifyServerCert: true,
 		updateMutex:         &sync.Mutex{},
+		metrics:             newClientMetrics(metrics.DefaultRegistry),
+		logger:              logrus.WithField(logging.FieldClientID, appID),
 	}
 	// guarantee unique ID ... okay this is ugly
 	time.Sleep(time.Millisecond)
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/wostzone/wost-go/pkg/logging"
+	"github.com/wostzone/wost-go/pkg/metrics"
 	"github.com/wostzone/wost-go/pkg/mqttclient"
 	"github.com/wostzone/wost-go/pkg/testenv"
 
@@ -157,58 +158,116 @@ func TestMQTTMultipleSubscriptions(t *testing.T) {
 		rx2 = string(msg)
 		logrus.Infof("Received message on handler 2: %s", msg)
 	}
-	_ = handler2
-	client.Subscribe(TEST_TOPIC, handler1)
+	sub1 := client.Subscribe(TEST_TOPIC, handler1)
 	client.Subscribe(TEST_TOPIC, handler2)
 	err = client.Publish(TEST_TOPIC, []byte(msg1))
 	assert.NoError(t, err)
 	time.Sleep(100 * time.Millisecond)
 
+	// both handlers receive the message
 	rxMutex.Lock()
-	// tbd
-	assert.Equalf(t, "", rx1, "Did not expect a message on handler 1")
+	assert.Equalf(t, msg1, rx1, "Did not receive the message on handler 1")
 	assert.Equalf(t, msg1, rx2, "Did not receive the message on handler 2")
-	// after unsubscribe no message should be received by handler 1
 	rx1 = ""
 	rx2 = ""
 	rxMutex.Unlock()
-	client.Unsubscribe(TEST_TOPIC)
+
+	// after removing handler 1, only handler 2 should receive the message
+	client.UnsubscribeHandler(sub1)
 	err = client.Publish(TEST_TOPIC, []byte(msg2))
 	assert.NoError(t, err)
 	time.Sleep(100 * time.Millisecond)
 
 	rxMutex.Lock()
 	assert.Equalf(t, "", rx1, "Received a message on handler 1 after unsubscribe")
-	assert.Equalf(t, "", rx2, "Received a message on handler 2 after unsubscribe")
+	assert.Equalf(t, msg2, rx2, "Did not receive the message on handler 2")
 	rx1 = ""
 	rx2 = ""
 	rxMutex.Unlock()
 
+	// when unsubscribing the topic, all handlers should be unsubscribed
 	client.Subscribe(TEST_TOPIC, handler1)
+	client.Unsubscribe(TEST_TOPIC)
 	err = client.Publish(TEST_TOPIC, []byte(msg2))
 	assert.NoError(t, err)
 	time.Sleep(100 * time.Millisecond)
 
 	rxMutex.Lock()
-	assert.Equalf(t, msg2, rx1, "Did not receive a message on handler 1 after subscribe")
-	assert.Equalf(t, "", rx2, "Receive the message on handler 2")
+	assert.Equalf(t, "", rx1, "Received a message on handler 1 after unsubscribe")
+	assert.Equalf(t, "", rx2, "Received a message on handler 2 after unsubscribe")
 	rxMutex.Unlock()
 
-	// when unsubscribing without handler, all handlers should be unsubscribed
-	rx1 = ""
-	rx2 = ""
-	client.Subscribe(TEST_TOPIC, handler1)
-	client.Subscribe(TEST_TOPIC, handler2)
-	client.Unsubscribe(TEST_TOPIC)
-	err = client.Publish(TEST_TOPIC, []byte(msg2))
-	assert.NoError(t, err)
+	client.Disconnect()
+}
+
+func TestMQTTOverlappingSubscriptions(t *testing.T) {
+	logrus.Infof("--- TestMQTTOverlappingSubscriptions ---")
+	const testTopic1 = "test/1/5"
+	const msg = "hello 1"
+	rxCount := 0
+	rxMutex := sync.Mutex{}
+
+	client := mqttclient.NewMqttClient(testPluginID, certs.CaCert, 0)
+	err := client.ConnectWithClientCert(mqttCertAddress, certs.PluginCert)
+	require.NoError(t, err)
+
+	handler := func(channel string, msg []byte) {
+		rxMutex.Lock()
+		defer rxMutex.Unlock()
+		rxCount++
+	}
+	client.Subscribe("test/#", handler)
+	client.Subscribe("test/+/5", handler)
+	sub3 := client.Subscribe(testTopic1, handler)
+
+	err = client.Publish(testTopic1, []byte(msg))
+	require.NoError(t, err)
 	time.Sleep(100 * time.Millisecond)
+	rxMutex.Lock()
+	assert.Equal(t, 3, rxCount)
+	rxCount = 0
+	rxMutex.Unlock()
 
+	client.UnsubscribeHandler(sub3)
+	err = client.Publish(testTopic1, []byte(msg))
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
 	rxMutex.Lock()
-	assert.Equalf(t, "", rx1, "Received a message on handler 1 after unsubscribe")
-	assert.Equalf(t, "", rx2, "Did not receive the message on handler 2")
+	assert.Equal(t, 2, rxCount)
+	rxMutex.Unlock()
+
+	client.Disconnect()
+}
+
+func TestMQTTPublishWithOptions(t *testing.T) {
+	logrus.Infof("--- TestMQTTPublishWithOptions ---")
+	const testTopic1 = "test/retained/1"
+	const msg = "retained 1"
+	var rxMsg string
+	rxMutex := sync.Mutex{}
+
+	client := mqttclient.NewMqttClient(testPluginID, certs.CaCert, 0)
+	err := client.ConnectWithClientCert(mqttCertAddress, certs.PluginCert)
+	require.NoError(t, err)
+
+	// a retained message is received by subscribers that subscribe afterwards
+	err = client.PublishWithOptions(testTopic1, []byte(msg), mqttclient.PublishOptions{QoS: 2, Retain: true})
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	sub := client.SubscribeWithQos(testTopic1, 0, func(channel string, message []byte) {
+		rxMutex.Lock()
+		defer rxMutex.Unlock()
+		rxMsg = string(message)
+	})
+	assert.Equal(t, byte(0), sub.QoS())
+	time.Sleep(100 * time.Millisecond)
+	rxMutex.Lock()
+	assert.Equal(t, msg, rxMsg)
 	rxMutex.Unlock()
 
+	// clear the retained message
+	err = client.PublishWithOptions(testTopic1, []byte{}, mqttclient.PublishOptions{QoS: 1, Retain: true})
+	assert.NoError(t, err)
 	client.Disconnect()
 }
 
@@ -236,6 +295,33 @@ func TestMQTTPubNoConnect(t *testing.T) {
 	client.Disconnect()
 }
 
+func TestMQTTMetrics(t *testing.T) {
+	logrus.Infof("--- TestMQTTMetrics ---")
+	registry := metrics.NewRegistry()
+	client := mqttclient.NewMqttClient(testPluginID, certs.CaCert, 0)
+	client.SetMetrics(registry)
+	publishes := registry.NewCounter("wost_mqtt_publish_total", "")
+	failures := registry.NewCounter("wost_mqtt_publish_failures_total", "")
+	received := registry.NewCounter("wost_mqtt_messages_received_total", "")
+	handlerDuration := registry.NewHistogram("wost_mqtt_handler_duration_seconds", "", nil)
+
+	// publishing without connection fails
+	err := client.Publish(TEST_TOPIC, []byte("Hello world"))
+	require.Error(t, err)
+	assert.Equal(t, 1.0, failures.Get(testPluginID))
+
+	err = client.ConnectWithClientCert(mqttCertAddress, certs.PluginCert)
+	require.NoError(t, err)
+	client.Subscribe(TEST_TOPIC, func(channel string, msg []byte) {})
+	err = client.Publish(TEST_TOPIC, []byte("Hello world"))
+	require.NoError(t, err)
+	time.Sleep(time.Second)
+	assert.Equal(t, 1.0, publishes.Get(testPluginID))
+	assert.Equal(t, 1.0, received.Get(testPluginID))
+	assert.Equal(t, uint64(1), handlerDuration.GetCount(testPluginID))
+	client.Disconnect()
+}
+
 func TestMQTTSubBeforeConnect(t *testing.T) {
 	logrus.Infof("--- TestMQTTSubBeforeConnect ---")
 
@@ -300,3 +386,35 @@ func TestSubscribeWildcard(t *testing.T) {
 
 	client.Disconnect()
 }
+
+func TestMQTTPublishQueue(t *testing.T) {
+	logrus.Infof("--- TestMQTTPublishQueue ---")
+	const msg = "queued message"
+	var rx string
+	rxMutex := sync.Mutex{}
+
+	client := mqttclient.NewMqttClient(testPluginID, certs.CaCert, 0)
+	client.SetPublishQueue(mqttclient.NewPublishQueue(0, ""))
+	client.Subscribe(TEST_TOPIC, func(channel string, msg []byte) {
+		rxMutex.Lock()
+		defer rxMutex.Unlock()
+		rx = string(msg)
+	})
+
+	// publish while offline is queued
+	err := client.Publish(TEST_TOPIC, []byte(msg))
+	require.NoError(t, err)
+	assert.Equal(t, 1, client.GetPublishQueue().Len())
+
+	// the queue is flushed after connecting
+	err = client.ConnectWithClientCert(mqttCertAddress, certs.PluginCert)
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	rxMutex.Lock()
+	assert.Equal(t, msg, rx)
+	rxMutex.Unlock()
+	assert.Equal(t, 0, client.GetPublishQueue().Len())
+
+	client.Disconnect()
+}
@@ -0,0 +1,438 @@
+package mqttclient
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// QueuePolicy determines how messages on a topic are queued while the client is offline
+type QueuePolicy string
+
+const (
+	// QueuePolicyKeepAll queues all messages, eg for events
+	QueuePolicyKeepAll QueuePolicy = "keepAll"
+	// QueuePolicyKeepLatest only keeps the latest message of a topic, eg for property values
+	QueuePolicyKeepLatest QueuePolicy = "keepLatest"
+	// QueuePolicyNone does not queue messages, eg for actions that are not wanted after a delay
+	QueuePolicyNone QueuePolicy = "none"
+)
+
+// DefaultQueueSize is the default maximum number of messages kept in memory
+const DefaultQueueSize = 100
+
+// DefaultSpoolSize is the default maximum number of messages kept in the spool file
+const DefaultSpoolSize = 10000
+
+// QueuedMessage holds a message waiting to be published
+type QueuedMessage struct {
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload"`
+	QoS     byte   `json:"qos"`
+	Retain  bool   `json:"retain,omitempty"`
+	// Expires is the time after which the message is discarded instead of published. Zero to never expire.
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// topicPolicy holds the queuing policy for topics matching the filter
+type topicPolicy struct {
+	filter string
+	policy QueuePolicy
+}
+
+// PublishQueue buffers messages that are published while the client is offline.
+//
+// Messages are kept in a bounded memory queue. When the memory queue is full the oldest message is moved
+// to the spool file, if one is configured, or is dropped otherwise. The spool file is a list of json encoded
+// messages, one per line, that survives a restart of the application. Use Save to move the memory queue
+// into the spool before shutting down. The spool holds at most SetMaxSpooled messages. When it is full,
+// the messages that overflow the memory queue are dropped, so the spool keeps the oldest messages.
+//
+// Flush publishes the spooled messages followed by the memory queue, in the order they were queued.
+// Spooled messages are only removed from the spool file after they are published, so a crash during
+// the flush can publish them again after a restart but doesn't lose them.
+type PublishQueue struct {
+	// default policy for topics without a specific policy
+	defaultPolicy QueuePolicy
+	// number of messages at the start of the spool file that are being flushed
+	flushSpooled int
+	// number of messages that are being flushed
+	inFlight int
+	// maximum number of messages in the memory queue
+	maxMessages int
+	// maximum number of messages in the spool file
+	maxSpooled int
+	// messages in the memory queue, oldest first
+	messages []*QueuedMessage
+	// policies for specific topics, the last matching filter is used
+	policies []topicPolicy
+	// number of messages in the spool file that are not being flushed
+	spoolCount int
+	// file to persist messages, "" to only use memory
+	spoolFile string
+	// mutex for concurrent access to the queue
+	mutex sync.Mutex
+	// mutex to allow only a single flush at a time
+	flushMutex sync.Mutex
+}
+
+// Enqueue adds a message to the queue using the policy of its topic and the default QoS.
+// Returns false if the message is not queued because of its policy.
+func (queue *PublishQueue) Enqueue(topic string, payload []byte) bool {
+	return queue.EnqueueWithOptions(topic, payload, PublishOptions{QoS: DefaultQos})
+}
+
+// EnqueueWithOptions adds a message to the queue using the policy of its topic.
+// The options are kept with the message and used when it is published.
+// Returns false if the message is not queued because of its policy.
+func (queue *PublishQueue) EnqueueWithOptions(topic string, payload []byte, options PublishOptions) bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	policy := queue.topicPolicy(topic)
+	if policy == QueuePolicyNone {
+		return false
+	}
+	if policy == QueuePolicyKeepLatest {
+		queue.messages = removeTopic(queue.messages, topic)
+	}
+	msg := &QueuedMessage{
+		Topic:   topic,
+		Payload: payload,
+		QoS:     options.QoS,
+		Retain:  options.Retain,
+	}
+	if options.Expiry > 0 {
+		msg.Expires = time.Now().Add(options.Expiry)
+	}
+	queue.messages = append(queue.messages, msg)
+	queue.spoolOverflow()
+	return true
+}
+
+// Flush publishes all queued messages in the order they were queued.
+// Messages of topics with the keep-latest policy are only published once with the latest value.
+// Messages that have expired are discarded. If publishing fails then the remaining messages stay queued.
+//
+//  publish is the function that publishes a message and returns an error if failed
+// Returns the error of the publish that failed
+func (queue *PublishQueue) Flush(publish func(msg *QueuedMessage) error) error {
+	queue.flushMutex.Lock()
+	defer queue.flushMutex.Unlock()
+
+	queue.mutex.Lock()
+	spooled, err := queue.readSpool()
+	if err != nil {
+		queue.mutex.Unlock()
+		return err
+	}
+	pending := queue.compact(append(spooled, queue.messages...))
+	queue.messages = make([]*QueuedMessage, 0)
+	// the spooled messages remain in the spool file until they are published
+	queue.flushSpooled = len(spooled)
+	queue.spoolCount = 0
+	queue.inFlight = len(pending)
+	queue.mutex.Unlock()
+
+	if len(pending) > 0 {
+		logrus.Infof("Flushing %d queued messages", len(pending))
+	}
+	for i, msg := range pending {
+		if !msg.Expires.IsZero() && time.Now().After(msg.Expires) {
+			logrus.Infof("Discarding expired message on topic '%s'", msg.Topic)
+			err = nil
+		} else {
+			err = publish(msg)
+		}
+		if err != nil {
+			logrus.Warningf("Flush interrupted with %d messages remaining: %s", len(pending)-i, err)
+			queue.requeue(pending[i:])
+			return err
+		}
+		queue.mutex.Lock()
+		queue.inFlight--
+		queue.mutex.Unlock()
+	}
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return queue.rewriteSpool(nil)
+}
+
+// GetTopicPolicy returns the queuing policy for a topic
+func (queue *PublishQueue) GetTopicPolicy(topic string) QueuePolicy {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return queue.topicPolicy(topic)
+}
+
+// Len returns the number of queued messages, including spooled messages and messages that are being flushed
+func (queue *PublishQueue) Len() int {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return len(queue.messages) + queue.spoolCount + queue.inFlight
+}
+
+// Save moves the messages in the memory queue into the spool file, so they are published after a restart.
+// This does nothing if no spool file is configured.
+func (queue *PublishQueue) Save() error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if queue.spoolFile == "" {
+		return nil
+	}
+	for len(queue.messages) > 0 {
+		err := queue.spoolMessage(queue.messages[0])
+		if err != nil {
+			logrus.Errorf("Failed saving queue to '%s': %s", queue.spoolFile, err)
+			return err
+		}
+		queue.messages = queue.messages[1:]
+	}
+	return nil
+}
+
+// SetMaxSpooled sets the maximum number of messages in the spool file. The default is DefaultSpoolSize.
+// When the spool is full then messages that overflow the memory queue are dropped.
+//  maxSpooled is the maximum number of spooled messages
+func (queue *PublishQueue) SetMaxSpooled(maxSpooled int) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	queue.maxSpooled = maxSpooled
+}
+
+// SetTopicPolicy sets the queuing policy for topics that match the given filter.
+// When multiple filters match a topic, the policy that was set last is used.
+//  filter is the topic filter and can contain the + and # wildcards
+//  policy is one of QueuePolicyKeepAll, QueuePolicyKeepLatest or QueuePolicyNone
+func (queue *PublishQueue) SetTopicPolicy(filter string, policy QueuePolicy) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	for i, tp := range queue.policies {
+		if tp.filter == filter {
+			queue.policies = append(queue.policies[:i:i], queue.policies[i+1:]...)
+			break
+		}
+	}
+	queue.policies = append(queue.policies, topicPolicy{filter: filter, policy: policy})
+}
+
+// appendToSpool appends a message to the spool file.
+// This must be called with the mutex locked.
+func (queue *PublishQueue) appendToSpool(msg *QueuedMessage) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	fp, err := os.OpenFile(queue.spoolFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	_, err = fp.Write(append(line, '\n'))
+	if err == nil {
+		queue.spoolCount++
+	}
+	return err
+}
+
+// compact removes the older messages of topics with the keep-latest policy
+// This must be called with the mutex locked.
+func (queue *PublishQueue) compact(messages []*QueuedMessage) []*QueuedMessage {
+	result := make([]*QueuedMessage, 0, len(messages))
+	for i, msg := range messages {
+		if queue.topicPolicy(msg.Topic) == QueuePolicyKeepLatest {
+			isReplaced := false
+			for _, later := range messages[i+1:] {
+				if later.Topic == msg.Topic {
+					isReplaced = true
+					break
+				}
+			}
+			if isReplaced {
+				continue
+			}
+		}
+		result = append(result, msg)
+	}
+	return result
+}
+
+// readSpool returns the messages in the spool file
+// This must be called with the mutex locked.
+func (queue *PublishQueue) readSpool() ([]*QueuedMessage, error) {
+	messages := make([]*QueuedMessage, 0)
+	if queue.spoolFile == "" {
+		return messages, nil
+	}
+	fp, err := os.Open(queue.spoolFile)
+	if os.IsNotExist(err) {
+		return messages, nil
+	} else if err != nil {
+		logrus.Errorf("Unable to read spool file '%s': %s", queue.spoolFile, err)
+		return messages, err
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		msg := &QueuedMessage{}
+		err = json.Unmarshal(scanner.Bytes(), msg)
+		if err != nil {
+			logrus.Warningf("Skipping invalid message in spool file '%s': %s", queue.spoolFile, err)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	return messages, scanner.Err()
+}
+
+// requeue puts messages that failed to publish back in front of the queue.
+// Messages that were spooled or queued during the flush are newer and are kept behind them.
+// With a spool file, the messages are written back to the spool so they survive a restart.
+func (queue *PublishQueue) requeue(messages []*QueuedMessage) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.inFlight = 0
+	if queue.spoolFile == "" {
+		queue.messages = queue.compact(append(messages, queue.messages...))
+		queue.spoolOverflow()
+		return
+	}
+	err := queue.rewriteSpool(messages)
+	if err != nil {
+		// keep the messages in memory, spooled messages can be published twice
+		queue.messages = queue.compact(append(messages, queue.messages...))
+	}
+}
+
+// rewriteSpool replaces the messages in the spool file that were being flushed with the given messages.
+// Messages that were spooled during the flush are kept behind them. The file is replaced by renaming a
+// new file so it is never partially written.
+// This must be called with the mutex locked.
+//  messages to put in front of the spool, nil to remove the flushed messages
+func (queue *PublishQueue) rewriteSpool(messages []*QueuedMessage) error {
+	flushSpooled := queue.flushSpooled
+	queue.flushSpooled = 0
+	if queue.spoolFile == "" || (flushSpooled == 0 && len(messages) == 0) {
+		return nil
+	}
+	spooled, err := queue.readSpool()
+	if err != nil {
+		return err
+	}
+	if flushSpooled > len(spooled) {
+		flushSpooled = len(spooled)
+	}
+	remaining := append(messages, spooled[flushSpooled:]...)
+	if len(remaining) == 0 {
+		queue.spoolCount = 0
+		err = os.Remove(queue.spoolFile)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	data := make([]byte, 0)
+	for _, msg := range remaining {
+		line, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	tmpFile := queue.spoolFile + ".tmp"
+	err = os.WriteFile(tmpFile, data, 0600)
+	if err == nil {
+		err = os.Rename(tmpFile, queue.spoolFile)
+	}
+	if err != nil {
+		logrus.Errorf("Unable to rewrite spool file '%s': %s", queue.spoolFile, err)
+		_ = os.Remove(tmpFile)
+		// the flushed messages remain in the spool file
+		queue.spoolCount = len(spooled)
+		return err
+	}
+	queue.spoolCount = len(remaining)
+	return nil
+}
+
+// spoolMessage appends a message to the spool file if the spool isn't full
+// This must be called with the mutex locked.
+func (queue *PublishQueue) spoolMessage(msg *QueuedMessage) error {
+	if queue.flushSpooled+queue.spoolCount >= queue.maxSpooled {
+		logrus.Warningf("Spool is full. Dropped message on topic '%s'", msg.Topic)
+		return nil
+	}
+	return queue.appendToSpool(msg)
+}
+
+// spoolOverflow moves the oldest messages that don't fit in the memory queue to the spool file.
+// Without a spool file, or when the spool is full, they are dropped.
+// This must be called with the mutex locked.
+func (queue *PublishQueue) spoolOverflow() {
+	for len(queue.messages) > queue.maxMessages {
+		oldest := queue.messages[0]
+		queue.messages = queue.messages[1:]
+		if queue.spoolFile == "" {
+			logrus.Warningf("Queue is full. Dropped oldest message on topic '%s'", oldest.Topic)
+		} else if err := queue.spoolMessage(oldest); err != nil {
+			logrus.Errorf("Queue is full and spooling failed. Dropped oldest message on topic '%s': %s",
+				oldest.Topic, err)
+		}
+	}
+}
+
+// topicPolicy returns the queuing policy for a topic
+// This must be called with the mutex locked.
+func (queue *PublishQueue) topicPolicy(topic string) QueuePolicy {
+	policy := queue.defaultPolicy
+	for _, tp := range queue.policies {
+		if MatchTopic(tp.filter, topic) {
+			policy = tp.policy
+		}
+	}
+	return policy
+}
+
+// removeTopic removes the messages with the given topic
+func removeTopic(messages []*QueuedMessage, topic string) []*QueuedMessage {
+	result := messages[:0]
+	for _, msg := range messages {
+		if msg.Topic != topic {
+			result = append(result, msg)
+		}
+	}
+	return result
+}
+
+// NewPublishQueue creates a queue for messages that are published while offline.
+// If a spool file is given then messages that remain in that file from a previous run are included.
+//
+//  maxMessages is the maximum number of messages kept in memory. Use 0 for DefaultQueueSize
+//  spoolFile is the file that holds the messages that don't fit in memory. Use "" for memory only.
+func NewPublishQueue(maxMessages int, spoolFile string) *PublishQueue {
+	if maxMessages <= 0 {
+		maxMessages = DefaultQueueSize
+	}
+	queue := &PublishQueue{
+		defaultPolicy: QueuePolicyKeepAll,
+		maxMessages:   maxMessages,
+		maxSpooled:    DefaultSpoolSize,
+		messages:      make([]*QueuedMessage, 0),
+		policies:      make([]topicPolicy, 0),
+		spoolFile:     spoolFile,
+	}
+	spooled, err := queue.readSpool()
+	if err == nil {
+		queue.spoolCount = len(spooled)
+	}
+	return queue
+}
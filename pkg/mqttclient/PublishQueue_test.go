@@ -0,0 +1,186 @@
+package mqttclient_test
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/wostzone/wost-go/pkg/mqttclient"
+)
+
+func TestQueueKeepAllAndLatest(t *testing.T) {
+	logrus.Infof("--- TestQueueKeepAllAndLatest ---")
+	const eventTopic = "things/thing1/event/event1"
+	const propTopic = "things/thing1/event/prop1"
+	const actionTopic = "things/thing1/action/action1"
+
+	queue := mqttclient.NewPublishQueue(0, "")
+	queue.SetTopicPolicy(propTopic, mqttclient.QueuePolicyKeepLatest)
+	queue.SetTopicPolicy("things/+/action/#", mqttclient.QueuePolicyNone)
+	assert.Equal(t, mqttclient.QueuePolicyKeepAll, queue.GetTopicPolicy(eventTopic))
+
+	assert.True(t, queue.Enqueue(eventTopic, []byte("1")))
+	assert.True(t, queue.Enqueue(propTopic, []byte("2")))
+	assert.True(t, queue.Enqueue(eventTopic, []byte("3")))
+	assert.True(t, queue.Enqueue(propTopic, []byte("4")))
+	assert.False(t, queue.Enqueue(actionTopic, []byte("5")))
+	assert.Equal(t, 3, queue.Len())
+
+	received := make([]string, 0)
+	err := queue.Flush(func(msg *mqttclient.QueuedMessage) error {
+		received = append(received, string(msg.Payload))
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1", "3", "4"}, received)
+	assert.Equal(t, 0, queue.Len())
+}
+
+func TestQueueFlushFailure(t *testing.T) {
+	logrus.Infof("--- TestQueueFlushFailure ---")
+	const topic1 = "things/thing1/event/event1"
+
+	queue := mqttclient.NewPublishQueue(10, "")
+	queue.Enqueue(topic1, []byte("1"))
+	queue.Enqueue(topic1, []byte("2"))
+	queue.Enqueue(topic1, []byte("3"))
+
+	// fail on the second message
+	received := make([]string, 0)
+	err := queue.Flush(func(msg *mqttclient.QueuedMessage) error {
+		if len(received) == 1 {
+			return errors.New("no connection")
+		}
+		received = append(received, string(msg.Payload))
+		return nil
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 2, queue.Len())
+
+	// the remaining messages are published in order on the next flush
+	err = queue.Flush(func(msg *mqttclient.QueuedMessage) error {
+		received = append(received, string(msg.Payload))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1", "2", "3"}, received)
+}
+
+func TestQueueSpool(t *testing.T) {
+	logrus.Infof("--- TestQueueSpool ---")
+	const topic1 = "things/thing1/event/event1"
+	spoolFile := path.Join(os.TempDir(), "wost-mqttclient-test-spool.json")
+	_ = os.Remove(spoolFile)
+
+	// the oldest messages overflow into the spool
+	queue := mqttclient.NewPublishQueue(2, spoolFile)
+	queue.Enqueue(topic1, []byte("1"))
+	queue.Enqueue(topic1, []byte("2"))
+	queue.Enqueue(topic1, []byte("3"))
+	queue.Enqueue(topic1, []byte("4"))
+	assert.Equal(t, 4, queue.Len())
+	err := queue.Save()
+	require.NoError(t, err)
+
+	// a new queue continues with the spooled messages
+	queue2 := mqttclient.NewPublishQueue(2, spoolFile)
+	assert.Equal(t, 4, queue2.Len())
+	queue2.Enqueue(topic1, []byte("5"))
+	received := make([]string, 0)
+	err = queue2.Flush(func(msg *mqttclient.QueuedMessage) error {
+		received = append(received, string(msg.Payload))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1", "2", "3", "4", "5"}, received)
+	assert.Equal(t, 0, queue2.Len())
+	assert.NoFileExists(t, spoolFile)
+}
+
+func TestQueuePublishOptions(t *testing.T) {
+	logrus.Infof("--- TestQueuePublishOptions ---")
+	const topic1 = "things/thing1/event/event1"
+	const topic2 = "things/thing1/event/prop1"
+
+	queue := mqttclient.NewPublishQueue(0, "")
+	queue.EnqueueWithOptions(topic1, []byte("1"), mqttclient.PublishOptions{QoS: 0, Expiry: time.Millisecond})
+	queue.EnqueueWithOptions(topic2, []byte("2"), mqttclient.PublishOptions{QoS: 2, Retain: true})
+	time.Sleep(time.Millisecond * 10)
+
+	// the expired message is discarded and the options of the other are kept
+	received := make([]*mqttclient.QueuedMessage, 0)
+	err := queue.Flush(func(msg *mqttclient.QueuedMessage) error {
+		received = append(received, msg)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(received))
+	assert.Equal(t, topic2, received[0].Topic)
+	assert.Equal(t, byte(2), received[0].QoS)
+	assert.True(t, received[0].Retain)
+	assert.Equal(t, 0, queue.Len())
+}
+
+func TestQueueSpoolFlushFailure(t *testing.T) {
+	logrus.Infof("--- TestQueueSpoolFlushFailure ---")
+	const topic1 = "things/thing1/event/event1"
+	spoolFile := path.Join(t.TempDir(), "spool.json")
+
+	queue := mqttclient.NewPublishQueue(1, spoolFile)
+	queue.Enqueue(topic1, []byte("1"))
+	queue.Enqueue(topic1, []byte("2"))
+	queue.Enqueue(topic1, []byte("3"))
+	assert.FileExists(t, spoolFile)
+
+	// spooled messages remain in the spool file while they are flushed
+	received := make([]string, 0)
+	err := queue.Flush(func(msg *mqttclient.QueuedMessage) error {
+		queue2 := mqttclient.NewPublishQueue(1, spoolFile)
+		assert.Equal(t, 2, queue2.Len())
+		if len(received) == 1 {
+			return errors.New("no connection")
+		}
+		received = append(received, string(msg.Payload))
+		return nil
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 2, queue.Len())
+
+	// after a failed flush the unpublished messages are in the spool so they survive a restart
+	queue2 := mqttclient.NewPublishQueue(1, spoolFile)
+	assert.Equal(t, 2, queue2.Len())
+	err = queue2.Flush(func(msg *mqttclient.QueuedMessage) error {
+		received = append(received, string(msg.Payload))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1", "2", "3"}, received)
+	assert.NoFileExists(t, spoolFile)
+}
+
+func TestQueueSpoolLimit(t *testing.T) {
+	logrus.Infof("--- TestQueueSpoolLimit ---")
+	const topic1 = "things/thing1/event/event1"
+	spoolFile := path.Join(t.TempDir(), "spool.json")
+
+	// the spool keeps the oldest messages and drops messages when it is full
+	queue := mqttclient.NewPublishQueue(1, spoolFile)
+	queue.SetMaxSpooled(2)
+	for _, payload := range []string{"1", "2", "3", "4", "5"} {
+		queue.Enqueue(topic1, []byte(payload))
+	}
+	assert.Equal(t, 3, queue.Len())
+	received := make([]string, 0)
+	err := queue.Flush(func(msg *mqttclient.QueuedMessage) error {
+		received = append(received, string(msg.Payload))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1", "2", "5"}, received)
+}
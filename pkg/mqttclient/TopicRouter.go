@@ -0,0 +1,325 @@
+package mqttclient
+
+import (
+	"crypto/sha256"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TopicSubscription is the handle of a single handler subscribed to a topic filter.
+// It is returned by Subscribe and used to remove the handler with UnsubscribeHandler.
+type TopicSubscription struct {
+	// unique ID of the subscription within the router
+	id uint64
+	// topic filter, this can contain the + and # wildcards
+	filter string
+	// maximum QoS at which the broker sends messages to this subscription
+	qos byte
+	// handler to invoke when a message is received on a matching topic
+	handler func(topic string, message []byte)
+}
+
+// Filter returns the topic filter the handler is subscribed to
+func (sub *TopicSubscription) Filter() string {
+	return sub.filter
+}
+
+// QoS returns the requested QoS of the subscription
+func (sub *TopicSubscription) QoS() byte {
+	return sub.qos
+}
+
+// DuplicateWindow is the time within which copies of a message that the broker sends for partially
+// overlapping filters are recognized as duplicates
+const DuplicateWindow = 5 * time.Second
+
+// pendingCopies holds the number of copies of a message that are still expected from the broker
+type pendingCopies struct {
+	remaining int
+	expires   time.Time
+}
+
+// TopicRouter dispatches received messages to the handlers of all matching topic filters.
+//
+// Multiple handlers can be subscribed to the same filter, and overlapping filters that contain
+// the + or # wildcards are matched locally. Brokers deliver a copy of a message for each matching
+// subscription, so only filters that are not covered by a wider filter need a broker subscription.
+// Use BrokerFilters to determine which filters these are.
+//
+// Filters that partially overlap, for example 'test/+/5' and 'test/1/+', both need a broker subscription
+// and the broker sends a copy of a message for each of them. The router dispatches the first copy and
+// drops the other copies that are received within the DuplicateWindow, so each handler is invoked once.
+type TopicRouter struct {
+	// subscriptions by topic filter
+	filters map[string][]*TopicSubscription
+	// copies still expected of dispatched messages, by topic and message hash
+	pending map[string]*pendingCopies
+	// last issued subscription ID
+	lastID uint64
+	// mutex for concurrent access to the filters
+	mutex sync.RWMutex
+}
+
+// Add a handler for a topic filter.
+//  filter is the topic filter and can contain the + and # wildcards
+//  qos is the maximum QoS at which the handler wants to receive messages
+//  handler is invoked with messages on topics that match the filter
+// Returns the subscription handle for use with Remove.
+func (router *TopicRouter) Add(
+	filter string, qos byte, handler func(topic string, message []byte)) *TopicSubscription {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+
+	router.lastID++
+	sub := &TopicSubscription{
+		id:      router.lastID,
+		filter:  filter,
+		qos:     qos,
+		handler: handler,
+	}
+	router.filters[filter] = append(router.filters[filter], sub)
+	return sub
+}
+
+// BrokerFilters returns the filters that need a subscription with the broker, with the QoS to subscribe with.
+// Filters that are covered by a wider filter, for example 'things/+/event' by 'things/#', are left out
+// as their messages are already received through the wider filter. The QoS of a broker filter is the
+// highest QoS of the subscriptions it covers.
+func (router *TopicRouter) BrokerFilters() map[string]byte {
+	router.mutex.RLock()
+	defer router.mutex.RUnlock()
+
+	brokerFilters := make(map[string]byte)
+	for filter := range router.filters {
+		isCovered := false
+		for other := range router.filters {
+			if other != filter && CoversTopicFilter(other, filter) {
+				isCovered = true
+				break
+			}
+		}
+		if !isCovered {
+			brokerFilters[filter] = router.maxQos(filter)
+		}
+	}
+	return brokerFilters
+}
+
+// Clear removes all subscriptions
+func (router *TopicRouter) Clear() {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+	router.filters = make(map[string][]*TopicSubscription)
+	router.pending = make(map[string]*pendingCopies)
+}
+
+// Dispatch a message to the handlers of all filters that match the topic.
+// When the topic matches multiple broker filters, the copies the broker sends for the other filters are
+// not dispatched. Note that this also drops an identical message on the same topic that is received
+// within the DuplicateWindow instead of the expected copy.
+// Handlers are invoked outside the lock so they are free to subscribe or unsubscribe.
+// Returns the number of handlers that were invoked.
+func (router *TopicRouter) Dispatch(topic string, message []byte) int {
+	handlers := make([]func(topic string, message []byte), 0)
+	matching := make([]string, 0)
+
+	router.mutex.Lock()
+	for filter, subs := range router.filters {
+		if MatchTopic(filter, topic) {
+			matching = append(matching, filter)
+			for _, sub := range subs {
+				handlers = append(handlers, sub.handler)
+			}
+		}
+	}
+	isCopy := router.isCopy(topic, message, router.countBrokerFilters(matching))
+	router.mutex.Unlock()
+
+	if isCopy {
+		logrus.Infof("Dropped copy of message on topic %s", topic)
+		return 0
+	}
+	if len(handlers) == 0 {
+		logrus.Infof("No handler for topic %s", topic)
+	}
+	for _, handler := range handlers {
+		handler(topic, message)
+	}
+	return len(handlers)
+}
+
+// countBrokerFilters returns the number of filters that need a broker subscription
+// A filter that is covered by a wider filter that matches the topic has no broker subscription.
+//  matching are the filters that match the topic
+func (router *TopicRouter) countBrokerFilters(matching []string) (count int) {
+	for _, filter := range matching {
+		isCovered := false
+		for _, other := range matching {
+			if other != filter && CoversTopicFilter(other, filter) {
+				isCovered = true
+				break
+			}
+		}
+		if !isCovered {
+			count++
+		}
+	}
+	return count
+}
+
+// isCopy returns true if the message is a copy of a message that was already dispatched.
+// If not, and the broker sends multiple copies, the copies that are still expected are recorded.
+// This must be called with the mutex locked.
+//  topic the message is received on
+//  message is the received message
+//  copies is the number of copies the broker sends of the message
+func (router *TopicRouter) isCopy(topic string, message []byte, copies int) bool {
+	now := time.Now()
+	for key, pending := range router.pending {
+		if now.After(pending.expires) {
+			delete(router.pending, key)
+		}
+	}
+	hash := sha256.Sum256(message)
+	key := topic + "\x00" + string(hash[:])
+	if pending, found := router.pending[key]; found {
+		pending.remaining--
+		if pending.remaining <= 0 {
+			delete(router.pending, key)
+		}
+		return true
+	}
+	if copies > 1 {
+		router.pending[key] = &pendingCopies{remaining: copies - 1, expires: now.Add(DuplicateWindow)}
+	}
+	return false
+}
+
+// Filters returns the topic filters that have at least one handler
+func (router *TopicRouter) Filters() []string {
+	router.mutex.RLock()
+	defer router.mutex.RUnlock()
+
+	filters := make([]string, 0, len(router.filters))
+	for filter := range router.filters {
+		filters = append(filters, filter)
+	}
+	return filters
+}
+
+// maxQos returns the highest QoS of the subscriptions covered by the filter
+// This must be called with the mutex locked.
+func (router *TopicRouter) maxQos(filter string) (qos byte) {
+	for other, subs := range router.filters {
+		if CoversTopicFilter(filter, other) {
+			for _, sub := range subs {
+				if sub.qos > qos {
+					qos = sub.qos
+				}
+			}
+		}
+	}
+	return qos
+}
+
+// Remove a subscription handler.
+// The filter is removed when its last handler is removed.
+// Returns true if the subscription was found.
+func (router *TopicRouter) Remove(sub *TopicSubscription) (found bool) {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+
+	subs := router.filters[sub.filter]
+	for i, existing := range subs {
+		if existing.id == sub.id {
+			subs = append(subs[:i:i], subs[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if len(subs) == 0 {
+		delete(router.filters, sub.filter)
+	} else {
+		router.filters[sub.filter] = subs
+	}
+	return found
+}
+
+// RemoveFilter removes all handlers of a topic filter.
+// Returns true if the filter had handlers.
+func (router *TopicRouter) RemoveFilter(filter string) (removed bool) {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+
+	_, removed = router.filters[filter]
+	delete(router.filters, filter)
+	return removed
+}
+
+// CoversTopicFilter returns true if all topics matched by filter are also matched by the wider filter.
+// For example 'things/#' covers 'things/+/event', which in turn covers 'things/thing1/event'.
+func CoversTopicFilter(wider string, filter string) bool {
+	if wider == filter {
+		return true
+	}
+	if strings.HasPrefix(filter, "$") && (strings.HasPrefix(wider, "+") || strings.HasPrefix(wider, "#")) {
+		return false
+	}
+	widerLevels := strings.Split(wider, "/")
+	filterLevels := strings.Split(filter, "/")
+
+	for i, widerLevel := range widerLevels {
+		if widerLevel == "#" {
+			return i == len(widerLevels)-1
+		}
+		if i >= len(filterLevels) || filterLevels[i] == "#" {
+			return false
+		}
+		if widerLevel != "+" && widerLevel != filterLevels[i] {
+			return false
+		}
+	}
+	return len(widerLevels) == len(filterLevels)
+}
+
+// MatchTopic returns true if the topic matches the topic filter.
+//
+// This follows the MQTT matching rules:
+//  '+' matches exactly one topic level
+//  '#' matches the parent level and any number of sub levels. It must be the last character of the filter.
+//  Topics starting with '$' are not matched by filters that start with a wildcard.
+func MatchTopic(filter string, topic string) bool {
+	if filter == topic {
+		return true
+	}
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, filterLevel := range filterLevels {
+		if filterLevel == "#" {
+			return i == len(filterLevels)-1
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if filterLevel != "+" && filterLevel != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// NewTopicRouter creates a new instance of a topic router without subscriptions
+func NewTopicRouter() *TopicRouter {
+	router := &TopicRouter{
+		filters: make(map[string][]*TopicSubscription),
+		pending: make(map[string]*pendingCopies),
+	}
+	return router
+}
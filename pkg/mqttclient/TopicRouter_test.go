@@ -0,0 +1,123 @@
+package mqttclient_test
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/wostzone/wost-go/pkg/mqttclient"
+)
+
+func TestMatchTopic(t *testing.T) {
+	logrus.Infof("--- TestMatchTopic ---")
+
+	assert.True(t, mqttclient.MatchTopic("things/thing1/event", "things/thing1/event"))
+	assert.True(t, mqttclient.MatchTopic("things/+/event", "things/thing1/event"))
+	assert.True(t, mqttclient.MatchTopic("things/#", "things/thing1/event/name"))
+	assert.True(t, mqttclient.MatchTopic("things/thing1/#", "things/thing1"))
+	assert.True(t, mqttclient.MatchTopic("#", "things/thing1"))
+	assert.True(t, mqttclient.MatchTopic("+/+/event/#", "things/thing1/event/name"))
+
+	assert.False(t, mqttclient.MatchTopic("things/thing1/event", "things/thing2/event"))
+	assert.False(t, mqttclient.MatchTopic("things/+", "things/thing1/event"))
+	assert.False(t, mqttclient.MatchTopic("things/+/event/+", "things/thing1/event"))
+	assert.False(t, mqttclient.MatchTopic("things/#/event", "things/thing1/event"))
+	assert.False(t, mqttclient.MatchTopic("#", "$SYS/broker"))
+}
+
+func TestCoversTopicFilter(t *testing.T) {
+	logrus.Infof("--- TestCoversTopicFilter ---")
+
+	assert.True(t, mqttclient.CoversTopicFilter("things/#", "things/+/event"))
+	assert.True(t, mqttclient.CoversTopicFilter("things/+/event", "things/thing1/event"))
+	assert.True(t, mqttclient.CoversTopicFilter("things/+/#", "things/+/event/#"))
+	assert.True(t, mqttclient.CoversTopicFilter("#", "things"))
+
+	assert.False(t, mqttclient.CoversTopicFilter("things/+/event", "things/#"))
+	assert.False(t, mqttclient.CoversTopicFilter("things/thing1/event", "things/+/event"))
+	assert.False(t, mqttclient.CoversTopicFilter("things/+/event", "things/+/action"))
+	assert.False(t, mqttclient.CoversTopicFilter("things/+/event", "things/+/event/name"))
+	assert.False(t, mqttclient.CoversTopicFilter("#", "$SYS/#"))
+}
+
+func TestTopicRouter(t *testing.T) {
+	logrus.Infof("--- TestTopicRouter ---")
+	const topic1 = "things/thing1/event/name"
+	const filter1 = "things/+/event/#"
+	rxCount := 0
+	handler := func(topic string, message []byte) {
+		rxCount++
+	}
+
+	router := mqttclient.NewTopicRouter()
+	sub1 := router.Add(filter1, 1, handler)
+	sub2 := router.Add(filter1, 0, handler)
+	router.Add(topic1, 2, handler)
+	assert.Equal(t, 2, len(router.Filters()))
+	assert.Equal(t, byte(1), sub1.QoS())
+	// topic1 is covered by filter1 and doesn't need a broker subscription, but its QoS does apply
+	assert.Equal(t, map[string]byte{filter1: 2}, router.BrokerFilters())
+
+	count := router.Dispatch(topic1, []byte("hello"))
+	assert.Equal(t, 3, count)
+	assert.Equal(t, 3, rxCount)
+	count = router.Dispatch("things/thing2/event/name", []byte("hello"))
+	assert.Equal(t, 2, count)
+
+	// the filter remains until its last handler is removed
+	found := router.Remove(sub1)
+	assert.True(t, found)
+	assert.Equal(t, 2, len(router.Filters()))
+	found = router.Remove(sub2)
+	assert.True(t, found)
+	assert.Equal(t, map[string]byte{topic1: 2}, router.BrokerFilters())
+	// removing twice is harmless
+	found = router.Remove(sub2)
+	assert.False(t, found)
+
+	removed := router.RemoveFilter(topic1)
+	assert.True(t, removed)
+	removed = router.RemoveFilter(topic1)
+	assert.False(t, removed)
+	count = router.Dispatch(topic1, []byte("hello"))
+	assert.Equal(t, 0, count)
+	assert.Empty(t, router.BrokerFilters())
+}
+
+func TestTopicRouterOverlappingFilters(t *testing.T) {
+	logrus.Infof("--- TestTopicRouterOverlappingFilters ---")
+	const topic1 = "test/1/5"
+	rxCount1 := 0
+	rxCount2 := 0
+
+	router := mqttclient.NewTopicRouter()
+	router.Add("test/+/5", 1, func(topic string, message []byte) {
+		rxCount1++
+	})
+	router.Add("test/1/+", 1, func(topic string, message []byte) {
+		rxCount2++
+	})
+	assert.Equal(t, 2, len(router.BrokerFilters()))
+
+	// the broker sends a copy for each filter, each handler is invoked once
+	count := router.Dispatch(topic1, []byte("hello"))
+	assert.Equal(t, 2, count)
+	count = router.Dispatch(topic1, []byte("hello"))
+	assert.Equal(t, 0, count)
+	assert.Equal(t, 1, rxCount1)
+	assert.Equal(t, 1, rxCount2)
+
+	// the next message is dispatched again
+	count = router.Dispatch(topic1, []byte("hello"))
+	assert.Equal(t, 2, count)
+	count = router.Dispatch(topic1, []byte("world"))
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 3, rxCount1)
+
+	// topics that match a single filter have no copies
+	count = router.Dispatch("test/2/5", []byte("hello"))
+	assert.Equal(t, 1, count)
+	count = router.Dispatch("test/2/5", []byte("hello"))
+	assert.Equal(t, 1, count)
+}
@@ -0,0 +1,53 @@
+package mqttclient
+
+import (
+	"github.com/wostzone/wost-go/pkg/metrics"
+)
+
+// clientMetrics holds the metrics of the MQTT client, labeled with the application ID
+type clientMetrics struct {
+	handlerDuration *metrics.Histogram
+	publishes       *metrics.Counter
+	publishFailures *metrics.Counter
+	received        *metrics.Counter
+	reconnects      *metrics.Counter
+}
+
+// newClientMetrics creates or obtains the MQTT client metrics in the registry
+// Returns nil if the registry is nil, which disables the metrics.
+func newClientMetrics(registry *metrics.Registry) *clientMetrics {
+	if registry == nil {
+		return nil
+	}
+	return &clientMetrics{
+		handlerDuration: registry.NewHistogram("wost_mqtt_handler_duration_seconds",
+			"Time spent by the subscription handlers of a received message", nil, "app"),
+		publishes: registry.NewCounter("wost_mqtt_publish_total",
+			"Number of messages published to the broker", "app"),
+		publishFailures: registry.NewCounter("wost_mqtt_publish_failures_total",
+			"Number of messages that failed to publish", "app"),
+		received: registry.NewCounter("wost_mqtt_messages_received_total",
+			"Number of messages received from the broker", "app"),
+		reconnects: registry.NewCounter("wost_mqtt_reconnects_total",
+			"Number of attempts to reconnect to the broker", "app"),
+	}
+}
+
+// countPublish counts a published message or a publish failure
+//  err is the publish error, or nil if publishing succeeded
+func (mqttClient *MqttClient) countPublish(err error) {
+	if m := mqttClient.metrics; m != nil {
+		if err != nil {
+			m.publishFailures.Inc(mqttClient.appID)
+		} else {
+			m.publishes.Inc(mqttClient.appID)
+		}
+	}
+}
+
+// countReconnect counts an attempt to reconnect to the broker
+func (mqttClient *MqttClient) countReconnect() {
+	if m := mqttClient.metrics; m != nil {
+		m.reconnects.Inc(mqttClient.appID)
+	}
+}
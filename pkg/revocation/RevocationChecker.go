@@ -0,0 +1,251 @@
+// Package revocation with checking of certificates against the revocation list and OCSP responses of the CA
+package revocation
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/wostzone/wost-go/pkg/watcher"
+)
+
+// ErrCertRevoked is the error returned when a certificate is revoked.
+// Use errors.Is to distinguish a revoked certificate from other authentication failures.
+var ErrCertRevoked = errors.New("certificate is revoked")
+
+// ErrCRLExpired is the error returned when certificates are checked against an expired revocation list.
+// Certificates are rejected until a new CRL is loaded, unless expired CRLs are allowed with SetAllowExpiredCRL.
+var ErrCRLExpired = errors.New("revocation list has expired")
+
+// ErrNoCRL is the error returned when certificates are checked before a revocation list is loaded.
+// Certificates are rejected until a CRL is loaded, unless running without CRL is allowed with SetAllowNoCRL.
+var ErrNoCRL = errors.New("no revocation list is loaded")
+
+// RevocationChecker checks whether certificates issued by a CA are revoked.
+//
+// The revoked certificates are read from a certificate revocation list (CRL) signed by the CA. When the
+// CRL is loaded from file with WatchCRL, it is reloaded when the file changes. Servers can also provide
+// an OCSP response signed by the CA with their certificate (OCSP stapling), which is checked by clients.
+type RevocationChecker struct {
+	// CA that issues the certificates and signs the CRL and OCSP responses
+	caCert *x509.Certificate
+	// serial numbers of revoked certificates, in hex
+	revoked map[string]time.Time
+	// time the CRL should be updated
+	nextUpdate time.Time
+	// a CRL has been loaded
+	crlLoaded bool
+	// reject server certificates without OCSP response
+	requireOCSPStaple bool
+	// keep using the CRL after it has expired instead of rejecting all certificates
+	allowExpiredCRL bool
+	// accept certificates while no CRL is loaded instead of rejecting all certificates
+	allowNoCRL bool
+	// watcher of the CRL file
+	crlWatcher *fsnotify.Watcher
+	// mutex for concurrent access to the revocation list
+	mutex sync.RWMutex
+}
+
+// CheckCert returns an error wrapping ErrCertRevoked if the certificate is in the revocation list.
+// If no CRL is loaded then an error wrapping ErrNoCRL is returned, unless running without CRL is allowed.
+// If the loaded CRL has expired then an error wrapping ErrCRLExpired is returned, unless expired CRLs are allowed.
+func (checker *RevocationChecker) CheckCert(cert *x509.Certificate) error {
+	checker.mutex.RLock()
+	revokedAt, isRevoked := checker.revoked[cert.SerialNumber.Text(16)]
+	nextUpdate := checker.nextUpdate
+	crlLoaded := checker.crlLoaded
+	allowExpiredCRL := checker.allowExpiredCRL
+	allowNoCRL := checker.allowNoCRL
+	checker.mutex.RUnlock()
+	if !crlLoaded && !allowNoCRL {
+		return fmt.Errorf("%w: unable to check certificate of '%s'", ErrNoCRL, cert.Subject.CommonName)
+	}
+	if !allowExpiredCRL && !nextUpdate.IsZero() && time.Now().After(nextUpdate) {
+		return fmt.Errorf("%w: unable to check certificate of '%s' as the CRL expired at %s", ErrCRLExpired,
+			cert.Subject.CommonName, nextUpdate.Format(time.RFC3339))
+	}
+	if isRevoked {
+		return fmt.Errorf("%w: certificate of '%s' with serial %x was revoked at %s", ErrCertRevoked,
+			cert.Subject.CommonName, cert.SerialNumber, revokedAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// CheckOCSPResponse verifies an OCSP response of the CA for the certificate.
+// Returns an error wrapping ErrCertRevoked if the certificate is revoked, or an error if the
+// response is invalid, expired, or its status is unknown.
+//  cert to check
+//  ocspResponse is the DER encoded OCSP response, as stapled by TLS servers
+func (checker *RevocationChecker) CheckOCSPResponse(cert *x509.Certificate, ocspResponse []byte) error {
+	response, err := ocsp.ParseResponseForCert(ocspResponse, cert, checker.caCert)
+	if err != nil {
+		return fmt.Errorf("CheckOCSPResponse: invalid OCSP response: %s", err)
+	}
+	if !response.NextUpdate.IsZero() && time.Now().After(response.NextUpdate) {
+		return errors.New("CheckOCSPResponse: OCSP response has expired")
+	}
+	switch response.Status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return fmt.Errorf("%w: OCSP status of '%s' is revoked since %s", ErrCertRevoked,
+			cert.Subject.CommonName, response.RevokedAt.Format(time.RFC3339))
+	}
+	return fmt.Errorf("CheckOCSPResponse: OCSP status of '%s' is unknown", cert.Subject.CommonName)
+}
+
+// Close stops watching the CRL file
+func (checker *RevocationChecker) Close() {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	if checker.crlWatcher != nil {
+		_ = checker.crlWatcher.Close()
+		checker.crlWatcher = nil
+	}
+}
+
+// GetNextUpdate returns the time the loaded CRL should be updated, or zero if no CRL is loaded
+func (checker *RevocationChecker) GetNextUpdate() time.Time {
+	checker.mutex.RLock()
+	defer checker.mutex.RUnlock()
+	return checker.nextUpdate
+}
+
+// LoadCRL loads the certificate revocation list from a PEM or DER encoded file
+func (checker *RevocationChecker) LoadCRL(crlFile string) error {
+	crlData, err := ioutil.ReadFile(crlFile)
+	if err != nil {
+		return err
+	}
+	return checker.UpdateCRL(crlData)
+}
+
+// SetAllowExpiredCRL sets whether an expired CRL is used until it is updated.
+// By default certificates are rejected with ErrCRLExpired when the CRL has expired, as certificates that
+// were revoked since are not known.
+func (checker *RevocationChecker) SetAllowExpiredCRL(allow bool) {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	checker.allowExpiredCRL = allow
+}
+
+// SetAllowNoCRL sets whether certificates are accepted while no CRL is loaded.
+// By default certificates are rejected with ErrNoCRL until a CRL is loaded, as revoked certificates are not known.
+// Only allow this if revocation is not used or is checked with OCSP responses.
+func (checker *RevocationChecker) SetAllowNoCRL(allow bool) {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	checker.allowNoCRL = allow
+}
+
+// SetRequireOCSPStaple sets whether servers must provide an OCSP response with their certificate.
+// By default OCSP responses are checked when they are provided.
+func (checker *RevocationChecker) SetRequireOCSPStaple(require bool) {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	checker.requireOCSPStaple = require
+}
+
+// UpdateCRL replaces the revocation list with the given CRL.
+// The CRL must be signed by the CA. After the CRL expires, CheckCert rejects all certificates until
+// the CRL is updated, unless SetAllowExpiredCRL is used.
+//  crlData is the PEM or DER encoded CRL
+func (checker *RevocationChecker) UpdateCRL(crlData []byte) error {
+	if block, _ := pem.Decode(crlData); block != nil {
+		crlData = block.Bytes
+	}
+	crl, err := x509.ParseCRL(crlData)
+	if err != nil {
+		return fmt.Errorf("UpdateCRL: invalid CRL: %s", err)
+	}
+	err = checker.caCert.CheckCRLSignature(crl)
+	if err != nil {
+		return fmt.Errorf("UpdateCRL: CRL is not signed by the CA: %s", err)
+	}
+	if crl.HasExpired(time.Now()) {
+		logrus.Warningf("CRL has expired at %s", crl.TBSCertList.NextUpdate.Format(time.RFC3339))
+	}
+	revoked := make(map[string]time.Time)
+	for _, entry := range crl.TBSCertList.RevokedCertificates {
+		revoked[entry.SerialNumber.Text(16)] = entry.RevocationTime
+	}
+	logrus.Infof("Loaded CRL with %d revoked certificates", len(revoked))
+
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	checker.revoked = revoked
+	checker.nextUpdate = crl.TBSCertList.NextUpdate
+	checker.crlLoaded = true
+	return nil
+}
+
+// VerifyConnection checks the certificate of the peer of a TLS connection.
+// Use this as the VerifyConnection function of a client's tls.Config. If the server provided an
+// OCSP response then it is checked as well. Without a CRL the certificate is only accepted if the server
+// provided an OCSP response.
+func (checker *RevocationChecker) VerifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := cs.PeerCertificates[0]
+	err := checker.CheckCert(cert)
+	if err != nil && !(errors.Is(err, ErrNoCRL) && len(cs.OCSPResponse) > 0) {
+		return err
+	}
+	checker.mutex.RLock()
+	requireOCSPStaple := checker.requireOCSPStaple
+	checker.mutex.RUnlock()
+	if len(cs.OCSPResponse) > 0 {
+		return checker.CheckOCSPResponse(cert, cs.OCSPResponse)
+	} else if requireOCSPStaple {
+		return fmt.Errorf("VerifyConnection: server '%s' did not provide an OCSP response", cert.Subject.CommonName)
+	}
+	return nil
+}
+
+// WatchCRL loads the certificate revocation list from file and reloads it when the file changes
+//  crlFile is the PEM or DER encoded CRL file
+func (checker *RevocationChecker) WatchCRL(crlFile string) error {
+	err := checker.LoadCRL(crlFile)
+	if err != nil {
+		logrus.Errorf("Unable to load CRL '%s': %s", crlFile, err)
+		return err
+	}
+	crlWatcher, err := watcher.WatchFile(crlFile, func() error {
+		err := checker.LoadCRL(crlFile)
+		if err != nil {
+			logrus.Errorf("Unable to reload CRL '%s': %s. Keeping the previous CRL.", crlFile, err)
+		}
+		return err
+	}, "RevocationChecker")
+	if err != nil {
+		_ = crlWatcher.Close()
+		return err
+	}
+	checker.Close()
+	checker.mutex.Lock()
+	checker.crlWatcher = crlWatcher
+	checker.mutex.Unlock()
+	return nil
+}
+
+// NewRevocationChecker creates a checker of certificates issued by a CA.
+// Certificates are rejected until a CRL is loaded with LoadCRL, UpdateCRL or WatchCRL, unless SetAllowNoCRL is used.
+//  caCert is the CA that issues the certificates and signs the CRL
+func NewRevocationChecker(caCert *x509.Certificate) *RevocationChecker {
+	checker := &RevocationChecker{
+		caCert:  caCert,
+		revoked: make(map[string]time.Time),
+	}
+	return checker
+}
@@ -0,0 +1,169 @@
+package revocation_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/wostzone/wost-go/pkg/certsclient"
+	"github.com/wostzone/wost-go/pkg/revocation"
+)
+
+// create a CA with a device certificate for testing
+func createTestCA(t *testing.T) (*certsclient.CertAuthority, *x509.Certificate) {
+	caKey := certsclient.CreateECDSAKeys()
+	caCert, err := certsclient.CreateCACert("Test CA", caKey, 0)
+	require.NoError(t, err)
+	ca, err := certsclient.NewCertAuthority(caCert, caKey, "")
+	require.NoError(t, err)
+	deviceKey := certsclient.CreateECDSAKeys()
+	deviceCert, err := ca.IssueCert(&deviceKey.PublicKey, certsclient.CSROptions{
+		CommonName:         "device1",
+		OrganizationalUnit: certsclient.OUIoTDevice,
+	})
+	require.NoError(t, err)
+	return ca, deviceCert
+}
+
+func TestCRL(t *testing.T) {
+	logrus.Infof("--- TestCRL ---")
+	crlFile := path.Join(t.TempDir(), "ca.crl")
+	ca, deviceCert := createTestCA(t)
+	crlPEM, err := ca.CreateCRL(time.Hour)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(crlFile, []byte(crlPEM), 0644)
+	require.NoError(t, err)
+
+	checker := revocation.NewRevocationChecker(ca.GetCACert())
+	err = checker.WatchCRL(crlFile)
+	require.NoError(t, err)
+	defer checker.Close()
+	assert.False(t, checker.GetNextUpdate().IsZero())
+	err = checker.CheckCert(deviceCert)
+	assert.NoError(t, err)
+
+	// the CRL is reloaded when the file changes
+	err = ca.Revoke(deviceCert.SerialNumber, certsclient.RevocationReasonKeyCompromise)
+	require.NoError(t, err)
+	crlPEM, _ = ca.CreateCRL(time.Hour)
+	err = ioutil.WriteFile(crlFile, []byte(crlPEM), 0644)
+	require.NoError(t, err)
+	time.Sleep(500 * time.Millisecond)
+	err = checker.CheckCert(deviceCert)
+	assert.True(t, errors.Is(err, revocation.ErrCertRevoked))
+
+	// a CRL from another CA is rejected
+	otherCA, _ := createTestCA(t)
+	otherPEM, _ := otherCA.CreateCRL(time.Hour)
+	err = checker.UpdateCRL([]byte(otherPEM))
+	assert.Error(t, err)
+	err = checker.UpdateCRL([]byte("not a crl"))
+	assert.Error(t, err)
+	err = checker.LoadCRL("/not/a/file")
+	assert.Error(t, err)
+	// the previous CRL is kept
+	err = checker.CheckCert(deviceCert)
+	assert.True(t, errors.Is(err, revocation.ErrCertRevoked))
+}
+
+func TestOCSPResponse(t *testing.T) {
+	logrus.Infof("--- TestOCSPResponse ---")
+	ca, deviceCert := createTestCA(t)
+	checker := revocation.NewRevocationChecker(ca.GetCACert())
+
+	ocspResponse, err := ca.CreateOCSPResponse(deviceCert, time.Hour)
+	require.NoError(t, err)
+	err = checker.CheckOCSPResponse(deviceCert, ocspResponse)
+	assert.NoError(t, err)
+	connState := tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{deviceCert},
+		OCSPResponse:     ocspResponse,
+	}
+	err = checker.VerifyConnection(connState)
+	assert.NoError(t, err)
+
+	// a missing OCSP response is rejected when required
+	checker.SetRequireOCSPStaple(true)
+	connState.OCSPResponse = nil
+	err = checker.VerifyConnection(connState)
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, revocation.ErrCertRevoked))
+
+	// revoked certificates are rejected
+	err = ca.Revoke(deviceCert.SerialNumber, certsclient.RevocationReasonUnspecified)
+	require.NoError(t, err)
+	ocspResponse, err = ca.CreateOCSPResponse(deviceCert, time.Hour)
+	require.NoError(t, err)
+	connState.OCSPResponse = ocspResponse
+	err = checker.VerifyConnection(connState)
+	assert.True(t, errors.Is(err, revocation.ErrCertRevoked))
+
+	err = checker.CheckOCSPResponse(deviceCert, []byte("not a response"))
+	assert.Error(t, err)
+}
+
+func TestExpiredCRL(t *testing.T) {
+	logrus.Infof("--- TestExpiredCRL ---")
+	ca, deviceCert := createTestCA(t)
+	checker := revocation.NewRevocationChecker(ca.GetCACert())
+	crlPEM, err := ca.CreateCRL(time.Millisecond)
+	require.NoError(t, err)
+	err = checker.UpdateCRL([]byte(crlPEM))
+	require.NoError(t, err)
+	time.Sleep(time.Second)
+
+	// certificates are rejected when the CRL has expired
+	err = checker.CheckCert(deviceCert)
+	assert.True(t, errors.Is(err, revocation.ErrCRLExpired))
+	assert.False(t, errors.Is(err, revocation.ErrCertRevoked))
+
+	// unless expired CRLs are allowed
+	checker.SetAllowExpiredCRL(true)
+	err = checker.CheckCert(deviceCert)
+	assert.NoError(t, err)
+
+	// an updated CRL is accepted
+	checker.SetAllowExpiredCRL(false)
+	crlPEM, _ = ca.CreateCRL(time.Hour)
+	err = checker.UpdateCRL([]byte(crlPEM))
+	require.NoError(t, err)
+	err = checker.CheckCert(deviceCert)
+	assert.NoError(t, err)
+}
+
+func TestNoCRL(t *testing.T) {
+	logrus.Infof("--- TestNoCRL ---")
+	ca, deviceCert := createTestCA(t)
+	checker := revocation.NewRevocationChecker(ca.GetCACert())
+
+	// certificates are rejected until a CRL is loaded
+	err := checker.CheckCert(deviceCert)
+	assert.True(t, errors.Is(err, revocation.ErrNoCRL))
+	assert.False(t, errors.Is(err, revocation.ErrCertRevoked))
+	connState := tls.ConnectionState{PeerCertificates: []*x509.Certificate{deviceCert}}
+	err = checker.VerifyConnection(connState)
+	assert.True(t, errors.Is(err, revocation.ErrNoCRL))
+
+	// unless running without CRL is allowed
+	checker.SetAllowNoCRL(true)
+	err = checker.CheckCert(deviceCert)
+	assert.NoError(t, err)
+
+	// a loaded CRL is used
+	checker.SetAllowNoCRL(false)
+	err = ca.Revoke(deviceCert.SerialNumber, certsclient.RevocationReasonUnspecified)
+	require.NoError(t, err)
+	crlPEM, _ := ca.CreateCRL(time.Hour)
+	err = checker.UpdateCRL([]byte(crlPEM))
+	require.NoError(t, err)
+	err = checker.CheckCert(deviceCert)
+	assert.True(t, errors.Is(err, revocation.ErrCertRevoked))
+}
@@ -0,0 +1,407 @@
+package signing
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"gopkg.in/square/go-jose.v2"
+
+	"github.com/wostzone/wost-go/pkg/certsclient"
+)
+
+// DefaultPreviousKeys is the default number of previous keys that a key ring keeps after rotation
+const DefaultPreviousKeys = 2
+
+// KeyRing holds the current and previous private keys of a client, and the public keys of others, by key ID.
+//
+// Messages are signed with the current key and include its key ID. After rotation the previous keys are kept
+// so that messages that were encrypted for them while in flight can still be decrypted. Receivers verify
+// signatures with the public key that matches the key ID of the message, which lets them accept messages
+// signed with the old and the new key while a rotation is in progress. A MessageSigner only accepts a signed
+// message if the key is bound to the sender of the message, see AddSenderPublicKey.
+type KeyRing struct {
+	// current private key for signing and decryption, nil for a verify-only key ring
+	current *jose.JSONWebKey
+	// maximum number of previous keys to keep
+	maxPrevious int
+	// previous private keys, newest first, used for decryption and verification
+	previous []*jose.JSONWebKey
+	// public keys of others by key ID
+	publicKeys map[string]*jose.JSONWebKey
+	// senders that the public keys of others belong to, by key ID
+	senders map[string]string
+	// mutex for concurrent access to the keys
+	mutex sync.RWMutex
+}
+
+// AddPublicKey adds the public key of another party for verifying its messages and encrypting messages to it.
+// An existing key with the same key ID is replaced.
+//  jwk with the public key. Private keys are reduced to their public key.
+func (ring *KeyRing) AddPublicKey(jwk *jose.JSONWebKey) error {
+	return ring.addPublicKey(jwk, "")
+}
+
+// AddSenderPublicKey adds the public key of a sender for verifying its signed messages and encrypting
+// messages to it. A MessageSigner only accepts messages signed with this key if they are from this sender.
+// An existing key with the same key ID is replaced.
+//  jwk with the public key. Private keys are reduced to their public key.
+//  sender is the client ID of the owner of the key
+func (ring *KeyRing) AddSenderPublicKey(jwk *jose.JSONWebKey, sender string) error {
+	if sender == "" {
+		return errors.New("AddSenderPublicKey: missing sender")
+	}
+	return ring.addPublicKey(jwk, sender)
+}
+
+// CurrentKeyID returns the key ID of the current private key, or "" if the key ring has no private key
+func (ring *KeyRing) CurrentKeyID() string {
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+	if ring.current == nil {
+		return ""
+	}
+	return ring.current.KeyID
+}
+
+// Decrypt a JWE message that was encrypted for the current or a previous key of the ring.
+// Returns the payload and the key ID used to decrypt
+func (ring *KeyRing) Decrypt(message string) (payload []byte, kid string, err error) {
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+	keys := ring.privateKeys()
+	return DecryptJWE(message, &keys)
+}
+
+// Encrypt the payload for the owner of a public key in the ring using JWE.
+//  payload to encrypt
+//  kid is the key ID of the receiver's public key, added with AddPublicKey
+// Returns the JWE compact serialized message
+func (ring *KeyRing) Encrypt(payload []byte, kid string) (string, error) {
+	ring.mutex.RLock()
+	jwk := ring.publicKey(kid)
+	ring.mutex.RUnlock()
+	if jwk == nil {
+		return "", fmt.Errorf("Encrypt: unknown key ID '%s'", kid)
+	}
+	return EncryptJWE(payload, jwk)
+}
+
+// PublicKeys returns the public keys of the current and previous private keys.
+// Share these with others so they can verify messages that were signed before and after rotation.
+func (ring *KeyRing) PublicKeys() jose.JSONWebKeySet {
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+	keySet := jose.JSONWebKeySet{Keys: make([]jose.JSONWebKey, 0)}
+	for _, key := range ring.privateKeys().Keys {
+		keySet.Keys = append(keySet.Keys, key.Public())
+	}
+	return keySet
+}
+
+// RemovePublicKey removes the public key of another party
+func (ring *KeyRing) RemovePublicKey(kid string) {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+	delete(ring.publicKeys, kid)
+	delete(ring.senders, kid)
+}
+
+// Rotate replaces the current private key with a new key. The current key becomes the newest
+// previous key and the oldest previous key is removed when more than the maximum are kept.
+//  privateKey is the new *ecdsa.PrivateKey, ed25519.PrivateKey or *rsa.PrivateKey
+// Returns the key ID of the new key
+func (ring *KeyRing) Rotate(privateKey crypto.Signer) (kid string, err error) {
+	jwk, err := NewJWK(privateKey)
+	if err != nil {
+		return "", err
+	}
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+	if ring.current != nil {
+		ring.previous = append([]*jose.JSONWebKey{ring.current}, ring.previous...)
+		if len(ring.previous) > ring.maxPrevious {
+			ring.previous = ring.previous[:ring.maxPrevious]
+		}
+	}
+	ring.current = jwk
+	return jwk.KeyID, nil
+}
+
+// Sign the payload with the current key using JWS. The key ID is included in the JWS header.
+// Returns the JWS compact serialized message
+func (ring *KeyRing) Sign(payload []byte) (string, error) {
+	ring.mutex.RLock()
+	current := ring.current
+	ring.mutex.RUnlock()
+	if current == nil {
+		return "", errors.New("Sign: key ring has no private key")
+	}
+	return SignJWS(payload, current)
+}
+
+// Verify a JWS message using the public key that matches its key ID.
+// The key is looked up in the public keys of others and of the ring's own current and previous keys.
+// Returns the payload and the key ID of the signer
+func (ring *KeyRing) Verify(message string) (payload []byte, kid string, err error) {
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+	keys := ring.privateKeys()
+	for _, jwk := range ring.publicKeys {
+		keys.Keys = append(keys.Keys, *jwk)
+	}
+	return VerifyJWS(message, &keys)
+}
+
+// addPublicKey adds the public key of another party and the sender it belongs to, if known
+func (ring *KeyRing) addPublicKey(jwk *jose.JSONWebKey, sender string) error {
+	if jwk == nil || !jwk.Valid() || jwk.KeyID == "" {
+		return errors.New("AddPublicKey: not a valid key with key ID")
+	}
+	publicKey := jwk.Public()
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+	ring.publicKeys[jwk.KeyID] = &publicKey
+	if sender != "" {
+		ring.senders[jwk.KeyID] = sender
+	} else {
+		delete(ring.senders, jwk.KeyID)
+	}
+	return nil
+}
+
+// isOwnKey returns true if the key ID is of the current or a previous private key of the ring
+func (ring *KeyRing) isOwnKey(kid string) bool {
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+	keys := ring.privateKeys()
+	return len(keys.Key(kid)) > 0
+}
+
+// keySender returns the sender that a public key of others is bound to, or "" if it isn't bound
+func (ring *KeyRing) keySender(kid string) string {
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+	return ring.senders[kid]
+}
+
+// privateKeys returns the current and previous private keys
+// This must be called with the mutex locked.
+func (ring *KeyRing) privateKeys() jose.JSONWebKeySet {
+	keySet := jose.JSONWebKeySet{Keys: make([]jose.JSONWebKey, 0)}
+	if ring.current != nil {
+		keySet.Keys = append(keySet.Keys, *ring.current)
+	}
+	for _, key := range ring.previous {
+		keySet.Keys = append(keySet.Keys, *key)
+	}
+	return keySet
+}
+
+// publicKey returns the public key with the given key ID, or nil if not found
+// This must be called with the mutex locked.
+func (ring *KeyRing) publicKey(kid string) *jose.JSONWebKey {
+	if jwk, found := ring.publicKeys[kid]; found {
+		return jwk
+	}
+	keys := ring.privateKeys()
+	if matches := keys.Key(kid); len(matches) > 0 {
+		publicKey := matches[0].Public()
+		return &publicKey
+	}
+	return nil
+}
+
+// DecryptJWE decrypts a JWE message using the key that matches the key ID in its header.
+// If the message has no key ID then each of the keys is tried.
+//  message is the JWE serialized message
+//  keys with the private keys of the receiver
+// Returns the payload and the key ID used to decrypt
+func DecryptJWE(message string, keys *jose.JSONWebKeySet) (payload []byte, kid string, err error) {
+	jwe, err := jose.ParseEncrypted(message)
+	if err != nil {
+		return nil, "", err
+	}
+	candidates := keys.Keys
+	if jwe.Header.KeyID != "" {
+		candidates = keys.Key(jwe.Header.KeyID)
+		if len(candidates) == 0 {
+			return nil, jwe.Header.KeyID, fmt.Errorf("DecryptJWE: unknown key ID '%s'", jwe.Header.KeyID)
+		}
+	}
+	err = errors.New("DecryptJWE: no key to decrypt the message")
+	for _, key := range candidates {
+		payload, err = jwe.Decrypt(key.Key)
+		if err == nil {
+			return payload, key.KeyID, nil
+		}
+	}
+	return nil, jwe.Header.KeyID, err
+}
+
+// EncryptJWE encrypts the payload for the owner of the key using JWE. The key ID is included in the header.
+// ECDSA keys use ECDH-ES and RSA keys use RSA-OAEP-256 key agreement. Ed25519 keys can't be used for encryption.
+//  payload to encrypt
+//  jwk with the public key of the receiver
+// Returns the JWE compact serialized message
+func EncryptJWE(payload []byte, jwk *jose.JSONWebKey) (string, error) {
+	var algorithm jose.KeyAlgorithm
+	switch certsclient.GetKeyType(jwk.Key) {
+	case certsclient.KeyTypeECDSA:
+		algorithm = jose.ECDH_ES
+	case certsclient.KeyTypeRSA:
+		algorithm = jose.RSA_OAEP_256
+	default:
+		return "", fmt.Errorf("EncryptJWE: key '%s' can't be used for encryption", jwk.KeyID)
+	}
+	publicKey := jwk.Public()
+	recipient := jose.Recipient{Algorithm: algorithm, Key: publicKey.Key, KeyID: jwk.KeyID}
+	encrypter, err := jose.NewEncrypter(jose.A128CBC_HS256, recipient, nil)
+	if err != nil {
+		return "", err
+	}
+	jwe, err := encrypter.Encrypt(payload)
+	if err != nil {
+		return "", err
+	}
+	return jwe.CompactSerialize()
+}
+
+// ExportJWK returns the JSON encoded JWK of a key
+//  jwk to export. Use jwk.Public() to only export the public key.
+func ExportJWK(jwk *jose.JSONWebKey) ([]byte, error) {
+	return json.Marshal(jwk)
+}
+
+// ImportJWK parses a JSON encoded JWK. If the key has no key ID then its thumbprint is used.
+// If the key has no algorithm then the signature algorithm of its key type is used, as in NewJWK.
+func ImportJWK(data []byte) (*jose.JSONWebKey, error) {
+	jwk := &jose.JSONWebKey{}
+	err := json.Unmarshal(data, jwk)
+	if err != nil {
+		return nil, err
+	} else if !jwk.Valid() || certsclient.GetKeyType(jwk.Key) == "" {
+		return nil, errors.New("ImportJWK: not a supported key")
+	}
+	algorithm, err := keyAlgorithm(jwk.Key)
+	if err != nil {
+		return nil, err
+	} else if jwk.Algorithm == "" {
+		jwk.Algorithm = string(algorithm)
+	} else if jwk.Algorithm != string(algorithm) {
+		return nil, fmt.Errorf("ImportJWK: algorithm '%s' doesn't match the key type", jwk.Algorithm)
+	}
+	if jwk.KeyID == "" {
+		jwk.KeyID, err = KeyID(jwk.Key)
+	}
+	return jwk, err
+}
+
+// KeyID returns the key ID of a private or public key.
+// This is the base64url encoded SHA-256 thumbprint of the public key, as described in RFC7638.
+func KeyID(key interface{}) (string, error) {
+	jwk := jose.JSONWebKey{Key: key}
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
+// NewJWK wraps a private or public key in a JWK with its key ID and signature algorithm.
+// ECDSA keys use ES256, Ed25519 keys use EdDSA, and RSA keys use RS256.
+//  key is the ECDSA, Ed25519 or RSA private or public key
+func NewJWK(key interface{}) (*jose.JSONWebKey, error) {
+	algorithm, err := keyAlgorithm(key)
+	if err != nil {
+		return nil, err
+	}
+	kid, err := KeyID(key)
+	if err != nil {
+		return nil, err
+	}
+	jwk := &jose.JSONWebKey{
+		Key:       key,
+		KeyID:     kid,
+		Algorithm: string(algorithm),
+	}
+	return jwk, nil
+}
+
+// keyAlgorithm returns the signature algorithm for the type of key
+func keyAlgorithm(key interface{}) (jose.SignatureAlgorithm, error) {
+	switch certsclient.GetKeyType(key) {
+	case certsclient.KeyTypeECDSA:
+		return jose.ES256, nil
+	case certsclient.KeyTypeEd25519:
+		return jose.EdDSA, nil
+	case certsclient.KeyTypeRSA:
+		return jose.RS256, nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", key)
+}
+
+// SignJWS signs the payload using JWS with the key's algorithm. The key ID is included in the header.
+//  payload to sign
+//  jwk with the private key of the signer, see NewJWK
+// Returns the JWS compact serialized message
+func SignJWS(payload []byte, jwk *jose.JSONWebKey) (string, error) {
+	signingKey := jose.SigningKey{Algorithm: jose.SignatureAlgorithm(jwk.Algorithm), Key: jwk}
+	joseSigner, err := jose.NewSigner(signingKey, nil)
+	if err != nil {
+		return "", err
+	}
+	signedObject, err := joseSigner.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	return signedObject.CompactSerialize()
+}
+
+// VerifyJWS verifies a JWS message using the public key that matches the key ID in its header.
+//  message is the JWS serialized message
+//  keys with the public keys of known signers
+// Returns the payload and the key ID of the signer
+func VerifyJWS(message string, keys *jose.JSONWebKeySet) (payload []byte, kid string, err error) {
+	jws, err := jose.ParseSigned(message)
+	if err != nil {
+		return nil, "", err
+	} else if len(jws.Signatures) == 0 {
+		return nil, "", errors.New("VerifyJWS: message has no signature")
+	}
+	kid = jws.Signatures[0].Header.KeyID
+	matches := keys.Key(kid)
+	if kid == "" || len(matches) == 0 {
+		return nil, kid, fmt.Errorf("VerifyJWS: unknown key ID '%s'", kid)
+	}
+	publicKey := matches[0].Public()
+	payload, err = jws.Verify(publicKey.Key)
+	if err != nil {
+		return nil, kid, fmt.Errorf("VerifyJWS: signature of key '%s' fails to verify", kid)
+	}
+	return payload, kid, nil
+}
+
+// NewKeyRing creates a key ring with a private key
+//  privateKey is the current *ecdsa.PrivateKey, ed25519.PrivateKey or *rsa.PrivateKey. nil to only verify messages.
+//  maxPrevious is the number of previous keys to keep after rotation. Use 0 for DefaultPreviousKeys.
+func NewKeyRing(privateKey crypto.Signer, maxPrevious int) (*KeyRing, error) {
+	if maxPrevious <= 0 {
+		maxPrevious = DefaultPreviousKeys
+	}
+	ring := &KeyRing{
+		maxPrevious: maxPrevious,
+		previous:    make([]*jose.JSONWebKey, 0),
+		publicKeys:  make(map[string]*jose.JSONWebKey),
+		senders:     make(map[string]string),
+	}
+	if privateKey != nil {
+		if _, err := ring.Rotate(privateKey); err != nil {
+			return nil, err
+		}
+	}
+	return ring, nil
+}
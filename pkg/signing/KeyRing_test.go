@@ -0,0 +1,284 @@
+package signing_test
+
+import (
+	"crypto/ecdsa"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+
+	"github.com/wostzone/wost-go/pkg/certsclient"
+	"github.com/wostzone/wost-go/pkg/revocation"
+	"github.com/wostzone/wost-go/pkg/signing"
+)
+
+func TestJWKImportExport(t *testing.T) {
+	for _, keyType := range []certsclient.KeyType{
+		certsclient.KeyTypeECDSA, certsclient.KeyTypeEd25519, certsclient.KeyTypeRSA} {
+
+		privKey, err := certsclient.CreateKeys(keyType)
+		require.NoError(t, err)
+		jwk, err := signing.NewJWK(privKey)
+		require.NoError(t, err)
+		assert.NotEmpty(t, jwk.KeyID)
+
+		// the public key has the same key ID
+		publicJWK := jwk.Public()
+		data, err := signing.ExportJWK(&publicJWK)
+		require.NoError(t, err)
+		imported, err := signing.ImportJWK(data)
+		require.NoError(t, err)
+		assert.Equal(t, jwk.KeyID, imported.KeyID)
+		assert.True(t, imported.IsPublic())
+
+		// keys without algorithm get the algorithm of their key type
+		data, _ = signing.ExportJWK(&jose.JSONWebKey{Key: publicJWK.Key})
+		imported, err = signing.ImportJWK(data)
+		require.NoError(t, err)
+		assert.Equal(t, jwk.Algorithm, imported.Algorithm)
+		assert.Equal(t, jwk.KeyID, imported.KeyID)
+		data, _ = signing.ExportJWK(&jose.JSONWebKey{Key: publicJWK.Key, Algorithm: "HS256"})
+		_, err = signing.ImportJWK(data)
+		assert.Error(t, err)
+
+		// sign and verify using the key ID
+		signed, err := signing.SignJWS([]byte("hello"), jwk)
+		require.NoError(t, err)
+		ring, _ := signing.NewKeyRing(nil, 0)
+		err = ring.AddPublicKey(imported)
+		require.NoError(t, err)
+		payload, kid, err := ring.Verify(signed)
+		assert.NoError(t, err)
+		assert.Equal(t, jwk.KeyID, kid)
+		assert.Equal(t, "hello", string(payload))
+	}
+	_, err := signing.ImportJWK([]byte("not a jwk"))
+	assert.Error(t, err)
+	_, err = signing.NewJWK("not a key")
+	assert.Error(t, err)
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	privKey1, _ := certsclient.CreateKeys(certsclient.KeyTypeECDSA)
+	device, err := signing.NewKeyRing(privKey1, 1)
+	require.NoError(t, err)
+	kid1 := device.CurrentKeyID()
+
+	// the consumer knows the device's public keys
+	consumer, _ := signing.NewKeyRing(nil, 0)
+	for _, jwk := range device.PublicKeys().Keys {
+		_ = consumer.AddPublicKey(&jwk)
+	}
+	signed1, err := device.Sign([]byte("before"))
+	require.NoError(t, err)
+	encrypted1, err := consumer.Encrypt([]byte("in flight"), kid1)
+	require.NoError(t, err)
+
+	// rotate the device key
+	privKey2, _ := certsclient.CreateKeys(certsclient.KeyTypeRSA)
+	kid2, err := device.Rotate(privKey2)
+	require.NoError(t, err)
+	assert.NotEqual(t, kid1, kid2)
+	assert.Len(t, device.PublicKeys().Keys, 2)
+	for _, jwk := range device.PublicKeys().Keys {
+		_ = consumer.AddPublicKey(&jwk)
+	}
+
+	// messages in flight still verify and decrypt
+	payload, kid, err := consumer.Verify(signed1)
+	assert.NoError(t, err)
+	assert.Equal(t, kid1, kid)
+	assert.Equal(t, "before", string(payload))
+	payload, kid, err = device.Decrypt(encrypted1)
+	assert.NoError(t, err)
+	assert.Equal(t, kid1, kid)
+	assert.Equal(t, "in flight", string(payload))
+
+	// new messages use the new key
+	signed2, _ := device.Sign([]byte("after"))
+	_, kid, err = consumer.Verify(signed2)
+	assert.NoError(t, err)
+	assert.Equal(t, kid2, kid)
+	encrypted2, err := consumer.Encrypt([]byte("new"), kid2)
+	require.NoError(t, err)
+	payload, _, err = device.Decrypt(encrypted2)
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(payload))
+
+	// the oldest key is dropped after the next rotation
+	privKey3, _ := certsclient.CreateKeys(certsclient.KeyTypeEd25519)
+	_, err = device.Rotate(privKey3)
+	require.NoError(t, err)
+	_, _, err = device.Decrypt(encrypted1)
+	assert.Error(t, err)
+
+	// unknown keys fail
+	_, err = consumer.Encrypt([]byte("new"), "unknown")
+	assert.Error(t, err)
+	consumer.RemovePublicKey(kid1)
+	_, _, err = consumer.Verify(signed1)
+	assert.Error(t, err)
+
+	// ed25519 keys can't be used for encryption
+	_, err = device.Encrypt([]byte("new"), device.CurrentKeyID())
+	assert.Error(t, err)
+}
+
+func TestMessageSignerKeyRing(t *testing.T) {
+	payload := []byte(`{"field1":"unlock"}`)
+	privKey1, _ := certsclient.CreateKeys(certsclient.KeyTypeECDSA)
+	deviceRing, err := signing.NewKeyRing(privKey1, 1)
+	require.NoError(t, err)
+	device := signing.NewMessageSigner("device1", nil, nil)
+	device.SetKeyRing(deviceRing)
+	assert.True(t, device.CanSign())
+
+	// the consumer knows the device's public keys
+	consumerRing, _ := signing.NewKeyRing(nil, 0)
+	for _, jwk := range deviceRing.PublicKeys().Keys {
+		_ = consumerRing.AddSenderPublicKey(&jwk, "device1")
+	}
+	consumer := signing.NewMessageSigner("consumer1", nil, nil)
+	consumer.SetKeyRing(consumerRing)
+	assert.False(t, consumer.CanSign())
+
+	signed1, err := device.SignMessage(testThingID, testTopic, payload)
+	require.NoError(t, err)
+	encrypted1, err := consumerRing.Encrypt(payload, deviceRing.CurrentKeyID())
+	require.NoError(t, err)
+
+	// after rotation the messages in flight are still accepted
+	privKey2, _ := certsclient.CreateKeys(certsclient.KeyTypeECDSA)
+	_, err = deviceRing.Rotate(privKey2)
+	require.NoError(t, err)
+	for _, jwk := range deviceRing.PublicKeys().Keys {
+		_ = consumerRing.AddSenderPublicKey(&jwk, "device1")
+	}
+	rxPayload, sender, isSigned, err := consumer.VerifyMessage([]byte(signed1), testThingID, testTopic)
+	assert.NoError(t, err)
+	assert.True(t, isSigned)
+	assert.Equal(t, "device1", sender)
+	assert.Equal(t, payload, rxPayload)
+	decrypted, isEncrypted, err := device.DecryptMessage([]byte(encrypted1))
+	assert.NoError(t, err)
+	assert.True(t, isEncrypted)
+	assert.Equal(t, payload, decrypted)
+
+	// new messages are signed with the new key
+	signed2, err := device.SignMessage(testThingID, testTopic, payload)
+	require.NoError(t, err)
+	_, _, _, err = consumer.VerifyMessage([]byte(signed2), testThingID, testTopic)
+	assert.NoError(t, err)
+
+	// messages signed with unknown keys are rejected
+	consumerRing.RemovePublicKey(deviceRing.CurrentKeyID())
+	_, _, _, err = consumer.VerifyMessage([]byte(signed2), testThingID, testTopic)
+	assert.Error(t, err)
+}
+
+func TestKeyRingOtherSender(t *testing.T) {
+	payload := []byte(`{"field1":"unlock"}`)
+	privKeyA, _ := certsclient.CreateKeys(certsclient.KeyTypeECDSA)
+	privKeyB, _ := certsclient.CreateKeys(certsclient.KeyTypeECDSA)
+	ringA, _ := signing.NewKeyRing(privKeyA, 0)
+	ringB, _ := signing.NewKeyRing(privKeyB, 0)
+
+	consumerRing, _ := signing.NewKeyRing(nil, 0)
+	for _, jwk := range ringA.PublicKeys().Keys {
+		_ = consumerRing.AddSenderPublicKey(&jwk, "device1")
+	}
+	for _, jwk := range ringB.PublicKeys().Keys {
+		_ = consumerRing.AddSenderPublicKey(&jwk, "device2")
+	}
+	consumer := signing.NewMessageSigner("consumer1", nil, nil)
+	consumer.SetKeyRing(consumerRing)
+
+	// the holder of key A can't sign messages as device2
+	impostor := signing.NewMessageSigner("device2", nil, nil)
+	impostor.SetKeyRing(ringA)
+	signed, err := impostor.SignMessage(testThingID, testTopic, payload)
+	require.NoError(t, err)
+	_, _, _, err = consumer.VerifyMessage([]byte(signed), testThingID, testTopic)
+	assert.Error(t, err)
+
+	// keys that are not bound to a sender are not accepted
+	otherRing, _ := signing.NewKeyRing(nil, 0)
+	for _, jwk := range ringA.PublicKeys().Keys {
+		_ = otherRing.AddPublicKey(&jwk)
+	}
+	consumer.SetKeyRing(otherRing)
+	device1 := signing.NewMessageSigner("device1", nil, nil)
+	device1.SetKeyRing(ringA)
+	signed, err = device1.SignMessage(testThingID, testTopic, payload)
+	require.NoError(t, err)
+	_, _, _, err = consumer.VerifyMessage([]byte(signed), testThingID, testTopic)
+	assert.Error(t, err)
+
+	// the binding is ignored if the key is the known public key of the sender
+	consumer.GetPublicKey = func(sender string) *ecdsa.PublicKey {
+		if sender == "device1" {
+			return &privKeyA.(*ecdsa.PrivateKey).PublicKey
+		}
+		return nil
+	}
+	_, _, _, err = consumer.VerifyMessage([]byte(signed), testThingID, testTopic)
+	assert.NoError(t, err)
+}
+
+func TestKeyRingSenderCertificate(t *testing.T) {
+	payload := []byte(`{"field1":"unlock"}`)
+	caKey := certsclient.CreateECDSAKeys()
+	caCert, err := certsclient.CreateCACert("Test CA", caKey, 0)
+	require.NoError(t, err)
+	ca, err := certsclient.NewCertAuthority(caCert, caKey, "")
+	require.NoError(t, err)
+	deviceKey := certsclient.CreateECDSAKeys()
+	deviceCert, err := ca.IssueCert(&deviceKey.PublicKey, certsclient.CSROptions{
+		CommonName:         "device1",
+		OrganizationalUnit: certsclient.OUIoTDevice,
+	})
+	require.NoError(t, err)
+	deviceRing, _ := signing.NewKeyRing(deviceKey, 0)
+	device := signing.NewMessageSigner("device1", nil, nil)
+	device.SetKeyRing(deviceRing)
+	impostor := signing.NewMessageSigner("device2", nil, nil)
+	impostor.SetKeyRing(deviceRing)
+
+	checker := revocation.NewRevocationChecker(caCert)
+	crlPEM, err := ca.CreateCRL(time.Hour)
+	require.NoError(t, err)
+	err = checker.UpdateCRL([]byte(crlPEM))
+	require.NoError(t, err)
+	consumer, _ := signing.NewCertMessageSigner(nil, caCert)
+	consumerRing, _ := signing.NewKeyRing(nil, 0)
+	err = consumer.AddSenderCertificate(deviceCert)
+	assert.Error(t, err, "no key ring")
+	consumer.SetKeyRing(consumerRing)
+	consumer.SetRevocationChecker(checker)
+	err = consumer.AddSenderCertificate(deviceCert)
+	require.NoError(t, err)
+
+	signed, err := device.SignMessage(testThingID, testTopic, payload)
+	require.NoError(t, err)
+	_, sender, _, err := consumer.VerifyMessage([]byte(signed), testThingID, testTopic)
+	assert.NoError(t, err)
+	assert.Equal(t, "device1", sender)
+
+	// the key of the certificate only belongs to device1
+	signed2, err := impostor.SignMessage(testThingID, testTopic, payload)
+	require.NoError(t, err)
+	_, _, _, err = consumer.VerifyMessage([]byte(signed2), testThingID, testTopic)
+	assert.Error(t, err)
+
+	// messages signed with the key of a revoked certificate are rejected
+	err = ca.Revoke(deviceCert.SerialNumber, certsclient.RevocationReasonKeyCompromise)
+	require.NoError(t, err)
+	crlPEM, err = ca.CreateCRL(time.Hour)
+	require.NoError(t, err)
+	err = checker.UpdateCRL([]byte(crlPEM))
+	require.NoError(t, err)
+	_, _, _, err = consumer.VerifyMessage([]byte(signed), testThingID, testTopic)
+	assert.ErrorIs(t, err, revocation.ErrCertRevoked)
+}
@@ -1,6 +1,7 @@
 package signing_test
 
 import (
+	"crypto/ecdsa"
 	"encoding/json"
 	"github.com/wostzone/wost-go/pkg/signing"
 	"testing"
@@ -58,3 +59,35 @@ func TestSignAndEncrypt(t *testing.T) {
 	assert.NoError(t, err)
 	// assert.NoErrorf(t,
 }
+
+func TestSignAndEncryptMessage(t *testing.T) {
+	const sender1 = "sender1"
+	senderKey := signing.CreateECDSAKeys()
+	receiverKey := signing.CreateECDSAKeys()
+	payload := []byte(`{"code":"1234"}`)
+
+	sender := signing.NewMessageSigner(sender1, senderKey, nil)
+	receiver := signing.NewMessageSigner("receiver", receiverKey, func(sender string) *ecdsa.PublicKey {
+		return &senderKey.PublicKey
+	})
+	encrypted, err := sender.SignAndEncryptMessage(testThingID, testTopic, payload, receiver.PublicKey())
+	assert.NoError(t, err)
+
+	// only the receiver can decrypt
+	_, isEncrypted, err := sender.DecryptMessage([]byte(encrypted))
+	assert.True(t, isEncrypted)
+	assert.Error(t, err)
+	signed, isEncrypted, err := receiver.DecryptMessage([]byte(encrypted))
+	assert.True(t, isEncrypted)
+	assert.NoError(t, err)
+	rxPayload, rxSender, err := receiver.VerifyWithPolicy(signed, testThingID, testTopic, signing.SignaturePolicyRequire)
+	assert.NoError(t, err)
+	assert.Equal(t, sender1, rxSender)
+	assert.Equal(t, payload, rxPayload)
+
+	// unencrypted messages pass as-is
+	msg, isEncrypted, err := receiver.DecryptMessage(payload)
+	assert.False(t, isEncrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, msg)
+}
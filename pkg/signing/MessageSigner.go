@@ -3,9 +3,10 @@ package signing
 
 import (
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/asn1"
 	"encoding/base64"
 	"encoding/json"
@@ -13,18 +14,41 @@ import (
 	"fmt"
 	"math/big"
 	"reflect"
+	"time"
 
 	"gopkg.in/square/go-jose.v2"
+
+	"github.com/wostzone/wost-go/pkg/certsclient"
+	"github.com/wostzone/wost-go/pkg/revocation"
 )
 
-// !!! THIS CODE IS NOT YET IN USE !!!
-// The message envelope is used if a message is signed
+// MessageSignatureEnvelope is the JWS signed content of a signed message.
+// The envelope identifies the sender whose public key is used to verify the signature.
+// When signed with JWS the signature is part of the JWS serialization and the Signature field is not used.
+// The issued-at time and nonce let receivers reject messages that are replayed.
+// The thing ID and topic bind the message to its destination, so it can't be replayed to another thing.
 type MessageSignatureEnvelope struct {
-	Sender    string `json:"sender"`    // sender clientID
-	Signature []byte `json:"signature"` // base64 encoded signature
-	Payload   []byte `json:"payload"`   // base64 encoded payload
+	Sender    string `json:"sender"`              // sender clientID
+	ThingID   string `json:"thingID,omitempty"`   // ID of the thing the message is for or from
+	Topic     string `json:"topic,omitempty"`     // topic the message is published on
+	IssuedAt  int64  `json:"iat,omitempty"`       // time the message was signed in msec since epoch
+	Nonce     string `json:"nonce,omitempty"`     // unique value of the message
+	Signature []byte `json:"signature,omitempty"` // base64 encoded signature
+	Payload   []byte `json:"payload"`             // base64 encoded payload
 }
 
+// SignaturePolicy determines how received messages are accepted based on their signature
+type SignaturePolicy string
+
+const (
+	// SignaturePolicyNone accepts all messages without verifying signatures
+	SignaturePolicyNone SignaturePolicy = "none"
+	// SignaturePolicyVerify accepts unsigned messages but rejects messages whose signature fails to verify
+	SignaturePolicyVerify SignaturePolicy = "verify"
+	// SignaturePolicyRequire rejects messages that are unsigned or whose signature fails to verify
+	SignaturePolicyRequire SignaturePolicy = "require"
+)
+
 // ECDSASignature ...
 type ECDSASignature struct {
 	R, S *big.Int
@@ -36,15 +60,82 @@ type MessageSigner struct {
 	GetPublicKey func(address string) *ecdsa.PublicKey // must be a variable
 	// messenger    IMessenger
 	privateKey *ecdsa.PrivateKey // private key for signing and decryption.
+	// sender ID included in signed messages
+	sender string
+	// certificate of the sender included in signed messages, if available
+	certificate *x509.Certificate
+	// CA that issued the certificates of senders, used to obtain their public key from their certificate
+	caCert *x509.Certificate
+	// optional guard that rejects replayed messages
+	replayGuard *ReplayGuard
+	// optional checker that rejects messages signed with a revoked certificate
+	revocationChecker *revocation.RevocationChecker
+	// optional key ring with the rotated keys of the signer and the public keys of other senders
+	keyRing *KeyRing
+	// certificates of senders whose key is added to the key ring, by key ID
+	senderCerts map[string]*x509.Certificate
+}
+
+// AddSenderCertificate adds the public key of a CA issued client certificate to the key ring.
+// The key is bound to the common name of the certificate. Messages signed with this key are only accepted
+// from that sender, and only as long as the certificate is not revoked.
+//  cert is the certificate of the sender
+func (signer *MessageSigner) AddSenderCertificate(cert *x509.Certificate) error {
+	if signer.keyRing == nil {
+		return errors.New("AddSenderCertificate: signer has no key ring")
+	}
+	publicKey, err := signer.CertificatePublicKey(cert)
+	if err != nil {
+		return err
+	}
+	jwk, err := NewJWK(publicKey)
+	if err != nil {
+		return err
+	}
+	err = signer.keyRing.AddSenderPublicKey(jwk, cert.Subject.CommonName)
+	if err != nil {
+		return err
+	}
+	if signer.senderCerts == nil {
+		signer.senderCerts = make(map[string]*x509.Certificate)
+	}
+	signer.senderCerts[jwk.KeyID] = cert
+	return nil
+}
+
+// Certificate returns the certificate of the signer that is included in signed messages, or nil if not available
+func (signer *MessageSigner) Certificate() *x509.Certificate {
+	return signer.certificate
+}
+
+// CertificatePublicKey returns the public key of a certificate that is issued by the CA for client
+// authentication and is not revoked. Use this to obtain the key of a receiver for encrypting messages.
+//  cert is the certificate of the receiver
+func (signer *MessageSigner) CertificatePublicKey(cert *x509.Certificate) (*ecdsa.PublicKey, error) {
+	if signer.caCert == nil {
+		return nil, errors.New("CertificatePublicKey: signer has no CA to verify the certificate")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(signer.caCert)
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("CertificatePublicKey: %w", err)
+	}
+	publicKey, err := signer.certPublicKey(cert)
+	if err != nil {
+		return nil, fmt.Errorf("CertificatePublicKey: %w", err)
+	}
+	return publicKey, nil
 }
 
 // CreateECDSAKeys creates a asymmetric key set
 // Returns a private key that contains its associated public key
+// Use certsclient.CreateKeys for other key types.
 func CreateECDSAKeys() *ecdsa.PrivateKey {
-	rng := rand.Reader
-	curve := elliptic.P256()
-	privKey, _ := ecdsa.GenerateKey(curve, rng)
-	return privKey
+	return certsclient.CreateECDSAKeys()
 }
 
 // DecodeMessage decrypts the message and verifies the sender signature.
@@ -72,6 +163,295 @@ func (signer *MessageSigner) VerifySignedMessage(rawMessage string, object inter
 	return isSigned, err
 }
 
+// CanSign returns true if the signer has a private key or key ring with private key for signing messages
+func (signer *MessageSigner) CanSign() bool {
+	return signer.privateKey != nil || (signer.keyRing != nil && signer.keyRing.CurrentKeyID() != "")
+}
+
+// DecryptMessage decrypts a JWE encrypted message using the current or a previous key of the key ring,
+// if set, or the signer's private key.
+// Messages that are not encrypted are returned as-is.
+// Returns the decrypted message, a flag whether it was encrypted, and an error if decryption failed
+func (signer *MessageSigner) DecryptMessage(rawMessage []byte) (message []byte, isEncrypted bool, err error) {
+	jwe, err := jose.ParseEncrypted(string(rawMessage))
+	if err != nil {
+		return rawMessage, false, nil
+	}
+	if signer.keyRing != nil {
+		message, _, err = signer.keyRing.Decrypt(string(rawMessage))
+		if err == nil {
+			return message, true, nil
+		} else if signer.privateKey == nil {
+			return nil, true, fmt.Errorf("DecryptMessage: decryption failed: %s", err)
+		}
+	}
+	if signer.privateKey == nil {
+		return nil, true, errors.New("DecryptMessage: no private key to decrypt the message")
+	}
+	message, err = jwe.Decrypt(signer.privateKey)
+	if err != nil {
+		return nil, true, fmt.Errorf("DecryptMessage: decryption failed: %s", err)
+	}
+	return message, true, nil
+}
+
+// PublicKey returns the public key of the signer that others use to verify signatures and encrypt messages.
+// Returns nil if the signer has no private key.
+func (signer *MessageSigner) PublicKey() *ecdsa.PublicKey {
+	if signer.privateKey == nil {
+		return nil
+	}
+	return &signer.privateKey.PublicKey
+}
+
+// SignAndEncryptMessage signs the payload with SignMessage, if the signer can sign,
+// and encrypts the result using JWE with ECDH-ES, so that only the owner of the public key can read it.
+//
+//  thingID is the ID of the thing the message is for
+//  topic the message is published on
+//  payload is the message to sign and encrypt
+//  publicKey of the receiver
+// Returns the JWE compact serialized message
+func (signer *MessageSigner) SignAndEncryptMessage(
+	thingID string, topic string, payload []byte, publicKey *ecdsa.PublicKey) (string, error) {
+	message := string(payload)
+	if signer.CanSign() {
+		signed, err := signer.SignMessage(thingID, topic, payload)
+		if err != nil {
+			return "", err
+		}
+		message = signed
+	}
+	return EncryptMessage(message, publicKey)
+}
+
+// SetKeyRing sets the key ring with the rotated keys of the signer and the public keys of other senders.
+// Messages are then signed with the current key of the ring and include its key ID instead of the certificate.
+// Received messages with a key ID are verified with the matching public key of the ring, and encrypted
+// messages are decrypted with the current or a previous key, so messages in flight during a rotation are
+// still accepted.
+//  ring to use or nil to sign with the signer's private key
+func (signer *MessageSigner) SetKeyRing(ring *KeyRing) {
+	signer.keyRing = ring
+}
+
+// SetReplayGuard sets the guard that rejects replayed messages in VerifyMessage.
+//  guard to use or nil to accept replayed messages
+func (signer *MessageSigner) SetReplayGuard(guard *ReplayGuard) {
+	signer.replayGuard = guard
+}
+
+// SetRevocationChecker sets the checker that rejects messages signed with a revoked certificate.
+//  checker to use or nil to not check for revocation
+func (signer *MessageSigner) SetRevocationChecker(checker *revocation.RevocationChecker) {
+	signer.revocationChecker = checker
+}
+
+// SignMessage signs the payload on behalf of the sender using JWS ES256.
+// If the signer has a certificate then it is included in the JWS 'x5c' header so that receivers
+// that trust the CA can verify the message without knowing the sender in advance.
+// If a key ring is set then its current key is used instead and the JWS 'kid' header identifies the key.
+//
+//  thingID is the ID of the thing the message is for or from
+//  topic the message is published on
+//  payload is the message to sign
+// Returns the JWS compact serialized message
+func (signer *MessageSigner) SignMessage(thingID string, topic string, payload []byte) (string, error) {
+	if !signer.CanSign() {
+		return "", errors.New("SignMessage: signer has no private key")
+	}
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	envelope, _ := json.Marshal(MessageSignatureEnvelope{
+		Sender:   signer.sender,
+		ThingID:  thingID,
+		Topic:    topic,
+		IssuedAt: time.Now().UnixMilli(),
+		Nonce:    base64.RawURLEncoding.EncodeToString(nonce),
+		Payload:  payload,
+	})
+	if signer.keyRing != nil && signer.keyRing.CurrentKeyID() != "" {
+		return signer.keyRing.Sign(envelope)
+	}
+	opts := &jose.SignerOptions{}
+	if signer.certificate != nil {
+		opts = opts.WithHeader("x5c", []string{base64.StdEncoding.EncodeToString(signer.certificate.Raw)})
+	}
+	joseSigner, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: signer.privateKey}, opts)
+	if err != nil {
+		return "", err
+	}
+	signedObject, err := joseSigner.Sign(envelope)
+	if err != nil {
+		return "", err
+	}
+	return signedObject.CompactSerialize()
+}
+
+// VerifyMessage verifies a message that was signed with SignMessage and returns its payload.
+//
+// Messages with a key ID are verified with the matching public key of the key ring, if set.
+// Otherwise the public key of the sender is taken from the certificate in the message if it is issued by the CA
+// and its common name matches the sender, or GetPublicKey is used to lookup the sender's key.
+// Messages that are not signed are returned as-is.
+// Signed messages are rejected if they were signed for another thing ID or topic.
+// If a replay guard is set then signed messages that are replayed or outside its acceptance window are rejected.
+//
+//  rawMessage is the received message
+//  thingID is the ID of the thing the message is expected to be for or from
+//  topic the message is received on
+// Returns the payload, the sender, a flag whether the message was signed, and an error if verification failed
+func (signer *MessageSigner) VerifyMessage(
+	rawMessage []byte, thingID string, topic string) (payload []byte, sender string, isSigned bool, err error) {
+	jwsSignature, err := jose.ParseSigned(string(rawMessage))
+	if err != nil {
+		// message is not signed
+		return rawMessage, "", false, nil
+	}
+	envelope := MessageSignatureEnvelope{}
+	err = json.Unmarshal(jwsSignature.UnsafePayloadWithoutVerification(), &envelope)
+	if err != nil {
+		return nil, "", true, fmt.Errorf("VerifyMessage: signed message has no envelope: %s", err)
+	} else if envelope.Sender == "" {
+		return nil, "", true, errors.New("VerifyMessage: missing sender in signed message")
+	}
+	err = signer.verifySignature(jwsSignature, rawMessage, envelope.Sender)
+	if err != nil {
+		return nil, envelope.Sender, true, err
+	}
+	if envelope.ThingID != thingID || envelope.Topic != topic {
+		err = fmt.Errorf("VerifyMessage: message from %s was signed for thing '%s' on topic '%s'",
+			envelope.Sender, envelope.ThingID, envelope.Topic)
+		return nil, envelope.Sender, true, err
+	}
+	if signer.replayGuard != nil {
+		err = signer.replayGuard.Check(envelope.Sender, envelope.Nonce, time.UnixMilli(envelope.IssuedAt))
+		if err != nil {
+			return nil, envelope.Sender, true, err
+		}
+	}
+	return envelope.Payload, envelope.Sender, true, nil
+}
+
+// VerifyWithPolicy verifies a received message and applies the signature policy
+//  rawMessage is the received message
+//  thingID is the ID of the thing the message is expected to be for or from
+//  topic the message is received on
+//  policy determines whether unsigned messages are accepted and signatures are verified
+// Returns the payload and sender of an accepted message or an error if the message is rejected
+func (signer *MessageSigner) VerifyWithPolicy(rawMessage []byte,
+	thingID string, topic string, policy SignaturePolicy) (payload []byte, sender string, err error) {
+	if policy == SignaturePolicyNone {
+		payload, sender, _ = OpenSignedMessage(rawMessage)
+		return payload, sender, nil
+	}
+	payload, sender, isSigned, err := signer.VerifyMessage(rawMessage, thingID, topic)
+	if err == nil && !isSigned && policy == SignaturePolicyRequire {
+		err = errors.New("VerifyWithPolicy: message is not signed")
+	}
+	return payload, sender, err
+}
+
+// senderPublicKey returns the public key to verify the signature of a message from the sender
+// The key of a certificate in the message is only used if the certificate is issued by the CA for client
+// authentication, belongs to the sender, and is not revoked.
+func (signer *MessageSigner) senderPublicKey(jwsSignature *jose.JSONWebSignature, sender string) (*ecdsa.PublicKey, error) {
+	if signer.caCert != nil && len(jwsSignature.Signatures) > 0 {
+		roots := x509.NewCertPool()
+		roots.AddCert(signer.caCert)
+		chains, err := jwsSignature.Signatures[0].Protected.Certificates(x509.VerifyOptions{
+			Roots:     roots,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err == nil {
+			senderCert := chains[0][0]
+			if senderCert.Subject.CommonName != sender {
+				return nil, fmt.Errorf("VerifyMessage: certificate of '%s' doesn't belong to sender '%s'",
+					senderCert.Subject.CommonName, sender)
+			}
+			publicKey, err := signer.certPublicKey(senderCert)
+			if err != nil {
+				return nil, fmt.Errorf("VerifyMessage: %w", err)
+			}
+			return publicKey, nil
+		}
+	}
+	if signer.GetPublicKey != nil {
+		if publicKey := signer.GetPublicKey(sender); publicKey != nil {
+			return publicKey, nil
+		}
+	}
+	return nil, errors.New("VerifyMessage: No public key available for sender " + sender)
+}
+
+// certPublicKey returns the ECDSA public key of a CA verified certificate if it is not revoked
+func (signer *MessageSigner) certPublicKey(cert *x509.Certificate) (*ecdsa.PublicKey, error) {
+	if signer.revocationChecker != nil {
+		if err := signer.revocationChecker.CheckCert(cert); err != nil {
+			return nil, err
+		}
+	}
+	publicKey, isECDSA := cert.PublicKey.(*ecdsa.PublicKey)
+	if !isECDSA {
+		return nil, fmt.Errorf("certificate of '%s' has no ECDSA key", cert.Subject.CommonName)
+	}
+	return publicKey, nil
+}
+
+// verifyKeySender verifies that the key with the key ID belongs to the sender.
+// This is the case for the signer's own keys, keys that are bound to the sender in the key ring, keys of
+// sender certificates that are not revoked, and the public key of the sender itself.
+func (signer *MessageSigner) verifyKeySender(jwsSignature *jose.JSONWebSignature, kid string, sender string) error {
+	if signer.keyRing.isOwnKey(kid) {
+		if sender == signer.sender {
+			return nil
+		}
+	} else if cert, found := signer.senderCerts[kid]; found {
+		if cert.Subject.CommonName == sender {
+			_, err := signer.certPublicKey(cert)
+			if err != nil {
+				return fmt.Errorf("VerifyMessage: %w", err)
+			}
+			return nil
+		}
+	} else if signer.keyRing.keySender(kid) == sender {
+		return nil
+	}
+	// the key of the sender's certificate, or the sender's known public key
+	publicKey, err := signer.senderPublicKey(jwsSignature, sender)
+	if errors.Is(err, revocation.ErrCertRevoked) {
+		return err
+	} else if err == nil {
+		if senderKid, _ := KeyID(publicKey); senderKid == kid {
+			return nil
+		}
+	}
+	return fmt.Errorf("VerifyMessage: key '%s' doesn't belong to sender '%s'", kid, sender)
+}
+
+// verifySignature verifies the signature of a message from the sender with the key ring or the sender's public key
+func (signer *MessageSigner) verifySignature(jwsSignature *jose.JSONWebSignature, rawMessage []byte, sender string) error {
+	if signer.keyRing != nil && len(jwsSignature.Signatures) > 0 && jwsSignature.Signatures[0].Header.KeyID != "" {
+		_, kid, err := signer.keyRing.Verify(string(rawMessage))
+		if err != nil {
+			return fmt.Errorf("VerifyMessage: message from %s: %s", sender, err)
+		}
+		return signer.verifyKeySender(jwsSignature, kid, sender)
+	}
+	publicKey, err := signer.senderPublicKey(jwsSignature, sender)
+	if err != nil {
+		return err
+	}
+	_, err = jwsSignature.Verify(publicKey)
+	if err != nil {
+		return fmt.Errorf("VerifyMessage: message signature from %s fails to verify with its public key", sender)
+	}
+	return nil
+}
+
 // CreateEcdsaSignature creates a ECDSA256 signature from the payload using the provided private key
 // This returns a base64url encoded signature
 //  payload to create the signature for
@@ -215,3 +595,63 @@ func VerifySenderJWSSignature(rawMessage string, object interface{}, getPublicKe
 	}
 	return true, err
 }
+
+// OpenSignedMessage returns the payload and sender of a message signed with SignMessage without
+// verifying the signature. Messages that are not signed are returned as-is.
+// Only use this when signatures are not checked.
+func OpenSignedMessage(rawMessage []byte) (payload []byte, sender string, isSigned bool) {
+	jwsSignature, err := jose.ParseSigned(string(rawMessage))
+	if err != nil {
+		return rawMessage, "", false
+	}
+	envelope := MessageSignatureEnvelope{}
+	err = json.Unmarshal(jwsSignature.UnsafePayloadWithoutVerification(), &envelope)
+	if err != nil {
+		return rawMessage, "", false
+	}
+	return envelope.Payload, envelope.Sender, true
+}
+
+// NewMessageSigner creates a signer for signing messages on behalf of the sender and verifying
+// received messages.
+//
+//  sender is the client ID that is included in signed messages
+//  privateKey for signing messages. nil to only verify messages
+//  getPublicKey is the lookup function of the public key of senders of received messages
+func NewMessageSigner(
+	sender string, privateKey *ecdsa.PrivateKey, getPublicKey func(sender string) *ecdsa.PublicKey) *MessageSigner {
+	signer := &MessageSigner{
+		GetPublicKey: getPublicKey,
+		privateKey:   privateKey,
+		sender:       sender,
+	}
+	return signer
+}
+
+// NewCertMessageSigner creates a signer that signs messages with the key of a CA issued client certificate.
+// The sender is the common name of the certificate. The certificate is included in signed messages so that
+// receivers that trust the same CA can verify the message.
+//
+//  clientCert is the client's TLS certificate with ECDSA private key. nil to only verify messages
+//  caCert is the CA that issues the client certificates of senders of received messages
+func NewCertMessageSigner(clientCert *tls.Certificate, caCert *x509.Certificate) (*MessageSigner, error) {
+	signer := &MessageSigner{caCert: caCert}
+	if clientCert == nil {
+		return signer, nil
+	}
+	if len(clientCert.Certificate) == 0 {
+		return nil, errors.New("NewCertMessageSigner: client certificate is empty")
+	}
+	privateKey, isECDSA := clientCert.PrivateKey.(*ecdsa.PrivateKey)
+	if !isECDSA {
+		return nil, errors.New("NewCertMessageSigner: client certificate doesn't have an ECDSA private key")
+	}
+	cert, err := x509.ParseCertificate(clientCert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	signer.privateKey = privateKey
+	signer.certificate = cert
+	signer.sender = cert.Subject.CommonName
+	return signer, nil
+}
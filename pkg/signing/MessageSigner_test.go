@@ -2,15 +2,21 @@ package signing_test
 
 import (
 	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"github.com/wostzone/wost-go/pkg/certsclient"
+	"github.com/wostzone/wost-go/pkg/revocation"
 	"github.com/wostzone/wost-go/pkg/signing"
+	"github.com/wostzone/wost-go/pkg/testenv"
 	"gopkg.in/square/go-jose.v2"
 	"log"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type TestObjectWithSender struct {
@@ -27,6 +33,10 @@ type TestObjectNoSender struct {
 
 const Pub1Address = "dom1.testpub.$identity"
 
+// thing ID and topic that signed test messages are bound to
+const testThingID = "urn:thing1"
+const testTopic = "things/urn:thing1/action/unlock"
+
 var testObject = TestObjectWithSender{
 	Field1: "The question",
 	Field2: 42,
@@ -236,3 +246,157 @@ func TestVerifySender(t *testing.T) {
 	_, err = signing.VerifyJWSMessage(sig1, nil)
 	assert.Error(t, err, "nil public key should result in error")
 }
+
+func TestCertMessageSigner(t *testing.T) {
+	certs := testenv.CreateCertBundle()
+	payload := []byte(`{"field1":"unlock"}`)
+
+	pluginSigner, err := signing.NewCertMessageSigner(certs.PluginCert, certs.CaCert)
+	require.NoError(t, err)
+	assert.True(t, pluginSigner.CanSign())
+	deviceSigner, err := signing.NewCertMessageSigner(certs.DeviceCert, certs.CaCert)
+	require.NoError(t, err)
+
+	// the receiver obtains the sender public key from the CA signed certificate in the message
+	signed, err := pluginSigner.SignMessage(testThingID, testTopic, payload)
+	require.NoError(t, err)
+	rxPayload, sender, isSigned, err := deviceSigner.VerifyMessage([]byte(signed), testThingID, testTopic)
+	assert.NoError(t, err)
+	assert.True(t, isSigned)
+	assert.Equal(t, "Plugin", sender)
+	assert.Equal(t, payload, rxPayload)
+
+	// a message signed for another thing or topic is rejected, so it can't be replayed to another thing
+	_, _, _, err = deviceSigner.VerifyMessage([]byte(signed), "urn:thing2", testTopic)
+	assert.Error(t, err)
+	_, _, _, err = deviceSigner.VerifyMessage([]byte(signed), testThingID, "things/urn:thing1/action/lock")
+	assert.Error(t, err)
+
+	// a certificate that is not for client authentication is not accepted
+	serverSigner, err := signing.NewCertMessageSigner(certs.ServerCert, certs.CaCert)
+	require.NoError(t, err)
+	signed2, _ := serverSigner.SignMessage(testThingID, testTopic, payload)
+	_, _, _, err = deviceSigner.VerifyMessage([]byte(signed2), testThingID, testTopic)
+	assert.Error(t, err)
+
+	// a verify-only signer can't sign
+	verifier, err := signing.NewCertMessageSigner(nil, certs.CaCert)
+	require.NoError(t, err)
+	assert.False(t, verifier.CanSign())
+	_, err = verifier.SignMessage(testThingID, testTopic, payload)
+	assert.Error(t, err)
+	_, _, err = verifier.VerifyWithPolicy([]byte(signed), testThingID, testTopic, signing.SignaturePolicyRequire)
+	assert.NoError(t, err)
+
+	// unsigned messages are only rejected when signatures are required
+	_, _, err = verifier.VerifyWithPolicy(payload, testThingID, testTopic, signing.SignaturePolicyVerify)
+	assert.NoError(t, err)
+	_, _, err = verifier.VerifyWithPolicy(payload, testThingID, testTopic, signing.SignaturePolicyRequire)
+	assert.Error(t, err)
+
+	// a certificate from another CA is not trusted
+	otherCerts := testenv.CreateCertBundle()
+	otherSigner, _ := signing.NewCertMessageSigner(otherCerts.PluginCert, otherCerts.CaCert)
+	signed, _ = otherSigner.SignMessage(testThingID, testTopic, payload)
+	_, _, err = verifier.VerifyWithPolicy([]byte(signed), testThingID, testTopic, signing.SignaturePolicyVerify)
+	assert.Error(t, err)
+	// without verification the payload is still available
+	rxPayload, _, err = verifier.VerifyWithPolicy([]byte(signed), testThingID, testTopic, signing.SignaturePolicyNone)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, rxPayload)
+}
+
+func TestRevokedSenderCert(t *testing.T) {
+	payload := []byte(`{"field1":"unlock"}`)
+	caKey := certsclient.CreateECDSAKeys()
+	caCert, err := certsclient.CreateCACert("Test CA", caKey, 0)
+	require.NoError(t, err)
+	ca, err := certsclient.NewCertAuthority(caCert, caKey, "")
+	require.NoError(t, err)
+	deviceKey := certsclient.CreateECDSAKeys()
+	deviceCert, err := ca.IssueCert(&deviceKey.PublicKey, certsclient.CSROptions{
+		CommonName:         "device1",
+		OrganizationalUnit: certsclient.OUIoTDevice,
+	})
+	require.NoError(t, err)
+	deviceSigner, err := signing.NewCertMessageSigner(
+		&tls.Certificate{Certificate: [][]byte{deviceCert.Raw}, PrivateKey: deviceKey}, caCert)
+	require.NoError(t, err)
+	signed, err := deviceSigner.SignMessage(testThingID, testTopic, payload)
+	require.NoError(t, err)
+
+	checker := revocation.NewRevocationChecker(caCert)
+	crlPEM, err := ca.CreateCRL(time.Hour)
+	require.NoError(t, err)
+	err = checker.UpdateCRL([]byte(crlPEM))
+	require.NoError(t, err)
+	receiver, _ := signing.NewCertMessageSigner(nil, caCert)
+	receiver.SetRevocationChecker(checker)
+	_, _, _, err = receiver.VerifyMessage([]byte(signed), testThingID, testTopic)
+	assert.NoError(t, err)
+
+	// messages signed with a revoked certificate are rejected
+	err = ca.Revoke(deviceCert.SerialNumber, certsclient.RevocationReasonKeyCompromise)
+	require.NoError(t, err)
+	crlPEM, err = ca.CreateCRL(time.Hour)
+	require.NoError(t, err)
+	err = checker.UpdateCRL([]byte(crlPEM))
+	require.NoError(t, err)
+	_, _, _, err = receiver.VerifyMessage([]byte(signed), testThingID, testTopic)
+	assert.ErrorIs(t, err, revocation.ErrCertRevoked)
+}
+
+func TestCertificatePublicKey(t *testing.T) {
+	certs := testenv.CreateCertBundle()
+	signer, err := signing.NewCertMessageSigner(nil, certs.CaCert)
+	require.NoError(t, err)
+
+	// the key of a client certificate issued by the CA is accepted
+	deviceCert, _ := x509.ParseCertificate(certs.DeviceCert.Certificate[0])
+	publicKey, err := signer.CertificatePublicKey(deviceCert)
+	require.NoError(t, err)
+	assert.Equal(t, &certs.DeviceKey.PublicKey, publicKey)
+
+	// server certificates and certificates of another CA are rejected
+	serverCert, _ := x509.ParseCertificate(certs.ServerCert.Certificate[0])
+	_, err = signer.CertificatePublicKey(serverCert)
+	assert.Error(t, err)
+	otherCerts := testenv.CreateCertBundle()
+	otherCert, _ := x509.ParseCertificate(otherCerts.DeviceCert.Certificate[0])
+	_, err = signer.CertificatePublicKey(otherCert)
+	assert.Error(t, err)
+
+	// a signer without CA can't verify certificates
+	signer = signing.NewMessageSigner("", nil, nil)
+	_, err = signer.CertificatePublicKey(deviceCert)
+	assert.Error(t, err)
+}
+
+func TestMessageSignerPublicKeyLookup(t *testing.T) {
+	const sender1 = "sender1"
+	privKey := signing.CreateECDSAKeys()
+	payload := []byte("hello")
+
+	signer := signing.NewMessageSigner(sender1, privKey, nil)
+	signed, err := signer.SignMessage(testThingID, testTopic, payload)
+	require.NoError(t, err)
+
+	receiver := signing.NewMessageSigner("receiver", nil, func(sender string) *ecdsa.PublicKey {
+		if sender == sender1 {
+			return &privKey.PublicKey
+		}
+		return nil
+	})
+	rxPayload, sender, isSigned, err := receiver.VerifyMessage([]byte(signed), testThingID, testTopic)
+	assert.NoError(t, err)
+	assert.True(t, isSigned)
+	assert.Equal(t, sender1, sender)
+	assert.Equal(t, payload, rxPayload)
+
+	// a forged message signed with another key fails
+	forger := signing.NewMessageSigner(sender1, signing.CreateECDSAKeys(), nil)
+	signed, _ = forger.SignMessage(testThingID, testTopic, payload)
+	_, _, isSigned, err = receiver.VerifyMessage([]byte(signed), testThingID, testTopic)
+	assert.True(t, isSigned)
+	assert.Error(t, err)
+}
@@ -0,0 +1,150 @@
+package signing
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultReplayWindow is the default maximum age of a signed message before it is rejected
+const DefaultReplayWindow = 5 * time.Minute
+
+// DefaultReplayCacheSize is the default maximum number of nonces kept by the replay guard
+const DefaultReplayCacheSize = 10000
+
+// replayEntry holds a nonce that has been accepted
+type replayEntry struct {
+	key      string
+	issuedAt time.Time
+}
+
+// ReplayGuard rejects signed messages that are replayed.
+//
+// Messages are accepted if they are issued within the acceptance window and their nonce has not been
+// seen before. Nonces are remembered until they are older than the window, after which the message is
+// rejected based on its age. The nonce cache is bounded. When it is full the nonce with the oldest issued-at
+// time is removed and messages issued at or before that time are rejected, so a removed nonce can't be replayed.
+// This time is never raised beyond the current time, so a sender with a clock that runs ahead can't cause
+// the messages of other senders to be rejected.
+type ReplayGuard struct {
+	// accepted nonces by sender/nonce key
+	nonces map[string]time.Time
+	// accepted nonces ordered by their issued-at time, oldest first
+	entries []replayEntry
+	// maximum number of nonces to remember
+	maxNonces int
+	// messages issued at or before this time are rejected as their nonce is no longer remembered
+	minIssuedAt time.Time
+	// maximum time difference between the issued-at time of a message and the current time
+	window time.Duration
+	// mutex for concurrent access to the cache
+	mutex sync.Mutex
+}
+
+// Check if a message with the given sender, nonce and issued-at time is accepted.
+// An accepted nonce is remembered so that the same message is rejected the next time.
+//
+//  sender of the message
+//  nonce is the unique value of the message
+//  issuedAt is the time the message was signed
+// Returns an error if the message is rejected
+func (guard *ReplayGuard) Check(sender string, nonce string, issuedAt time.Time) error {
+	if nonce == "" || issuedAt.IsZero() {
+		return fmt.Errorf("ReplayGuard: message from '%s' has no nonce or issued-at time", sender)
+	}
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+
+	now := time.Now()
+	guard.expire(now)
+	age := now.Sub(issuedAt)
+	if age > guard.window || age < -guard.window {
+		return fmt.Errorf("ReplayGuard: message from '%s' issued at %s is outside the acceptance window",
+			sender, issuedAt.Format(time.RFC3339))
+	}
+	if !issuedAt.After(guard.minIssuedAt) {
+		return fmt.Errorf("ReplayGuard: message from '%s' is older than the nonces that are remembered", sender)
+	}
+	key := sender + "/" + nonce
+	if _, found := guard.nonces[key]; found {
+		return fmt.Errorf("ReplayGuard: message from '%s' is replayed", sender)
+	}
+	guard.nonces[key] = issuedAt
+	i := sort.Search(len(guard.entries), func(i int) bool {
+		return guard.entries[i].issuedAt.After(issuedAt)
+	})
+	guard.entries = append(guard.entries, replayEntry{})
+	copy(guard.entries[i+1:], guard.entries[i:])
+	guard.entries[i] = replayEntry{key: key, issuedAt: issuedAt}
+	for len(guard.entries) > guard.maxNonces {
+		oldest := guard.entries[0]
+		guard.entries = guard.entries[1:]
+		delete(guard.nonces, oldest.key)
+		minIssuedAt := oldest.issuedAt
+		if minIssuedAt.After(now) {
+			minIssuedAt = now
+		}
+		if minIssuedAt.After(guard.minIssuedAt) {
+			guard.minIssuedAt = minIssuedAt
+		}
+	}
+	return nil
+}
+
+// Len returns the number of remembered nonces
+func (guard *ReplayGuard) Len() int {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	return len(guard.nonces)
+}
+
+// SetWindow changes the acceptance window.
+//  window is the maximum time difference between the issued-at time of a message and the current time
+func (guard *ReplayGuard) SetWindow(window time.Duration) {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	guard.window = window
+}
+
+// Window returns the acceptance window
+func (guard *ReplayGuard) Window() time.Duration {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	return guard.window
+}
+
+// expire removes the nonces of messages that are outside the acceptance window.
+// These messages are rejected based on their age.
+// This must be called with the mutex locked.
+func (guard *ReplayGuard) expire(now time.Time) {
+	i := 0
+	for ; i < len(guard.entries); i++ {
+		if now.Sub(guard.entries[i].issuedAt) <= guard.window {
+			break
+		}
+		delete(guard.nonces, guard.entries[i].key)
+	}
+	guard.entries = guard.entries[i:]
+}
+
+// NewReplayGuard creates a guard that rejects replayed messages
+//
+//  window is the maximum time difference between the issued-at time of a message and the current time.
+//   Use 0 for DefaultReplayWindow.
+//  maxNonces is the maximum number of nonces to remember. Use 0 for DefaultReplayCacheSize.
+func NewReplayGuard(window time.Duration, maxNonces int) *ReplayGuard {
+	if window <= 0 {
+		window = DefaultReplayWindow
+	}
+	if maxNonces <= 0 {
+		maxNonces = DefaultReplayCacheSize
+	}
+	guard := &ReplayGuard{
+		nonces:    make(map[string]time.Time),
+		entries:   make([]replayEntry, 0),
+		maxNonces: maxNonces,
+		window:    window,
+	}
+	return guard
+}
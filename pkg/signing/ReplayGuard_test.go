@@ -0,0 +1,108 @@
+package signing_test
+
+import (
+	"crypto/ecdsa"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/wostzone/wost-go/pkg/signing"
+)
+
+func TestReplayGuard(t *testing.T) {
+	guard := signing.NewReplayGuard(time.Minute, 0)
+	assert.Equal(t, time.Minute, guard.Window())
+	now := time.Now()
+
+	err := guard.Check("sender1", "nonce1", now)
+	assert.NoError(t, err)
+	// the same nonce from another sender is accepted
+	err = guard.Check("sender2", "nonce1", now)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, guard.Len())
+
+	// replay is rejected
+	err = guard.Check("sender1", "nonce1", now)
+	assert.Error(t, err)
+
+	// messages outside the window are rejected
+	err = guard.Check("sender1", "nonce2", now.Add(-2*time.Minute))
+	assert.Error(t, err)
+	err = guard.Check("sender1", "nonce3", now.Add(2*time.Minute))
+	assert.Error(t, err)
+	guard.SetWindow(time.Hour)
+	err = guard.Check("sender1", "nonce2", now.Add(-2*time.Minute))
+	assert.NoError(t, err)
+
+	// missing nonce or time
+	err = guard.Check("sender1", "", now)
+	assert.Error(t, err)
+	err = guard.Check("sender1", "nonce4", time.Time{})
+	assert.Error(t, err)
+}
+
+func TestReplayGuardCacheSize(t *testing.T) {
+	guard := signing.NewReplayGuard(time.Minute, 2)
+	now := time.Now()
+
+	assert.NoError(t, guard.Check("sender1", "nonce1", now.Add(-3*time.Second)))
+	assert.NoError(t, guard.Check("sender1", "nonce2", now.Add(-2*time.Second)))
+	assert.NoError(t, guard.Check("sender1", "nonce3", now.Add(-time.Second)))
+	assert.Equal(t, 2, guard.Len())
+
+	// the first nonce is no longer remembered, so its message must be rejected based on time
+	err := guard.Check("sender1", "nonce1", now.Add(-3*time.Second))
+	assert.Error(t, err)
+	// newer messages are still accepted
+	err = guard.Check("sender1", "nonce4", now)
+	assert.NoError(t, err)
+}
+
+func TestVerifyReplayedMessage(t *testing.T) {
+	const sender1 = "sender1"
+	privKey := signing.CreateECDSAKeys()
+	payload := []byte("unlock")
+
+	signer := signing.NewMessageSigner(sender1, privKey, nil)
+	signed, err := signer.SignMessage(testThingID, testTopic, payload)
+	require.NoError(t, err)
+
+	receiver := signing.NewMessageSigner("receiver", nil, func(sender string) *ecdsa.PublicKey {
+		return &privKey.PublicKey
+	})
+	receiver.SetReplayGuard(signing.NewReplayGuard(0, 0))
+
+	rxPayload, _, err := receiver.VerifyWithPolicy([]byte(signed), testThingID, testTopic, signing.SignaturePolicyRequire)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, rxPayload)
+
+	// the captured message can't be replayed
+	_, _, err = receiver.VerifyWithPolicy([]byte(signed), testThingID, testTopic, signing.SignaturePolicyRequire)
+	assert.Error(t, err)
+
+	// a new message with the same payload is accepted
+	signed, _ = signer.SignMessage(testThingID, testTopic, payload)
+	_, _, err = receiver.VerifyWithPolicy([]byte(signed), testThingID, testTopic, signing.SignaturePolicyRequire)
+	assert.NoError(t, err)
+}
+
+func TestReplayGuardSkewedSender(t *testing.T) {
+	guard := signing.NewReplayGuard(time.Minute, 2)
+	now := time.Now()
+
+	// nonces are removed by issued-at time, not by arrival
+	assert.NoError(t, guard.Check("sender1", "nonce1", now.Add(-time.Second)))
+	assert.NoError(t, guard.Check("sender2", "nonce1", now.Add(-3*time.Second)))
+	assert.NoError(t, guard.Check("sender1", "nonce2", now.Add(-2*time.Second)))
+	err := guard.Check("sender1", "nonce1", now.Add(-time.Second))
+	assert.Error(t, err, "the newest nonce must still be remembered")
+
+	// a sender with a clock that runs ahead doesn't cause the messages of other senders to be rejected
+	assert.NoError(t, guard.Check("skewed", "nonce1", now.Add(50*time.Second)))
+	assert.NoError(t, guard.Check("skewed", "nonce2", now.Add(55*time.Second)))
+	assert.NoError(t, guard.Check("skewed", "nonce3", now.Add(58*time.Second)))
+	err = guard.Check("sender1", "nonce3", time.Now().Add(time.Second))
+	assert.NoError(t, err)
+}
@@ -10,7 +10,6 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"github.com/wostzone/wost-go/pkg/certsclient"
-	"math/big"
 	"net"
 	"os"
 	"path"
@@ -61,37 +60,10 @@ func CreateCA() (caCert *x509.Certificate, caKey *ecdsa.PrivateKey) {
 	validity := time.Hour
 
 	caKey = certsclient.CreateECDSAKeys()
-
-	// set up our CA certificate
-	// see also: https://superuser.com/questions/738612/openssl-ca-keyusage-extension
-	template := &x509.Certificate{
-		SerialNumber: big.NewInt(2021),
-		Subject: pkix.Name{
-			Country:      []string{"CA"},
-			Organization: []string{"Testing"},
-			Province:     []string{"BC"},
-			Locality:     []string{"wostzone"},
-			CommonName:   "WoST CA",
-		},
-		NotBefore: time.Now().Add(-10 * time.Second),
-		NotAfter:  time.Now().Add(validity),
-		// CA cert can be used to sign certificate and revocation lists
-		KeyUsage:    x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
-
-		// This hub cert is the only CA. No intermediate CAs
-		BasicConstraintsValid: true,
-		IsCA:                  true,
-		MaxPathLen:            0,
-		MaxPathLenZero:        true,
+	caCert, err := certsclient.CreateCACert("WoST CA", caKey, validity)
+	if err != nil {
+		logrus.Panicf("CreateCA. Failed creating CA: %s", err)
 	}
-
-	// create the CA
-	certDerBytes, _ := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
-	// certPEMBuffer := new(bytes.Buffer)
-	// pem.Encode(certPEMBuffer, &pem.Block{Type: "CERTIFICATE", Bytes: certDerBytes})
-
-	caCert, _ = x509.ParseCertificate(certDerBytes)
 	return caCert, caKey
 }
 
@@ -137,8 +109,9 @@ func CreateX509Cert(cn string, ou string, isServer bool, pubKey *ecdsa.PublicKey
 		keyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
 	}
 
+	serialNumber, _ := certsclient.NewSerialNumber()
 	template := &x509.Certificate{
-		SerialNumber: big.NewInt(2021),
+		SerialNumber: serialNumber,
 		Subject: pkix.Name{
 			Country:            []string{"CA"},
 			Organization:       []string{"Testing"},
@@ -2,6 +2,8 @@
 // as described here: https://www.w3.org/TR/wot-thing-description/#sec-data-schema-vocabulary-definition
 package thing
 
+import "github.com/wostzone/wost-go/pkg/vocab"
+
 //func (ds *AnySchema) UnmarshalJSON(data []byte) error {
 //	return nil
 //}
@@ -99,3 +101,17 @@ type DataSchema struct {
 	// e.g., image/png, or audio/mpeg)
 	StringContentMediaType string `json:"contentMediaType,omitempty"`
 }
+
+// IsSecret returns true if the data is a secret or an object that holds a secret.
+// Secret data is only passed end-to-end encrypted. See also vocab.DataTypeSecret.
+func (ds *DataSchema) IsSecret() bool {
+	if ds.Type == vocab.DataTypeSecret {
+		return true
+	}
+	for _, propSchema := range ds.Properties {
+		if propSchema.IsSecret() {
+			return true
+		}
+	}
+	return false
+}
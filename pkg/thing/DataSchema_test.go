@@ -54,3 +54,16 @@ func TestObjectSchema(t *testing.T) {
 
 	logrus.Infof("%s", enc1)
 }
+
+func TestSecretSchema(t *testing.T) {
+	os := DataSchema{
+		Type:       vocab.WoTDataTypeObject,
+		Properties: make(map[string]DataSchema),
+	}
+	os.Properties["name"] = DataSchema{Type: vocab.WoTDataTypeString}
+	assert.False(t, os.IsSecret())
+
+	// an object with a secret field is secret
+	os.Properties["code"] = DataSchema{Type: vocab.DataTypeSecret}
+	assert.True(t, os.IsSecret())
+}
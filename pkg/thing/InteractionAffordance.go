@@ -13,6 +13,12 @@ type Form struct {
 	// operations types of a form as per https://www.w3.org/TR/wot-thing-description11/#form
 	// readproperty, writeproperty, ...
 	Op string `json:"op"`
+
+	// MQTT quality of service of the messages of this interaction as per the MQTT protocol binding.
+	// "0" at most once, eg for high rate telemetry, "1" at least once, "2" exactly once. Default is "1".
+	MqvQos string `json:"mqv:qos,omitempty"`
+	// MQTT retain flag. Retained messages are kept by the broker as the latest value for new subscribers.
+	MqvRetain bool `json:"mqv:retain,omitempty"`
 }
 
 // InteractionAffordance metadata of a Thing that suggests to Consumers how to interact with the Thing
@@ -21,7 +21,9 @@ func (ts *ThingStore) AddTD(td *ThingTD) {
 
 // GetIDs returns the array of thing IDs
 func (ts *ThingStore) GetIDs() []string {
-	idList := make([]string, len(ts.tdMap))
+	ts.tdMapMutex.RLock()
+	defer ts.tdMapMutex.RUnlock()
+	idList := make([]string, 0, len(ts.tdMap))
 	for key := range ts.tdMap {
 		idList = append(idList, key)
 	}
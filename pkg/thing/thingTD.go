@@ -77,6 +77,10 @@ type ThingTD struct {
 	// Not actually applied unless names are used in a security name-value pair. (why is this mandatory then?)
 	SecurityDefinitions map[string]string `json:"securityDefinitions,omitempty"`
 
+	// PEM encoded certificate of the publisher of the thing, issued by the Hub CA. Consumers verify it
+	// against the CA and encrypt secret action inputs with its public key. Only the exposed thing can decrypt them.
+	Certificate string `json:"wost:certificate,omitempty"`
+
 	// profile: todo
 	// schemaDefinitions: todo
 	// uriVariables: todo
@@ -195,6 +199,14 @@ func (tdoc *ThingTD) GetProperty(name string) *PropertyAffordance {
 	return propAffordance
 }
 
+// GetCertificate returns the PEM encoded certificate of the publisher for encrypting action inputs,
+// or "" if not available
+func (tdoc *ThingTD) GetCertificate() string {
+	tdoc.updateMutex.RLock()
+	defer tdoc.updateMutex.RUnlock()
+	return tdoc.Certificate
+}
+
 // GetID returns the ID of the thing TD
 func (tdoc *ThingTD) GetID() string {
 	return tdoc.ID
@@ -219,6 +231,14 @@ func (tdoc *ThingTD) UpdateEvent(name string, affordance *EventAffordance) *Even
 	return affordance
 }
 
+// UpdateCertificate sets the PEM encoded certificate of the publisher used by consumers to encrypt
+// secret action inputs
+func (tdoc *ThingTD) UpdateCertificate(certPEM string) {
+	tdoc.updateMutex.Lock()
+	defer tdoc.updateMutex.Unlock()
+	tdoc.Certificate = certPEM
+}
+
 // UpdateForms sets the top level forms section of the TD
 // NOTE: In WoST actions are always routed via the Hub using the Hub's protocol binding.
 // Under normal circumstances forms are therefore not needed.
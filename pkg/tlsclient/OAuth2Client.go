@@ -0,0 +1,255 @@
+package tlsclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// OAuth2 grant types used with the token endpoint of an identity provider
+const (
+	// GrantTypeClientCredentials for services that authenticate with their client ID and secret
+	GrantTypeClientCredentials = "client_credentials"
+	// GrantTypeDeviceCode for devices without a browser, where the user authorizes on another device
+	GrantTypeDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+// DefaultDeviceCodeInterval is the polling interval of the token endpoint in the device code flow,
+// if the identity provider doesn't specify one.
+const DefaultDeviceCodeInterval = 5 * time.Second
+
+// OAuth2DeviceCodeResponse is the response of the device authorization endpoint, RFC8628 section 3.2
+// The user must open the verification URI and enter the user code to authorize the device.
+type OAuth2DeviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval,omitempty"`
+}
+
+// OAuth2ErrorResponse is the error response of the token endpoint, RFC6749 section 5.2
+type OAuth2ErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// OAuth2TokenResponse is the successful response of the token endpoint, RFC6749 section 5.1
+type OAuth2TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// ConnectWithClientCredentials obtains an access token from an OAuth2 identity provider using the client
+// credentials grant. This is intended for services that authenticate as themselves.
+// The server certificate of the identity provider is always verified. See SetIdentityProviderCA.
+// The access token is used as bearer token in followup requests.
+//
+//  tokenURL full URL of the token endpoint of the identity provider
+//  clientID of the service as registered with the identity provider
+//  clientSecret of the service
+//  scopes to request, or nil for the default scopes
+// Returns the access token or an error if the identity provider refused the request.
+func (cl *TLSClient) ConnectWithClientCredentials(
+	tokenURL string, clientID string, clientSecret string, scopes []string) (accessToken string, err error) {
+
+	form := url.Values{}
+	form.Set("grant_type", GrantTypeClientCredentials)
+	if len(scopes) > 0 {
+		form.Set("scope", strings.Join(scopes, " "))
+	}
+	cl.httpClient = cl.connect()
+	tokens, oauthErr, err := cl.requestOAuth2Token(tokenURL, clientID, clientSecret, form)
+	if err == nil && oauthErr != nil {
+		err = fmt.Errorf("%s: %s", oauthErr.Error, oauthErr.ErrorDescription)
+	}
+	if err != nil {
+		err = fmt.Errorf("ConnectWithClientCredentials: client '%s' failed to obtain a token from %s: %s",
+			clientID, tokenURL, err)
+		logrus.Warning(err)
+		return "", err
+	}
+	cl.userID = clientID
+	cl.jwtAccessToken = tokens.AccessToken
+	return cl.jwtAccessToken, nil
+}
+
+// ConnectWithDeviceCode obtains an access token from an OAuth2 identity provider using the device
+// authorization grant, RFC8628. The prompt handler is invoked with the user code and verification URI
+// to show to the user. This polls the token endpoint until the user authorized the device, denied
+// access, or the device code expired.
+// The server certificate of the identity provider is always verified. See SetIdentityProviderCA.
+// The access token is used as bearer token in followup requests.
+//
+//  deviceAuthURL full URL of the device authorization endpoint of the identity provider
+//  tokenURL full URL of the token endpoint of the identity provider
+//  clientID of the application as registered with the identity provider
+//  scopes to request, or nil for the default scopes
+//  prompt handler that shows the user code and verification URI to the user
+// Returns the access token or an error if authorization failed.
+func (cl *TLSClient) ConnectWithDeviceCode(deviceAuthURL string, tokenURL string, clientID string,
+	scopes []string, prompt func(deviceCode OAuth2DeviceCodeResponse)) (accessToken string, err error) {
+
+	cl.httpClient = cl.connect()
+	deviceCode, err := cl.RequestDeviceCode(deviceAuthURL, clientID, scopes)
+	if err != nil {
+		return "", err
+	}
+	prompt(*deviceCode)
+
+	interval := DefaultDeviceCodeInterval
+	if deviceCode.Interval > 0 {
+		interval = time.Duration(deviceCode.Interval) * time.Second
+	}
+	expiry := time.Now().Add(time.Duration(deviceCode.ExpiresIn) * time.Second)
+	form := url.Values{}
+	form.Set("grant_type", GrantTypeDeviceCode)
+	form.Set("device_code", deviceCode.DeviceCode)
+	form.Set("client_id", clientID)
+	for time.Now().Before(expiry) {
+		time.Sleep(interval)
+		tokens, oauthErr, err := cl.requestOAuth2Token(tokenURL, "", "", form)
+		if err != nil {
+			return "", fmt.Errorf("ConnectWithDeviceCode: token request to %s failed: %s", tokenURL, err)
+		} else if oauthErr == nil {
+			cl.userID = clientID
+			cl.jwtAccessToken = tokens.AccessToken
+			return cl.jwtAccessToken, nil
+		}
+		switch oauthErr.Error {
+		case "authorization_pending":
+			// the user hasn't authorized the device yet
+		case "slow_down":
+			interval += DefaultDeviceCodeInterval
+		default:
+			// access_denied, expired_token or another error
+			err = fmt.Errorf("ConnectWithDeviceCode: authorization of client '%s' failed: %s: %s",
+				clientID, oauthErr.Error, oauthErr.ErrorDescription)
+			logrus.Warning(err)
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("ConnectWithDeviceCode: the device code of client '%s' expired", clientID)
+}
+
+// RequestDeviceCode requests a device code and user code from the device authorization endpoint of an
+// identity provider. Use ConnectWithDeviceCode to complete the device code flow.
+//  deviceAuthURL full URL of the device authorization endpoint of the identity provider
+//  clientID of the application as registered with the identity provider
+//  scopes to request, or nil for the default scopes
+func (cl *TLSClient) RequestDeviceCode(
+	deviceAuthURL string, clientID string, scopes []string) (*OAuth2DeviceCodeResponse, error) {
+
+	form := url.Values{}
+	form.Set("client_id", clientID)
+	if len(scopes) > 0 {
+		form.Set("scope", strings.Join(scopes, " "))
+	}
+	respBody, statusCode, err := cl.postForm(deviceAuthURL, "", "", form)
+	if err == nil && statusCode >= 400 {
+		err = fmt.Errorf("status %d: %s", statusCode, respBody)
+	}
+	var deviceCode OAuth2DeviceCodeResponse
+	if err == nil {
+		err = json.Unmarshal(respBody, &deviceCode)
+	}
+	if err == nil && (deviceCode.DeviceCode == "" || deviceCode.UserCode == "") {
+		err = errors.New("response has no device code")
+	}
+	if err != nil {
+		err = fmt.Errorf("RequestDeviceCode: request to %s failed: %s", deviceAuthURL, err)
+		logrus.Warning(err)
+		return nil, err
+	}
+	return &deviceCode, nil
+}
+
+// SetIdentityProviderCA sets the CA certificate of the OAuth2 identity provider's server certificate.
+// By default the system CAs are used, as the identity provider is usually not part of the Hub. The CA
+// certificate of the client is not used for the identity provider.
+//  caCert is the CA certificate of the identity provider, or nil to use the system CAs
+func (cl *TLSClient) SetIdentityProviderCA(caCert *x509.Certificate) {
+	cl.idpCertPool = nil
+	if caCert != nil {
+		cl.idpCertPool = x509.NewCertPool()
+		cl.idpCertPool.AddCert(caCert)
+	}
+}
+
+// idpClient returns the http client for requests to the identity provider
+// The server certificate is always verified as these requests include credentials.
+func (cl *TLSClient) idpClient() *http.Client {
+	tlsTransport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsTransport.TLSClientConfig = &tls.Config{RootCAs: cl.idpCertPool}
+	return &http.Client{
+		Transport: tlsTransport,
+		Timeout:   cl.timeout,
+	}
+}
+
+// postForm posts a form encoded request to the identity provider and returns the response body and status code
+//  clientID and clientSecret for basic authentication of the client, if clientSecret is not empty
+func (cl *TLSClient) postForm(postURL string, clientID string, clientSecret string, form url.Values) (
+	respBody []byte, statusCode int, err error) {
+
+	req, err := http.NewRequest(http.MethodPost, postURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+	}
+	idpClient := cl.idpClient()
+	defer idpClient.CloseIdleConnections()
+	resp, err := idpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	respBody, err = ioutil.ReadAll(resp.Body)
+	return respBody, resp.StatusCode, err
+}
+
+// requestOAuth2Token posts a token request to the token endpoint
+// Returns the tokens, or the OAuth2 error response if the request is refused, or an error if the
+// request failed.
+func (cl *TLSClient) requestOAuth2Token(tokenURL string, clientID string, clientSecret string, form url.Values) (
+	tokens *OAuth2TokenResponse, oauthErr *OAuth2ErrorResponse, err error) {
+
+	respBody, statusCode, err := cl.postForm(tokenURL, clientID, clientSecret, form)
+	if err != nil {
+		return nil, nil, err
+	}
+	if statusCode >= 400 {
+		oauthErr = &OAuth2ErrorResponse{}
+		if json.Unmarshal(respBody, oauthErr) != nil || oauthErr.Error == "" {
+			return nil, nil, fmt.Errorf("status %d: %s", statusCode, respBody)
+		}
+		return nil, oauthErr, nil
+	}
+	tokens = &OAuth2TokenResponse{}
+	err = json.Unmarshal(respBody, tokens)
+	if err == nil && tokens.AccessToken == "" {
+		err = errors.New("response has no access token")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return tokens, nil, nil
+}
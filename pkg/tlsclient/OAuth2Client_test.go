@@ -0,0 +1,125 @@
+package tlsclient_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/wostzone/wost-go/pkg/tlsclient"
+)
+
+func TestClientCredentials(t *testing.T) {
+	logrus.Infof("--- TestClientCredentials ---")
+	tokenPath := "/token"
+	path1 := "/things"
+	tokenURL := fmt.Sprintf("https://%s%s", testAddress, tokenPath)
+
+	// stand-in identity provider and resource server
+	mux := http.NewServeMux()
+	srv, err := startTestServer(mux)
+	require.NoError(t, err)
+	defer srv.Close()
+	mux.HandleFunc(tokenPath, func(resp http.ResponseWriter, req *http.Request) {
+		clientID, secret, _ := req.BasicAuth()
+		_ = req.ParseForm()
+		resp.Header().Set("Content-Type", "application/json")
+		if req.Form.Get("grant_type") != tlsclient.GrantTypeClientCredentials || clientID != "service1" || secret != "secret1" {
+			resp.WriteHeader(http.StatusUnauthorized)
+			_, _ = resp.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+		assert.Equal(t, "things.read", req.Form.Get("scope"))
+		_ = json.NewEncoder(resp).Encode(tlsclient.OAuth2TokenResponse{
+			AccessToken: "accesstoken1", TokenType: "Bearer", ExpiresIn: 300})
+	})
+	mux.HandleFunc(path1, func(resp http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "bearer accesstoken1", req.Header.Get("Authorization"))
+	})
+
+	// the identity provider isn't verified with the CA of the hub or the system CAs
+	cl := tlsclient.NewTLSClient(testAddress, certs.CaCert)
+	_, err = cl.ConnectWithClientCredentials(tokenURL, "service1", "secret1", []string{"things.read"})
+	assert.Error(t, err)
+	cl.Close()
+
+	// the identity provider is verified even if the hub server isn't
+	cl = tlsclient.NewTLSClient(testAddress, nil)
+	_, err = cl.ConnectWithClientCredentials(tokenURL, "service1", "secret1", []string{"things.read"})
+	assert.Error(t, err)
+	cl.Close()
+
+	cl.SetIdentityProviderCA(certs.CaCert)
+	accessToken, err := cl.ConnectWithClientCredentials(tokenURL, "service1", "secret1", []string{"things.read"})
+	require.NoError(t, err)
+	assert.Equal(t, "accesstoken1", accessToken)
+	cl.Close()
+
+	_, err = cl.ConnectWithClientCredentials(tokenURL, "service1", "wrongsecret", []string{"things.read"})
+	assert.Error(t, err)
+	cl.Close()
+}
+
+func TestDeviceCode(t *testing.T) {
+	logrus.Infof("--- TestDeviceCode ---")
+	devicePath := "/device"
+	tokenPath := "/token"
+	deviceAuthURL := fmt.Sprintf("https://%s%s", testAddress, devicePath)
+	tokenURL := fmt.Sprintf("https://%s%s", testAddress, tokenPath)
+	pollCount := 0
+	denied := false
+
+	// stand-in identity provider that authorizes the device on the second poll
+	mux := http.NewServeMux()
+	srv, err := startTestServer(mux)
+	require.NoError(t, err)
+	defer srv.Close()
+	mux.HandleFunc(devicePath, func(resp http.ResponseWriter, req *http.Request) {
+		_ = req.ParseForm()
+		assert.Equal(t, "app1", req.Form.Get("client_id"))
+		_ = json.NewEncoder(resp).Encode(tlsclient.OAuth2DeviceCodeResponse{
+			DeviceCode: "devicecode1", UserCode: "ABCD-EFGH", VerificationURI: "https://idp/device",
+			ExpiresIn: 10, Interval: 1})
+	})
+	mux.HandleFunc(tokenPath, func(resp http.ResponseWriter, req *http.Request) {
+		_ = req.ParseForm()
+		assert.Equal(t, tlsclient.GrantTypeDeviceCode, req.Form.Get("grant_type"))
+		assert.Equal(t, "devicecode1", req.Form.Get("device_code"))
+		pollCount++
+		if denied || pollCount < 2 {
+			oauthErr := tlsclient.OAuth2ErrorResponse{Error: "authorization_pending"}
+			if denied {
+				oauthErr.Error = "access_denied"
+			}
+			resp.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(resp).Encode(oauthErr)
+			return
+		}
+		_ = json.NewEncoder(resp).Encode(tlsclient.OAuth2TokenResponse{AccessToken: "accesstoken1", TokenType: "Bearer"})
+	})
+
+	cl := tlsclient.NewTLSClient(testAddress, certs.CaCert)
+	cl.SetIdentityProviderCA(certs.CaCert)
+	userCode := ""
+	accessToken, err := cl.ConnectWithDeviceCode(deviceAuthURL, tokenURL, "app1", []string{"openid"},
+		func(deviceCode tlsclient.OAuth2DeviceCodeResponse) {
+			userCode = deviceCode.UserCode
+		})
+	require.NoError(t, err)
+	assert.Equal(t, "ABCD-EFGH", userCode)
+	assert.Equal(t, "accesstoken1", accessToken)
+	assert.Equal(t, 2, pollCount)
+
+	// the user denies access
+	denied = true
+	_, err = cl.ConnectWithDeviceCode(deviceAuthURL, tokenURL, "app1", nil,
+		func(deviceCode tlsclient.OAuth2DeviceCodeResponse) {})
+	assert.Error(t, err)
+	_, err = cl.RequestDeviceCode(fmt.Sprintf("https://%s/nodevice", testAddress), "app1", nil)
+	assert.Error(t, err)
+	cl.Close()
+}
@@ -17,6 +17,8 @@ import (
 
 	"github.com/golang-jwt/jwt"
 	"github.com/sirupsen/logrus"
+
+	"github.com/wostzone/wost-go/pkg/revocation"
 )
 
 // Authentication methods for use with ConnectWithLoginID
@@ -94,6 +96,15 @@ type TLSClient struct {
 	// JWT access after login, refresh, or external source
 	// Invoke will use this if set.
 	jwtAccessToken string
+	// JWT refresh token after login or refresh, or from a previous session
+	// RefreshJWTTokens will use this if set, in addition to the refresh token cookie.
+	jwtRefreshToken string
+
+	// optional checker of revoked server certificates
+	revocationChecker *revocation.RevocationChecker
+
+	// CA certificates of the OAuth2 identity provider, or nil to use the system CAs
+	idpCertPool *x509.CertPool
 }
 
 // Certificate returns the client auth certificate or nil if none is used
@@ -118,6 +129,7 @@ func (cl *TLSClient) connect() *http.Client {
 		RootCAs:            cl.caCertPool,
 		InsecureSkipVerify: !cl.checkServerCert,
 	}
+	cl.setRevocationCheck(tlsConfig)
 
 	tlsTransport := http.DefaultTransport
 	tlsTransport.(*http.Transport).TLSClientConfig = tlsConfig
@@ -192,6 +204,7 @@ func (cl *TLSClient) ConnectWithClientCert(clientCert *tls.Certificate) (err err
 		Certificates:       clientCertList,
 		InsecureSkipVerify: !cl.checkServerCert,
 	}
+	cl.setRevocationCheck(tlsConfig)
 
 	tlsTransport := http.DefaultTransport
 	tlsTransport.(*http.Transport).TLSClientConfig = tlsConfig
@@ -257,6 +270,7 @@ func (cl *TLSClient) ConnectWithJWTLogin(loginID string, secret string, authLogi
 		return "", err
 	}
 	cl.jwtAccessToken = jwtResp.AccessToken
+	cl.jwtRefreshToken = jwtResp.RefreshToken
 	return cl.jwtAccessToken, err
 }
 
@@ -392,8 +406,13 @@ func (cl *TLSClient) RefreshJWTTokens(refreshURL string) (refreshTokens *JwtAuth
 		refreshURL = fmt.Sprintf("https://%s%s", cl.hostPort, DefaultJWTRefreshPath)
 	}
 
-	// refresh token exists in client cookie
-	req, err := http.NewRequest("POST", refreshURL, http.NoBody)
+	// refresh token exists in client cookie, or was obtained in a previous session
+	var body io.Reader = http.NoBody
+	if cl.jwtRefreshToken != "" {
+		bodyBytes, _ := json.Marshal(JwtAuthResponse{RefreshToken: cl.jwtRefreshToken})
+		body = bytes.NewReader(bodyBytes)
+	}
+	req, err := http.NewRequest("POST", refreshURL, body)
 	var resp *http.Response
 	if err != nil {
 		logrus.Warningf("RefreshJWTTokens: Error creating request for URL %s: %s", refreshURL, err)
@@ -407,7 +426,7 @@ func (cl *TLSClient) RefreshJWTTokens(refreshURL string) (refreshTokens *JwtAuth
 		return nil, err
 	} else if resp.StatusCode >= 400 {
 		logrus.Warningf("RefreshJWTTokens: refresh using URL %s failed with: %s", refreshURL, resp.Status)
-		return nil, err
+		return nil, fmt.Errorf("RefreshJWTTokens: refresh failed with: %s", resp.Status)
 	}
 	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -417,6 +436,9 @@ func (cl *TLSClient) RefreshJWTTokens(refreshURL string) (refreshTokens *JwtAuth
 	var jwtTokens JwtAuthResponse
 	err = json.Unmarshal(respBody, &jwtTokens)
 	cl.jwtAccessToken = jwtTokens.AccessToken
+	if jwtTokens.RefreshToken != "" {
+		cl.jwtRefreshToken = jwtTokens.RefreshToken
+	}
 	return &jwtTokens, err
 }
 
@@ -448,6 +470,32 @@ func (cl *TLSClient) RefreshJWTTokenIfExpired() error {
 	return err
 }
 
+// GetRefreshToken returns the JWT refresh token obtained with the last login or refresh
+// This can be stored to refresh the tokens in a later session. See SetRefreshToken.
+func (cl *TLSClient) GetRefreshToken() string {
+	return cl.jwtRefreshToken
+}
+
+// SetRefreshToken sets the JWT refresh token to use with RefreshJWTTokens, eg from a previous session
+func (cl *TLSClient) SetRefreshToken(refreshToken string) {
+	cl.jwtRefreshToken = refreshToken
+}
+
+// SetRevocationChecker sets the checker that rejects server certificates that are revoked.
+// The server's OCSP response is checked if it is provided. Connection errors caused by a revoked
+// certificate wrap revocation.ErrCertRevoked. This applies to the next connect.
+//  checker to use or nil to disable revocation checking
+func (cl *TLSClient) SetRevocationChecker(checker *revocation.RevocationChecker) {
+	cl.revocationChecker = checker
+}
+
+// setRevocationCheck adds the revocation check to the TLS configuration if a checker is set
+func (cl *TLSClient) setRevocationCheck(tlsConfig *tls.Config) {
+	if cl.revocationChecker != nil {
+		tlsConfig.VerifyConnection = cl.revocationChecker.VerifyConnection
+	}
+}
+
 // NewTLSClient creates a new TLS Client instance.
 // Use connect/Close to open and close connections
 //  hostPort is the server hostname or IP address and port to connect to
@@ -2,12 +2,15 @@ package tlsserver
 
 import (
 	"github.com/wostzone/wost-go/pkg/certsclient"
+	"github.com/wostzone/wost-go/pkg/revocation"
 	"net/http"
 )
 
 // CertAuthenticator verifies the client certificate authentication is used
-// This simply checks if a client certificate is active and assumes that having one is sufficient to pass auth
+// This checks if a client certificate is active and, if a revocation checker is set, that it isn't revoked.
 type CertAuthenticator struct {
+	// optional checker of revoked client certificates
+	revocationChecker *revocation.RevocationChecker
 }
 
 // AuthenticateRequest
@@ -15,6 +18,14 @@ type CertAuthenticator struct {
 // If the certificate is a plugin, then no userID is returned
 // Returns the userID of the certificate (CN) or an error if no client certificate is used
 func (hauth *CertAuthenticator) AuthenticateRequest(resp http.ResponseWriter, req *http.Request) (userID string, ok bool) {
+	if hauth.CheckRevocation(req) != nil {
+		return "", false
+	}
+	return hauth.authenticateCert(req)
+}
+
+// authenticateCert returns the userID of the client certificate without checking if it is revoked
+func (hauth *CertAuthenticator) authenticateCert(req *http.Request) (userID string, ok bool) {
 	if len(req.TLS.PeerCertificates) == 0 {
 		return "", false
 	}
@@ -28,6 +39,16 @@ func (hauth *CertAuthenticator) AuthenticateRequest(resp http.ResponseWriter, re
 	return userID, true
 }
 
+// CheckRevocation checks if the client certificate of the request is revoked.
+// Returns an error wrapping revocation.ErrCertRevoked if the certificate is revoked, or nil if the request
+// has no client certificate or no revocation checker is set.
+func (hauth *CertAuthenticator) CheckRevocation(req *http.Request) error {
+	if hauth.revocationChecker == nil || req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return hauth.revocationChecker.CheckCert(req.TLS.PeerCertificates[0])
+}
+
 // GetClientOU returns the authorization OU of the client certificate, if any.
 // Returns OUNone if the request has no client certificate or the certificate has no OU
 // client certificate.
@@ -42,6 +63,12 @@ func (hauth *CertAuthenticator) GetClientOU(request *http.Request) (certOU strin
 	return certOU
 }
 
+// SetRevocationChecker sets the checker that rejects revoked client certificates
+//  checker to use or nil to accept all certificates signed by the CA
+func (hauth *CertAuthenticator) SetRevocationChecker(checker *revocation.RevocationChecker) {
+	hauth.revocationChecker = checker
+}
+
 // NewCertAuthenticator creates a new HTTP authenticator
 // Use .AuthenticateRequest() to authenticate the incoming request
 func NewCertAuthenticator() *CertAuthenticator {
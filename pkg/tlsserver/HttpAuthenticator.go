@@ -2,7 +2,10 @@ package tlsserver
 
 import (
 	"crypto/ecdsa"
+	"crypto/x509"
 	"net/http"
+
+	"github.com/wostzone/wost-go/pkg/certsclient"
 )
 
 // HttpAuthenticator chains the selected authenticators
@@ -10,33 +13,116 @@ type HttpAuthenticator struct {
 	BasicAuth *BasicAuthenticator
 	CertAuth  *CertAuthenticator
 	JwtAuth   *JWTAuthenticator
+	OidcAuth  *OIDCAuthenticator
+	// optional lookup of the roles of a user, for users that authenticate with basic or JWT authentication
+	roleLookup func(userID string) []string
 }
 
+// Methods with which a request is authenticated
+const (
+	authMethodNone  = ""
+	authMethodCert  = "cert"
+	authMethodJWT   = "jwt"
+	authMethodOIDC  = "oidc"
+	authMethodBasic = "basic"
+)
+
 // AuthenticateRequest
-// Checks in order: client certificate, JWT bearer, Basic
+// Checks in order: client certificate, JWT bearer, OIDC bearer, Basic
 // Returns the authenticated userID or an error if authentication failed
 func (hauth *HttpAuthenticator) AuthenticateRequest(resp http.ResponseWriter, req *http.Request) (userID string, match bool) {
+	userID, method, _ := hauth.authenticate(resp, req)
+	return userID, method != authMethodNone
+}
+
+// authenticate the request, checking the revocation of the client certificate once.
+// Returns the authenticated userID and the method it authenticated with, or authMethodNone if authentication
+// failed. If the client certificate is revoked then the error wraps revocation.ErrCertRevoked.
+func (hauth *HttpAuthenticator) authenticate(
+	resp http.ResponseWriter, req *http.Request) (userID string, method string, err error) {
+	var match bool
 	if hauth.CertAuth != nil {
+		// a revoked certificate is not accepted, even if other credentials are provided
+		if err = hauth.CertAuth.CheckRevocation(req); err != nil {
+			return "", authMethodNone, err
+		}
 		// FIXME: how to differentiate between cert auth and other for authorization
 		// workaround: plugin certificates do not have a name
-		userID, match = hauth.CertAuth.AuthenticateRequest(resp, req)
+		userID, match = hauth.CertAuth.authenticateCert(req)
 		if match {
-			return userID, match
+			return userID, authMethodCert, nil
 		}
 	}
 	if hauth.JwtAuth != nil {
 		userID, match = hauth.JwtAuth.AuthenticateRequest(resp, req)
 		if match {
-			return userID, match
+			return userID, authMethodJWT, nil
+		}
+	}
+	if hauth.OidcAuth != nil {
+		userID, match = hauth.OidcAuth.AuthenticateRequest(resp, req)
+		if match {
+			return userID, authMethodOIDC, nil
 		}
 	}
 	if hauth.BasicAuth != nil {
 		userID, match = hauth.BasicAuth.AuthenticateRequest(resp, req)
 		if match {
-			return userID, match
+			return userID, authMethodBasic, nil
+		}
+	}
+	return userID, authMethodNone, nil
+}
+
+// CheckRevocation checks if the client certificate of the request is revoked
+// Returns an error wrapping revocation.ErrCertRevoked if the certificate is revoked
+func (hauth *HttpAuthenticator) CheckRevocation(req *http.Request) error {
+	if hauth.CertAuth == nil {
+		return nil
+	}
+	return hauth.CertAuth.CheckRevocation(req)
+}
+
+// GetRoles authenticates the request and returns the roles of its client, for use in authorization.
+// The roles are only taken from the credentials that authenticated the request:
+// - client certificate: the OU of the certificate
+// - JWT access token: the roles claim of the token and the role lookup of the user, if set
+// - OIDC access token: the roles claim of the token that are mapped to hub roles
+// - basic authentication: the role lookup of the user, if set
+// Returns nil if the request isn't authenticated
+func (hauth *HttpAuthenticator) GetRoles(req *http.Request) []string {
+	userID, method, err := hauth.authenticate(nil, req)
+	if err != nil || method == authMethodNone {
+		return nil
+	}
+	return hauth.getRoles(req, userID, method)
+}
+
+// getRoles returns the roles of the client of a request that is authenticated with the given method
+func (hauth *HttpAuthenticator) getRoles(req *http.Request, userID string, method string) []string {
+	roles := make([]string, 0)
+	switch method {
+	case authMethodCert:
+		if certOU := hauth.CertAuth.GetClientOU(req); certOU != certsclient.OUNone {
+			roles = append(roles, certOU)
 		}
+	case authMethodJWT:
+		roles = append(roles, hauth.JwtAuth.GetRoles(req)...)
+		roles = append(roles, hauth.lookupRoles(userID)...)
+	case authMethodOIDC:
+		roles = append(roles, hauth.OidcAuth.GetRoles(req)...)
+	case authMethodBasic:
+		roles = append(roles, hauth.lookupRoles(userID)...)
 	}
-	return userID, false
+	return roles
+}
+
+// lookupRoles returns the roles of a user from the role lookup, if set
+func (hauth *HttpAuthenticator) lookupRoles(userID string) []string {
+	if hauth.roleLookup == nil || userID == "" {
+		return nil
+	}
+	return hauth.roleLookup(userID)
 }
 
 // GetClientOU returns the authorization OU of the requester's client certificate, if any.
@@ -62,6 +148,20 @@ func (hauth *HttpAuthenticator) EnableJwtAuth(verificationKey *ecdsa.PublicKey)
 	hauth.JwtAuth = NewJWTAuthenticator(verificationKey)
 }
 
+// EnableOIDCAuth enables authentication with access tokens issued by an OpenID Connect identity provider
+// See NewOIDCAuthenticator for the parameters.
+func (hauth *HttpAuthenticator) EnableOIDCAuth(issuerURL string, audience string, caCert *x509.Certificate) {
+	hauth.OidcAuth = NewOIDCAuthenticator(issuerURL, audience, caCert)
+}
+
+// SetRoleLookup sets the function that returns the roles of a user
+// This is only used for users that authenticate with basic authentication or a JWT access token.
+// The roles of clients that authenticate with a certificate or OIDC token are not looked up.
+//  roleLookup returns the roles of the userID, or nil to remove the lookup
+func (hauth *HttpAuthenticator) SetRoleLookup(roleLookup func(userID string) []string) {
+	hauth.roleLookup = roleLookup
+}
+
 // NewHttpAuthenticator creates a container to apply HTTP request authenticators
 // By default the certificate authenticator is enabled. Additional authenticators can be enabled using the Enable... functions
 //
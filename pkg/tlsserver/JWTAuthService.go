@@ -0,0 +1,227 @@
+package tlsserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/sirupsen/logrus"
+
+	"github.com/wostzone/wost-go/pkg/tlsclient"
+)
+
+// DefaultJWTLogoutPath for revoking the refresh token with the auth service
+const DefaultJWTLogoutPath = "/auth/logout"
+
+// RefreshTokenCookieName is the name of the cookie that holds the refresh token
+const RefreshTokenCookieName = "refreshToken"
+
+// refreshCookiePath limits the refresh token cookie to the auth service paths
+const refreshCookiePath = "/auth"
+
+// MaxClientConfigSize is the maximum size of the client configuration stored with the auth service
+const MaxClientConfigSize = 64 * 1024
+
+// JWTAuthService is an authentication service that issues JWT tokens to users that login with their credentials.
+//
+// The service handles the login, refresh and config requests of the TLSClient, and logout:
+//  POST DefaultJWTLoginPath with a JwtAuthLogin message returns a JwtAuthResponse with new tokens
+//  POST DefaultJWTRefreshPath with the refresh token cookie or JwtAuthResponse message returns new tokens
+//  POST DefaultJWTLogoutPath revokes the refresh token
+//  GET/PUT DefaultJWTConfigPath reads or stores the configuration of the authenticated user
+//
+// The refresh token is also set as a HttpOnly cookie. The cookie is kept after the browser closes if the
+// user logs in with RememberMe.
+type JWTAuthService struct {
+	// the issuer of tokens
+	issuer *JWTIssuer
+	// the server the service is mounted on
+	srv *TLSServer
+	// the password verification handler
+	validateCredentials func(loginID string, password string) bool
+	// client configuration by user ID
+	clientConfig map[string][]byte
+	// mutex for concurrent access to the client configuration
+	mutex sync.RWMutex
+}
+
+// GetIssuer returns the issuer of the tokens, eg to revoke the tokens of a user
+func (service *JWTAuthService) GetIssuer() *JWTIssuer {
+	return service.issuer
+}
+
+// getRoles returns the roles of a user from the role lookup of the server, or nil if no lookup is set
+func (service *JWTAuthService) getRoles(userID string) []string {
+	if userID == "" || service.srv.httpAuthenticator.roleLookup == nil {
+		return nil
+	}
+	return service.srv.httpAuthenticator.roleLookup(userID)
+}
+
+// getRefreshToken returns the refresh token from the request cookie or body
+func (service *JWTAuthService) getRefreshToken(req *http.Request) string {
+	cookie, err := req.Cookie(RefreshTokenCookieName)
+	if err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	var tokens tlsclient.JwtAuthResponse
+	body, _ := ioutil.ReadAll(io.LimitReader(req.Body, MaxClientConfigSize))
+	_ = json.Unmarshal(body, &tokens)
+	return tokens.RefreshToken
+}
+
+// handleConfig reads or stores the configuration of the authenticated user
+func (service *JWTAuthService) handleConfig(userID string, resp http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet {
+		service.mutex.RLock()
+		config := service.clientConfig[userID]
+		service.mutex.RUnlock()
+		if config == nil {
+			config = []byte("{}")
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		_, _ = resp.Write(config)
+		return
+	}
+	config, err := ioutil.ReadAll(io.LimitReader(req.Body, MaxClientConfigSize+1))
+	if err != nil || len(config) > MaxClientConfigSize || !json.Valid(config) {
+		service.srv.WriteBadRequest(resp, fmt.Sprintf("JWTAuthService: invalid configuration of user '%s'", userID))
+		return
+	}
+	service.mutex.Lock()
+	service.clientConfig[userID] = config
+	service.mutex.Unlock()
+}
+
+// handleLogin issues new tokens to users with valid credentials
+func (service *JWTAuthService) handleLogin(resp http.ResponseWriter, req *http.Request) {
+	var login tlsclient.JwtAuthLogin
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, MaxClientConfigSize))
+	if err == nil {
+		err = json.Unmarshal(body, &login)
+	}
+	if err != nil || login.LoginID == "" {
+		service.srv.WriteBadRequest(resp, fmt.Sprintf("JWTAuthService: invalid login request from %s", req.RemoteAddr))
+		return
+	}
+	clientIP := GetClientIP(req)
+	if lockout := service.srv.getLockout(clientIP); lockout > 0 {
+		service.srv.WriteTooManyRequests(resp, fmt.Sprintf("JWTAuthService: login of user '%s' from %s is locked out",
+			login.LoginID, req.RemoteAddr), lockout)
+		return
+	}
+	if !service.validateCredentials(login.LoginID, login.Password) {
+		service.srv.recordAuthFailure(clientIP)
+		service.srv.WriteUnauthorized(resp, fmt.Sprintf("JWTAuthService: invalid login of user '%s' from %s",
+			login.LoginID, req.RemoteAddr))
+		return
+	}
+	accessToken, refreshToken, err := service.issuer.CreateTokens(
+		login.LoginID, service.getRoles(login.LoginID), login.RememberMe)
+	if err != nil {
+		service.srv.WriteInternalError(resp, fmt.Sprintf("JWTAuthService: failed creating tokens: %s", err))
+		return
+	}
+	logrus.Infof("JWTAuthService: user '%s' logged in from %s", login.LoginID, req.RemoteAddr)
+	service.writeTokens(resp, req, accessToken, refreshToken, login.RememberMe)
+}
+
+// handleLogout revokes the refresh token and clears the refresh token cookie
+func (service *JWTAuthService) handleLogout(resp http.ResponseWriter, req *http.Request) {
+	refreshToken := service.getRefreshToken(req)
+	if refreshToken != "" {
+		_ = service.issuer.RevokeToken(refreshToken)
+	}
+	http.SetCookie(resp, &http.Cookie{
+		Name:     RefreshTokenCookieName,
+		Path:     refreshCookiePath,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+	})
+}
+
+// handleRefresh issues new tokens in exchange for a valid refresh token
+func (service *JWTAuthService) handleRefresh(resp http.ResponseWriter, req *http.Request) {
+	refreshToken := service.getRefreshToken(req)
+	clientIP := GetClientIP(req)
+	if lockout := service.srv.getLockout(clientIP); lockout > 0 {
+		service.srv.WriteTooManyRequests(resp, fmt.Sprintf("JWTAuthService: refresh from %s is locked out",
+			req.RemoteAddr), lockout)
+		return
+	}
+	// the user is needed to lookup the roles. The token is verified by the issuer.
+	unverifiedClaims := &JwtClaims{}
+	_, _, _ = new(jwt.Parser).ParseUnverified(refreshToken, unverifiedClaims)
+	accessToken, newRefreshToken, err := service.issuer.RefreshTokens(
+		refreshToken, service.getRoles(unverifiedClaims.Username))
+	if err != nil {
+		service.srv.recordAuthFailure(clientIP)
+		service.srv.WriteUnauthorized(resp, fmt.Sprintf("JWTAuthService: refresh from %s failed: %s", req.RemoteAddr, err))
+		return
+	}
+	claims, err := service.issuer.DecodeToken(newRefreshToken)
+	if err != nil {
+		service.srv.WriteInternalError(resp, fmt.Sprintf("JWTAuthService: failed creating tokens: %s", err))
+		return
+	}
+	service.writeTokens(resp, req, accessToken, newRefreshToken, claims.RememberMe)
+}
+
+// writeTokens responds with the tokens and sets the refresh token cookie
+func (service *JWTAuthService) writeTokens(resp http.ResponseWriter, req *http.Request,
+	accessToken string, refreshToken string, rememberMe bool) {
+
+	cookie := &http.Cookie{
+		Name:     RefreshTokenCookieName,
+		Value:    refreshToken,
+		Path:     refreshCookiePath,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	}
+	if rememberMe {
+		service.issuer.mutex.RLock()
+		cookie.MaxAge = int(service.issuer.refreshValidity.Seconds())
+		service.issuer.mutex.RUnlock()
+	}
+	http.SetCookie(resp, cookie)
+	response := tlsclient.JwtAuthResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		RefreshURL:   fmt.Sprintf("https://%s%s", req.Host, tlsclient.DefaultJWTRefreshPath),
+	}
+	responseJSON, _ := json.Marshal(response)
+	resp.Header().Set("Content-Type", "application/json")
+	_, _ = resp.Write(responseJSON)
+}
+
+// NewJWTAuthService creates an authentication service and mounts it on the TLS server.
+// This enables JWT authentication on the server using the issuer's public key. The roles of users are
+// obtained from the role lookup of the server. See TLSServer.SetRoleLookup.
+//
+//  srv is the TLS server to add the login, refresh, logout and config handlers to
+//  issuer of the tokens
+//  validateCredentials is the function that verifies the login credentials, eg of a password store
+func NewJWTAuthService(srv *TLSServer, issuer *JWTIssuer,
+	validateCredentials func(loginID string, password string) bool) *JWTAuthService {
+
+	service := &JWTAuthService{
+		issuer:              issuer,
+		srv:                 srv,
+		validateCredentials: validateCredentials,
+		clientConfig:        make(map[string][]byte),
+	}
+	_ = srv.EnableJwtAuth(issuer.GetPublicKey())
+	srv.Authenticator().JwtAuth.SetRevocationCheck(issuer.CheckRevoked)
+	srv.AddHandlerNoAuth(tlsclient.DefaultJWTLoginPath, service.handleLogin).Methods(http.MethodPost)
+	srv.AddHandlerNoAuth(tlsclient.DefaultJWTRefreshPath, service.handleRefresh).Methods(http.MethodPost)
+	srv.AddHandlerNoAuth(DefaultJWTLogoutPath, service.handleLogout).Methods(http.MethodPost)
+	srv.AddHandler(tlsclient.DefaultJWTConfigPath, service.handleConfig).
+		Methods(http.MethodGet, http.MethodPut, http.MethodPost)
+	return service
+}
@@ -0,0 +1,140 @@
+package tlsserver_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/wostzone/wost-go/pkg/tlsclient"
+	"github.com/wostzone/wost-go/pkg/tlsserver"
+)
+
+func TestJWTIssuer(t *testing.T) {
+	logrus.Infof("--- TestJWTIssuer ---")
+	issuer := tlsserver.NewJWTIssuer("test", testCerts.ServerKey)
+	accessToken, refreshToken, err := issuer.CreateTokens("user1", []string{tlsserver.RoleAdmin}, true)
+	require.NoError(t, err)
+	claims, err := issuer.DecodeToken(accessToken)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", claims.Username)
+	assert.Equal(t, tlsserver.TokenTypeAccess, claims.TokenType)
+	assert.Equal(t, []string{tlsserver.RoleAdmin}, claims.Roles)
+
+	// access tokens can't be used to refresh
+	_, _, err = issuer.RefreshTokens(accessToken, nil)
+	assert.Error(t, err)
+
+	// refresh tokens are rotated and keep the roles and rememberMe
+	accessToken2, refreshToken2, err := issuer.RefreshTokens(refreshToken, nil)
+	require.NoError(t, err)
+	claims, err = issuer.DecodeToken(refreshToken2)
+	require.NoError(t, err)
+	assert.True(t, claims.RememberMe)
+	assert.Equal(t, []string{tlsserver.RoleAdmin}, claims.Roles)
+
+	// reuse of a refresh token revokes all tokens of the user
+	_, _, err = issuer.RefreshTokens(refreshToken, nil)
+	assert.Error(t, err)
+	_, err = issuer.DecodeToken(accessToken2)
+	assert.Error(t, err)
+	_, _, err = issuer.RefreshTokens(refreshToken2, nil)
+	assert.Error(t, err)
+
+	// tokens issued right after revoking the user are valid
+	issuer.RevokeUser("user1")
+	accessToken, refreshToken, err = issuer.CreateTokens("user1", nil, false)
+	require.NoError(t, err)
+	_, err = issuer.DecodeToken(accessToken)
+	assert.NoError(t, err)
+	_, _, err = issuer.RefreshTokens(refreshToken, nil)
+	assert.NoError(t, err)
+
+	// revoking a user after a restart of the issuer revokes the tokens issued before the restart
+	accessToken, _, err = issuer.CreateTokens("user1", nil, false)
+	require.NoError(t, err)
+	restarted := tlsserver.NewJWTIssuer("test", testCerts.ServerKey)
+	_, err = restarted.DecodeToken(accessToken)
+	assert.NoError(t, err)
+	restarted.RevokeUser("user1")
+	_, err = restarted.DecodeToken(accessToken)
+	assert.Error(t, err)
+
+	// expired tokens are rejected
+	issuer.SetValidity(-time.Minute, 0)
+	accessToken, _, err = issuer.CreateTokens("user2", nil, false)
+	require.NoError(t, err)
+	_, err = issuer.DecodeToken(accessToken)
+	assert.Error(t, err)
+}
+
+func TestJWTAuthService(t *testing.T) {
+	logrus.Infof("--- TestJWTAuthService ---")
+	path1 := "/admin"
+	path1Hit := 0
+	user1 := "user1"
+	password1 := "user1pass"
+
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort,
+		testCerts.ServerCert, testCerts.CaCert)
+	srv.SetRoleLookup(func(userID string) []string {
+		return []string{tlsserver.RoleAdmin}
+	})
+	issuer := tlsserver.NewJWTIssuer("test", testCerts.ServerKey)
+	tlsserver.NewJWTAuthService(srv, issuer, func(loginID string, password string) bool {
+		return loginID == user1 && password == password1
+	})
+	srv.AddHandler(path1, func(userID string, resp http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, user1, userID)
+		path1Hit++
+	}, tlsserver.RequireRole(tlsserver.RoleAdmin))
+	err := srv.Start()
+	require.NoError(t, err)
+	defer srv.Stop()
+
+	// login and use the access token with its roles
+	cl := tlsclient.NewTLSClient(clientHostPort, testCerts.CaCert)
+	accessToken, err := cl.ConnectWithJWTLogin(user1, password1, "")
+	require.NoError(t, err)
+	assert.NotEmpty(t, accessToken)
+	_, err = cl.Get(path1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, path1Hit)
+
+	// the client configuration is stored for the user
+	_, err = cl.Put(tlsclient.DefaultJWTConfigPath, map[string]string{"theme": "dark"})
+	assert.NoError(t, err)
+	config, err := cl.Get(tlsclient.DefaultJWTConfigPath)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"theme":"dark"}`, string(config))
+
+	// refresh uses the refresh token cookie
+	tokens, err := cl.RefreshJWTTokens("")
+	require.NoError(t, err)
+	assert.NotEmpty(t, tokens.AccessToken)
+	_, err = cl.Get(path1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, path1Hit)
+
+	// revoked access tokens are rejected by the server
+	err = issuer.RevokeToken(tokens.AccessToken)
+	require.NoError(t, err)
+	_, err = cl.Get(path1)
+	assert.Error(t, err)
+	assert.Equal(t, 2, path1Hit)
+
+	// after logout the refresh token is revoked
+	_, err = cl.Post(tlsserver.DefaultJWTLogoutPath, nil)
+	assert.NoError(t, err)
+	_, err = cl.Post(tlsclient.DefaultJWTRefreshPath, tokens)
+	assert.Error(t, err)
+	cl.Close()
+
+	// invalid login
+	_, err = cl.ConnectWithJWTLogin(user1, "wrongpassword", "")
+	assert.Error(t, err)
+	cl.Close()
+}
@@ -12,6 +12,14 @@ import (
 // JwtClaims this is temporary while figuring things out
 type JwtClaims struct {
 	Username string `json:"username"`
+	// Roles of the user for authorization, eg RoleAdmin
+	Roles []string `json:"roles,omitempty"`
+	// TokenType is TokenTypeAccess or TokenTypeRefresh for tokens issued by the JWTIssuer
+	TokenType string `json:"tokenType,omitempty"`
+	// RememberMe is set in refresh tokens of users that want to stay logged in
+	RememberMe bool `json:"rememberMe,omitempty"`
+	// Epoch is the revocation epoch of the JWTIssuer when the token was issued
+	Epoch int64 `json:"epoch,omitempty"`
 	jwt.StandardClaims
 }
 
@@ -22,6 +30,8 @@ type JwtClaims struct {
 type JWTAuthenticator struct {
 	// Service certificate whose public key is used for token verification
 	publicKey *ecdsa.PublicKey
+	// optional check that rejects revoked tokens, eg JWTIssuer.CheckRevoked
+	revocationCheck func(claims *JwtClaims) error
 }
 
 // AuthenticateRequest validates the access token
@@ -47,15 +57,35 @@ func (jauth *JWTAuthenticator) AuthenticateRequest(resp http.ResponseWriter, req
 		return "", false
 	}
 	// TODO: verify claims: iat, iss, aud
+	if claims.TokenType == TokenTypeRefresh {
+		logrus.Infof("JWTAuthenticator: Refresh token used as access token in request %s '%s' from %s",
+			req.Method, req.RequestURI, req.RemoteAddr)
+		return "", false
+	}
 
 	// hoora its valid
 	logrus.Debugf("JWTAuthenticator. Request by %s authenticated with valid JWT token", jwtToken.Header)
 	return claims.Username, true
 }
 
+// GetRoles returns the roles in the claims of a valid access token of the request
+// Returns nil if the request has no valid access token
+func (jauth *JWTAuthenticator) GetRoles(req *http.Request) []string {
+	accessTokenString, err := hubnet.GetBearerToken(req)
+	if err != nil {
+		return nil
+	}
+	_, claims, err := jauth.DecodeToken(accessTokenString)
+	if err != nil {
+		return nil
+	}
+	return claims.Roles
+}
+
 // DecodeToken and return its claims
 //
 // If the token is invalid then claims will be empty and an error is returned
+// If the token is revoked according to the revocation check, the token and claims are returned with an error
 // If the token is valid but has an incorrect signature, the token and claims will be returned with an error
 func (jauth *JWTAuthenticator) DecodeToken(tokenString string) (
 	jwtToken *jwt.Token, claims *JwtClaims, err error) {
@@ -73,10 +103,21 @@ func (jauth *JWTAuthenticator) DecodeToken(tokenString string) (
 		return jwtToken, claims, fmt.Errorf("invalid JWT claims: err=%s", err)
 	}
 	claims = jwtToken.Claims.(*JwtClaims)
-
+	if jauth.revocationCheck != nil {
+		if err = jauth.revocationCheck(claims); err != nil {
+			return jwtToken, claims, fmt.Errorf("revoked JWT token: %s", err)
+		}
+	}
 	return jwtToken, claims, nil
 }
 
+// SetRevocationCheck sets the check that rejects revoked tokens
+//  revocationCheck returns an error if the token with the claims is revoked, eg JWTIssuer.CheckRevoked.
+//  Use nil to only verify the signature and validity of tokens.
+func (jauth *JWTAuthenticator) SetRevocationCheck(revocationCheck func(claims *JwtClaims) error) {
+	jauth.revocationCheck = revocationCheck
+}
+
 // NewJWTAuthenticator creates a new JWT authenticator
 // publicKey is the public key for verifying the private key signature
 func NewJWTAuthenticator(publicKey *ecdsa.PublicKey) *JWTAuthenticator {
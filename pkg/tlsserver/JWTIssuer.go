@@ -0,0 +1,288 @@
+package tlsserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/sirupsen/logrus"
+)
+
+// Default validity of issued tokens
+const (
+	DefaultJWTAccessValidity  = time.Hour
+	DefaultJWTRefreshValidity = 14 * 24 * time.Hour
+)
+
+// Token types in the JwtClaims
+const (
+	TokenTypeAccess  = "access"
+	TokenTypeRefresh = "refresh"
+)
+
+// JWTIssuer issues ES256 signed access and refresh token pairs.
+//
+// Refresh tokens are rotated: a refresh token can be used only once, after which it is revoked and a new
+// pair is issued. If a revoked refresh token is used again then it was likely stolen, and all tokens of
+// the user are revoked.
+// The tokens can be verified with the JWTAuthenticator using the issuer's public key. Use CheckRevoked as its
+// revocation check to also reject revoked access tokens.
+//
+// The revocations are only kept in memory. After a restart of the issuer, revoked tokens that haven't expired are
+// accepted again, so use a short access token validity. The revocation epoch starts at the start time of the issuer,
+// so revoking a user after a restart also revokes the tokens that were issued before the restart.
+type JWTIssuer struct {
+	// name of the issuer in the token claims
+	issuerName string
+	// key used to sign the tokens
+	signingKey *ecdsa.PrivateKey
+	// validity of the tokens
+	accessValidity  time.Duration
+	refreshValidity time.Duration
+	// IDs of used or revoked refresh tokens with their expiry time
+	revokedTokens map[string]time.Time
+	// revocation epoch that is included in issued tokens. It starts at the start time in nanoseconds and
+	// increases with each revocation of a user.
+	epoch int64
+	// revocation of all tokens of users
+	revokedUsers map[string]userRevocation
+	// mutex for concurrent access to the revocation lists
+	mutex sync.RWMutex
+}
+
+// userRevocation revokes the tokens of a user that were issued before the revocation
+type userRevocation struct {
+	// tokens of the user with a lower epoch are revoked
+	epoch int64
+	// time the revoked tokens have expired, after which the revocation can be removed
+	expiry time.Time
+}
+
+// CreateTokens issues a new pair of access and refresh tokens for a user
+//  userID is the authenticated user
+//  roles of the user to include in the claims. See also RequireRole.
+//  rememberMe is included in the refresh token claims, so it is kept after refresh
+func (issuer *JWTIssuer) CreateTokens(userID string, roles []string, rememberMe bool) (
+	accessToken string, refreshToken string, err error) {
+
+	issuer.mutex.RLock()
+	accessValidity := issuer.accessValidity
+	refreshValidity := issuer.refreshValidity
+	issuer.mutex.RUnlock()
+
+	accessToken, err = issuer.createToken(userID, roles, TokenTypeAccess, false, accessValidity)
+	if err == nil {
+		refreshToken, err = issuer.createToken(userID, roles, TokenTypeRefresh, rememberMe, refreshValidity)
+	}
+	return accessToken, refreshToken, err
+}
+
+// CheckRevoked returns an error if the token with the claims is revoked
+// Use this as the revocation check of the JWTAuthenticator to reject revoked access tokens.
+func (issuer *JWTIssuer) CheckRevoked(claims *JwtClaims) error {
+	issuer.mutex.RLock()
+	defer issuer.mutex.RUnlock()
+	return issuer.checkRevoked(claims)
+}
+
+// DecodeToken verifies the signature and validity of a token issued by this issuer and returns its claims.
+// Revoked tokens are rejected.
+func (issuer *JWTIssuer) DecodeToken(tokenString string) (claims *JwtClaims, err error) {
+	claims, err = issuer.verifyToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	return claims, issuer.CheckRevoked(claims)
+}
+
+// GetPublicKey returns the public key for verifying the issued tokens, eg with TLSServer.EnableJwtAuth
+func (issuer *JWTIssuer) GetPublicKey() *ecdsa.PublicKey {
+	return &issuer.signingKey.PublicKey
+}
+
+// RefreshTokens issues a new pair of tokens in exchange for a valid refresh token.
+// The refresh token is revoked so it can't be used again. If a refresh token is used more than once then
+// all tokens of the user are revoked.
+//  refreshToken is the refresh token from the last login or refresh
+//  roles of the user to include in the new tokens, or nil to keep the roles of the refresh token
+func (issuer *JWTIssuer) RefreshTokens(refreshToken string, roles []string) (
+	accessToken string, newRefreshToken string, err error) {
+
+	claims, err := issuer.verifyToken(refreshToken)
+	if err != nil {
+		return "", "", fmt.Errorf("RefreshTokens: invalid refresh token: %s", err)
+	}
+	if claims.TokenType != TokenTypeRefresh {
+		return "", "", errors.New("RefreshTokens: not a refresh token")
+	}
+	// check and revoke the refresh token at once, so it can't be used twice concurrently
+	issuer.mutex.Lock()
+	err = issuer.checkRevoked(claims)
+	if _, isReused := issuer.revokedTokens[claims.Id]; isReused {
+		logrus.Warningf("RefreshTokens: refresh token of user '%s' is reused. Revoking all tokens of the user.",
+			claims.Username)
+		issuer.revokeUser(claims.Username)
+	} else if err == nil {
+		issuer.revokeClaims(claims)
+	}
+	issuer.mutex.Unlock()
+	if err != nil {
+		return "", "", fmt.Errorf("RefreshTokens: invalid refresh token: %s", err)
+	}
+	if roles == nil {
+		roles = claims.Roles
+	}
+	return issuer.CreateTokens(claims.Username, roles, claims.RememberMe)
+}
+
+// RevokeToken revokes a refresh or access token, eg on logout
+// Access tokens are only rejected by JWTAuthenticators that use CheckRevoked as their revocation check.
+// Returns an error if the token isn't a valid token of this issuer.
+func (issuer *JWTIssuer) RevokeToken(tokenString string) error {
+	claims, err := issuer.DecodeToken(tokenString)
+	if err != nil {
+		return err
+	}
+	issuer.mutex.Lock()
+	defer issuer.mutex.Unlock()
+	issuer.revokeClaims(claims)
+	return nil
+}
+
+// RevokeUser revokes all tokens that have been issued to the user. Tokens issued afterwards are valid.
+// Access tokens are only rejected by JWTAuthenticators that use CheckRevoked as their revocation check.
+func (issuer *JWTIssuer) RevokeUser(userID string) {
+	issuer.mutex.Lock()
+	defer issuer.mutex.Unlock()
+	issuer.revokeUser(userID)
+}
+
+// SetValidity sets the validity of newly issued tokens
+//  accessValidity is the validity of access tokens. 0 for DefaultJWTAccessValidity
+//  refreshValidity is the validity of refresh tokens. 0 for DefaultJWTRefreshValidity
+func (issuer *JWTIssuer) SetValidity(accessValidity time.Duration, refreshValidity time.Duration) {
+	if accessValidity == 0 {
+		accessValidity = DefaultJWTAccessValidity
+	}
+	if refreshValidity == 0 {
+		refreshValidity = DefaultJWTRefreshValidity
+	}
+	issuer.mutex.Lock()
+	defer issuer.mutex.Unlock()
+	issuer.accessValidity = accessValidity
+	issuer.refreshValidity = refreshValidity
+}
+
+// createToken creates a signed token with a unique ID
+func (issuer *JWTIssuer) createToken(
+	userID string, roles []string, tokenType string, rememberMe bool, validity time.Duration) (string, error) {
+
+	tokenID := make([]byte, 16)
+	_, err := rand.Read(tokenID)
+	if err != nil {
+		return "", err
+	}
+	issuer.mutex.RLock()
+	epoch := issuer.epoch
+	issuer.mutex.RUnlock()
+	now := time.Now()
+	claims := JwtClaims{
+		Username:   userID,
+		Roles:      roles,
+		TokenType:  tokenType,
+		RememberMe: rememberMe,
+		Epoch:      epoch,
+		StandardClaims: jwt.StandardClaims{
+			Id:        base64.RawURLEncoding.EncodeToString(tokenID),
+			Issuer:    issuer.issuerName,
+			Subject:   userID,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(validity).Unix(),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	return token.SignedString(issuer.signingKey)
+}
+
+// checkRevoked returns an error if the token with the claims is revoked
+// This must be called with the mutex locked.
+func (issuer *JWTIssuer) checkRevoked(claims *JwtClaims) error {
+	if _, revoked := issuer.revokedTokens[claims.Id]; revoked {
+		return errors.New("token is revoked")
+	}
+	if revocation, found := issuer.revokedUsers[claims.Username]; found && claims.Epoch < revocation.epoch {
+		return errors.New("tokens of the user are revoked")
+	}
+	return nil
+}
+
+// pruneRevocations removes the revocations of tokens that have expired
+// This must be called with the mutex locked.
+func (issuer *JWTIssuer) pruneRevocations() {
+	now := time.Now()
+	for tokenID, expiry := range issuer.revokedTokens {
+		if now.After(expiry) {
+			delete(issuer.revokedTokens, tokenID)
+		}
+	}
+	for userID, revocation := range issuer.revokedUsers {
+		if now.After(revocation.expiry) {
+			delete(issuer.revokedUsers, userID)
+		}
+	}
+}
+
+// revokeClaims revokes the token with the claims and removes expired revocations
+// This must be called with the mutex locked.
+func (issuer *JWTIssuer) revokeClaims(claims *JwtClaims) {
+	issuer.pruneRevocations()
+	issuer.revokedTokens[claims.Id] = time.Unix(claims.ExpiresAt, 0)
+}
+
+// revokeUser revokes the tokens issued to the user until now and removes expired revocations.
+// The revocation is kept until all tokens issued before it have expired.
+// This must be called with the mutex locked.
+func (issuer *JWTIssuer) revokeUser(userID string) {
+	issuer.pruneRevocations()
+	issuer.epoch++
+	if now := time.Now().UnixNano(); now > issuer.epoch {
+		issuer.epoch = now
+	}
+	validity := issuer.refreshValidity
+	if issuer.accessValidity > validity {
+		validity = issuer.accessValidity
+	}
+	issuer.revokedUsers[userID] = userRevocation{
+		epoch:  issuer.epoch,
+		expiry: time.Now().Add(validity),
+	}
+}
+
+// verifyToken verifies the signature and validity of a token issued by this issuer, without checking
+// whether it is revoked.
+func (issuer *JWTIssuer) verifyToken(tokenString string) (claims *JwtClaims, err error) {
+	auth := NewJWTAuthenticator(&issuer.signingKey.PublicKey)
+	_, claims, err = auth.DecodeToken(tokenString)
+	return claims, err
+}
+
+// NewJWTIssuer creates an issuer of JWT tokens
+//  issuerName to include in the claims, eg the hostname of the service
+//  signingKey is the private key used to sign the tokens, eg the private key of the server certificate
+func NewJWTIssuer(issuerName string, signingKey *ecdsa.PrivateKey) *JWTIssuer {
+	issuer := &JWTIssuer{
+		issuerName:      issuerName,
+		signingKey:      signingKey,
+		accessValidity:  DefaultJWTAccessValidity,
+		refreshValidity: DefaultJWTRefreshValidity,
+		revokedTokens:   make(map[string]time.Time),
+		revokedUsers:    make(map[string]userRevocation),
+		epoch:           time.Now().UnixNano(),
+	}
+	return issuer
+}
@@ -0,0 +1,358 @@
+package tlsserver
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/wostzone/wost-go/pkg/tlsclient"
+)
+
+// RequestIDHeader is the header with the ID of a request. A valid ID provided by the client is used, so
+// requests can be traced across services. Otherwise the RequestLogger generates an ID.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the maximum length of a request ID provided by the client
+const maxRequestIDLength = 64
+
+// Middleware wraps a handler to add behaviour before and after the handler processes a request.
+// See TLSServer.Use
+type Middleware func(next http.Handler) http.Handler
+
+// requestInfoKey is the context key of the request info
+type requestInfoKey struct{}
+
+// requestInfo holds the request ID and the authenticated user of a request, for use by middleware
+type requestInfo struct {
+	requestID string
+	userID    string
+}
+
+// responseRecorder records the status and size of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	// optional handler invoked before the response header is written, to add headers
+	beforeWriteHeader func(status int)
+	size              int
+	status            int
+	wroteHeader       bool
+}
+
+// Flush sends buffered data to the client, if supported by the underlying writer
+func (rec *responseRecorder) Flush() {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the handler take over the connection, eg for websockets
+func (rec *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the underlying response writer
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Write records the size of the response body
+func (rec *responseRecorder) Write(data []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	n, err := rec.ResponseWriter.Write(data)
+	rec.size += n
+	return n, err
+}
+
+// WriteHeader records the status of the response
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.wroteHeader {
+		return
+	}
+	rec.wroteHeader = true
+	rec.status = status
+	if rec.beforeWriteHeader != nil {
+		rec.beforeWriteHeader(status)
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// gzipResponseWriter compresses the response body if the response isn't encoded already
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	req         *http.Request
+	wroteHeader bool
+}
+
+// Flush sends the compressed data to the client
+func (gzw *gzipResponseWriter) Flush() {
+	if !gzw.wroteHeader {
+		gzw.WriteHeader(http.StatusOK)
+	}
+	if gzw.gz != nil {
+		_ = gzw.gz.Flush()
+	}
+	if flusher, ok := gzw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying response writer
+func (gzw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return gzw.ResponseWriter
+}
+
+// Write compresses the data
+func (gzw *gzipResponseWriter) Write(data []byte) (int, error) {
+	if !gzw.wroteHeader {
+		if gzw.Header().Get("Content-Type") == "" {
+			gzw.Header().Set("Content-Type", http.DetectContentType(data))
+		}
+		gzw.WriteHeader(http.StatusOK)
+	}
+	if gzw.gz != nil {
+		return gzw.gz.Write(data)
+	}
+	return gzw.ResponseWriter.Write(data)
+}
+
+// WriteHeader decides whether to compress the response body
+// Responses without body and responses that are already encoded are not compressed.
+func (gzw *gzipResponseWriter) WriteHeader(status int) {
+	if gzw.wroteHeader {
+		return
+	}
+	gzw.wroteHeader = true
+	header := gzw.Header()
+	if gzw.req.Method != http.MethodHead && status != http.StatusNoContent &&
+		status != http.StatusNotModified && status >= http.StatusOK && header.Get("Content-Encoding") == "" {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		gzw.gz = gzipWriterPool.Get().(*gzip.Writer)
+		gzw.gz.Reset(gzw.ResponseWriter)
+	}
+	header.Add("Vary", "Accept-Encoding")
+	gzw.ResponseWriter.WriteHeader(status)
+}
+
+// close completes the compressed response body
+func (gzw *gzipResponseWriter) close() {
+	if gzw.gz != nil {
+		_ = gzw.gz.Close()
+		gzipWriterPool.Put(gzw.gz)
+		gzw.gz = nil
+	}
+}
+
+// gzipWriterPool reuses gzip writers, as they allocate a large buffer
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// acceptsGzip returns true if the Accept-Encoding header accepts gzip with a non-zero quality.
+// An explicit gzip entry takes precedence over the "*" wildcard.
+func acceptsGzip(acceptEncoding string) bool {
+	gzipQ := -1.0
+	wildcardQ := -1.0
+	for _, entry := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(entry, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if len(param) > 2 && strings.EqualFold(param[:2], "q=") {
+				value, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					value = 0
+				}
+				q = value
+			}
+		}
+		if coding == "gzip" {
+			gzipQ = q
+		} else if coding == "*" {
+			wildcardQ = q
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return wildcardQ > 0
+}
+
+// Gzip returns the middleware that compresses response bodies for clients that accept gzip encoding.
+// Websocket upgrade requests and responses that set their own Content-Encoding are not compressed.
+//
+// Responses of the token endpoints of the JWTAuthService and of the given paths are never compressed,
+// as compressing secrets along with data from the request exposes them to the BREACH attack.
+//  excludedPaths are additional paths whose responses contain secrets
+func Gzip(excludedPaths ...string) Middleware {
+	excluded := map[string]bool{
+		tlsclient.DefaultJWTLoginPath:   true,
+		tlsclient.DefaultJWTRefreshPath: true,
+		DefaultJWTLogoutPath:            true,
+	}
+	for _, path := range excludedPaths {
+		excluded[path] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			if !acceptsGzip(req.Header.Get("Accept-Encoding")) || req.Header.Get("Upgrade") != "" ||
+				excluded[req.URL.Path] {
+				next.ServeHTTP(resp, req)
+				return
+			}
+			gzw := &gzipResponseWriter{ResponseWriter: resp, req: req}
+			defer gzw.close()
+			next.ServeHTTP(gzw, req)
+		})
+	}
+}
+
+// GetRequestID returns the ID of the request as assigned by the RequestLogger, or "" if the request
+// has no ID.
+func GetRequestID(req *http.Request) string {
+	if info, ok := req.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return info.requestID
+	}
+	return ""
+}
+
+// Recoverer returns the middleware that recovers from a panic in a handler. The panic is logged with its
+// stack trace and the client receives a 500 Internal Server Error, if the response hasn't started yet.
+func Recoverer() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			rec := &responseRecorder{ResponseWriter: resp}
+			defer func() {
+				recovered := recover()
+				if recovered == nil {
+					return
+				} else if recovered == http.ErrAbortHandler {
+					// the handler intentionally aborted the response
+					panic(recovered)
+				}
+				logrus.WithField("requestID", GetRequestID(req)).Errorf(
+					"TLSServer: Panic in handler of %s %s from %s: %v\n%s",
+					req.Method, req.URL.Path, req.RemoteAddr, recovered, debug.Stack())
+				if !rec.wroteHeader {
+					http.Error(rec, "Internal server error", http.StatusInternalServerError)
+				}
+			}()
+			next.ServeHTTP(rec, req)
+		})
+	}
+}
+
+// RequestLogger returns the middleware that assigns each request an ID and logs the completed request.
+// The request ID is returned in the X-Request-ID response header and is available to handlers with
+// GetRequestID. The access log is written with fields for the request ID, method, path, client,
+// authenticated user, status, response size and duration.
+func RequestLogger() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			info := &requestInfo{requestID: req.Header.Get(RequestIDHeader)}
+			if !isValidRequestID(info.requestID) {
+				info.requestID = newRequestID()
+			}
+			resp.Header().Set(RequestIDHeader, info.requestID)
+			req = req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, info))
+			rec := &responseRecorder{ResponseWriter: resp, status: http.StatusOK}
+
+			next.ServeHTTP(rec, req)
+
+			entry := logrus.WithFields(logrus.Fields{
+				"requestID": info.requestID,
+				"method":    req.Method,
+				"path":      req.URL.Path,
+				"remote":    req.RemoteAddr,
+				"user":      info.userID,
+				"status":    rec.status,
+				"size":      rec.size,
+				"duration":  time.Since(start).String(),
+			})
+			if rec.status >= http.StatusInternalServerError {
+				entry.Error("TLSServer: request failed")
+			} else {
+				entry.Info("TLSServer: request completed")
+			}
+		})
+	}
+}
+
+// RequestTiming returns the middleware that reports the time spent handling a request in the Server-Timing
+// response header, and logs a warning for requests that take longer than the threshold.
+//  slowThreshold is the duration after which a request is logged as slow. 0 to not log slow requests.
+func RequestTiming(slowThreshold time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			rec := &responseRecorder{ResponseWriter: resp, status: http.StatusOK}
+			rec.beforeWriteHeader = func(status int) {
+				duration := time.Since(start)
+				rec.Header().Add("Server-Timing", fmt.Sprintf("app;dur=%.3f", float64(duration)/float64(time.Millisecond)))
+			}
+
+			next.ServeHTTP(rec, req)
+
+			duration := time.Since(start)
+			if slowThreshold > 0 && duration > slowThreshold {
+				logrus.WithField("requestID", GetRequestID(req)).Warningf(
+					"TLSServer: Slow request %s %s from %s took %s", req.Method, req.URL.Path, req.RemoteAddr, duration)
+			}
+		})
+	}
+}
+
+// isValidRequestID returns whether a request ID provided by a client can be used
+// This prevents log injection with control characters or huge IDs.
+func isValidRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range requestID {
+		isAlphaNum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !isAlphaNum && c != '-' && c != '_' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random request ID
+func newRequestID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// setRequestUser sets the authenticated user of the request for use in the access log
+func setRequestUser(req *http.Request, userID string) {
+	if info, ok := req.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.userID = userID
+	}
+}
@@ -0,0 +1,140 @@
+package tlsserver_test
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/wostzone/wost-go/pkg/tlsclient"
+	"github.com/wostzone/wost-go/pkg/tlsserver"
+)
+
+func TestMiddleware(t *testing.T) {
+	logrus.Infof("--- TestMiddleware ---")
+	path1 := "/hello"
+	path2 := "/panic"
+	path3 := "/empty"
+	user1 := "user1"
+	password1 := "user1pass"
+	body1 := strings.Repeat("hello world ", 100)
+	var order []string
+	var handlerRequestID string
+
+	marker := func(name string) tlsserver.Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(resp, req)
+			})
+		}
+	}
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort, testCerts.ServerCert, testCerts.CaCert,
+		tlsserver.WithMiddleware(marker("first"), tlsserver.RequestLogger()))
+	srv.Use(tlsserver.Recoverer(), tlsserver.RequestTiming(time.Second), tlsserver.Gzip(), marker("last"))
+	srv.EnableBasicAuth(func(loginName string, password string) bool {
+		return loginName == user1 && password == password1
+	})
+	srv.AddHandler(path1, func(userID string, resp http.ResponseWriter, req *http.Request) {
+		handlerRequestID = tlsserver.GetRequestID(req)
+		_, _ = resp.Write([]byte(body1))
+	})
+	srv.AddHandlerNoAuth(path2, func(resp http.ResponseWriter, req *http.Request) {
+		panic("handler failed")
+	})
+	srv.AddHandlerNoAuth(path3, func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(http.StatusNoContent)
+	})
+	srv.AddHandlerNoAuth(tlsclient.DefaultJWTLoginPath, func(resp http.ResponseWriter, req *http.Request) {
+		_, _ = resp.Write([]byte(body1))
+	})
+	err := srv.Start()
+	require.NoError(t, err)
+	defer srv.Stop()
+
+	caCertPool := x509.NewCertPool()
+	caCertPool.AddCert(testCerts.CaCert)
+	// disable the transparent decompression of the transport to check the encoding
+	httpClient := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:    &tls.Config{RootCAs: caCertPool},
+		DisableCompression: true,
+	}}
+	invoke := func(path string, requestID string, acceptEncoding string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("https://%s%s", clientHostPort, path), nil)
+		req.SetBasicAuth(user1, password1)
+		if requestID != "" {
+			req.Header.Set(tlsserver.RequestIDHeader, requestID)
+		}
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		resp, err := httpClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, body
+	}
+
+	// middleware runs in order of use, the request ID is generated and the response is timed
+	resp, body := invoke(path1, "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, body1, string(body))
+	assert.Equal(t, []string{"first", "last"}, order)
+	assert.NotEmpty(t, resp.Header.Get(tlsserver.RequestIDHeader))
+	assert.Equal(t, resp.Header.Get(tlsserver.RequestIDHeader), handlerRequestID)
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Server-Timing"), "app;dur="))
+
+	// a valid request ID of the client is used, an invalid ID is replaced
+	resp, _ = invoke(path1, "trace-123", "")
+	assert.Equal(t, "trace-123", resp.Header.Get(tlsserver.RequestIDHeader))
+	resp, _ = invoke(path1, "bad id", "")
+	assert.NotEqual(t, "bad id", resp.Header.Get(tlsserver.RequestIDHeader))
+	assert.NotEmpty(t, resp.Header.Get(tlsserver.RequestIDHeader))
+
+	// responses are compressed if the client accepts gzip
+	resp, body = invoke(path1, "", "gzip")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Less(t, len(body), len(body1))
+	gz, err := gzip.NewReader(strings.NewReader(string(body)))
+	require.NoError(t, err)
+	unzipped, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, body1, string(unzipped))
+	resp, body = invoke(path3, "", "gzip")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Empty(t, body)
+	resp, _ = invoke(path1, "", "deflate, *;q=0.5")
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+
+	// gzip with quality 0 is refused by the client
+	resp, body = invoke(path1, "", "gzip;q=0")
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, body1, string(body))
+	resp, _ = invoke(path1, "", "*, gzip;q=0")
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+
+	// responses of token endpoints are not compressed
+	resp, body = invoke(tlsclient.DefaultJWTLoginPath, "", "gzip")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, body1, string(body))
+
+	// a panic in a handler returns an internal error and the server keeps running
+	resp, _ = invoke(path2, "", "")
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	resp, _ = invoke(path1, "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	httpClient.CloseIdleConnections()
+}
@@ -0,0 +1,333 @@
+package tlsserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2"
+
+	"github.com/wostzone/wost-go/pkg/hubnet"
+)
+
+// DefaultJWKSCacheDuration is the time the keys of the identity provider are cached before they are fetched again
+const DefaultJWKSCacheDuration = time.Hour
+
+// DefaultJWKSRefetchInterval limits fetching the keys when a token is signed with an unknown key, eg after
+// the identity provider rotated its keys.
+const DefaultJWKSRefetchInterval = time.Minute
+
+// OIDCDiscoveryPath is the path of the OpenID provider configuration, relative to the issuer URL
+const OIDCDiscoveryPath = "/.well-known/openid-configuration"
+
+// DefaultOIDCRolesClaim is the default name of the claim of OIDC access tokens that holds the roles of the user
+const DefaultOIDCRolesClaim = "roles"
+
+// maxJWKSSize is the maximum size of the provider configuration and key set documents
+const maxJWKSSize = 1024 * 1024
+
+// oidcProviderConfig holds the fields of the OpenID provider configuration used by the authenticator
+type oidcProviderConfig struct {
+	Issuer  string `json:"issuer"`
+	JwksURI string `json:"jwks_uri"`
+}
+
+// OIDCAuthenticator verifies access tokens issued by an OpenID Connect identity provider.
+//
+// The signing keys of the provider are obtained from the JWKS URI of its OpenID provider configuration.
+// Keys are cached and fetched again when a token is signed with an unknown key, to support key rotation.
+// Tokens must be signed with RS256 or ES256, be issued by the issuer and have the audience of the server.
+//
+// The user ID of a token is its subject qualified by the issuer, as in '<issuerURL>#<sub>'. This can't
+// be mistaken for a local login name, which can't contain a ':'. The roles of the user are the roles of
+// the token that are mapped to hub roles with SetRoleMapping.
+type OIDCAuthenticator struct {
+	// expected audience of the tokens
+	audience string
+	// time keys are cached
+	cacheDuration time.Duration
+	// mutex to fetch the keys one at a time
+	fetchMutex sync.Mutex
+	// client for fetching the provider configuration and keys
+	httpClient *http.Client
+	// URL of the identity provider as used in the 'iss' claim
+	issuerURL string
+	// URL of the key set, obtained from the provider configuration
+	jwksURL string
+	// public keys of the provider by key ID
+	keys map[string]interface{}
+	// time the keys were last fetched
+	keysFetched time.Time
+	// minimum time between fetching the keys for tokens with an unknown key
+	refetchInterval time.Duration
+	// name of the claim that holds the roles
+	rolesClaim string
+	// hub roles by role of the identity provider
+	roleMapping map[string]string
+	// mutex for concurrent access to the keys and configuration
+	mutex sync.RWMutex
+}
+
+// AuthenticateRequest validates the OIDC access token
+// The access token is provided in the request header using the Bearer schema:
+//
+//   Authorization: Bearer <token>
+//
+// Returns the issuer qualified subject of the token and true if there is a match, of false if authentication failed
+func (oauth *OIDCAuthenticator) AuthenticateRequest(resp http.ResponseWriter, req *http.Request) (userID string, match bool) {
+	accessToken, err := hubnet.GetBearerToken(req)
+	if err != nil {
+		return "", false
+	}
+	claims, err := oauth.DecodeToken(accessToken)
+	if err != nil {
+		logrus.Infof("OIDCAuthenticator: Invalid access token in request %s '%s' from %s: %s",
+			req.Method, req.RequestURI, req.RemoteAddr, err)
+		return "", false
+	}
+	return oauth.getUserID(claims), true
+}
+
+// DecodeToken verifies the token signature, issuer, audience and validity period, and returns its claims
+// Tokens without expiry are rejected.
+func (oauth *OIDCAuthenticator) DecodeToken(tokenString string) (claims jwt.MapClaims, err error) {
+	claims = jwt.MapClaims{}
+	parser := &jwt.Parser{ValidMethods: []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg()}}
+	jwtToken, err := parser.ParseWithClaims(tokenString, claims, oauth.getKey)
+	if err != nil || !jwtToken.Valid {
+		return claims, fmt.Errorf("invalid OIDC token: %s", err)
+	}
+	if !claims.VerifyIssuer(oauth.issuerURL, true) {
+		return claims, fmt.Errorf("OIDC token has issuer '%v' instead of '%s'", claims["iss"], oauth.issuerURL)
+	}
+	if !claims.VerifyAudience(oauth.audience, true) {
+		return claims, fmt.Errorf("OIDC token is not intended for audience '%s'", oauth.audience)
+	}
+	if subject, _ := claims["sub"].(string); subject == "" {
+		return claims, fmt.Errorf("OIDC token has no subject")
+	}
+	// the parser only verifies the expiry if the token has one
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return claims, fmt.Errorf("OIDC token has no expiry or is expired")
+	}
+	return claims, nil
+}
+
+// GetRoles returns the hub roles that the roles in the claims of a valid access token of the request map to
+// Roles without mapping are ignored. Returns nil if the request has no valid access token.
+func (oauth *OIDCAuthenticator) GetRoles(req *http.Request) []string {
+	accessToken, err := hubnet.GetBearerToken(req)
+	if err != nil {
+		return nil
+	}
+	claims, err := oauth.DecodeToken(accessToken)
+	if err != nil {
+		return nil
+	}
+	oauth.mutex.RLock()
+	defer oauth.mutex.RUnlock()
+	var idpRoles []string
+	switch claimValue := claims[oauth.rolesClaim].(type) {
+	case string:
+		idpRoles = strings.Fields(claimValue)
+	case []interface{}:
+		for _, role := range claimValue {
+			if roleName, isString := role.(string); isString {
+				idpRoles = append(idpRoles, roleName)
+			}
+		}
+	}
+	var roles []string
+	for _, idpRole := range idpRoles {
+		if hubRole, found := oauth.roleMapping[idpRole]; found {
+			roles = append(roles, hubRole)
+		}
+	}
+	return roles
+}
+
+// SetCacheDuration sets the time the keys of the identity provider are cached, and the minimum time
+// between fetching the keys when a token is signed with an unknown key.
+//  cacheDuration is the cache time. 0 for DefaultJWKSCacheDuration
+//  refetchInterval is the minimum time between fetches. 0 for DefaultJWKSRefetchInterval
+func (oauth *OIDCAuthenticator) SetCacheDuration(cacheDuration time.Duration, refetchInterval time.Duration) {
+	if cacheDuration <= 0 {
+		cacheDuration = DefaultJWKSCacheDuration
+	}
+	if refetchInterval <= 0 {
+		refetchInterval = DefaultJWKSRefetchInterval
+	}
+	oauth.mutex.Lock()
+	defer oauth.mutex.Unlock()
+	oauth.cacheDuration = cacheDuration
+	oauth.refetchInterval = refetchInterval
+}
+
+// SetRolesClaim sets the name of the claim that holds the roles, if the identity provider uses another
+// claim than the default.
+//  rolesClaim is the claim with the list of roles. "" for DefaultOIDCRolesClaim
+func (oauth *OIDCAuthenticator) SetRolesClaim(rolesClaim string) {
+	if rolesClaim == "" {
+		rolesClaim = DefaultOIDCRolesClaim
+	}
+	oauth.mutex.Lock()
+	defer oauth.mutex.Unlock()
+	oauth.rolesClaim = rolesClaim
+}
+
+// SetRoleMapping sets the hub roles of the roles of the identity provider.
+// Roles of the identity provider without mapping are ignored. Without mapping users of the identity
+// provider only have access to handlers that don't require a role.
+//  roleMapping maps the role names of the identity provider to hub roles, eg {"hub-admins": RoleAdmin}
+func (oauth *OIDCAuthenticator) SetRoleMapping(roleMapping map[string]string) {
+	mapping := make(map[string]string, len(roleMapping))
+	for idpRole, hubRole := range roleMapping {
+		mapping[idpRole] = hubRole
+	}
+	oauth.mutex.Lock()
+	defer oauth.mutex.Unlock()
+	oauth.roleMapping = mapping
+}
+
+// fetchJSON reads a JSON document from the identity provider
+func (oauth *OIDCAuthenticator) fetchJSON(docURL string, doc interface{}) error {
+	resp, err := oauth.httpClient.Get(docURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("reading %s failed: %s", docURL, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, doc)
+}
+
+// fetchKeys fetches the provider configuration if needed, and the key set of the identity provider
+// This does not access the fields that are protected by the mutex.
+//  jwksURL is the URL of the key set, or "" to obtain it from the provider configuration
+// Returns the URL and the keys of the key set
+func (oauth *OIDCAuthenticator) fetchKeys(jwksURL string) (string, map[string]interface{}, error) {
+	if jwksURL == "" {
+		config := oidcProviderConfig{}
+		err := oauth.fetchJSON(strings.TrimSuffix(oauth.issuerURL, "/")+OIDCDiscoveryPath, &config)
+		if err != nil {
+			return "", nil, fmt.Errorf("reading the provider configuration failed: %s", err)
+		} else if config.Issuer != oauth.issuerURL || config.JwksURI == "" {
+			return "", nil, fmt.Errorf("provider configuration of '%s' has issuer '%s' and JWKS URI '%s'",
+				oauth.issuerURL, config.Issuer, config.JwksURI)
+		}
+		jwksURL = config.JwksURI
+	}
+	keySet := jose.JSONWebKeySet{}
+	err := oauth.fetchJSON(jwksURL, &keySet)
+	if err != nil {
+		return jwksURL, nil, fmt.Errorf("reading the keys failed: %s", err)
+	}
+	keys := make(map[string]interface{})
+	for _, key := range keySet.Keys {
+		if key.Use == "" || key.Use == "sig" {
+			keys[key.KeyID] = key.Key
+		}
+	}
+	logrus.Infof("OIDCAuthenticator: Obtained %d keys of '%s'", len(keys), oauth.issuerURL)
+	return jwksURL, keys, nil
+}
+
+// getKey returns the public key to verify the token signature with
+// The keys are fetched if the cache has expired or the token is signed with an unknown key.
+func (oauth *OIDCAuthenticator) getKey(token *jwt.Token) (interface{}, error) {
+	keyID, _ := token.Header["kid"].(string)
+	oauth.mutex.RLock()
+	key, found := oauth.keys[keyID]
+	isExpired := time.Since(oauth.keysFetched) > oauth.cacheDuration
+	oauth.mutex.RUnlock()
+	if found && !isExpired {
+		return key, nil
+	}
+
+	oauth.refreshKeys()
+	oauth.mutex.RLock()
+	key, found = oauth.keys[keyID]
+	oauth.mutex.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("unknown signing key '%s'", keyID)
+	}
+	return key, nil
+}
+
+// getUserID returns the user ID of the claims, which is the subject qualified by the issuer
+func (oauth *OIDCAuthenticator) getUserID(claims jwt.MapClaims) string {
+	subject, _ := claims["sub"].(string)
+	return oauth.issuerURL + "#" + subject
+}
+
+// refreshKeys fetches the keys of the identity provider, unless they were fetched less than the
+// refetch interval ago. The keys are fetched without holding the mutex, so requests with known keys
+// are not blocked by the identity provider.
+func (oauth *OIDCAuthenticator) refreshKeys() {
+	oauth.fetchMutex.Lock()
+	defer oauth.fetchMutex.Unlock()
+
+	// another request might have fetched the keys already
+	oauth.mutex.Lock()
+	if time.Since(oauth.keysFetched) <= oauth.refetchInterval {
+		oauth.mutex.Unlock()
+		return
+	}
+	oauth.keysFetched = time.Now()
+	jwksURL := oauth.jwksURL
+	oauth.mutex.Unlock()
+
+	jwksURL, keys, err := oauth.fetchKeys(jwksURL)
+	if err != nil {
+		logrus.Warningf("OIDCAuthenticator: %s", err)
+	}
+	oauth.mutex.Lock()
+	defer oauth.mutex.Unlock()
+	oauth.jwksURL = jwksURL
+	if keys != nil {
+		oauth.keys = keys
+	}
+}
+
+// NewOIDCAuthenticator creates an authenticator of access tokens issued by an OpenID Connect identity provider.
+// The keys of the identity provider are fetched when the first token is verified.
+// Use SetRoleMapping to give users of the identity provider hub roles.
+//
+//  issuerURL is the URL of the identity provider as used in the 'iss' claim, eg https://idp.example.com/realms/hub
+//  audience of the tokens, eg the client ID of the Hub as registered with the identity provider
+//  caCert is the CA of the identity provider's server certificate, or nil to use the system CAs
+func NewOIDCAuthenticator(issuerURL string, audience string, caCert *x509.Certificate) *OIDCAuthenticator {
+	var rootCAs *x509.CertPool
+	if caCert != nil {
+		rootCAs = x509.NewCertPool()
+		rootCAs.AddCert(caCert)
+	}
+	oauth := &OIDCAuthenticator{
+		audience:      audience,
+		cacheDuration: DefaultJWKSCacheDuration,
+		httpClient: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: rootCAs}},
+		},
+		issuerURL:       issuerURL,
+		keys:            make(map[string]interface{}),
+		refetchInterval: DefaultJWKSRefetchInterval,
+		rolesClaim:      DefaultOIDCRolesClaim,
+		roleMapping:     make(map[string]string),
+	}
+	return oauth
+}
@@ -0,0 +1,181 @@
+package tlsserver_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+
+	"github.com/wostzone/wost-go/pkg/tlsclient"
+	"github.com/wostzone/wost-go/pkg/tlsserver"
+)
+
+// testIdentityProvider is a local stand-in of an OIDC identity provider that serves its keys
+type testIdentityProvider struct {
+	issuerURL string
+	keySet    jose.JSONWebKeySet
+	srv       *tlsserver.TLSServer
+	mutex     sync.Mutex
+}
+
+// createToken returns a token signed with the key of the given ID
+func (idp *testIdentityProvider) createToken(t *testing.T, keyID string, signingKey interface{},
+	method jwt.SigningMethod, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = keyID
+	tokenString, err := token.SignedString(signingKey)
+	require.NoError(t, err)
+	return tokenString
+}
+
+// setKeys replaces the published keys
+func (idp *testIdentityProvider) setKeys(keys ...jose.JSONWebKey) {
+	idp.mutex.Lock()
+	defer idp.mutex.Unlock()
+	idp.keySet = jose.JSONWebKeySet{Keys: keys}
+}
+
+// startTestIdentityProvider starts the stand-in identity provider on the given port
+func startTestIdentityProvider(t *testing.T, port uint) *testIdentityProvider {
+	idp := &testIdentityProvider{
+		issuerURL: fmt.Sprintf("https://%s:%d/realms/hub", serverAddress, port),
+		srv:       tlsserver.NewTLSServer(serverAddress, port, testCerts.ServerCert, testCerts.CaCert),
+	}
+	idp.srv.AddHandlerNoAuth("/realms/hub"+tlsserver.OIDCDiscoveryPath, func(resp http.ResponseWriter, req *http.Request) {
+		config, _ := json.Marshal(map[string]string{
+			"issuer":   idp.issuerURL,
+			"jwks_uri": idp.issuerURL + "/certs",
+		})
+		_, _ = resp.Write(config)
+	})
+	idp.srv.AddHandlerNoAuth("/realms/hub/certs", func(resp http.ResponseWriter, req *http.Request) {
+		idp.mutex.Lock()
+		keySet, _ := json.Marshal(idp.keySet)
+		idp.mutex.Unlock()
+		_, _ = resp.Write(keySet)
+	})
+	err := idp.srv.Start()
+	require.NoError(t, err)
+	return idp
+}
+
+func TestOIDCAuthenticator(t *testing.T) {
+	logrus.Infof("--- TestOIDCAuthenticator ---")
+	path1 := "/admin"
+	path1Hit := 0
+	path2 := "/user"
+	path2User := ""
+	audience := "hub"
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey := testCerts.DeviceKey
+	idp := startTestIdentityProvider(t, serverPort+1)
+	defer idp.srv.Stop()
+	idp.setKeys(jose.JSONWebKey{Key: &rsaKey.PublicKey, KeyID: "rsa1", Algorithm: "RS256", Use: "sig"})
+
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort, testCerts.ServerCert, testCerts.CaCert)
+	oidcAuth := srv.EnableOIDCAuth(idp.issuerURL, audience, testCerts.CaCert)
+	oidcAuth.SetRolesClaim("groups")
+	oidcAuth.SetRoleMapping(map[string]string{"hub-admins": tlsserver.RoleAdmin})
+	oidcAuth.SetCacheDuration(0, 100*time.Millisecond)
+	// the role lookup of local users doesn't apply to users of the identity provider
+	srv.SetRoleLookup(func(userID string) []string {
+		return []string{tlsserver.RoleAdmin}
+	})
+	srv.AddHandler(path1, func(userID string, resp http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, idp.issuerURL+"#f81d4fae", userID)
+		path1Hit++
+	}, tlsserver.RequireRole(tlsserver.RoleAdmin))
+	srv.AddHandler(path2, func(userID string, resp http.ResponseWriter, req *http.Request) {
+		path2User = userID
+	})
+	err = srv.Start()
+	require.NoError(t, err)
+	defer srv.Stop()
+
+	newClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":                idp.issuerURL,
+			"aud":                []string{audience, "other"},
+			"sub":                "f81d4fae",
+			"preferred_username": "user1",
+			"groups":             []string{"hub-admins"},
+			"iat":                time.Now().Unix(),
+			"exp":                time.Now().Add(time.Minute).Unix(),
+		}
+	}
+	invokePath := func(path string, token string) error {
+		cl := tlsclient.NewTLSClient(clientHostPort, testCerts.CaCert)
+		cl.ConnectWithJwtAccessToken("user1", token)
+		_, err := cl.Get(path)
+		cl.Close()
+		return err
+	}
+	invoke := func(token string) error {
+		return invokePath(path1, token)
+	}
+
+	// RS256 token of the provider is accepted
+	token := idp.createToken(t, "rsa1", rsaKey, jwt.SigningMethodRS256, newClaims())
+	err = invoke(token)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, path1Hit)
+
+	// the provider rotates to an ES256 key
+	idp.setKeys(jose.JSONWebKey{Key: &ecKey.PublicKey, KeyID: "ec2", Algorithm: "ES256", Use: "sig"})
+	time.Sleep(100 * time.Millisecond)
+	token = idp.createToken(t, "ec2", ecKey, jwt.SigningMethodES256, newClaims())
+	err = invoke(token)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, path1Hit)
+
+	// tokens with the wrong issuer, audience, role or an expired token are rejected
+	claims := newClaims()
+	claims["iss"] = "https://evil.example.com"
+	err = invoke(idp.createToken(t, "ec2", ecKey, jwt.SigningMethodES256, claims))
+	assert.Error(t, err)
+	claims = newClaims()
+	claims["aud"] = "other"
+	err = invoke(idp.createToken(t, "ec2", ecKey, jwt.SigningMethodES256, claims))
+	assert.Error(t, err)
+	claims = newClaims()
+	claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	_, err = oidcAuth.DecodeToken(idp.createToken(t, "ec2", ecKey, jwt.SigningMethodES256, claims))
+	assert.Error(t, err)
+	// tokens without expiry are rejected
+	delete(claims, "exp")
+	_, err = oidcAuth.DecodeToken(idp.createToken(t, "ec2", ecKey, jwt.SigningMethodES256, claims))
+	assert.Error(t, err)
+	// roles of the identity provider without mapping are ignored, even if named like a hub role
+	claims = newClaims()
+	claims["groups"] = []string{tlsserver.RoleAdmin}
+	err = invoke(idp.createToken(t, "ec2", ecKey, jwt.SigningMethodES256, claims))
+	assert.Error(t, err)
+	assert.Equal(t, 2, path1Hit)
+
+	// the key of the rotated out RSA key and unsupported algorithms are rejected
+	_, err = oidcAuth.DecodeToken(idp.createToken(t, "rsa1", rsaKey, jwt.SigningMethodRS256, newClaims()))
+	assert.Error(t, err)
+	_, err = oidcAuth.DecodeToken(idp.createToken(t, "ec2", []byte("secret"), jwt.SigningMethodHS256, newClaims()))
+	assert.Error(t, err)
+
+	// the user is the subject qualified by the issuer, not the user name of the token
+	err = invokePath(path2, idp.createToken(t, "ec2", ecKey, jwt.SigningMethodES256, newClaims()))
+	assert.NoError(t, err)
+	assert.Equal(t, idp.issuerURL+"#f81d4fae", path2User)
+	claims = newClaims()
+	delete(claims, "sub")
+	_, err = oidcAuth.DecodeToken(idp.createToken(t, "ec2", ecKey, jwt.SigningMethodES256, claims))
+	assert.Error(t, err)
+}
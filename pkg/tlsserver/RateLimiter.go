@@ -0,0 +1,214 @@
+package tlsserver
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimit is the limit of a token bucket. Each request takes a token from the bucket. The bucket holds
+// up to Burst tokens and is refilled at Rate tokens per second.
+type RateLimit struct {
+	// Rate is the sustained number of requests per second. 0 disables the limit
+	Rate float64
+	// Burst is the number of requests that can be made at once
+	Burst int
+}
+
+// RateLimitConfig configures the rate limits and brute-force protection of the server
+type RateLimitConfig struct {
+	// PerIP limits the requests of a client IP address, including unauthenticated requests
+	PerIP RateLimit
+	// PerUser limits the requests of an authenticated user
+	PerUser RateLimit
+	// MaxAuthFailures is the number of failed authentication attempts of a client IP address before it is
+	// locked out. 0 disables the lockout.
+	MaxAuthFailures int
+	// AuthLockout is the time a client is locked out after MaxAuthFailures. It doubles with each further
+	// failure up to MaxAuthLockout.
+	AuthLockout time.Duration
+	// MaxAuthLockout is the maximum time a client is locked out. Failures are forgotten after this time.
+	MaxAuthLockout time.Duration
+}
+
+// DefaultRateLimitConfig returns the recommended rate limits for a Hub service
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		PerIP:           RateLimit{Rate: 20, Burst: 100},
+		PerUser:         RateLimit{Rate: 10, Burst: 50},
+		MaxAuthFailures: 5,
+		AuthLockout:     time.Second,
+		MaxAuthLockout:  15 * time.Minute,
+	}
+}
+
+// authFailures tracks the failed authentication attempts of a client
+type authFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// tokenBucket holds the tokens available to a client
+type tokenBucket struct {
+	tokens     float64
+	lastUpdate time.Time
+}
+
+// RateLimiter applies token bucket rate limits per client IP address and per user, and locks out
+// client IP addresses after repeated failed authentication attempts.
+// The lockout only applies to the IP address of the failed attempts, so failed attempts from elsewhere
+// can't lock a user out.
+type RateLimiter struct {
+	config RateLimitConfig
+	// failed authentication attempts by client IP address
+	failures map[string]*authFailures
+	// token buckets by client IP address
+	ipBuckets map[string]*tokenBucket
+	// time stale buckets and failures were last removed
+	lastCleanup time.Time
+	// token buckets by user
+	userBuckets map[string]*tokenBucket
+	// mutex for concurrent access to the buckets and failures
+	mutex sync.Mutex
+}
+
+// AllowIP takes a token from the bucket of the client IP address
+// Returns true if the request is allowed, or false and the time to wait before retrying
+func (rl *RateLimiter) AllowIP(clientIP string) (allowed bool, retryAfter time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.cleanup()
+	return takeToken(rl.ipBuckets, clientIP, rl.config.PerIP)
+}
+
+// AllowUser takes a token from the bucket of the authenticated user
+// Returns true if the request is allowed, or false and the time to wait before retrying
+func (rl *RateLimiter) AllowUser(userID string) (allowed bool, retryAfter time.Duration) {
+	if userID == "" {
+		return true, 0
+	}
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	return takeToken(rl.userBuckets, userID, rl.config.PerUser)
+}
+
+// GetLockout returns the remaining lockout time of the client IP address, or 0 if not locked out
+//  clientIP address of the client
+func (rl *RateLimiter) GetLockout(clientIP string) time.Duration {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if failures, found := rl.failures[clientIP]; found {
+		if remaining := time.Until(failures.lockedUntil); remaining > 0 {
+			return remaining
+		}
+	}
+	return 0
+}
+
+// RecordAuthFailure records a failed authentication attempt of the client IP address.
+// After MaxAuthFailures the client is locked out, with a doubling lockout time for each further failure.
+// Successful authentication doesn't clear the failures, as one valid account should not reset the
+// protection of other accounts.
+//  clientIP address of the client
+func (rl *RateLimiter) RecordAuthFailure(clientIP string) {
+	if rl.config.MaxAuthFailures <= 0 {
+		return
+	}
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	now := time.Now()
+	failures, found := rl.failures[clientIP]
+	if !found || now.Sub(failures.lastFailure) > rl.config.MaxAuthLockout {
+		failures = &authFailures{}
+		rl.failures[clientIP] = failures
+	}
+	failures.count++
+	failures.lastFailure = now
+	if excess := failures.count - rl.config.MaxAuthFailures; excess >= 0 {
+		lockout := time.Duration(float64(rl.config.AuthLockout) * math.Pow(2, math.Min(float64(excess), 30)))
+		if lockout > rl.config.MaxAuthLockout {
+			lockout = rl.config.MaxAuthLockout
+		}
+		failures.lockedUntil = now.Add(lockout)
+	}
+}
+
+// cleanup removes buckets that are full and failures that are forgotten, at most once a minute
+// This must be called with the mutex locked.
+func (rl *RateLimiter) cleanup() {
+	now := time.Now()
+	if now.Sub(rl.lastCleanup) < time.Minute {
+		return
+	}
+	rl.lastCleanup = now
+	removeFullBuckets(rl.ipBuckets, rl.config.PerIP, now)
+	removeFullBuckets(rl.userBuckets, rl.config.PerUser, now)
+	for key, failures := range rl.failures {
+		if now.Sub(failures.lastFailure) > rl.config.MaxAuthLockout {
+			delete(rl.failures, key)
+		}
+	}
+}
+
+// removeFullBuckets removes the buckets that are refilled completely, as they are equal to a new bucket
+func removeFullBuckets(buckets map[string]*tokenBucket, limit RateLimit, now time.Time) {
+	if limit.Rate <= 0 {
+		return
+	}
+	refillTime := time.Duration(float64(limit.Burst) / limit.Rate * float64(time.Second))
+	for key, bucket := range buckets {
+		if now.Sub(bucket.lastUpdate) > refillTime {
+			delete(buckets, key)
+		}
+	}
+}
+
+// takeToken takes a token from the bucket with the given key, creating a full bucket if needed
+// Returns true if a token was available, or false and the time until a token is available
+func takeToken(buckets map[string]*tokenBucket, key string, limit RateLimit) (allowed bool, retryAfter time.Duration) {
+	if limit.Rate <= 0 {
+		return true, 0
+	}
+	now := time.Now()
+	bucket, found := buckets[key]
+	if !found {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), lastUpdate: now}
+		buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+now.Sub(bucket.lastUpdate).Seconds()*limit.Rate)
+	bucket.lastUpdate = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / limit.Rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// GetClientIP returns the IP address of the client of a request
+// Forwarding headers are not used, as they can be set by the client.
+func GetClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// NewRateLimiter creates a limiter of requests and failed authentication attempts
+//  config with the limits. See also DefaultRateLimitConfig.
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	if config.MaxAuthLockout < config.AuthLockout {
+		config.MaxAuthLockout = config.AuthLockout
+	}
+	rl := &RateLimiter{
+		config:      config,
+		failures:    make(map[string]*authFailures),
+		ipBuckets:   make(map[string]*tokenBucket),
+		lastCleanup: time.Now(),
+		userBuckets: make(map[string]*tokenBucket),
+	}
+	return rl
+}
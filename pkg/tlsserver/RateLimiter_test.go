@@ -0,0 +1,166 @@
+package tlsserver_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/wostzone/wost-go/pkg/tlsclient"
+	"github.com/wostzone/wost-go/pkg/tlsserver"
+)
+
+func TestRateLimiter(t *testing.T) {
+	logrus.Infof("--- TestRateLimiter ---")
+	rl := tlsserver.NewRateLimiter(tlsserver.RateLimitConfig{
+		PerIP:           tlsserver.RateLimit{Rate: 10, Burst: 2},
+		PerUser:         tlsserver.RateLimit{Rate: 1, Burst: 1},
+		MaxAuthFailures: 2,
+		AuthLockout:     100 * time.Millisecond,
+		MaxAuthLockout:  time.Second,
+	})
+
+	// the burst is allowed after which the bucket refills at the rate
+	allowed, _ := rl.AllowIP("1.2.3.4")
+	assert.True(t, allowed)
+	allowed, _ = rl.AllowIP("1.2.3.4")
+	assert.True(t, allowed)
+	allowed, retryAfter := rl.AllowIP("1.2.3.4")
+	assert.False(t, allowed)
+	assert.Greater(t, retryAfter, time.Duration(0))
+	assert.LessOrEqual(t, retryAfter, 100*time.Millisecond)
+	allowed, _ = rl.AllowIP("5.6.7.8")
+	assert.True(t, allowed)
+	time.Sleep(retryAfter)
+	allowed, _ = rl.AllowIP("1.2.3.4")
+	assert.True(t, allowed)
+
+	allowed, _ = rl.AllowUser("user1")
+	assert.True(t, allowed)
+	allowed, _ = rl.AllowUser("user1")
+	assert.False(t, allowed)
+	allowed, _ = rl.AllowUser("")
+	assert.True(t, allowed)
+
+	// lockout of the IP address after too many failures, doubling with each further failure
+	rl.RecordAuthFailure("1.2.3.4")
+	assert.Equal(t, time.Duration(0), rl.GetLockout("1.2.3.4"))
+	rl.RecordAuthFailure("1.2.3.4")
+	lockout := rl.GetLockout("1.2.3.4")
+	assert.Greater(t, lockout, 50*time.Millisecond)
+	assert.LessOrEqual(t, lockout, 100*time.Millisecond)
+	rl.RecordAuthFailure("1.2.3.4")
+	assert.Greater(t, rl.GetLockout("1.2.3.4"), 100*time.Millisecond)
+
+	// failures of an IP address don't lock out other addresses
+	assert.Equal(t, time.Duration(0), rl.GetLockout("5.6.7.8"))
+	time.Sleep(2 * lockout)
+	assert.Equal(t, time.Duration(0), rl.GetLockout("1.2.3.4"))
+}
+
+func TestServerLimits(t *testing.T) {
+	logrus.Infof("--- TestServerLimits ---")
+	path1 := "/hello"
+	path2 := "/noauth"
+	user1 := "user1"
+	password1 := "user1pass"
+
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort, testCerts.ServerCert, testCerts.CaCert)
+	srv.EnableBasicAuth(func(loginName string, password string) bool {
+		return loginName == user1 && password == password1
+	})
+	srv.SetRateLimits(tlsserver.RateLimitConfig{
+		PerIP:           tlsserver.RateLimit{Rate: 100, Burst: 100},
+		PerUser:         tlsserver.RateLimit{Rate: 1, Burst: 2},
+		MaxAuthFailures: 2,
+		AuthLockout:     2 * time.Second,
+		MaxAuthLockout:  time.Minute,
+	})
+	srv.SetMaxBodySize(100)
+	srv.SetTimeouts(time.Second, time.Second)
+	srv.AddHandler(path1, func(userID string, resp http.ResponseWriter, req *http.Request) {})
+	srv.AddHandlerNoAuth(path2, func(resp http.ResponseWriter, req *http.Request) {
+		_, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusRequestEntityTooLarge)
+		}
+	})
+	err := srv.Start()
+	require.NoError(t, err)
+	defer srv.Stop()
+
+	caCertPool := x509.NewCertPool()
+	caCertPool.AddCert(testCerts.CaCert)
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caCertPool}}}
+	invoke := func(path string, password string, body string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("https://%s%s", clientHostPort, path),
+			strings.NewReader(body))
+		req.SetBasicAuth(user1, password)
+		resp, err := httpClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	// the user exceeds its rate limit after the burst
+	assert.Equal(t, http.StatusOK, invoke(path1, password1, "").StatusCode)
+	assert.Equal(t, http.StatusOK, invoke(path1, password1, "").StatusCode)
+	resp := invoke(path1, password1, "")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	// request bodies are limited, also without content length
+	assert.Equal(t, http.StatusOK, invoke(path2, "", "small").StatusCode)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, invoke(path2, "", strings.Repeat("x", 101)).StatusCode)
+	req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("https://%s%s", clientHostPort, path2),
+		ioutil.NopCloser(bytes.NewReader(make([]byte, 200))))
+	resp, err = httpClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	// the IP address is locked out after failed authentication
+	assert.Equal(t, http.StatusForbidden, invoke(path1, "wrongpass", "").StatusCode)
+	assert.Equal(t, http.StatusForbidden, invoke(path1, "wrongpass", "").StatusCode)
+	resp = invoke(path1, password1, "")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+	httpClient.CloseIdleConnections()
+}
+
+func TestLoginLockout(t *testing.T) {
+	logrus.Infof("--- TestLoginLockout ---")
+	user1 := "user1"
+	password1 := "user1pass"
+
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort, testCerts.ServerCert, testCerts.CaCert)
+	config := tlsserver.DefaultRateLimitConfig()
+	config.MaxAuthFailures = 2
+	srv.SetRateLimits(config)
+	issuer := tlsserver.NewJWTIssuer("test", testCerts.ServerKey)
+	tlsserver.NewJWTAuthService(srv, issuer, func(loginID string, password string) bool {
+		return loginID == user1 && password == password1
+	})
+	err := srv.Start()
+	require.NoError(t, err)
+	defer srv.Stop()
+
+	cl := tlsclient.NewTLSClient(clientHostPort, testCerts.CaCert)
+	_, err = cl.ConnectWithJWTLogin(user1, "wrongpass", "")
+	assert.Error(t, err)
+	_, err = cl.ConnectWithJWTLogin(user1, "wrongpass", "")
+	assert.Error(t, err)
+	// while locked out the correct password is refused
+	_, err = cl.ConnectWithJWTLogin(user1, password1, "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "429")
+	cl.Close()
+}
@@ -0,0 +1,56 @@
+package tlsserver
+
+import (
+	"github.com/wostzone/wost-go/pkg/certsclient"
+)
+
+// Roles of authenticated clients. The role of a client certificate is its OU.
+const (
+	// RoleAdmin lets a client approve thing provisioning and manage users
+	RoleAdmin = certsclient.OUAdmin
+	// RoleClient is the role of consumers
+	RoleClient = certsclient.OUClient
+	// RoleIoTDevice is the role of IoT devices
+	RoleIoTDevice = certsclient.OUIoTDevice
+	// RolePlugin is the role of Hub plugins and services
+	RolePlugin = certsclient.OUPlugin
+)
+
+// RouteOption is an option of TLSServer.AddHandler
+type RouteOption func(route *Route)
+
+// RequireRole is the option to restrict access to the route to authenticated clients that have at least one
+// of the given roles. Requests from other clients are rejected with 403 forbidden.
+//  roles that are allowed, eg RoleAdmin
+func RequireRole(roles ...string) RouteOption {
+	return func(route *Route) {
+		route.roles = append(route.roles, roles...)
+	}
+}
+
+// Route holds the authorization of a handler added with TLSServer.AddHandler
+type Route struct {
+	// roles that are allowed to access the route. Empty to allow all authenticated clients
+	roles []string
+}
+
+// GetRoles returns the roles that are allowed to access the route
+// Returns an empty list if all authenticated clients are allowed
+func (route *Route) GetRoles() []string {
+	return route.roles
+}
+
+// IsAuthorized returns whether a client with the given roles is allowed to access the route
+func (route *Route) IsAuthorized(clientRoles []string) bool {
+	if len(route.roles) == 0 {
+		return true
+	}
+	for _, required := range route.roles {
+		for _, role := range clientRoles {
+			if role == required {
+				return true
+			}
+		}
+	}
+	return false
+}
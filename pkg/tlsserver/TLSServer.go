@@ -2,22 +2,55 @@
 package tlsserver
 
 import (
+	"bytes"
 	"context"
 	"crypto/ecdsa"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"net/http"
-	"strings"
 	"sync"
 	"time"
 
-	"github.com/rs/cors"
-
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
+
+	"github.com/wostzone/wost-go/pkg/certsclient"
+	"github.com/wostzone/wost-go/pkg/cors"
+	"github.com/wostzone/wost-go/pkg/metrics"
+	"github.com/wostzone/wost-go/pkg/revocation"
+)
+
+// DefaultMaxBodySize is the default maximum size of a request body
+const DefaultMaxBodySize = 4 * 1024 * 1024
+
+// Default timeouts of reading a request and writing the response
+const (
+	// DefaultReadTimeout allows for delays when 'curl' on OSx prompts for username/password
+	DefaultReadTimeout  = 5 * time.Minute
+	DefaultWriteTimeout = 10 * time.Second
+	// DefaultReadHeaderTimeout limits the time clients can take to send the request headers
+	DefaultReadHeaderTimeout = 10 * time.Second
 )
 
+// TLSServerOption is an option of NewTLSServer
+type TLSServerOption func(srv *TLSServer)
+
+// WithCORS is the option to use the given policy for cross-origin requests
+func WithCORS(corsConfig cors.CORSConfig) TLSServerOption {
+	return func(srv *TLSServer) {
+		srv.SetCORS(corsConfig)
+	}
+}
+
+// WithMiddleware is the option to add middleware to the server. See TLSServer.Use
+func WithMiddleware(middleware ...Middleware) TLSServerOption {
+	return func(srv *TLSServer) {
+		srv.Use(middleware...)
+	}
+}
+
 // TLSServer is a simple TLS Server supporting BASIC, Jwt and client certificate authentication
 type TLSServer struct {
 	address           string
@@ -27,6 +60,33 @@ type TLSServer struct {
 	httpServer        *http.Server
 	router            *mux.Router
 	httpAuthenticator *HttpAuthenticator
+	// optional provider of the server certificate, used instead of serverCert when set
+	certProvider *certsclient.CertProvider
+	// OCSP response of the server certificate that is included in the TLS handshake
+	ocspStaple []byte
+	// DER encoded certificate the OCSP response belongs to
+	ocspStapleCert []byte
+	// optional source for renewing the OCSP response
+	ocspSource OCSPSource
+	// stops renewing the OCSP response
+	ocspStop chan bool
+	// requests renewal of the OCSP response after the certificate has changed
+	ocspRenew chan bool
+	// mutex for concurrent access to the server certificate and OCSP response
+	certMutex sync.RWMutex
+	// policy for cross-origin requests
+	corsConfig cors.CORSConfig
+	// maximum size of a request body
+	maxBodySize int64
+	// metrics of the requests, nil when disabled
+	metrics *serverMetrics
+	// middleware applied to all requests, in order of use
+	middleware []Middleware
+	// optional limiter of requests and failed authentication, nil when rate limiting is disabled
+	rateLimiter *RateLimiter
+	// timeouts of reading a request and writing the response
+	readTimeout  time.Duration
+	writeTimeout time.Duration
 
 	//jwtIssuer *JWTIssuer
 }
@@ -38,18 +98,24 @@ type TLSServer struct {
 // If authentication is not enabled then the userID is empty.
 //
 // apply .Method(http.MethodXyz) to restrict the accepted HTTP methods
+// use the RequireRole(role) option to restrict access to clients with the role. Other clients are rejected with 403.
 //
 //  path to listen on. See https://github.com/gorilla/mux
 //  handler to invoke with the request. The userID is only provided when an authenticator is used
+//  options of the route, eg RequireRole(RoleAdmin)
 // Returns the route. Apply '.Method(http.MethodPut|Post|Get)' to restrict the accepted HTTP methods
 func (srv *TLSServer) AddHandler(path string,
-	handler func(userID string, resp http.ResponseWriter, req *http.Request)) *mux.Route {
+	handler func(userID string, resp http.ResponseWriter, req *http.Request), options ...RouteOption) *mux.Route {
 
 	// do we need a local copy of handler? not sure
 	local_handler := handler
 
+	route := &Route{}
+	for _, option := range options {
+		option(route)
+	}
 	// the internal authenticator performs certificate based, basic or jwt token authentication if needed
-	route := srv.router.HandleFunc(path, func(resp http.ResponseWriter, req *http.Request) {
+	return srv.router.HandleFunc(path, func(resp http.ResponseWriter, req *http.Request) {
 		// test, allow CORS if enabled.
 		if req.Method == http.MethodOptions {
 			// don't return a payload with the cors options request
@@ -59,18 +125,54 @@ func (srv *TLSServer) AddHandler(path string,
 			path, req.Method, req.RemoteAddr, mux.Vars(req))
 		logrus.Infof("%s", msg)
 
+		// clients that failed to authenticate too often are locked out
+		clientIP := GetClientIP(req)
+		if lockout := srv.getLockout(clientIP); lockout > 0 {
+			msg := fmt.Sprintf("TLSServer.HandleFunc %s: Client %s is locked out after failed authentication",
+				path, req.RemoteAddr)
+			srv.WriteTooManyRequests(resp, msg, lockout)
+			return
+		}
+
 		// valid authentication without userID means a plugin certificate was used which is always authorized
-		userID, match := srv.httpAuthenticator.AuthenticateRequest(resp, req)
-		if !match {
+		userID, authMethod, revokedErr := srv.httpAuthenticator.authenticate(resp, req)
+		match := authMethod != authMethodNone
+		if match {
+			setRequestUser(req, userID)
+		} else if req.Header.Get("Authorization") != "" {
+			srv.recordAuthFailure(clientIP)
+		}
+		if revokedErr != nil {
+			// distinguish a revoked certificate from other authentication failures
+			msg := fmt.Sprintf("TLSServer.HandleFunc %s: Client certificate from %s is rejected: %s",
+				path, req.RemoteAddr, revokedErr)
+			srv.WriteUnauthorized(resp, msg)
+		} else if !match {
 			msg := fmt.Sprintf("TLSServer.HandleFunc %s: User '%s' from %s is unauthorized",
 				path, userID, req.RemoteAddr)
 			logrus.Warningf("%s", msg)
 			srv.WriteForbidden(resp, msg)
+		} else if roles := srv.httpAuthenticator.getRoles(req, userID, authMethod); !route.IsAuthorized(roles) {
+			msg := fmt.Sprintf("TLSServer.HandleFunc %s: User '%s' from %s with roles %v is not authorized. Required roles: %v",
+				path, userID, req.RemoteAddr, roles, route.GetRoles())
+			logrus.Warningf("%s", msg)
+			srv.WriteForbidden(resp, msg)
+		} else if allowed, retryAfter := srv.allowUser(userID); !allowed {
+			msg := fmt.Sprintf("TLSServer.HandleFunc %s: User '%s' from %s exceeds the rate limit",
+				path, userID, req.RemoteAddr)
+			srv.WriteTooManyRequests(resp, msg, retryAfter)
 		} else {
 			local_handler(userID, resp, req)
 		}
 	})
-	return route
+}
+
+// allowUser applies the rate limit of the authenticated user, if rate limiting is enabled
+func (srv *TLSServer) allowUser(userID string) (allowed bool, retryAfter time.Duration) {
+	if srv.rateLimiter == nil {
+		return true, 0
+	}
+	return srv.rateLimiter.AllowUser(userID)
 }
 
 // Authenticator returns the authenticator used for this server
@@ -109,26 +211,219 @@ func (srv *TLSServer) EnableBasicAuth(validateCredentials func(loginName string,
 // authentication server using the server's private key.
 //
 // verificationKey is the public key used to verify tokens. Use nil to use the TLS server own public key
-func (srv *TLSServer) EnableJwtAuth(verificationKey *ecdsa.PublicKey) {
+// Returns an error if no key is provided and the server certificate has no ECDSA key
+func (srv *TLSServer) EnableJwtAuth(verificationKey *ecdsa.PublicKey) error {
 	if verificationKey == nil {
-		issuerKey := srv.serverCert.PrivateKey.(*ecdsa.PrivateKey)
+		srv.certMutex.RLock()
+		serverCert := srv.getServerCert()
+		srv.certMutex.RUnlock()
+		if serverCert == nil {
+			return errors.New("EnableJwtAuth: no verification key and no server certificate")
+		}
+		issuerKey, isECDSA := serverCert.PrivateKey.(*ecdsa.PrivateKey)
+		if !isECDSA {
+			return errors.New("EnableJwtAuth: server certificate doesn't have an ECDSA key")
+		}
 		verificationKey = &issuerKey.PublicKey
 	}
 	srv.httpAuthenticator.EnableJwtAuth(verificationKey)
+	return nil
+}
+
+// EnableOIDCAuth enables authentication with access tokens issued by an OpenID Connect identity provider,
+// eg the company identity provider. Tokens must be signed with RS256 or ES256 by a key of the provider's JWKS,
+// and have the issuer and audience.
+//
+//  issuerURL is the URL of the identity provider as used in the 'iss' claim
+//  audience of the tokens, eg the client ID of the Hub as registered with the identity provider
+//  caCert is the CA of the identity provider's server certificate, or nil to use the system CAs
+// Returns the authenticator, eg to set the names of the user name and roles claims
+func (srv *TLSServer) EnableOIDCAuth(issuerURL string, audience string, caCert *x509.Certificate) *OIDCAuthenticator {
+	srv.httpAuthenticator.EnableOIDCAuth(issuerURL, audience, caCert)
+	return srv.httpAuthenticator.OidcAuth
+}
+
+// getLockout returns the remaining lockout time of a client after failed authentication attempts
+func (srv *TLSServer) getLockout(clientIP string) time.Duration {
+	if srv.rateLimiter == nil {
+		return 0
+	}
+	return srv.rateLimiter.GetLockout(clientIP)
+}
+
+// limitRequests applies the rate limit of the client IP address and the maximum body size to all requests
+func (srv *TLSServer) limitRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if srv.rateLimiter != nil {
+			if allowed, retryAfter := srv.rateLimiter.AllowIP(GetClientIP(req)); !allowed {
+				msg := fmt.Sprintf("TLSServer: Client %s exceeds the rate limit", req.RemoteAddr)
+				srv.WriteTooManyRequests(resp, msg, retryAfter)
+				return
+			}
+		}
+		if req.ContentLength > srv.maxBodySize {
+			msg := fmt.Sprintf("TLSServer: Request body of %d bytes from %s exceeds the limit of %d bytes",
+				req.ContentLength, req.RemoteAddr, srv.maxBodySize)
+			logrus.Warning(msg)
+			http.Error(resp, msg, http.StatusRequestEntityTooLarge)
+			return
+		}
+		req.Body = http.MaxBytesReader(resp, req.Body, srv.maxBodySize)
+		next.ServeHTTP(resp, req)
+	})
+}
+
+// recordAuthFailure records a failed authentication attempt, if rate limiting is enabled
+func (srv *TLSServer) recordAuthFailure(clientIP string) {
+	if srv.rateLimiter != nil {
+		srv.rateLimiter.RecordAuthFailure(clientIP)
+	}
+}
+
+// SetCertProvider sets the provider of the server certificate, eg one that watches the certificate PEM files.
+// The certificate is obtained from the provider on each TLS handshake, so a renewed certificate takes effect
+// without restarting the server.
+//  certProvider to use, or nil to use the certificate the server was created with
+func (srv *TLSServer) SetCertProvider(certProvider *certsclient.CertProvider) {
+	srv.certMutex.Lock()
+	defer srv.certMutex.Unlock()
+	srv.certProvider = certProvider
+}
+
+// SetCORS sets the policy for cross-origin requests from web browsers. This must be called before Start.
+//  corsConfig with the policy. See also cors.DefaultCORSConfig
+func (srv *TLSServer) SetCORS(corsConfig cors.CORSConfig) {
+	srv.corsConfig = corsConfig
+}
+
+// SetMaxBodySize sets the maximum size of request bodies. Larger requests are rejected with 413.
+// This must be called before Start.
+//  maxBodySize in bytes. 0 for DefaultMaxBodySize
+func (srv *TLSServer) SetMaxBodySize(maxBodySize int64) {
+	if maxBodySize <= 0 {
+		maxBodySize = DefaultMaxBodySize
+	}
+	srv.maxBodySize = maxBodySize
+}
+
+// SetMetrics sets the registry of the request metrics. The default is metrics.DefaultRegistry.
+// This must be called before Start. Use AddMetricsHandler to serve the metrics.
+//  registry to use, or nil to disable the request metrics
+func (srv *TLSServer) SetMetrics(registry *metrics.Registry) {
+	srv.metrics = newServerMetrics(registry)
+}
+
+// SetRateLimits enables rate limiting of requests per client IP address and per authenticated user, and the
+// lockout of clients after repeated failed authentication. Clients that exceed the limits are rejected with
+// 429 Too Many Requests and a Retry-After header.
+// This must be called before Start.
+//  config with the limits, eg DefaultRateLimitConfig()
+func (srv *TLSServer) SetRateLimits(config RateLimitConfig) {
+	srv.rateLimiter = NewRateLimiter(config)
+}
+
+// SetRoleLookup sets the function that returns the roles of a user for authorization of routes with
+// required roles. This is only used for users that authenticate with basic authentication or a JWT
+// access token, not for clients that authenticate with a certificate or OIDC access token.
+//  roleLookup returns the roles of the userID, or nil to remove the lookup
+func (srv *TLSServer) SetRoleLookup(roleLookup func(userID string) []string) {
+	srv.httpAuthenticator.SetRoleLookup(roleLookup)
+}
+
+// SetOCSPSource sets the source of the OCSP response of the server certificate. The response is obtained
+// when the server starts and is renewed when half of its validity has passed. This must be called before Start.
+//  source that provides the response, or nil to not renew the response
+func (srv *TLSServer) SetOCSPSource(source OCSPSource) {
+	srv.ocspSource = source
+}
+
+// SetOCSPStaple sets the OCSP response of the server certificate, which is included in the TLS handshake
+// so clients can verify the server certificate isn't revoked. See also certsclient.CertAuthority.CreateOCSPResponse.
+// The response is not renewed. Use SetOCSPSource to renew it before it expires.
+// The response belongs to the current server certificate and is not included after the certificate changes.
+//  ocspResponse is the DER encoded OCSP response from the CA. Use nil to remove it.
+func (srv *TLSServer) SetOCSPStaple(ocspResponse []byte) {
+	srv.certMutex.Lock()
+	defer srv.certMutex.Unlock()
+	srv.ocspStaple = ocspResponse
+	srv.ocspStapleCert = nil
+	if serverCert := srv.getServerCert(); serverCert != nil && len(serverCert.Certificate) > 0 {
+		srv.ocspStapleCert = serverCert.Certificate[0]
+	}
+}
+
+// SetTimeouts sets the timeouts of reading a request, including the body, and of writing the response.
+// This must be called before Start.
+//  readTimeout 0 for DefaultReadTimeout
+//  writeTimeout 0 for DefaultWriteTimeout
+func (srv *TLSServer) SetTimeouts(readTimeout time.Duration, writeTimeout time.Duration) {
+	if readTimeout <= 0 {
+		readTimeout = DefaultReadTimeout
+	}
+	if writeTimeout <= 0 {
+		writeTimeout = DefaultWriteTimeout
+	}
+	srv.readTimeout = readTimeout
+	srv.writeTimeout = writeTimeout
+}
+
+// SetRevocationChecker sets the checker that rejects requests with a revoked client certificate.
+// These requests are rejected with an unauthorized (401) status.
+//  checker to use or nil to accept all client certificates signed by the CA
+func (srv *TLSServer) SetRevocationChecker(checker *revocation.RevocationChecker) {
+	srv.httpAuthenticator.CertAuth.SetRevocationChecker(checker)
+}
+
+// Use adds middleware that is applied to all requests, including requests that are rejected by the
+// rate limits or for which no route exists. The first middleware added is the outermost and sees the
+// request first. This must be called before Start.
+//
+// Built-in middleware are RequestLogger, Recoverer, RequestTiming and Gzip. Recommended is:
+//  srv.Use(RequestLogger(), Recoverer(), RequestTiming(time.Second), Gzip())
+func (srv *TLSServer) Use(middleware ...Middleware) {
+	srv.middleware = append(srv.middleware, middleware...)
+}
+
+// getCertificate returns the server certificate with its OCSP response for use in the TLS handshake.
+// The OCSP response is only included if it belongs to the certificate. After the certificate changed,
+// a new response is requested from the OCSP source.
+func (srv *TLSServer) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	srv.certMutex.RLock()
+	defer srv.certMutex.RUnlock()
+	serverCert := srv.getServerCert()
+	cert := *serverCert
+	if len(cert.Certificate) > 0 && bytes.Equal(cert.Certificate[0], srv.ocspStapleCert) {
+		cert.OCSPStaple = srv.ocspStaple
+	} else if srv.ocspRenew != nil {
+		select {
+		case srv.ocspRenew <- true:
+		default:
+		}
+	}
+	return &cert, nil
+}
+
+// getServerCert returns the current server certificate from the certificate provider, if set
+// This must be called with the certMutex locked.
+func (srv *TLSServer) getServerCert() *tls.Certificate {
+	if srv.certProvider != nil {
+		return srv.certProvider.GetCert()
+	}
+	return srv.serverCert
 }
 
 // Start the TLS server using the provided CA and Server certificates.
 // If a client certificate is provided it must be valid.
-// This configures handling of CORS requests to allow:
-//  - any origin by returning the requested origin (not using wildcard '*').
-//  - any method, eg PUT, POST, GET, PATCH,
-//  - headers "Origin", "Accept", "Content-Type", "X-Requested-With"
+// Cross-origin requests are handled using the CORS policy. See SetCORS.
 func (srv *TLSServer) Start() error {
 	var err error
 	var mutex = sync.Mutex{}
 
 	logrus.Infof("Starting TLS server on address: %s:%d.", srv.address, srv.port)
-	if srv.caCert == nil || srv.serverCert == nil {
+	srv.certMutex.RLock()
+	hasServerCert := srv.serverCert != nil || srv.certProvider != nil
+	srv.certMutex.RUnlock()
+	if srv.caCert == nil || !hasServerCert {
 		err := fmt.Errorf("missing CA or server certificate")
 		logrus.Error(err)
 		return err
@@ -138,46 +433,33 @@ func (srv *TLSServer) Start() error {
 	caCertPool.AddCert(srv.caCert)
 
 	serverTLSConf := &tls.Config{
-		Certificates:       []tls.Certificate{*srv.serverCert},
+		GetCertificate:     srv.getCertificate,
 		ClientAuth:         tls.VerifyClientCertIfGiven,
 		ClientCAs:          caCertPool,
 		MinVersion:         tls.VersionTLS12,
 		InsecureSkipVerify: false,
 	}
 
-	// handle CORS using the cors plugin
-	// see also: https://stackoverflow.com/questions/43871637/no-access-control-allow-origin-header-is-present-on-the-requested-resource-whe
-	// TODO: add configuration for CORS origin: allowed, sameaddress, exact
-	c := cors.New(cors.Options{
-		// return the origin as allowed origin
-		AllowOriginFunc: func(orig string) bool {
-			// local requests are always allowed, even over http (for testing) - todo: disable in production
-			if strings.HasPrefix(orig, "https://127.0.0.1") || strings.HasPrefix(orig, "https://localhost") ||
-				strings.HasPrefix(orig, "http://127.0.0.1") || strings.HasPrefix(orig, "http://localhost") {
-				logrus.Debugf("TLSServer.AllowOriginFunc: Cors: orig: %s (localhost). Is True", orig)
-				return true
-			} else if strings.HasPrefix(orig, "https://"+srv.address) {
-				logrus.Debugf("TLSServer.AllowOriginFunc: Cors: orig:%s. Is True", orig)
-				return true
-			}
-			logrus.Warningf("TLSServer.AllowOriginFunc: Cors: orig:%s. Is False", orig)
-			return false
-		},
-		// default allowed headers is "Origin", "Accept", "Content-Type", "X-Requested-With" (missing authorization)
-		AllowedHeaders: []string{"Origin", "Accept", "Content-Type", "Authorization", "Headers"},
-		// default is get/put/patch/post/delete/head
-		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions},
-		Debug:            true,
-		AllowCredentials: true,
-	})
-	handler := c.Handler(srv.router)
+	var handler http.Handler = srv.limitRequests(corsHandler(srv.corsConfig, srv.router))
+	for i := len(srv.middleware) - 1; i >= 0; i-- {
+		handler = srv.middleware[i](handler)
+	}
+	handler = srv.measureRequests(handler)
 
 	srv.httpServer = &http.Server{
-		Addr: fmt.Sprintf("%s:%d", srv.address, srv.port),
-		// ReadTimeout:  5 * time.Minute, // 5 min to allow for delays when 'curl' on OSx prompts for username/password
-		// WriteTimeout: 10 * time.Second,
-		Handler:   handler,
-		TLSConfig: serverTLSConf,
+		Addr:              fmt.Sprintf("%s:%d", srv.address, srv.port),
+		ReadHeaderTimeout: DefaultReadHeaderTimeout,
+		ReadTimeout:       srv.readTimeout,
+		WriteTimeout:      srv.writeTimeout,
+		Handler:           handler,
+		TLSConfig:         serverTLSConf,
+	}
+	if srv.ocspSource != nil {
+		srv.ocspStop = make(chan bool)
+		srv.certMutex.Lock()
+		srv.ocspRenew = make(chan bool, 1)
+		srv.certMutex.Unlock()
+		go srv.renewOCSPStaple(srv.ocspStop, srv.ocspRenew)
 	}
 	// mutex to capture error result in case startup in the background failed
 	go func() {
@@ -202,6 +484,10 @@ func (srv *TLSServer) Start() error {
 func (srv *TLSServer) Stop() {
 	logrus.Infof("Stopping TLS server")
 
+	if srv.ocspStop != nil {
+		close(srv.ocspStop)
+		srv.ocspStop = nil
+	}
 	if srv.httpServer != nil {
 		srv.httpServer.Shutdown(context.Background())
 	}
@@ -219,17 +505,24 @@ func (srv *TLSServer) Stop() {
 //  port           listening port
 //  serverCert     Server TLS certificate
 //  caCert         CA certificate to verify client certificates
+//  options        optional server options, eg WithCORS
 //
 // returns TLS server for handling requests
 func NewTLSServer(address string, port uint,
 	serverCert *tls.Certificate,
 	caCert *x509.Certificate,
+	options ...TLSServerOption,
 ) *TLSServer {
 
 	srv := &TLSServer{
-		caCert:     caCert,
-		serverCert: serverCert,
-		router:     mux.NewRouter(),
+		caCert:       caCert,
+		corsConfig:   cors.DefaultCORSConfig(),
+		maxBodySize:  DefaultMaxBodySize,
+		metrics:      newServerMetrics(metrics.DefaultRegistry),
+		readTimeout:  DefaultReadTimeout,
+		serverCert:   serverCert,
+		router:       mux.NewRouter(),
+		writeTimeout: DefaultWriteTimeout,
 	}
 	//// support for CORS response headers
 	//srv.router.Use(mux.CORSMethodMiddleware(srv.router))
@@ -243,5 +536,8 @@ func NewTLSServer(address string, port uint,
 
 	srv.address = address
 	srv.port = port
+	for _, option := range options {
+		option(srv)
+	}
 	return srv
 }
@@ -1,18 +1,25 @@
 package tlsserver_test
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"github.com/wostzone/wost-go/pkg/certsclient"
+	"github.com/wostzone/wost-go/pkg/revocation"
 	"github.com/wostzone/wost-go/pkg/testenv"
 	"github.com/wostzone/wost-go/pkg/tlsclient"
 	"github.com/wostzone/wost-go/pkg/tlsserver"
 	"net/http"
 	"os"
+	"path"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ocsp"
 )
 
 var serverAddress string
@@ -260,3 +267,185 @@ func TestBasicAuth(t *testing.T) {
 	cl.Close()
 	srv.Stop()
 }
+
+// the server uses the renewed certificate of the cert provider without a restart
+func TestCertProvider(t *testing.T) {
+	logrus.Infof("--- TestCertProvider ---")
+	certFolder := t.TempDir()
+	certFile := path.Join(certFolder, "serverCert.pem")
+	keyFile := path.Join(certFolder, "serverKey.pem")
+	err := certsclient.SaveTLSCertToPEM(testCerts.ServerCert, certFile, keyFile)
+	require.NoError(t, err)
+	provider, err := certsclient.NewCertProvider(certFile, keyFile)
+	require.NoError(t, err)
+	err = provider.Watch()
+	require.NoError(t, err)
+	defer provider.Close()
+	changed := make(chan bool, 1)
+	provider.OnChange(func(cert *tls.Certificate) {
+		select {
+		case changed <- true:
+		default:
+		}
+	})
+
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort, nil, testCerts.CaCert)
+	err = srv.EnableJwtAuth(nil)
+	assert.Error(t, err, "no server certificate")
+	srv.SetCertProvider(provider)
+	// the key of the provided certificate is used to verify tokens
+	err = srv.EnableJwtAuth(nil)
+	assert.NoError(t, err)
+	err = srv.Start()
+	require.NoError(t, err)
+	defer srv.Stop()
+	serverCert, _ := x509.ParseCertificate(testCerts.ServerCert.Certificate[0])
+	ocspResponse, err := ocsp.CreateResponse(testCerts.CaCert, testCerts.CaCert, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: serverCert.SerialNumber,
+		ThisUpdate:   time.Now(),
+		NextUpdate:   time.Now().Add(time.Hour),
+	}, testCerts.CaKey)
+	require.NoError(t, err)
+	srv.SetOCSPStaple(ocspResponse)
+
+	getServerState := func() tls.ConnectionState {
+		conn, err := tls.Dial("tcp", clientHostPort, &tls.Config{InsecureSkipVerify: true})
+		require.NoError(t, err)
+		defer conn.Close()
+		return conn.ConnectionState()
+	}
+	state := getServerState()
+	assert.Equal(t, testCerts.ServerCert.Certificate[0], state.PeerCertificates[0].Raw)
+	assert.Equal(t, ocspResponse, state.OCSPResponse)
+
+	renewedCert := testenv.CreateTlsCert("Server", "wost", true,
+		testCerts.ServerKey, testCerts.CaCert, testCerts.CaKey)
+	err = certsclient.SaveTLSCertToPEM(renewedCert, certFile, keyFile)
+	require.NoError(t, err)
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("certificate was not reloaded")
+	}
+
+	// the renewed certificate doesn't carry the OCSP response of the previous certificate
+	state = getServerState()
+	assert.Equal(t, renewedCert.Certificate[0], state.PeerCertificates[0].Raw)
+	assert.Empty(t, state.OCSPResponse)
+}
+
+func TestOCSPSource(t *testing.T) {
+	logrus.Infof("--- TestOCSPSource ---")
+	var count int32
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort, testCerts.ServerCert, testCerts.CaCert)
+	srv.SetOCSPSource(func(cert *x509.Certificate) ([]byte, error) {
+		atomic.AddInt32(&count, 1)
+		now := time.Now()
+		return ocsp.CreateResponse(testCerts.CaCert, testCerts.CaCert, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: cert.SerialNumber,
+			ThisUpdate:   now,
+			NextUpdate:   now.Add(2 * time.Second),
+		}, testCerts.CaKey)
+	})
+	err := srv.Start()
+	require.NoError(t, err)
+	defer srv.Stop()
+
+	// the server includes the OCSP response in the handshake
+	checker := revocation.NewRevocationChecker(testCerts.CaCert)
+	checker.SetRequireOCSPStaple(true)
+	conn, err := tls.Dial("tcp", clientHostPort, &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection:   checker.VerifyConnection,
+	})
+	require.NoError(t, err)
+	_ = conn.Close()
+
+	// the response is renewed when half of its validity has passed
+	time.Sleep(1500 * time.Millisecond)
+	assert.GreaterOrEqual(t, atomic.LoadInt32(&count), int32(2))
+	conn, err = tls.Dial("tcp", clientHostPort, &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection:   checker.VerifyConnection,
+	})
+	require.NoError(t, err)
+	_ = conn.Close()
+}
+
+// routes with required roles reject clients without the role
+func TestRequireRole(t *testing.T) {
+	logrus.Infof("--- TestRequireRole ---")
+	path1 := "/admin"
+	path1Hit := 0
+	path2 := "/service"
+	path2Hit := 0
+	loginID1 := "user1"
+	password1 := "user1pass"
+
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort,
+		testCerts.ServerCert, testCerts.CaCert)
+	srv.EnableBasicAuth(func(userID, password string) bool {
+		return userID == loginID1 && password == password1
+	})
+	srv.SetRoleLookup(func(userID string) []string {
+		if userID == loginID1 {
+			return []string{tlsserver.RoleAdmin}
+		}
+		return nil
+	})
+	err := srv.Start()
+	require.NoError(t, err)
+	defer srv.Stop()
+	srv.AddHandler(path1, func(string, http.ResponseWriter, *http.Request) {
+		path1Hit++
+	}, tlsserver.RequireRole(tlsserver.RoleAdmin)).Methods(http.MethodGet)
+	srv.AddHandler(path2, func(string, http.ResponseWriter, *http.Request) {
+		path2Hit++
+	}, tlsserver.RequireRole(tlsserver.RoleAdmin, tlsserver.RolePlugin))
+
+	// a plugin certificate doesn't have the admin role
+	cl := tlsclient.NewTLSClient(clientHostPort, testCerts.CaCert)
+	err = cl.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	_, err = cl.Get(path1)
+	assert.Error(t, err)
+	assert.Equal(t, 0, path1Hit)
+	cl.Close()
+
+	// the OU of an admin certificate is its role
+	adminCert := testenv.CreateTlsCert("admin1", certsclient.OUAdmin, false,
+		testCerts.DeviceKey, testCerts.CaCert, testCerts.CaKey)
+	err = cl.ConnectWithClientCert(adminCert)
+	require.NoError(t, err)
+	_, err = cl.Get(path1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, path1Hit)
+	cl.Close()
+
+	// the role of a user is obtained from the lookup
+	cl.ConnectWithBasicAuth(loginID1, password1)
+	_, err = cl.Get(path1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, path1Hit)
+	cl.Close()
+
+	// the lookup isn't used for clients that authenticate with a certificate
+	userCert := testenv.CreateTlsCert(loginID1, certsclient.OUClient, false,
+		testCerts.DeviceKey, testCerts.CaCert, testCerts.CaKey)
+	err = cl.ConnectWithClientCert(userCert)
+	require.NoError(t, err)
+	_, err = cl.Get(path1)
+	assert.Error(t, err)
+	assert.Equal(t, 2, path1Hit)
+	cl.Close()
+
+	// any of the required roles is allowed
+	err = cl.ConnectWithClientCert(testCerts.PluginCert)
+	require.NoError(t, err)
+	_, err = cl.Get(path2)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, path2Hit)
+	cl.Close()
+}
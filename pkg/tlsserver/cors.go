@@ -0,0 +1,35 @@
+package tlsserver
+
+import (
+	"net/http"
+
+	rscors "github.com/rs/cors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/wostzone/wost-go/pkg/cors"
+)
+
+// corsHandler returns the handler that applies the CORS policy to the next handler
+// Origins with the same host as the request are allowed if the policy allows the same address.
+func corsHandler(config cors.CORSConfig, next http.Handler) http.Handler {
+	for _, allowed := range config.AllowedOrigins {
+		if allowed == "*" && config.AllowCredentials {
+			logrus.Warningf("CORS: The '*' origin is ignored as credentials are allowed")
+		}
+	}
+	c := rscors.New(rscors.Options{
+		AllowOriginRequestFunc: func(req *http.Request, origin string) bool {
+			allowed := config.IsOriginAllowed(origin, req.Host)
+			if !allowed {
+				logrus.Warningf("CORS: origin '%s' is not allowed", origin)
+			}
+			return allowed
+		},
+		AllowedHeaders:   config.AllowedHeaders,
+		AllowedMethods:   config.AllowedMethods,
+		AllowCredentials: config.AllowCredentials,
+		MaxAge:           config.MaxAge,
+		Debug:            config.Debug,
+	})
+	return c.Handler(next)
+}
@@ -0,0 +1,59 @@
+package tlsserver_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/wostzone/wost-go/pkg/cors"
+	"github.com/wostzone/wost-go/pkg/tlsserver"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	logrus.Infof("--- TestCORSPreflight ---")
+	path1 := "/hello"
+	config := cors.DefaultCORSConfig()
+	config.AllowedOrigins = []string{"http://localhost:*"}
+	config.MaxAge = 60
+
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort, testCerts.ServerCert, testCerts.CaCert,
+		tlsserver.WithCORS(config))
+	srv.AddHandlerNoAuth(path1, func(resp http.ResponseWriter, req *http.Request) {})
+	err := srv.Start()
+	require.NoError(t, err)
+	defer srv.Stop()
+
+	caCertPool := x509.NewCertPool()
+	caCertPool.AddCert(testCerts.CaCert)
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caCertPool}}}
+	preflight := func(origin string) *http.Response {
+		req, _ := http.NewRequest(http.MethodOptions, fmt.Sprintf("https://%s%s", clientHostPort, path1), nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		req.Header.Set("Access-Control-Request-Headers", "Authorization")
+		resp, err := httpClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	resp := preflight("http://localhost:8080")
+	assert.Equal(t, "http://localhost:8080", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "60", resp.Header.Get("Access-Control-Max-Age"))
+	assert.Contains(t, resp.Header.Get("Access-Control-Allow-Headers"), "Authorization")
+
+	// the web application of the host the request is sent to is allowed, on any port
+	resp = preflight("https://" + serverAddress + ":8443")
+	assert.Equal(t, "https://"+serverAddress+":8443", resp.Header.Get("Access-Control-Allow-Origin"))
+
+	resp = preflight("https://evil.example.com")
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+	httpClient.CloseIdleConnections()
+}
@@ -0,0 +1,108 @@
+package tlsserver
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/wostzone/wost-go/pkg/metrics"
+)
+
+// unmatchedRoute is the route label of requests that don't match a route
+const unmatchedRoute = "unmatched"
+
+// otherMethod is the method label of requests with a non-standard method
+const otherMethod = "other"
+
+// standardMethods are the HTTP methods that are used as method label
+var standardMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// serverMetrics holds the request metrics of the server
+type serverMetrics struct {
+	requestDuration *metrics.Histogram
+	requests        *metrics.Counter
+}
+
+// newServerMetrics creates or obtains the server metrics in the registry
+// Returns nil if the registry is nil, which disables the metrics.
+func newServerMetrics(registry *metrics.Registry) *serverMetrics {
+	if registry == nil {
+		return nil
+	}
+	return &serverMetrics{
+		requestDuration: registry.NewHistogram("wost_tlsserver_request_duration_seconds",
+			"Time spent handling HTTP requests", nil, "method", "route"),
+		requests: registry.NewCounter("wost_tlsserver_requests_total",
+			"Number of HTTP requests by route and status", "method", "route", "status"),
+	}
+}
+
+// AddMetricsHandler adds the handler that serves the metrics of the registry in the Prometheus text format.
+// Requests must be authenticated. Use AddHandlerNoAuth(path, registry.ServeHTTP) to serve the metrics without
+// authentication.
+//
+// use the RequireRole(role) option to restrict access to clients with the role, eg RoleAdmin
+//
+//  path to serve the metrics on, eg metrics.DefaultMetricsPath
+//  registry with the metrics, eg metrics.DefaultRegistry
+//  options of the route, eg RequireRole(RoleAdmin)
+func (srv *TLSServer) AddMetricsHandler(path string, registry *metrics.Registry, options ...RouteOption) *mux.Route {
+	return srv.AddHandler(path, func(userID string, resp http.ResponseWriter, req *http.Request) {
+		registry.ServeHTTP(resp, req)
+	}, options...)
+}
+
+// methodLabel returns the method label of the request, or "other" for non-standard methods
+func methodLabel(req *http.Request) string {
+	if standardMethods[req.Method] {
+		return req.Method
+	}
+	return otherMethod
+}
+
+// routeLabel returns the path template of the route that matches the request, or "unmatched" if no route
+// matches or the route has no path template. The raw path is never used as it is chosen by the client.
+func (srv *TLSServer) routeLabel(req *http.Request) string {
+	match := mux.RouteMatch{}
+	if !srv.router.Match(req, &match) || match.MatchErr != nil || match.Route == nil {
+		return unmatchedRoute
+	}
+	pathTemplate, err := match.Route.GetPathTemplate()
+	if err != nil || pathTemplate == "" {
+		return unmatchedRoute
+	}
+	return pathTemplate
+}
+
+// measureRequests returns the handler that counts requests by method, route and status, and measures
+// their duration. The method is limited to the standard methods and the route is the path template
+// of the matching route, to limit the number of series.
+func (srv *TLSServer) measureRequests(next http.Handler) http.Handler {
+	m := srv.metrics
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		method := methodLabel(req)
+		route := srv.routeLabel(req)
+		rec := &responseRecorder{ResponseWriter: resp, status: http.StatusOK}
+
+		next.ServeHTTP(rec, req)
+
+		m.requests.Inc(method, route, strconv.Itoa(rec.status))
+		m.requestDuration.ObserveSince(start, method, route)
+	})
+}
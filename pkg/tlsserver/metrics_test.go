@@ -0,0 +1,75 @@
+package tlsserver_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/wostzone/wost-go/pkg/metrics"
+	"github.com/wostzone/wost-go/pkg/tlsserver"
+)
+
+func TestServerMetrics(t *testing.T) {
+	logrus.Infof("--- TestServerMetrics ---")
+	path1 := "/things/{thingID}"
+	user1 := "user1"
+	password1 := "user1pass"
+	registry := metrics.NewRegistry()
+
+	srv := tlsserver.NewTLSServer(serverAddress, serverPort, testCerts.ServerCert, testCerts.CaCert)
+	srv.SetMetrics(registry)
+	srv.EnableBasicAuth(func(loginName string, password string) bool {
+		return loginName == user1 && password == password1
+	})
+	srv.AddHandler(path1, func(userID string, resp http.ResponseWriter, req *http.Request) {})
+	srv.AddMetricsHandler(metrics.DefaultMetricsPath, registry)
+	err := srv.Start()
+	require.NoError(t, err)
+	defer srv.Stop()
+
+	caCertPool := x509.NewCertPool()
+	caCertPool.AddCert(testCerts.CaCert)
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caCertPool}}}
+	invoke := func(method string, path string, password string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, fmt.Sprintf("https://%s%s", clientHostPort, path), nil)
+		req.SetBasicAuth(user1, password)
+		resp, err := httpClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	// requests are counted by route template and status
+	invoke(http.MethodGet, "/things/thing1", password1)
+	invoke(http.MethodGet, "/things/thing2", password1)
+	invoke(http.MethodGet, "/things/thing1", "wrongpass")
+	invoke(http.MethodGet, "/notfound", password1)
+	requests := registry.NewCounter("wost_tlsserver_requests_total", "")
+	assert.Equal(t, 2.0, requests.Get(http.MethodGet, path1, "200"))
+	assert.Equal(t, 1.0, requests.Get(http.MethodGet, path1, "403"))
+	assert.Equal(t, 1.0, requests.Get(http.MethodGet, "unmatched", "404"))
+
+	// non-standard methods are counted as other
+	invoke("FOO", "/things/thing1", password1)
+	assert.Equal(t, 1.0, requests.Get("other", path1, "200"))
+	assert.Equal(t, 0.0, requests.Get("FOO", path1, "200"))
+	duration := registry.NewHistogram("wost_tlsserver_request_duration_seconds", "", nil)
+	assert.Equal(t, uint64(3), duration.GetCount(http.MethodGet, path1))
+
+	// the metrics handler requires authentication
+	resp, _ := invoke(http.MethodGet, metrics.DefaultMetricsPath, "wrongpass")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, body := invoke(http.MethodGet, metrics.DefaultMetricsPath, password1)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, metrics.TextContentType, resp.Header.Get("Content-Type"))
+	assert.Contains(t, body, `wost_tlsserver_requests_total{method="GET",route="/things/{thingID}",status="200"} 2`)
+	httpClient.CloseIdleConnections()
+}
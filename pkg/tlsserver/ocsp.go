@@ -0,0 +1,73 @@
+package tlsserver
+
+import (
+	"crypto/x509"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ocsp"
+)
+
+// Intervals of renewing the OCSP response of the server certificate
+const (
+	// OCSPRetryInterval is the interval to retry obtaining an OCSP response after it failed
+	OCSPRetryInterval = time.Minute
+	// DefaultOCSPRenewInterval is the interval to renew OCSP responses that don't have a next update time
+	DefaultOCSPRenewInterval = time.Hour
+)
+
+// OCSPSource provides a new DER encoded OCSP response of the server certificate, for example from
+// certsclient.CertAuthority.CreateOCSPResponse or the OCSP responder of the CA.
+type OCSPSource func(cert *x509.Certificate) ([]byte, error)
+
+// refreshOCSPStaple obtains a new OCSP response for the current server certificate from the source
+// Returns the time the response should be renewed
+func (srv *TLSServer) refreshOCSPStaple() (renewAt time.Time, err error) {
+	srv.certMutex.RLock()
+	serverCert := srv.getServerCert()
+	srv.certMutex.RUnlock()
+	if serverCert == nil || len(serverCert.Certificate) == 0 {
+		return time.Now().Add(OCSPRetryInterval), nil
+	}
+	cert, err := x509.ParseCertificate(serverCert.Certificate[0])
+	if err != nil {
+		return time.Now().Add(OCSPRetryInterval), err
+	}
+	// don't hold the lock while the source is busy
+	ocspResponse, err := srv.ocspSource(cert)
+	if err != nil {
+		return time.Now().Add(OCSPRetryInterval), err
+	}
+	response, err := ocsp.ParseResponse(ocspResponse, nil)
+	if err != nil {
+		return time.Now().Add(OCSPRetryInterval), err
+	}
+	srv.certMutex.Lock()
+	srv.ocspStaple = ocspResponse
+	srv.ocspStapleCert = serverCert.Certificate[0]
+	srv.certMutex.Unlock()
+	if response.NextUpdate.IsZero() {
+		return time.Now().Add(DefaultOCSPRenewInterval), nil
+	}
+	return response.ThisUpdate.Add(response.NextUpdate.Sub(response.ThisUpdate) / 2), nil
+}
+
+// renewOCSPStaple obtains the OCSP response and renews it when half of its validity has passed or
+// when renewal is requested after the certificate changed, until stop is closed.
+func (srv *TLSServer) renewOCSPStaple(stop chan bool, renew chan bool) {
+	for {
+		renewAt, err := srv.refreshOCSPStaple()
+		renewRequest := renew
+		if err != nil {
+			logrus.Errorf("Unable to obtain the OCSP response of the server certificate: %s", err)
+			// retry after the retry interval instead of on each handshake
+			renewRequest = nil
+		}
+		select {
+		case <-stop:
+			return
+		case <-renewRequest:
+		case <-time.After(time.Until(renewAt)):
+		}
+	}
+}
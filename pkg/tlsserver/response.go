@@ -1,7 +1,10 @@
 package tlsserver
 
 import (
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -30,6 +33,15 @@ func (srv *TLSServer) WriteNotImplemented(resp http.ResponseWriter, errMsg strin
 	http.Error(resp, errMsg, http.StatusNotImplemented)
 }
 
+// WriteTooManyRequests logs and responds with too many requests (429) status code and the Retry-After header
+// Use this when a client exceeds its rate limit or is locked out
+//  retryAfter is the time after which the client can retry, rounded up to seconds
+func (srv *TLSServer) WriteTooManyRequests(resp http.ResponseWriter, errMsg string, retryAfter time.Duration) {
+	logrus.Warning(errMsg)
+	resp.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(resp, errMsg, http.StatusTooManyRequests)
+}
+
 // WriteUnauthorized responds with unauthorized (401) status code and log http error
 // Use this when login fails
 func (srv *TLSServer) WriteUnauthorized(resp http.ResponseWriter, errMsg string) {
@@ -15,6 +15,10 @@ package vocab
 // DataType of configuration, input and ouput values.
 // type DataType string
 
+// DataTypeSecret is a string value that is only passed end-to-end encrypted, eg a door lock code.
+// Actions and properties with secret values require an encrypted request.
+const DataTypeSecret = "wost:secret"
+
 // Available data types. See WoT vocabulary WoTDataTypeXxx
 const (
 // DataTypeArray value is an array of ?